@@ -0,0 +1,167 @@
+package acl
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+// Permission is the level of access a grant gives
+type Permission string
+
+const (
+	Read      Permission = "read"
+	ReadWrite Permission = "read-write"
+)
+
+var (
+	ErrNotFound          = errors.New("grant not found")
+	ErrInvalidPermission = errors.New("permission must be read or read-write")
+)
+
+// Grant gives another user access to one of the owner's folders
+type Grant struct {
+	ID         string     `json:"id"`
+	Owner      string     `json:"owner"`
+	Path       string     `json:"path"`
+	Grantee    string     `json:"grantee"`
+	Permission Permission `json:"permission"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CanWrite reports whether the grant allows changes
+func (g *Grant) CanWrite() bool {
+	return g.Permission == ReadWrite
+}
+
+// ParsePermission validates a permission value
+func ParsePermission(value string) (Permission, error) {
+	switch permission := Permission(value); permission {
+	case Read, ReadWrite:
+		return permission, nil
+	case "write", "rw":
+		return ReadWrite, nil
+	}
+	return "", ErrInvalidPermission
+}
+
+// Store keeps grants in memory and persists them as JSON
+type Store struct {
+	mu     sync.RWMutex
+	file   *storage.JSONFile
+	grants map[string]*Grant // keyed by ID
+}
+
+// NewStore loads the grants saved at path; an empty path keeps them in memory only
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		file:   storage.NewJSONFile(path),
+		grants: make(map[string]*Grant),
+	}
+	if err := s.file.Load(&s.grants); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save persists the current grants; callers hold the lock
+func (s *Store) save() error {
+	return s.file.Save(s.grants)
+}
+
+// Grant gives grantee access to owner's folder at path.
+// Granting the same folder to the same user again updates the permission.
+func (s *Store) Grant(owner, path, grantee string, permission Permission) (*Grant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, grant := range s.grants {
+		if grant.Owner == owner && grant.Path == path && grant.Grantee == grantee {
+			grant.Permission = permission
+			if err := s.save(); err != nil {
+				return nil, err
+			}
+			copied := *grant
+			return &copied, nil
+		}
+	}
+
+	id, err := storage.RandomID()
+	if err != nil {
+		return nil, err
+	}
+	grant := &Grant{
+		ID:         id,
+		Owner:      owner,
+		Path:       path,
+		Grantee:    grantee,
+		Permission: permission,
+		CreatedAt:  time.Now().UTC(),
+	}
+	s.grants[id] = grant
+	if err := s.save(); err != nil {
+		delete(s.grants, id)
+		return nil, err
+	}
+	copied := *grant
+	return &copied, nil
+}
+
+// Revoke removes one of the owner's grants
+func (s *Store) Revoke(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	grant, ok := s.grants[id]
+	if !ok || grant.Owner != owner {
+		return ErrNotFound
+	}
+	delete(s.grants, id)
+	return s.save()
+}
+
+// RevokeAll removes every grant username gave or was given
+func (s *Store) RevokeAll(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, grant := range s.grants {
+		if grant.Owner == username || grant.Grantee == username {
+			delete(s.grants, id)
+		}
+	}
+	return s.save()
+}
+
+// list returns the grants matching keep, oldest first
+func (s *Store) list(keep func(*Grant) bool) []Grant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var list []Grant
+	for _, grant := range s.grants {
+		if keep(grant) {
+			list = append(list, *grant)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// ListByOwner returns everything owner has shared
+func (s *Store) ListByOwner(owner string) []Grant {
+	return s.list(func(g *Grant) bool { return g.Owner == owner })
+}
+
+// ListForGrantee returns everything shared with grantee
+func (s *Store) ListForGrantee(grantee string) []Grant {
+	return s.list(func(g *Grant) bool { return g.Grantee == grantee })
+}
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+// Scopes of personal access tokens. Logins through /api/login hold all of them.
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeDelete = "delete"
+	ScopeShare  = "share"
+)
+
+// Scopes lists every scope a token can be given
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeDelete, ScopeShare}
+
+const (
+	// accessTokenPrefix tells personal access tokens apart from JWTs and makes leaked ones easy to search for
+	accessTokenPrefix = "csp_"
+	// maxAccessTokensPerUser bounds the tokens one user can create
+	maxAccessTokensPerUser = 50
+	// accessTokenUsageInterval is how often the last use of a token is written to disk
+	accessTokenUsageInterval = time.Minute
+)
+
+var (
+	ErrAccessTokenNotFound = errors.New("access token not found")
+	ErrTooManyAccessTokens = errors.New("too many access tokens")
+	ErrInvalidScope        = errors.New("invalid scope")
+)
+
+// AccessToken is a long-lived credential a user creates for scripts and CI.
+// It acts as its owner within its scopes and, when Paths is set, only below those folders.
+// Only a hash of the token is stored.
+type AccessToken struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	// BackendRoles are the owner's roles from the account backend when the token was created;
+	// the configured roles are added each time the token is used
+	BackendRoles []string   `json:"backend_roles,omitempty"`
+	Scopes       []string   `json:"scopes"`
+	Paths        []string   `json:"paths,omitempty"`
+	TokenHash    string     `json:"token_hash"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// expired reports whether the token can no longer be used at now
+func (t *AccessToken) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// AccessTokenStore persists the personal access tokens of all users.
+// A token is "csp_<id>_<secret>"; the id finds the record, the secret is checked against its hash.
+type AccessTokenStore struct {
+	mu     sync.Mutex
+	file   *storage.JSONFile
+	tokens map[string]*AccessToken
+}
+
+// NewAccessTokenStore loads the tokens at path
+func NewAccessTokenStore(path string) (*AccessTokenStore, error) {
+	s := &AccessTokenStore{
+		file:   storage.NewJSONFile(path),
+		tokens: make(map[string]*AccessToken),
+	}
+	if err := s.file.Load(&s.tokens); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func hashAccessToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsAccessToken reports whether a bearer token looks like a personal access token rather than a JWT
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, accessTokenPrefix)
+}
+
+// normalizeScopes checks the scopes and returns them sorted without duplicates
+func normalizeScopes(scopes []string) ([]string, error) {
+	set := make(map[string]bool)
+	for _, scope := range scopes {
+		valid := false
+		for _, known := range Scopes {
+			valid = valid || scope == known
+		}
+		if !valid {
+			return nil, ErrInvalidScope
+		}
+		set[scope] = true
+	}
+	if len(set) == 0 {
+		return nil, ErrInvalidScope
+	}
+	list := make([]string, 0, len(set))
+	for scope := range set {
+		list = append(list, scope)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// normalizePaths cleans the folders a token is limited to; the root means no limit
+func normalizePaths(paths []string) []string {
+	var list []string
+	for _, p := range paths {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		clean := path.Join("/", p)
+		if clean == "/" {
+			return nil
+		}
+		list = append(list, clean)
+	}
+	return list
+}
+
+// Create issues a token for owner and returns it with the secret, which is not stored and shown only once
+func (s *AccessTokenStore) Create(owner string, backendRoles []string, name string, scopes, paths []string, expiresAt *time.Time) (AccessToken, string, error) {
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+	id, err := storage.RandomID()
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+	secret, err := storage.RandomToken(32)
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+
+	token := &AccessToken{
+		ID:           id,
+		Name:         name,
+		Owner:        owner,
+		BackendRoles: backendRoles,
+		Scopes:       scopes,
+		Paths:        normalizePaths(paths),
+		TokenHash:    hashAccessToken(secret),
+		CreatedAt:    time.Now(),
+		ExpiresAt:    expiresAt,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropExpired()
+	count := 0
+	for _, t := range s.tokens {
+		if t.Owner == owner {
+			count++
+		}
+	}
+	if count >= maxAccessTokensPerUser {
+		return AccessToken{}, "", ErrTooManyAccessTokens
+	}
+	s.tokens[id] = token
+	if err := s.file.Save(s.tokens); err != nil {
+		delete(s.tokens, id)
+		return AccessToken{}, "", err
+	}
+	return *token, accessTokenPrefix + id + "_" + secret, nil
+}
+
+// dropExpired forgets tokens past their expiry; callers hold the lock
+func (s *AccessTokenStore) dropExpired() {
+	now := time.Now()
+	for id, token := range s.tokens {
+		if token.expired(now) {
+			delete(s.tokens, id)
+		}
+	}
+}
+
+// Verify returns the token record behind a presented token
+func (s *AccessTokenStore) Verify(presented string) (AccessToken, error) {
+	if !IsAccessToken(presented) {
+		return AccessToken{}, ErrInvalidToken
+	}
+	id, secret, ok := strings.Cut(strings.TrimPrefix(presented, accessTokenPrefix), "_")
+	if !ok {
+		return AccessToken{}, ErrInvalidToken
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[id]
+	now := time.Now()
+	if !ok || token.expired(now) {
+		return AccessToken{}, ErrInvalidToken
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAccessToken(secret)), []byte(token.TokenHash)) != 1 {
+		return AccessToken{}, ErrInvalidToken
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= accessTokenUsageInterval {
+		token.LastUsedAt = &now
+		// Failing to record the use is no reason to refuse the request
+		s.file.Save(s.tokens)
+	}
+	return *token, nil
+}
+
+// List returns the tokens of owner, newest first
+func (s *AccessTokenStore) List(owner string) []AccessToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	list := []AccessToken{}
+	for _, token := range s.tokens {
+		if token.Owner == owner && !token.expired(now) {
+			list = append(list, *token)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Revoke deletes one of the tokens of owner
+func (s *AccessTokenStore) Revoke(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[id]
+	if !ok || token.Owner != owner {
+		return ErrAccessTokenNotFound
+	}
+	delete(s.tokens, id)
+	if err := s.file.Save(s.tokens); err != nil {
+		s.tokens[id] = token
+		return err
+	}
+	return nil
+}
+
+// RevokeAll deletes every token of owner
+func (s *AccessTokenStore) RevokeAll(owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, token := range s.tokens {
+		if token.Owner == owner {
+			delete(s.tokens, id)
+		}
+	}
+	return s.file.Save(s.tokens)
+}
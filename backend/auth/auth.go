@@ -2,53 +2,82 @@ package auth
 
 import (
 	"errors"
-	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"manschko.com/cloud-storage/storage"
 )
 
 var (
 	ErrInvalidCredentials = errors.New("invalid credentials")
 	ErrInvalidToken       = errors.New("invalid token")
+	ErrRevokedToken       = errors.New("token revoked")
+	ErrTwoFactorRequired  = errors.New("two-factor authentication required")
 )
 
 // UserClaims represents the JWT claims for a user
 type UserClaims struct {
 	Username string `json:"username"`
+	// SessionID names the refresh session the token was issued for, if any
+	SessionID string `json:"sid,omitempty"`
+	// Roles are granted by the account backend, such as through LDAP groups, and the configuration
+	Roles []string `json:"roles,omitempty"`
+	// BackendRoles are the part of Roles the account backend granted
+	BackendRoles []string `json:"backend_roles,omitempty"`
 	jwt.RegisteredClaims
 }
 
 // GenerateToken creates a JWT token for the authenticated user
-func GenerateToken(username string, secret string, expiration time.Duration) (string, error) {
+func GenerateToken(principal Principal, keys *KeySet, expiration time.Duration) (string, error) {
+	return GenerateSessionToken(principal, "", keys, expiration)
+}
+
+// GenerateSessionToken creates a JWT token for the principal of session sessionID.
+// Every token gets a unique jti so that it can be revoked on its own.
+func GenerateSessionToken(principal Principal, sessionID string, keys *KeySet, expiration time.Duration) (string, error) {
+	jti, err := storage.RandomID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
 	claims := &UserClaims{
-		Username: username,
+		Username:     principal.Username,
+		SessionID:    sessionID,
+		Roles:        principal.Roles,
+		BackendRoles: principal.BackendRoles,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiration)),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	return keys.Sign(claims)
 }
 
 // ValidateToken checks if a token is valid and returns the claims
-func ValidateToken(tokenString string, secret string) (*UserClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(secret), nil
-	})
-
+func ValidateToken(tokenString string, keys *KeySet) (*UserClaims, error) {
+	token, err := keys.Parse(tokenString, &UserClaims{})
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*UserClaims); ok && token.Valid {
+	// Access tokens have no audience; tokens for one, such as two-factor challenges, are not access tokens
+	if claims, ok := token.Claims.(*UserClaims); ok && token.Valid && len(claims.Audience) == 0 {
 		return claims, nil
 	}
 
 	return nil, ErrInvalidToken
 }
+
+// CheckToken validates a token like ValidateToken and also rejects it when revoked
+func CheckToken(tokenString string, keys *KeySet, revoked *RevocationList) (*UserClaims, error) {
+	claims, err := ValidateToken(tokenString, keys)
+	if err != nil {
+		return nil, err
+	}
+	if revoked.IsRevoked(claims) {
+		return nil, ErrRevokedToken
+	}
+	return claims, nil
+}
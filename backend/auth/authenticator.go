@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"manschko.com/cloud-storage/sftp"
+)
+
+// Principal is a user whose credentials were accepted
+type Principal struct {
+	// Username is the account name as the backend knows it, which may differ in case from what was typed
+	Username string
+	Roles    []string
+	// BackendRoles are the roles the account backend gave, before the configured ones were added.
+	// They are kept with sessions and tokens so that the configured roles can be applied afresh.
+	BackendRoles []string
+}
+
+// Authenticator checks passwords against one account backend. Rejected credentials give
+// ErrInvalidCredentials; other errors mean the backend could not be asked, so that they
+// do not count as failed logins.
+type Authenticator interface {
+	Name() string
+	Authenticate(ctx context.Context, username, password string) (*Principal, error)
+}
+
+// UsableUsername reports whether username can name a home folder on the server:
+// a single path element that is not hidden, as hidden top-level folders such as the
+// group spaces belong to the server itself
+func UsableUsername(username string) bool {
+	return username != "" && !strings.HasPrefix(username, ".") && !strings.ContainsAny(username, "/\\")
+}
+
+// Authenticators asks each backend in turn until one accepts the credentials
+type Authenticators []Authenticator
+
+// Name lists the backends
+func (a Authenticators) Name() string {
+	names := make([]string, len(a))
+	for i, backend := range a {
+		names[i] = backend.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Authenticate returns the principal of the first backend accepting the credentials.
+// When none does and one of them could not be asked, its error is returned rather than
+// ErrInvalidCredentials, as that backend might have known the user.
+func (a Authenticators) Authenticate(ctx context.Context, username, password string) (*Principal, error) {
+	var unavailable error
+	for _, backend := range a {
+		principal, err := backend.Authenticate(ctx, username, password)
+		switch {
+		case err == nil:
+			return principal, nil
+		case !errors.Is(err, ErrInvalidCredentials) && unavailable == nil:
+			unavailable = err
+		}
+	}
+	if unavailable != nil {
+		return nil, unavailable
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// SFTPAuthenticator accepts the credentials the SFTP server lets log in
+type SFTPAuthenticator struct {
+	Host string
+	Port int
+}
+
+// Name identifies the backend
+func (a *SFTPAuthenticator) Name() string {
+	return "sftp"
+}
+
+// Authenticate opens and closes an SSH session with the credentials
+func (a *SFTPAuthenticator) Authenticate(ctx context.Context, username, password string) (*Principal, error) {
+	err := sftp.NewConnection(a.Host, a.Port, username, password).TestConnection()
+	if errors.Is(err, sftp.ErrAuthFailed) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{Username: username}, nil
+}
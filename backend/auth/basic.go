@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authenticator returns the configured backend, checking against the SFTP server by default
+func (c *AuthController) authenticator() Authenticator {
+	if c.Authenticator != nil {
+		return c.Authenticator
+	}
+	return &SFTPAuthenticator{Host: c.SFTPHost, Port: c.SFTPPort}
+}
+
+// authenticate checks a password with the configured authenticator.
+// Usernames that cannot have a home of their own are refused before any backend is asked.
+func (c *AuthController) authenticate(ctx context.Context, username, password string) (*Principal, error) {
+	if !UsableUsername(username) {
+		return nil, ErrInvalidCredentials
+	}
+	principal, err := c.authenticator().Authenticate(ctx, username, password)
+	if err == nil && !UsableUsername(principal.Username) {
+		return nil, ErrInvalidCredentials
+	}
+	return principal, err
+}
+
+// VerifyCredentials checks a username and password with the configured authenticator.
+// Rejected credentials give ErrInvalidCredentials; other errors mean the backend could not be asked.
+// A password alone is not enough for users with a second factor, who get ErrTwoFactorRequired
+// and have to use a bearer token instead.
+func (c *AuthController) VerifyCredentials(username, password string) (*Principal, error) {
+	principal, err := c.authenticate(context.Background(), username, password)
+	if err != nil {
+		return nil, err
+	}
+	*principal = c.Roles.Assign(*principal)
+	if c.needsTwoFactor(*principal) {
+		return nil, ErrTwoFactorRequired
+	}
+	return principal, nil
+}
+
+// CredentialCache remembers recently verified logins.
+// Clients such as WebDAV mounts send Basic credentials with every request,
+// and opening an SSH session for each of them would be far too slow.
+type CredentialCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedLogin // credential digest -> login
+}
+
+// cachedLogin is a verified login and when it has to be checked again
+type cachedLogin struct {
+	principal *Principal
+	expires   time.Time
+}
+
+// NewCredentialCache creates a cache keeping verified logins for ttl
+func NewCredentialCache(ttl time.Duration) *CredentialCache {
+	return &CredentialCache{
+		ttl:     ttl,
+		entries: make(map[string]cachedLogin),
+	}
+}
+
+func credentialKey(username, password string) string {
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify checks the credentials, consulting verify only when they are not cached
+func (c *CredentialCache) Verify(username, password string, verify func(username, password string) (*Principal, error)) (*Principal, error) {
+	key := credentialKey(username, password)
+	now := time.Now()
+
+	c.mu.Lock()
+	login, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(login.expires) {
+		return login.principal, nil
+	}
+
+	principal, err := verify(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedLogin{principal: principal, expires: now.Add(c.ttl)}
+	return principal, nil
+}
+
+// Forget drops the cached logins of username, so that their next request is checked again
+func (c *CredentialCache) Forget(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if strings.EqualFold(e.principal.Username, username) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// BasicOrBearerMiddleware accepts either a JWT bearer token or HTTP Basic credentials.
+// Failures answer with a Basic challenge so that file managers prompt for a login.
+// Credentials not in the cache are checked through guard like any other login.
+func BasicOrBearerMiddleware(keys *KeySet, revoked *RevocationList, realm string, cache *CredentialCache, guard *LoginGuard, verify func(username, password string) (*Principal, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		challenge := func() {
+			c.Header("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+		}
+
+		if authHeader := c.GetHeader("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+			claims, err := CheckToken(authHeader[7:], keys, revoked)
+			if err != nil {
+				challenge()
+				return
+			}
+			c.Set("username", claims.Username)
+			c.Set("roles", claims.Roles)
+			c.Next()
+			return
+		}
+
+		username, password, ok := c.Request.BasicAuth()
+		if !ok || username == "" {
+			challenge()
+			return
+		}
+		principal, err := cache.Verify(username, password, func(username, password string) (*Principal, error) {
+			var principal *Principal
+			err := guard.Attempt(c.ClientIP(), username, func() (err error) {
+				principal, err = verify(username, password)
+				return err
+			})
+			return principal, err
+		})
+		var blocked *BlockedError
+		if errors.As(err, &blocked) {
+			setRetryAfter(c, blocked.RetryAfter)
+			c.AbortWithStatus(http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			challenge()
+			return
+		}
+		c.Set("username", principal.Username)
+		c.Set("roles", principal.Roles)
+		c.Next()
+	}
+}
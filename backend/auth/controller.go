@@ -1,9 +1,9 @@
 package auth
 import (
+	"context"
 	"net/http"
 	"time"
 	"github.com/gin-gonic/gin"
-	"manschko.com/cloud-storage/sftp"
 )
 
 // LoginRequest represents the login form data
@@ -14,22 +14,76 @@ type LoginRequest struct {
 
 // LoginResponse represents the response after successful login
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// ExpiresIn is the lifetime of Token, or of ChallengeToken, in seconds
+	ExpiresIn int `json:"expires_in"`
+
+	// With a second factor, the password only earns a ChallengeToken to send back with the code.
+	// EnrollmentRequired asks the user to set up an authenticator app first.
+	TwoFactorRequired  bool   `json:"two_factor_required,omitempty"`
+	EnrollmentRequired bool   `json:"enrollment_required,omitempty"`
+	ChallengeToken     string `json:"challenge_token,omitempty"`
+	// RecoveryCodes are issued once, when the second factor is set up during login
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
 }
 
 // AuthController handles authentication operations
 type AuthController struct {
-	JWTSecret string
-	SFTPHost  string
-	SFTPPort  int
+	// Keys sign the tokens we issue and verify the ones presented
+	Keys     *KeySet
+	SFTPHost string
+	SFTPPort int
+
+	// Authenticator checks passwords; nil checks them against the SFTP server
+	Authenticator Authenticator
+
+	// Guard throttles login attempts; nil disables it
+	Guard *LoginGuard
+
+	// Roles adds the configured roles to those from the account backend whenever tokens are issued
+	Roles RoleConfig
+
+	// AccessTokenTTL is the lifetime of access tokens, RefreshTokenTTL how long a session
+	// survives without being refreshed
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// Sessions holds the refresh tokens; nil issues access tokens only
+	Sessions *SessionStore
+	// Revoked lists access tokens ended by logout or refresh token reuse
+	Revoked *RevocationList
+
+	// OIDC enables single sign-on through an identity provider; nil disables it.
+	// IdentityRules map provider accounts to users, whose homes are kept in Identities,
+	// and the browser returns to OIDCFrontendURL when the login is done.
+	OIDC            *OIDCProvider
+	OIDCLogins      *OIDCLogins
+	IdentityRules   []IdentityRule
+	Identities      *IdentityStore
+	OIDCFrontendURL string
+	// AccountEnabled refuses single sign-on to accounts disabled on the SFTP server; nil lets everyone in
+	AccountEnabled func(ctx context.Context, username string) (bool, error)
+
+	// TwoFactor holds the authenticator apps of users; nil disables two-factor authentication.
+	// TwoFactorPolicy names who must have one, and TwoFactorIssuer labels the entry in the app.
+	TwoFactor       *TwoFactorStore
+	TwoFactorPolicy TwoFactorPolicy
+	TwoFactorIssuer string
+
+	// AccessTokens holds the personal access tokens of users; nil disables them
+	AccessTokens *AccessTokenStore
 }
 
 // NewAuthController creates a new auth controller
-func NewAuthController(jwtSecret string, sftpHost string, sftpPort int) *AuthController {
+func NewAuthController(keys *KeySet, sftpHost string, sftpPort int) *AuthController {
 	return &AuthController{
-		JWTSecret: jwtSecret,
-		SFTPHost:  sftpHost,
-		SFTPPort:  sftpPort,
+		Keys:     keys,
+		SFTPHost: sftpHost,
+		SFTPPort: sftpPort,
+
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
 	}
 }
 
@@ -41,26 +95,30 @@ func (c *AuthController) Login(ctx *gin.Context) {
 		return
 	}
 
-	// Create SFTP connection with provided credentials
-	sftpConn := sftp.NewConnection(
-		c.SFTPHost,
-		c.SFTPPort,
-		loginReq.Username,
-		loginReq.Password,
-	)
-
-	// Test connection to verify credentials
-	if err := sftpConn.TestConnection(); err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	// Verify the credentials with the account backend, unless the guard holds this login back
+	var principal *Principal
+	err := c.Guard.Attempt(ctx.ClientIP(), loginReq.Username, func() (err error) {
+		principal, err = c.authenticate(ctx.Request.Context(), loginReq.Username, loginReq.Password)
+		return err
+	})
+	if err != nil {
+		respondLoginError(ctx, err)
+		return
+	}
+	*principal = c.Roles.Assign(*principal)
+
+	// Users with a second factor get a challenge for their code instead of tokens
+	if c.needsTwoFactor(*principal) {
+		c.challenge(ctx, *principal)
 		return
 	}
 
-	// Generate JWT token
-	token, err := GenerateToken(loginReq.Username, c.JWTSecret, 24*time.Hour)
+	// Start a session and hand out its first tokens
+	response, err := c.startSession(*principal)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, LoginResponse{Token: token})
+	ctx.JSON(http.StatusOK, response)
 }
\ No newline at end of file
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// loginBaseDelay is the wait after the first failure; it doubles with each further one
+	loginBaseDelay = time.Second
+	// loginMaxDelay caps the backoff between attempts short of a lockout
+	loginMaxDelay = time.Minute
+	// maxPendingPerIP bounds the logins one address may have in progress at once
+	maxPendingPerIP = 4
+	// guardSweepInterval is how often forgotten entries are dropped
+	guardSweepInterval = time.Minute
+)
+
+// ErrTooManyLogins is returned when too many logins are being checked at once
+var ErrTooManyLogins = errors.New("too many logins in progress")
+
+// Lockout kinds
+const (
+	LockUser  = "user"
+	LockIP    = "ip"
+	LockShare = "share"
+)
+
+// BlockedError is returned for logins refused without checking the password,
+// because the username or address failed too often recently
+type BlockedError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *BlockedError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("locked out, retry in %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// GuardConfig sets how many failures lead to a lockout and for how long.
+// Failures are forgotten after a quiet period as long as the lockout.
+type GuardConfig struct {
+	MaxFailures      int
+	MaxFailuresPerIP int
+	Lockout          time.Duration
+	MaxInFlight      int
+}
+
+// Lockout is a username or address that may not log in until Until
+type Lockout struct {
+	Kind     string    `json:"kind"`
+	Value    string    `json:"value"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// attempts is the recent login history of one username or address
+type attempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	locked       bool
+	pending      int
+}
+
+type guardKey struct {
+	kind  string
+	value string
+}
+
+// LoginGuard stops the login endpoints from being used to guess passwords.
+// Every failure makes the username and the address wait longer before the next try,
+// too many lock them out for a while, and only a bounded number of logins are
+// checked against the SFTP server at once.
+type LoginGuard struct {
+	cfg      GuardConfig
+	inFlight chan struct{}
+
+	mu        sync.Mutex
+	entries   map[guardKey]*attempts
+	lastSweep time.Time
+}
+
+// NewLoginGuard creates a guard for cfg
+func NewLoginGuard(cfg GuardConfig) *LoginGuard {
+	return &LoginGuard{
+		cfg:       cfg,
+		inFlight:  make(chan struct{}, max(cfg.MaxInFlight, 1)),
+		entries:   make(map[guardKey]*attempts),
+		lastSweep: time.Now(),
+	}
+}
+
+// entry returns the history of key, creating it when missing; callers hold the lock
+func (g *LoginGuard) entry(key guardKey, now time.Time) *attempts {
+	e, ok := g.entries[key]
+	if !ok {
+		e = &attempts{}
+		g.entries[key] = e
+	}
+	// A quiet period as long as a lockout wipes the slate clean
+	if e.failures > 0 && now.Sub(e.lastFailure) > g.cfg.Lockout && now.After(e.blockedUntil) {
+		e.failures, e.locked = 0, false
+	}
+	return e
+}
+
+// sweep drops entries that no longer hold anything back; callers hold the lock
+func (g *LoginGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < guardSweepInterval {
+		return
+	}
+	g.lastSweep = now
+	for key, e := range g.entries {
+		if e.pending == 0 && now.After(e.blockedUntil) && now.Sub(e.lastFailure) > g.cfg.Lockout {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// Attempt checks a login with verify unless the username or address is held back.
+// A verify error matching ErrInvalidCredentials counts as a failure; other errors,
+// such as an unreachable server, do not count against anyone.
+func (g *LoginGuard) Attempt(ip, username string, verify func() error) error {
+	if g == nil {
+		return verify()
+	}
+	return g.attempt([]guardKey{{LockUser, username}, {LockIP, ip}}, verify)
+}
+
+// AttemptShare checks the password of a share link like Attempt checks a login,
+// keyed on the link's token instead of a username
+func (g *LoginGuard) AttemptShare(ip, token string, verify func() error) error {
+	if g == nil {
+		return verify()
+	}
+	return g.attempt([]guardKey{{LockShare, token}, {LockIP, ip}}, verify)
+}
+
+// attempt runs verify once none of keys is held back; the first key is the account being guessed
+func (g *LoginGuard) attempt(keys []guardKey, verify func() error) error {
+	if err := g.begin(keys); err != nil {
+		return err
+	}
+	defer g.end(keys)
+
+	select {
+	case g.inFlight <- struct{}{}:
+	default:
+		return ErrTooManyLogins
+	}
+	err := verify()
+	<-g.inFlight
+
+	switch {
+	case err == nil:
+		g.succeed(keys[0])
+	case errors.Is(err, ErrInvalidCredentials):
+		g.fail(keys)
+	}
+	return err
+}
+
+// begin refuses the attempt while a key is blocked or, for a username, another attempt is in progress.
+// Waiting for one answer before the next keeps parallel guesses from slipping past the backoff.
+func (g *LoginGuard) begin(keys []guardKey) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.sweep(now)
+
+	for _, key := range keys {
+		e := g.entry(key, now)
+		if now.Before(e.blockedUntil) {
+			return &BlockedError{RetryAfter: e.blockedUntil.Sub(now), Locked: e.locked}
+		}
+		// Many visitors may open the same share link at once
+		limit := 1
+		if key.kind != LockUser {
+			limit = maxPendingPerIP
+		}
+		if e.pending >= limit {
+			return &BlockedError{RetryAfter: loginBaseDelay}
+		}
+	}
+	for _, key := range keys {
+		g.entries[key].pending++
+	}
+	return nil
+}
+
+// end releases the keys taken by begin
+func (g *LoginGuard) end(keys []guardKey) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range keys {
+		if e, ok := g.entries[key]; ok {
+			e.pending--
+		}
+	}
+}
+
+// fail records a failed attempt against every key, backing off or locking them out
+func (g *LoginGuard) fail(keys []guardKey) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+
+	for _, key := range keys {
+		e := g.entry(key, now)
+		e.failures++
+		e.lastFailure = now
+
+		limit := g.cfg.MaxFailures
+		if key.kind == LockIP {
+			limit = g.cfg.MaxFailuresPerIP
+		}
+		if limit > 0 && e.failures >= limit {
+			e.locked = true
+			e.blockedUntil = now.Add(g.cfg.Lockout)
+			log.Printf("Login lockout: %s %q locked for %s after %d failed attempts", key.kind, key.value, g.cfg.Lockout, e.failures)
+			continue
+		}
+		delay := loginBaseDelay << min(e.failures-1, 16)
+		e.blockedUntil = now.Add(min(delay, loginMaxDelay))
+	}
+}
+
+// succeed forgets the failures of the username or share link. The address keeps its history,
+// so that logging in to one's own account does not reset guesses at others.
+func (g *LoginGuard) succeed(key guardKey) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if e, ok := g.entries[key]; ok {
+		e.failures, e.locked, e.blockedUntil = 0, false, time.Time{}
+	}
+}
+
+// Lockouts lists the usernames and addresses currently locked out
+func (g *LoginGuard) Lockouts() []Lockout {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+
+	list := []Lockout{}
+	for key, e := range g.entries {
+		if e.locked && now.Before(e.blockedUntil) {
+			list = append(list, Lockout{Kind: key.kind, Value: key.value, Failures: e.failures, Until: e.blockedUntil})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Until.Before(list[j].Until) })
+	return list
+}
+
+// Clear lifts the lockout and forgets the failures of a username or address.
+// It reports false when there was nothing to clear.
+func (g *LoginGuard) Clear(kind, value string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e, ok := g.entries[guardKey{kind, value}]
+	if !ok || e.failures == 0 {
+		return false
+	}
+	e.failures, e.locked, e.blockedUntil = 0, false, time.Time{}
+	return true
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+// ErrIdentityTaken is returned when a username is already linked to another provider account
+var ErrIdentityTaken = errors.New("username belongs to another provider account")
+
+// LinkedIdentity records which provider account logs in as a username, and where its home is
+type LinkedIdentity struct {
+	Username  string    `json:"username"`
+	Home      string    `json:"home,omitempty"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email,omitempty"`
+	LastLogin time.Time `json:"last_login"`
+}
+
+// IdentityStore persists the identities of single sign-on users. The home folders are kept
+// so that shares and grants of a user resolve to the same folder while they are logged out.
+type IdentityStore struct {
+	mu         sync.RWMutex
+	file       *storage.JSONFile
+	identities map[string]*LinkedIdentity
+}
+
+// NewIdentityStore loads the identities at path
+func NewIdentityStore(path string) (*IdentityStore, error) {
+	s := &IdentityStore{
+		file:       storage.NewJSONFile(path),
+		identities: make(map[string]*LinkedIdentity),
+	}
+	if err := s.file.Load(&s.identities); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Link records a login of identity. The first provider account to log in as a username keeps it:
+// another issuer or subject mapped to the same username gets ErrIdentityTaken.
+func (s *IdentityStore) Link(identity LinkedIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if linked, ok := s.identities[identity.Username]; ok && (linked.Issuer != identity.Issuer || linked.Subject != identity.Subject) {
+		return ErrIdentityTaken
+	}
+	s.identities[identity.Username] = &identity
+	return s.file.Save(s.identities)
+}
+
+// HomeDir returns the home folder mapped for username, if any
+func (s *IdentityStore) HomeDir(username string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	identity, ok := s.identities[username]
+	if !ok || identity.Home == "" {
+		return "", false
+	}
+	return identity.Home, true
+}
@@ -0,0 +1,345 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minRSABits is the smallest RSA modulus accepted for signing keys
+const minRSABits = 2048
+
+// Key is one JWT signing or verification key. Its ID goes into the kid header of the
+// tokens it signs and is derived from the key itself, so it stays stable across restarts.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+
+	sign   interface{}
+	verify interface{}
+}
+
+// CanSign reports whether the key holds the secret or private part needed to issue tokens
+func (k *Key) CanSign() bool {
+	return k.sign != nil
+}
+
+// NewHMACKey creates an HS256 key from a shared secret
+func NewHMACKey(secret string) *Key {
+	sum := sha256.Sum256([]byte("kid:" + secret))
+	return &Key{
+		ID:     "hs256-" + hex.EncodeToString(sum[:8]),
+		Method: jwt.SigningMethodHS256,
+		sign:   []byte(secret),
+		verify: []byte(secret),
+	}
+}
+
+// LoadKeyFile reads a PEM encoded key from path, see ParseKeyPEM
+func LoadKeyFile(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// ParseKeyPEM reads an RSA, ECDSA or Ed25519 key. A private key can sign and verify,
+// a public key only verify, which is enough for the previous keys of a rotation.
+func ParseKeyPEM(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var public crypto.PublicKey
+	var private interface{}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		public, private = &k.PublicKey, k
+	case *ecdsa.PrivateKey:
+		public, private = &k.PublicKey, k
+	case ed25519.PrivateKey:
+		public, private = k.Public(), k
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		public = k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	method, err := methodFor(public)
+	if err != nil {
+		return nil, err
+	}
+	jwk := publicJWK(public)
+	return &Key{ID: jwk.thumbprint(), Method: method, sign: private, verify: public}, nil
+}
+
+// methodFor picks the signing algorithm matching a public key
+func methodFor(public crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA keys need at least %d bits", minRSABits)
+		}
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, errors.New("unsupported elliptic curve")
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", public)
+}
+
+// JWK is the public half of a key as published in a JSON Web Key Set
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// publicJWK describes a public key with only the members that identify it
+func publicJWK(public crypto.PublicKey) JWK {
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Crv: k.Curve.Params().Name,
+			X:   b64(k.X.FillBytes(make([]byte, size))),
+			Y:   b64(k.Y.FillBytes(make([]byte, size))),
+		}
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: b64(k)}
+	}
+	return JWK{}
+}
+
+// PublicKey decodes the key the JWK describes, such as one published by an identity provider
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := func(member, value string) ([]byte, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("invalid JWK member %q", member)
+		}
+		return data, nil
+	}
+
+	switch j.Kty {
+	case "RSA":
+		n, err := decode("n", j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e", j.E)
+		if err != nil || len(e) > 4 {
+			return nil, errors.New("invalid JWK member \"e\"")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := decode("x", j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y", j.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		x, err := decode("x", j.X)
+		if err != nil {
+			return nil, err
+		}
+		if j.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
+
+// thumbprint is the RFC 7638 SHA-256 thumbprint of the key, used as its kid
+func (j JWK) thumbprint() string {
+	// The required members in lexicographic order; encoding/json sorts map keys
+	members := map[string]string{"kty": j.Kty}
+	switch j.Kty {
+	case "RSA":
+		members["n"], members["e"] = j.N, j.E
+	case "EC":
+		members["crv"], members["x"], members["y"] = j.Crv, j.X, j.Y
+	case "OKP":
+		members["crv"], members["x"] = j.Crv, j.X
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return b64(sum[:])
+}
+
+// KeySet signs tokens with one key and accepts those of several, so that tokens issued
+// before a key rotation stay valid until they expire
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+	order   []*Key
+	methods []string
+}
+
+// NewKeySet creates a set signing with signing and also verifying with the previous keys
+func NewKeySet(signing *Key, previous ...*Key) (*KeySet, error) {
+	if signing == nil || !signing.CanSign() {
+		return nil, errors.New("the signing key has no private part")
+	}
+	s := &KeySet{signing: signing, keys: make(map[string]*Key)}
+	for _, key := range append([]*Key{signing}, previous...) {
+		if _, ok := s.keys[key.ID]; ok {
+			continue
+		}
+		s.keys[key.ID] = key
+		s.order = append(s.order, key)
+		s.methods = appendUnique(s.methods, key.Method.Alg())
+	}
+	return s, nil
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// Sign issues a token for claims with the signing key
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.signing.Method, claims)
+	token.Header["kid"] = s.signing.ID
+	return token.SignedString(s.signing.sign)
+}
+
+// keyFor finds the key a token claims to be signed with. The algorithm must be the key's own,
+// so that a public key can never be used as an HMAC secret. Tokens from before kids were
+// issued are checked against every HMAC key.
+func (s *KeySet) keyFor(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		var set jwt.VerificationKeySet
+		for _, key := range s.order {
+			if key.Method.Alg() == jwt.SigningMethodHS256.Alg() && token.Method.Alg() == key.Method.Alg() {
+				set.Keys = append(set.Keys, key.verify)
+			}
+		}
+		if len(set.Keys) == 0 {
+			return nil, ErrInvalidToken
+		}
+		return set, nil
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if key.Method.Alg() != token.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verify, nil
+}
+
+// Parse verifies tokenString and decodes it into claims
+func (s *KeySet) Parse(tokenString string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	opts = append(opts, jwt.WithValidMethods(s.methods))
+	return jwt.ParseWithClaims(tokenString, claims, s.keyFor, opts...)
+}
+
+// JWKS returns the public keys other services can verify our tokens with.
+// HMAC secrets are never published, so a set with only those is empty.
+func (s *KeySet) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range s.order {
+		if key.Method == jwt.SigningMethodHS256 {
+			continue
+		}
+		jwk := publicJWK(key.verify)
+		jwk.Kid, jwk.Use, jwk.Alg = key.ID, "sig", key.Method.Alg()
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
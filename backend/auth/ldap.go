@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"manschko.com/cloud-storage/ldap"
+)
+
+// LDAPConfig describes how users are found and checked in a directory such as Active Directory
+type LDAPConfig struct {
+	// URL is ldap://host[:port] or ldaps://host[:port]; StartTLS upgrades plain ldap connections
+	URL       string
+	StartTLS  bool
+	TLSConfig *tls.Config
+
+	// BindDN and BindPassword are the service account searching for users; empty searches anonymously
+	BindDN       string
+	BindPassword string
+
+	// UserFilter finds the user below BaseDN, with {username} replaced by the escaped login name,
+	// e.g. "(&(objectClass=user)(sAMAccountName={username}))". It may also require group membership.
+	BaseDN            string
+	UserFilter        string
+	UsernameAttribute string
+
+	// GroupFilter finds the groups of a user below GroupBaseDN, with {dn} and {username} replaced,
+	// e.g. "(member={dn})". Without it the memberOf attribute of the user is read instead.
+	GroupBaseDN string
+	GroupFilter string
+
+	// RequiredGroups, when set, limit logins to members of at least one of them.
+	// Groups here and in RoleMap are given by DN or common name, ignoring case.
+	RequiredGroups []string
+	RoleMap        map[string]string
+}
+
+// LDAPAuthenticator checks passwords with search-then-bind: the service account looks up
+// the user's DN, then a bind as that DN with the password proves it
+type LDAPAuthenticator struct {
+	cfg LDAPConfig
+}
+
+// NewLDAPAuthenticator creates an authenticator for cfg
+func NewLDAPAuthenticator(cfg LDAPConfig) (*LDAPAuthenticator, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("invalid LDAP URL %q", cfg.URL)
+	}
+	if cfg.StartTLS && u.Scheme == "ldaps" {
+		return nil, errors.New("StartTLS cannot be used with ldaps")
+	}
+	if cfg.BaseDN == "" {
+		return nil, errors.New("LDAP base DN is required")
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(uid={username})"
+	}
+	if !strings.Contains(cfg.UserFilter, "{username}") {
+		return nil, errors.New("LDAP user filter must contain {username}")
+	}
+	if cfg.UsernameAttribute == "" {
+		cfg.UsernameAttribute = "uid"
+	}
+	if cfg.GroupBaseDN == "" {
+		cfg.GroupBaseDN = cfg.BaseDN
+	}
+	return &LDAPAuthenticator{cfg: cfg}, nil
+}
+
+// Name identifies the backend
+func (a *LDAPAuthenticator) Name() string {
+	return "ldap"
+}
+
+// connect opens a connection, upgraded with StartTLS when configured, and binds the service account
+func (a *LDAPAuthenticator) connect(ctx context.Context) (*ldap.Conn, error) {
+	conn, err := ldap.Dial(ctx, a.cfg.URL, a.cfg.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	if a.cfg.StartTLS {
+		u, _ := url.Parse(a.cfg.URL)
+		if err := conn.StartTLS(a.cfg.TLSConfig, u.Hostname()); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP StartTLS failed: %w", err)
+		}
+	}
+	if a.cfg.BindDN != "" {
+		if err := conn.Bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP service account bind failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// Authenticate finds the user, binds as them and collects their groups
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, username, password string) (*Principal, error) {
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := a.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	filter := strings.ReplaceAll(a.cfg.UserFilter, "{username}", ldap.EscapeFilter(username))
+	entries, err := conn.Search(a.cfg.BaseDN, filter, []string{a.cfg.UsernameAttribute, "memberOf"})
+	if err != nil {
+		return nil, fmt.Errorf("LDAP user search failed: %w", err)
+	}
+	// An unknown or ambiguous username is a failed login like a wrong password
+	if len(entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	user := entries[0]
+
+	groups := user.Get("memberOf")
+	if a.cfg.GroupFilter != "" {
+		groups = nil
+		filter := strings.NewReplacer(
+			"{dn}", ldap.EscapeFilter(user.DN),
+			"{username}", ldap.EscapeFilter(username),
+		).Replace(a.cfg.GroupFilter)
+		found, err := conn.Search(a.cfg.GroupBaseDN, filter, []string{"cn"})
+		if err != nil {
+			return nil, fmt.Errorf("LDAP group search failed: %w", err)
+		}
+		for _, group := range found {
+			groups = append(groups, group.DN)
+		}
+	}
+
+	if err := conn.Bind(user.DN, password); err != nil {
+		if errors.Is(err, ldap.ErrInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("LDAP bind failed: %w", err)
+	}
+
+	if len(a.cfg.RequiredGroups) > 0 && !inAnyGroup(groups, a.cfg.RequiredGroups) {
+		return nil, ErrInvalidCredentials
+	}
+
+	principal := &Principal{Username: username, Roles: a.roles(groups)}
+	if names := user.Get(a.cfg.UsernameAttribute); len(names) == 1 && names[0] != "" {
+		principal.Username = names[0]
+	}
+	return principal, nil
+}
+
+// groupCN returns the common name of a group DN such as "cn=admins,ou=groups,dc=example,dc=com"
+func groupCN(dn string) string {
+	first, _, _ := strings.Cut(dn, ",")
+	if attr, value, ok := strings.Cut(first, "="); ok && strings.EqualFold(strings.TrimSpace(attr), "cn") {
+		return strings.TrimSpace(value)
+	}
+	return ""
+}
+
+// groupMatches reports whether group, a DN, is name given as a DN or common name
+func groupMatches(group, name string) bool {
+	return strings.EqualFold(group, name) || strings.EqualFold(groupCN(group), name)
+}
+
+func inAnyGroup(groups, names []string) bool {
+	for _, group := range groups {
+		for _, name := range names {
+			if groupMatches(group, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// roles maps the groups of a user to roles through the role map
+func (a *LDAPAuthenticator) roles(groups []string) []string {
+	set := make(map[string]bool)
+	for _, group := range groups {
+		for name, role := range a.cfg.RoleMap {
+			if groupMatches(group, name) {
+				set[role] = true
+			}
+		}
+	}
+	roles := make([]string, 0, len(set))
+	for role := range set {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
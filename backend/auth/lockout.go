@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setRetryAfter tells the client how many whole seconds to wait
+func setRetryAfter(ctx *gin.Context, wait time.Duration) {
+	ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// respondLoginError answers a login that did not succeed
+func respondLoginError(ctx *gin.Context, err error) {
+	var blocked *BlockedError
+	switch {
+	case errors.As(err, &blocked):
+		setRetryAfter(ctx, blocked.RetryAfter)
+		ctx.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "Too many failed login attempts, try again later",
+			"retry_after": int(math.Ceil(blocked.RetryAfter.Seconds())),
+		})
+	case errors.Is(err, ErrTooManyLogins):
+		setRetryAfter(ctx, loginBaseDelay)
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many logins in progress, try again shortly"})
+	case errors.Is(err, ErrInvalidCredentials):
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	default:
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": "Could not reach the storage server"})
+	}
+}
+
+// ListLockouts returns the usernames and addresses currently locked out. Admins only.
+func (c *AuthController) ListLockouts(ctx *gin.Context) {
+	if c.Guard == nil {
+		ctx.JSON(http.StatusOK, []Lockout{})
+		return
+	}
+	ctx.JSON(http.StatusOK, c.Guard.Lockouts())
+}
+
+// ClearLockout lets a locked out username or address log in again. Admins only.
+func (c *AuthController) ClearLockout(ctx *gin.Context) {
+	admin := ctx.GetString("username")
+	kind, value := ctx.Param("kind"), ctx.Param("value")
+	if kind != LockUser && kind != LockIP && kind != LockShare {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "kind must be user, ip or share"})
+		return
+	}
+	if c.Guard == nil || !c.Guard.Clear(kind, value) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "No failed logins recorded"})
+		return
+	}
+	log.Printf("Login lockout: %s %q cleared by %s", kind, value, admin)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Lockout cleared"})
+}
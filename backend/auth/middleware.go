@@ -6,8 +6,11 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// Middleware creates a Gin middleware for JWT authentication
-func Middleware(jwtSecret string) gin.HandlerFunc {
+// Middleware creates a Gin middleware for JWT authentication.
+// Tokens on the revocation list are refused. Personal access tokens from tokens are
+// accepted too; their scopes and paths are kept in the context for RequirePermission and the handlers,
+// and roles adds the configured roles to theirs.
+func Middleware(keys *KeySet, revoked *RevocationList, tokens *AccessTokenStore, roles RoleConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -24,8 +27,19 @@ func Middleware(jwtSecret string) gin.HandlerFunc {
 		// Extract token from "Bearer <token>"
 		tokenString := authHeader[7:]
 
+		if tokens != nil && IsAccessToken(tokenString) {
+			token, err := tokens.Verify(tokenString)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				return
+			}
+			setAccessToken(c, token, roles)
+			c.Next()
+			return
+		}
+
 		// Parse and validate token
-		claims, err := ValidateToken(tokenString, jwtSecret)
+		claims, err := CheckToken(tokenString, keys, revoked)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			return
@@ -33,6 +47,33 @@ func Middleware(jwtSecret string) gin.HandlerFunc {
 
 		// Store user info in context
 		c.Set("username", claims.Username)
+		c.Set("roles", claims.Roles)
+		c.Set("backend_roles", claims.BackendRoles)
+		c.Next()
+	}
+}
+
+// StreamMiddleware authenticates like Middleware but also accepts the token as the
+// access_token query parameter, since EventSource and browser WebSockets cannot set headers
+func StreamMiddleware(keys *KeySet, revoked *RevocationList) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := c.Query("access_token")
+		if authHeader := c.GetHeader("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+			tokenString = authHeader[7:]
+		}
+		if tokenString == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header or access_token required"})
+			return
+		}
+
+		claims, err := CheckToken(tokenString, keys, revoked)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		c.Set("username", claims.Username)
+		c.Set("roles", claims.Roles)
 		c.Next()
 	}
-}
\ No newline at end of file
+}
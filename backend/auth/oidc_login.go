@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/storage"
+)
+
+const (
+	// oidcLoginTimeout is how long a user has at the provider before the login must start over
+	oidcLoginTimeout = 10 * time.Minute
+	// oidcHandoffTimeout is how long the frontend has to pick up the tokens of a finished login
+	oidcHandoffTimeout = time.Minute
+	// maxPendingOIDCLogins bounds the logins waiting for the provider
+	maxPendingOIDCLogins = 10000
+	// oidcStateCookie ties the callback to the browser that started the login
+	oidcStateCookie = "oidc_state"
+)
+
+// ErrTooManyOIDCLogins is returned when too many logins are waiting for the provider
+var ErrTooManyOIDCLogins = errors.New("too many pending single sign-on logins")
+
+// pendingOIDCLogin is a login waiting for the provider to redirect back
+type pendingOIDCLogin struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+// oidcHandoff holds the tokens of a finished login until the frontend exchanges its code
+type oidcHandoff struct {
+	response LoginResponse
+	expires  time.Time
+}
+
+// OIDCLogins keeps the state of single sign-on logins in progress between requests
+type OIDCLogins struct {
+	mu       sync.Mutex
+	pending  map[string]pendingOIDCLogin
+	handoffs map[string]oidcHandoff
+}
+
+// NewOIDCLogins creates an empty login state
+func NewOIDCLogins() *OIDCLogins {
+	return &OIDCLogins{
+		pending:  make(map[string]pendingOIDCLogin),
+		handoffs: make(map[string]oidcHandoff),
+	}
+}
+
+// sweep drops expired entries; callers hold the lock
+func (l *OIDCLogins) sweep(now time.Time) {
+	for state, login := range l.pending {
+		if now.After(login.expires) {
+			delete(l.pending, state)
+		}
+	}
+	for code, handoff := range l.handoffs {
+		if now.After(handoff.expires) {
+			delete(l.handoffs, code)
+		}
+	}
+}
+
+func (l *OIDCLogins) begin(state string, login pendingOIDCLogin) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(time.Now())
+	if len(l.pending) >= maxPendingOIDCLogins {
+		return ErrTooManyOIDCLogins
+	}
+	l.pending[state] = login
+	return nil
+}
+
+// finish removes the login for state, so that every callback is handled at most once
+func (l *OIDCLogins) finish(state string) (pendingOIDCLogin, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	login, ok := l.pending[state]
+	delete(l.pending, state)
+	return login, ok && time.Now().Before(login.expires)
+}
+
+func (l *OIDCLogins) hand(code string, response LoginResponse) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handoffs[code] = oidcHandoff{response: response, expires: time.Now().Add(oidcHandoffTimeout)}
+}
+
+func (l *OIDCLogins) claim(code string) (LoginResponse, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	handoff, ok := l.handoffs[code]
+	delete(l.handoffs, code)
+	return handoff.response, ok && time.Now().Before(handoff.expires)
+}
+
+// OIDCExchangeRequest carries the one-time code the frontend got after a single sign-on login
+type OIDCExchangeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// redirectToFrontend sends the browser back to the login page with the outcome in the query
+func (c *AuthController) redirectToFrontend(ctx *gin.Context, key, value string) {
+	target, err := url.Parse(c.OIDCFrontendURL)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid frontend URL"})
+		return
+	}
+	query := target.Query()
+	query.Set(key, value)
+	target.RawQuery = query.Encode()
+	ctx.Redirect(http.StatusFound, target.String())
+}
+
+// OIDCLogin starts a single sign-on login by sending the browser to the identity provider
+func (c *AuthController) OIDCLogin(ctx *gin.Context) {
+	if c.OIDC == nil || c.OIDCLogins == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+
+	var login pendingOIDCLogin
+	state, err := storage.RandomToken(24)
+	if err == nil {
+		login.nonce, err = storage.RandomToken(24)
+	}
+	if err == nil {
+		login.verifier, err = storage.RandomToken(32)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	login.expires = time.Now().Add(oidcLoginTimeout)
+
+	authURL, err := c.OIDC.AuthCodeURL(ctx.Request.Context(), state, login.nonce, login.verifier)
+	if err != nil {
+		log.Printf("Single sign-on unavailable: %v", err)
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": "Could not reach the identity provider"})
+		return
+	}
+	if err := c.OIDCLogins.begin(state, login); err != nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many logins in progress, try again shortly"})
+		return
+	}
+
+	ctx.SetSameSite(http.SameSiteLaxMode)
+	ctx.SetCookie(oidcStateCookie, state, int(oidcLoginTimeout/time.Second), "/api/oidc", "", ctx.Request.TLS != nil, true)
+	ctx.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback completes a login when the provider redirects back. The ID token is verified,
+// mapped to a user through the identity rules, and the browser returns to the frontend with
+// a one-time code for the tokens, which keeps them out of URLs and browser history.
+func (c *AuthController) OIDCCallback(ctx *gin.Context) {
+	if c.OIDC == nil || c.OIDCLogins == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+
+	state := ctx.Query("state")
+	cookie, _ := ctx.Cookie(oidcStateCookie)
+	ctx.SetCookie(oidcStateCookie, "", -1, "/api/oidc", "", ctx.Request.TLS != nil, true)
+	login, ok := c.OIDCLogins.finish(state)
+	if !ok || cookie != state {
+		c.redirectToFrontend(ctx, "sso_error", "Login expired, please try again")
+		return
+	}
+	if providerErr := ctx.Query("error"); providerErr != "" {
+		log.Printf("Single sign-on refused by the provider: %s %s", providerErr, ctx.Query("error_description"))
+		c.redirectToFrontend(ctx, "sso_error", "The identity provider refused the login")
+		return
+	}
+
+	idToken, err := c.OIDC.Exchange(ctx.Request.Context(), ctx.Query("code"), login.verifier)
+	if err != nil {
+		log.Printf("Single sign-on code exchange failed: %v", err)
+		c.redirectToFrontend(ctx, "sso_error", "Could not complete the login with the identity provider")
+		return
+	}
+	claims, err := c.OIDC.VerifyIDToken(ctx.Request.Context(), idToken, login.nonce)
+	if err != nil {
+		log.Printf("Single sign-on ID token rejected: %v", err)
+		c.redirectToFrontend(ctx, "sso_error", "The identity provider returned an invalid token")
+		return
+	}
+
+	rules := c.IdentityRules
+	if rules == nil {
+		rules = DefaultIdentityRules
+	}
+	subject, _ := claims.GetSubject()
+	identity, err := MapIdentity(rules, claims)
+	if err != nil {
+		log.Printf("Single sign-on of subject %q refused: %v", subject, err)
+		c.redirectToFrontend(ctx, "sso_error", "Your account has no access to this storage")
+		return
+	}
+	if c.AccountEnabled != nil {
+		enabled, err := c.AccountEnabled(ctx.Request.Context(), identity.Username)
+		if err != nil {
+			log.Printf("Single sign-on of %q: checking the account failed: %v", identity.Username, err)
+			c.redirectToFrontend(ctx, "sso_error", "Could not check your account, please try again")
+			return
+		}
+		if !enabled {
+			log.Printf("Single sign-on of subject %q refused: account %q is disabled", subject, identity.Username)
+			c.redirectToFrontend(ctx, "sso_error", "Your account has no access to this storage")
+			return
+		}
+	}
+	if c.Identities != nil {
+		email, _ := claims["email"].(string)
+		issuer, _ := claims.GetIssuer()
+		err := c.Identities.Link(LinkedIdentity{
+			Username:  identity.Username,
+			Home:      identity.Home,
+			Issuer:    issuer,
+			Subject:   subject,
+			Email:     email,
+			LastLogin: time.Now(),
+		})
+		if errors.Is(err, ErrIdentityTaken) {
+			log.Printf("Single sign-on of subject %q refused: username %q is linked to another account", subject, identity.Username)
+			c.redirectToFrontend(ctx, "sso_error", "Your account has no access to this storage")
+			return
+		}
+		if err != nil {
+			c.redirectToFrontend(ctx, "sso_error", "Failed to record the login")
+			return
+		}
+	}
+
+	// Second factors are left to the identity provider, so no challenge follows here
+	response, err := c.startSession(c.Roles.Assign(Principal{Username: identity.Username}))
+	if err != nil {
+		c.redirectToFrontend(ctx, "sso_error", "Failed to generate token")
+		return
+	}
+	code, err := storage.RandomToken(24)
+	if err != nil {
+		c.redirectToFrontend(ctx, "sso_error", "Failed to generate token")
+		return
+	}
+	c.OIDCLogins.hand(code, response)
+	c.redirectToFrontend(ctx, "sso_code", code)
+}
+
+// OIDCExchange hands the tokens of a finished single sign-on login to the frontend, once
+func (c *AuthController) OIDCExchange(ctx *gin.Context) {
+	var req OIDCExchangeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if c.OIDCLogins == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+	response, ok := c.OIDCLogins.claim(req.Code)
+	if !ok {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login code"})
+		return
+	}
+	ctx.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ErrNoIdentityRule is returned for provider accounts no rule lets in
+var ErrNoIdentityRule = errors.New("no rule maps this account")
+
+// validMappedUsername keeps mapped usernames usable as a folder name
+var validMappedUsername = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]{0,63}$`)
+
+// templateField matches the {claim} placeholders of rule templates
+var templateField = regexp.MustCompile(`\{([A-Za-z0-9_.-]+)\}`)
+
+// IdentityRule maps provider accounts whose Claim matches Pattern to a username and home folder.
+// Patterns are case-insensitive globs with * and ?; a list claim such as groups matches when
+// any entry does, and a rule without Claim matches everyone. Username and Home are templates
+// where {claim} is replaced by a claim value, and {email_local} and {email_domain} are the
+// parts of the email address. Deny refuses the matching accounts instead.
+type IdentityRule struct {
+	Claim    string `json:"claim,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+	Username string `json:"username,omitempty"`
+	Home     string `json:"home,omitempty"`
+	Deny     bool   `json:"deny,omitempty"`
+}
+
+// Identity is what a provider account maps to
+type Identity struct {
+	Username string
+	// Home overrides the default home folder of the user when set
+	Home string
+}
+
+// DefaultIdentityRules lets every account in under its subject. Names such as preferred_username
+// can be chosen or changed by the account holder at many providers, so they need rules of their own.
+var DefaultIdentityRules = []IdentityRule{{Username: "{sub}"}}
+
+// LoadIdentityRules reads a JSON list of rules from path
+func LoadIdentityRules(path string) ([]IdentityRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []IdentityRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, rule := range rules {
+		if !rule.Deny && rule.Username == "" {
+			return nil, fmt.Errorf("%s: rule %d has no username", path, i+1)
+		}
+	}
+	return rules, nil
+}
+
+// globMatch reports whether value matches pattern, ignoring case
+func globMatch(pattern, value string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	matched, _ := regexp.MatchString("(?is)^"+expr+"$", value)
+	return matched
+}
+
+// claimValues returns a claim as a list of strings
+func claimValues(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	case bool, float64:
+		return []string{fmt.Sprint(v)}
+	}
+	return nil
+}
+
+// identityClaims prepares the claims rules see: an unverified email is dropped,
+// since anyone could have typed it in, and the email parts are added
+func identityClaims(claims map[string]interface{}) map[string]interface{} {
+	prepared := make(map[string]interface{}, len(claims)+2)
+	for k, v := range claims {
+		prepared[k] = v
+	}
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		delete(prepared, "email")
+	}
+	if email, ok := prepared["email"].(string); ok {
+		email = strings.ToLower(email)
+		prepared["email"] = email
+		if local, domain, ok := strings.Cut(email, "@"); ok {
+			prepared["email_local"], prepared["email_domain"] = local, domain
+		}
+	}
+	return prepared
+}
+
+// expand fills in the {claim} placeholders of template
+func expand(template string, claims map[string]interface{}) (string, error) {
+	var missing string
+	out := templateField.ReplaceAllStringFunc(template, func(field string) string {
+		name := field[1 : len(field)-1]
+		values := claimValues(claims, name)
+		if len(values) != 1 || values[0] == "" {
+			missing = name
+			return ""
+		}
+		return values[0]
+	})
+	if missing != "" {
+		return "", fmt.Errorf("claim %q is missing", missing)
+	}
+	return out, nil
+}
+
+// MapIdentity applies the first rule matching the claims of an ID token
+func MapIdentity(rules []IdentityRule, claims map[string]interface{}) (Identity, error) {
+	claims = identityClaims(claims)
+	for _, rule := range rules {
+		if rule.Claim != "" {
+			matched := false
+			for _, value := range claimValues(claims, rule.Claim) {
+				if globMatch(rule.Pattern, value) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		if rule.Deny {
+			return Identity{}, ErrNoIdentityRule
+		}
+
+		username, err := expand(rule.Username, claims)
+		if err != nil {
+			return Identity{}, err
+		}
+		if !validMappedUsername.MatchString(username) {
+			return Identity{}, fmt.Errorf("mapped username %q is not allowed", username)
+		}
+		identity := Identity{Username: username}
+		if rule.Home != "" {
+			home, err := expand(rule.Home, claims)
+			if err != nil {
+				return Identity{}, err
+			}
+			if strings.Contains(home, "..") {
+				return Identity{}, fmt.Errorf("mapped home %q is not allowed", home)
+			}
+			identity.Home = path.Clean("/" + home)
+			// Hidden top-level folders such as the group spaces belong to the server
+			if top, _, _ := strings.Cut(strings.TrimPrefix(identity.Home, "/"), "/"); !UsableUsername(top) {
+				return Identity{}, fmt.Errorf("mapped home %q is not allowed", home)
+			}
+		}
+		return identity, nil
+	}
+	return Identity{}, ErrNoIdentityRule
+}
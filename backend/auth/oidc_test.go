@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID = "storage"
+	testCode     = "code-from-provider"
+)
+
+// mockProvider is an OpenID Connect provider answering discovery, its key set and the token endpoint
+type mockProvider struct {
+	server *httptest.Server
+	// issuer is what discovery reports, with a trailing slash like some providers use
+	issuer string
+	key    *ecdsa.PrivateKey
+	kid    string
+	// idToken is what the token endpoint hands out next
+	idToken string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{key: key, kid: "provider-key"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcMetadata{
+			Issuer:                p.issuer,
+			AuthorizationEndpoint: p.server.URL + "/authorize",
+			TokenEndpoint:         p.server.URL + "/token",
+			JWKSURI:               p.server.URL + "/jwks",
+			CodeChallengeMethods:  []string{"S256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk := publicJWK(p.key.Public())
+		jwk.Kid, jwk.Use = p.kid, "sig"
+		json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.FormValue("code") != testCode || r.FormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	p.issuer = p.server.URL + "/"
+	return p
+}
+
+// claims returns valid ID token claims for subject, to be changed by the test
+func (p *mockProvider) claims(subject, nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":   p.issuer,
+		"aud":   testClientID,
+		"sub":   subject,
+		"nonce": nonce,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+	}
+}
+
+// sign issues an ID token with the provider key
+func (p *mockProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = p.kid
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (p *mockProvider) provider() *OIDCProvider {
+	return NewOIDCProvider(OIDCConfig{
+		Issuer:      p.issuer,
+		ClientID:    testClientID,
+		RedirectURL: "https://storage.example.com/api/oidc/callback",
+	}, p.server.Client())
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	p := newMockProvider(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token func() string
+		ok    bool
+	}{
+		{"valid", func() string { return p.sign(t, p.claims("alice-id", "n1")) }, true},
+		{"wrong nonce", func() string { return p.sign(t, p.claims("alice-id", "other")) }, false},
+		{"issuer not exactly as discovered", func() string {
+			claims := p.claims("alice-id", "n1")
+			claims["iss"] = strings.TrimSuffix(p.issuer, "/")
+			return p.sign(t, claims)
+		}, false},
+		{"other audience", func() string {
+			claims := p.claims("alice-id", "n1")
+			claims["aud"] = "someone-else"
+			return p.sign(t, claims)
+		}, false},
+		{"several audiences without azp", func() string {
+			claims := p.claims("alice-id", "n1")
+			claims["aud"] = []string{testClientID, "someone-else"}
+			return p.sign(t, claims)
+		}, false},
+		{"expired", func() string {
+			claims := p.claims("alice-id", "n1")
+			claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			return p.sign(t, claims)
+		}, false},
+		{"no subject", func() string { return p.sign(t, p.claims("", "n1")) }, false},
+		{"unknown key", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodES256, p.claims("alice-id", "n1"))
+			token.Header["kid"] = "not-published"
+			signed, _ := token.SignedString(otherKey)
+			return signed
+		}, false},
+		{"HMAC", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, p.claims("alice-id", "n1"))
+			token.Header["kid"] = p.kid
+			signed, _ := token.SignedString([]byte("guessable"))
+			return signed
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := p.provider().VerifyIDToken(context.Background(), tt.token(), "n1")
+			if tt.ok && err != nil {
+				t.Fatalf("VerifyIDToken() error = %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("VerifyIDToken() accepted the token with claims %v", claims)
+			}
+		})
+	}
+}
+
+// newOIDCController creates a controller logging in through p only
+func newOIDCController(t *testing.T, p *mockProvider) *AuthController {
+	t.Helper()
+	keys, err := NewKeySet(NewHMACKey("test secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := NewIdentityStore(filepath.Join(t.TempDir(), "identities.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &AuthController{
+		Keys:            keys,
+		AccessTokenTTL:  time.Minute,
+		OIDC:            p.provider(),
+		OIDCLogins:      NewOIDCLogins(),
+		Identities:      identities,
+		OIDCFrontendURL: "https://storage.example.com/login",
+	}
+}
+
+// ssoLogin runs a browser through the login: to the provider, which logs in subject with
+// the extra claims, and back. It returns the query the browser lands on at the frontend.
+func ssoLogin(t *testing.T, c *AuthController, p *mockProvider, subject string, extra jwt.MapClaims) url.Values {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/oidc/login", c.OIDCLogin)
+	router.GET("/api/oidc/callback", c.OIDCCallback)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: status %d, body %s", rec.Code, rec.Body)
+	}
+	authURL, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authURL.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != testClientID {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	claims := p.claims(subject, query.Get("nonce"))
+	for k, v := range extra {
+		claims[k] = v
+	}
+	p.idToken = p.sign(t, claims)
+
+	callback := httptest.NewRequest(http.MethodGet, "/api/oidc/callback?"+url.Values{
+		"state": {query.Get("state")},
+		"code":  {testCode},
+	}.Encode(), nil)
+	for _, cookie := range rec.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, callback)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("callback: status %d, body %s", rec.Code, rec.Body)
+	}
+	landing, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return landing.Query()
+}
+
+// exchangeCode trades the code of a finished login for its access token and returns the username in it
+func exchangeCode(t *testing.T, c *AuthController, code string) string {
+	t.Helper()
+	router := gin.New()
+	router.POST("/api/oidc/exchange", c.OIDCExchange)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/oidc/exchange", strings.NewReader(`{"code":"`+code+`"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("exchange: status %d, body %s", rec.Code, rec.Body)
+	}
+	var response LoginResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateToken(response.Token, c.Keys)
+	if err != nil {
+		t.Fatalf("issued token is invalid: %v", err)
+	}
+	return claims.Username
+}
+
+func TestOIDCCallbackLogsInUnderSubject(t *testing.T) {
+	p := newMockProvider(t)
+	c := newOIDCController(t, p)
+
+	landing := ssoLogin(t, c, p, "alice-id", jwt.MapClaims{"preferred_username": "admin"})
+	if landing.Get("sso_error") != "" {
+		t.Fatalf("login refused: %s", landing.Get("sso_error"))
+	}
+	if username := exchangeCode(t, c, landing.Get("sso_code")); username != "alice-id" {
+		t.Fatalf("logged in as %q, want the subject", username)
+	}
+	linked := c.Identities.identities["alice-id"]
+	if linked == nil || linked.Issuer != p.issuer || linked.Subject != "alice-id" {
+		t.Fatalf("identity linked as %+v", linked)
+	}
+}
+
+func TestOIDCCallbackKeepsUsernameWithFirstAccount(t *testing.T) {
+	p := newMockProvider(t)
+	c := newOIDCController(t, p)
+	c.IdentityRules = []IdentityRule{{Username: "{preferred_username}"}}
+
+	landing := ssoLogin(t, c, p, "alice-id", jwt.MapClaims{"preferred_username": "alice"})
+	if landing.Get("sso_code") == "" {
+		t.Fatalf("first login refused: %s", landing.Get("sso_error"))
+	}
+
+	// Another account choosing the same name must not take over the user
+	landing = ssoLogin(t, c, p, "mallory-id", jwt.MapClaims{"preferred_username": "alice"})
+	if landing.Get("sso_code") != "" || landing.Get("sso_error") == "" {
+		t.Fatalf("second account logged in as alice: %v", landing)
+	}
+
+	landing = ssoLogin(t, c, p, "alice-id", jwt.MapClaims{"preferred_username": "alice"})
+	if landing.Get("sso_code") == "" {
+		t.Fatalf("linked account refused: %s", landing.Get("sso_error"))
+	}
+	if username := exchangeCode(t, c, landing.Get("sso_code")); username != "alice" {
+		t.Fatalf("logged in as %q, want alice", username)
+	}
+}
+
+func TestOIDCCallbackRefusesDisabledAccount(t *testing.T) {
+	p := newMockProvider(t)
+	c := newOIDCController(t, p)
+	c.AccountEnabled = func(ctx context.Context, username string) (bool, error) {
+		return username != "alice-id", nil
+	}
+
+	landing := ssoLogin(t, c, p, "alice-id", nil)
+	if landing.Get("sso_code") != "" || landing.Get("sso_error") == "" {
+		t.Fatalf("disabled account logged in: %v", landing)
+	}
+	if _, ok := c.Identities.identities["alice-id"]; ok {
+		t.Fatal("login of a disabled account was recorded")
+	}
+
+	if landing := ssoLogin(t, c, p, "bob-id", nil); landing.Get("sso_code") == "" {
+		t.Fatalf("enabled account refused: %s", landing.Get("sso_error"))
+	}
+}
+
+func TestOIDCCallbackRejectsForeignBrowser(t *testing.T) {
+	p := newMockProvider(t)
+	c := newOIDCController(t, p)
+	router := gin.New()
+	router.GET("/api/oidc/login", c.OIDCLogin)
+	router.GET("/api/oidc/callback", c.OIDCCallback)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	authURL, _ := url.Parse(rec.Header().Get("Location"))
+	state := authURL.Query().Get("state")
+	p.idToken = p.sign(t, p.claims("alice-id", authURL.Query().Get("nonce")))
+
+	// The callback arrives without the state cookie of the browser that started the login
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/callback?state="+url.QueryEscape(state)+"&code="+testCode, nil))
+	landing, _ := url.Parse(rec.Header().Get("Location"))
+	if landing == nil || landing.Query().Get("sso_code") != "" || landing.Query().Get("sso_error") == "" {
+		t.Fatalf("callback without the state cookie was accepted: %s", rec.Header().Get("Location"))
+	}
+}
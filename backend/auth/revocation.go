@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+// revocations is the persisted form of a RevocationList
+type revocations struct {
+	Tokens   map[string]time.Time `json:"tokens"`
+	Sessions map[string]time.Time `json:"sessions"`
+}
+
+// RevocationList holds access tokens that were revoked before they expired,
+// by jti for single tokens and by session for every token of an ended session.
+// Entries are kept until the tokens they cover would have expired anyway.
+type RevocationList struct {
+	mu   sync.Mutex
+	file *storage.JSONFile
+	list revocations
+}
+
+// NewRevocationList loads the revocation list at path
+func NewRevocationList(path string) (*RevocationList, error) {
+	r := &RevocationList{
+		file: storage.NewJSONFile(path),
+		list: revocations{Tokens: map[string]time.Time{}, Sessions: map[string]time.Time{}},
+	}
+	if err := r.file.Load(&r.list); err != nil {
+		return nil, err
+	}
+	if r.list.Tokens == nil {
+		r.list.Tokens = map[string]time.Time{}
+	}
+	if r.list.Sessions == nil {
+		r.list.Sessions = map[string]time.Time{}
+	}
+	return r, nil
+}
+
+// save drops entries that no longer matter and persists the rest; callers hold the lock
+func (r *RevocationList) save() error {
+	now := time.Now()
+	for jti, until := range r.list.Tokens {
+		if now.After(until) {
+			delete(r.list.Tokens, jti)
+		}
+	}
+	for sid, until := range r.list.Sessions {
+		if now.After(until) {
+			delete(r.list.Sessions, sid)
+		}
+	}
+	return r.file.Save(r.list)
+}
+
+// RevokeToken rejects the access token jti until it expires
+func (r *RevocationList) RevokeToken(jti string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.list.Tokens[jti] = expiresAt
+	return r.save()
+}
+
+// RevokeSession rejects every access token of session sid issued so far, until the last of them expires
+func (r *RevocationList) RevokeSession(sid string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.list.Sessions[sid] = until
+	return r.save()
+}
+
+// IsRevoked reports whether the token with claims was revoked
+func (r *RevocationList) IsRevoked(claims *UserClaims) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.list.Tokens[claims.ID]; ok && claims.ID != "" {
+		return true
+	}
+	_, ok := r.list.Sessions[claims.SessionID]
+	return ok && claims.SessionID != ""
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles a user can hold. They come from the account backend, such as LDAP groups,
+// and from the configuration; a user holding several gets the permissions of all.
+const (
+	RoleAdmin    = "admin"
+	RoleUser     = "user"
+	RoleReadOnly = "read-only"
+	RoleUploader = "uploader"
+)
+
+// Permission is something a role allows
+type Permission string
+
+const (
+	// PermRead lists folders and downloads files
+	PermRead Permission = "read"
+	// PermUpload adds new files and folders
+	PermUpload Permission = "upload"
+	// PermWrite changes, moves and replaces existing entries
+	PermWrite Permission = "write"
+	// PermDelete removes entries
+	PermDelete Permission = "delete"
+	// PermShare hands files to others through links, file requests, grants and groups
+	PermShare Permission = "share"
+	// PermAdmin manages the server and other users
+	PermAdmin Permission = "admin"
+)
+
+// rolePermissions lists what each role allows
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:    {PermRead, PermUpload, PermWrite, PermDelete, PermShare, PermAdmin},
+	RoleUser:     {PermRead, PermUpload, PermWrite, PermDelete, PermShare},
+	RoleReadOnly: {PermRead},
+	RoleUploader: {PermUpload},
+}
+
+// permissionScopes is the scope a personal access token needs for each permission.
+// Tokens never get PermAdmin.
+var permissionScopes = map[Permission]string{
+	PermRead:   ScopeRead,
+	PermUpload: ScopeWrite,
+	PermWrite:  ScopeWrite,
+	PermDelete: ScopeDelete,
+	PermShare:  ScopeShare,
+}
+
+// IsRole reports whether name is a known role
+func IsRole(name string) bool {
+	_, ok := rolePermissions[name]
+	return ok
+}
+
+// Permits reports whether any of roles allows perm; no roles at all count as RoleUser
+func Permits(roles []string, perm Permission) bool {
+	if len(roles) == 0 {
+		roles = []string{RoleUser}
+	}
+	for _, role := range roles {
+		for _, granted := range rolePermissions[role] {
+			if granted == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RoleConfig assigns roles on top of those from the account backend
+type RoleConfig struct {
+	// Users maps usernames to their roles
+	Users map[string][]string
+	// Default is given to users without any known role; empty means RoleUser
+	Default string
+}
+
+// Assign returns principal with the configured roles added, sorted and without duplicates.
+// Roles unknown here, such as unmapped LDAP groups, are kept but grant nothing.
+// The roles principal came with are kept as its BackendRoles.
+func (r RoleConfig) Assign(principal Principal) Principal {
+	principal.BackendRoles = principal.Roles
+	set := make(map[string]bool)
+	known := false
+	for _, role := range append(append([]string{}, principal.Roles...), r.Users[principal.Username]...) {
+		set[role] = true
+		known = known || IsRole(role)
+	}
+	if !known {
+		if r.Default != "" {
+			set[r.Default] = true
+		} else {
+			set[RoleUser] = true
+		}
+	}
+
+	principal.Roles = make([]string, 0, len(set))
+	for role := range set {
+		principal.Roles = append(principal.Roles, role)
+	}
+	sort.Strings(principal.Roles)
+	return principal
+}
+
+// HasPermission reports whether the authenticated user's roles allow perm and,
+// for personal access tokens, whether the token's scopes do too
+func HasPermission(c *gin.Context, perm Permission) bool {
+	if !Permits(c.GetStringSlice("roles"), perm) {
+		return false
+	}
+	if _, limited := c.Get("scopes"); !limited {
+		return true
+	}
+	scope, ok := permissionScopes[perm]
+	return ok && HasScope(c, scope)
+}
+
+// RequirePermission refuses requests whose roles, or token scopes, do not allow perm
+func RequirePermission(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasPermission(c, perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Your role or access token does not allow this operation"})
+			return
+		}
+		c.Next()
+	}
+}
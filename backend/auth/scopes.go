@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setAccessToken stores the user and limits of a personal access token in the context.
+// Its roles are resolved now, so that role changes apply to tokens that never expire.
+func setAccessToken(c *gin.Context, token AccessToken, roles RoleConfig) {
+	principal := roles.Assign(Principal{Username: token.Owner, Roles: token.BackendRoles})
+	c.Set("username", principal.Username)
+	c.Set("roles", principal.Roles)
+	c.Set("backend_roles", principal.BackendRoles)
+	c.Set("token_id", token.ID)
+	c.Set("scopes", token.Scopes)
+	if len(token.Paths) > 0 {
+		c.Set("token_paths", token.Paths)
+	}
+}
+
+// HasScope reports whether the request may act within scope.
+// Only personal access tokens are limited; logins hold every scope.
+func HasScope(c *gin.Context, scope string) bool {
+	scopes, limited := c.Get("scopes")
+	if !limited {
+		return true
+	}
+	for _, granted := range scopes.([]string) {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireLogin refuses personal access tokens, for routes managing credentials and accounts.
+// A token that could create tokens or keys could shed its own limits.
+func RequireLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, limited := c.Get("scopes"); limited {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Personal access tokens cannot be used here, log in instead"})
+			return
+		}
+		c.Next()
+	}
+}
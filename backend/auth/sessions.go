@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// Session is one login of a user, kept alive by rotating its refresh token.
+// Only a hash of the current refresh token is stored.
+type Session struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	// BackendRoles are the roles from the account backend at login; the configured roles
+	// are added each time an access token is issued
+	BackendRoles []string  `json:"backend_roles,omitempty"`
+	TokenHash    string    `json:"token_hash"`
+	Generation   int       `json:"generation"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// SessionStore persists the sessions behind refresh tokens.
+// A refresh token is "<session id>.<secret>" and can be used once; using it returns the next one.
+type SessionStore struct {
+	mu       sync.Mutex
+	file     *storage.JSONFile
+	sessions map[string]*Session
+	// maxAge ends a session this long after the login however often it is refreshed
+	maxAge time.Duration
+}
+
+// NewSessionStore loads the sessions at path. Sessions end at the latest maxAge after their login.
+func NewSessionStore(path string, maxAge time.Duration) (*SessionStore, error) {
+	s := &SessionStore{
+		file:     storage.NewJSONFile(path),
+		sessions: make(map[string]*Session),
+		maxAge:   maxAge,
+	}
+	if err := s.file.Load(&s.sessions); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save drops expired sessions and persists the rest; callers hold the lock
+func (s *SessionStore) save() error {
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+	return s.file.Save(s.sessions)
+}
+
+func hashRefreshSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSecret gives session a fresh refresh token, valid for ttl from now but not past the
+// session's maximum age; callers hold the lock
+func (s *SessionStore) newSecret(session *Session, ttl time.Duration) (string, error) {
+	secret, err := storage.RandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	session.TokenHash = hashRefreshSecret(secret)
+	session.Generation++
+	session.LastUsedAt = now
+	session.ExpiresAt = now.Add(ttl)
+	if end := session.CreatedAt.Add(s.maxAge); s.maxAge > 0 && session.ExpiresAt.After(end) {
+		session.ExpiresAt = end
+	}
+	return session.ID + "." + secret, nil
+}
+
+// Create starts a session for principal and returns its first refresh token
+func (s *SessionStore) Create(principal Principal, ttl time.Duration) (Session, string, error) {
+	id, err := storage.RandomID()
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session := &Session{ID: id, Username: principal.Username, BackendRoles: principal.BackendRoles, CreatedAt: time.Now()}
+	token, err := s.newSecret(session, ttl)
+	if err != nil {
+		return Session{}, "", err
+	}
+	s.sessions[id] = session
+	return *session, token, s.save()
+}
+
+// lookup finds the live session a refresh token names and reports whether the token is its current one;
+// callers hold the lock
+func (s *SessionStore) lookup(refreshToken string) (*Session, bool, error) {
+	id, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok {
+		return nil, false, ErrInvalidRefreshToken
+	}
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return nil, false, ErrInvalidRefreshToken
+	}
+	current := subtle.ConstantTimeCompare([]byte(hashRefreshSecret(secret)), []byte(session.TokenHash)) == 1
+	return session, current, nil
+}
+
+// Rotate exchanges a refresh token for the next one, extending the session by ttl up to its maximum age.
+// Presenting a token that was already exchanged means it leaked: the session is ended
+// and returned with ErrRefreshTokenReused, so that its access tokens can be revoked too.
+func (s *SessionStore) Rotate(refreshToken string, ttl time.Duration) (Session, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, current, err := s.lookup(refreshToken)
+	if err != nil {
+		return Session{}, "", err
+	}
+	if !current {
+		delete(s.sessions, session.ID)
+		log.Printf("Refresh token reuse detected for user %q, session %s ended", session.Username, session.ID)
+		return *session, "", errors.Join(ErrRefreshTokenReused, s.save())
+	}
+
+	token, err := s.newSecret(session, ttl)
+	if err != nil {
+		return Session{}, "", err
+	}
+	return *session, token, s.save()
+}
+
+// End removes a session of username. It reports false when there was no such session.
+func (s *SessionStore) End(username, id string) (Session, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.Username != username {
+		return Session{}, false, nil
+	}
+	delete(s.sessions, id)
+	return *session, true, s.save()
+}
+
+// EndByToken removes the session a refresh token belongs to, whether or not the token is current
+func (s *SessionStore) EndByToken(refreshToken string) (Session, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, _, err := s.lookup(refreshToken)
+	if err != nil {
+		return Session{}, false, nil
+	}
+	delete(s.sessions, session.ID)
+	return *session, true, s.save()
+}
+
+// EndAll removes every session of username and returns them
+func (s *SessionStore) EndAll(username string) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ended []Session
+	for id, session := range s.sessions {
+		if session.Username == username {
+			ended = append(ended, *session)
+			delete(s.sessions, id)
+		}
+	}
+	return ended, s.save()
+}
+
+// List returns the live sessions of username, most recently used first
+func (s *SessionStore) List(username string) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	list := []Session{}
+	for _, session := range s.sessions {
+		if session.Username == username && now.Before(session.ExpiresAt) {
+			list = append(list, *session)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastUsedAt.After(list[j].LastUsedAt) })
+	return list
+}
@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RefreshRequest carries the refresh token to exchange
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// LogoutRequest optionally names the session to end, or asks to end all of them
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+	All          bool   `json:"all"`
+}
+
+// startSession issues the tokens for a fresh login of principal
+func (c *AuthController) startSession(principal Principal) (LoginResponse, error) {
+	if c.Sessions == nil {
+		token, err := GenerateToken(principal, c.Keys, c.AccessTokenTTL)
+		return LoginResponse{Token: token, ExpiresIn: int(c.AccessTokenTTL / time.Second)}, err
+	}
+	session, refreshToken, err := c.Sessions.Create(principal, c.RefreshTokenTTL)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	return c.tokenResponse(session, refreshToken)
+}
+
+// tokenResponse issues an access token for session next to its refresh token.
+// The configured roles are applied again, so that changes reach sessions on their next refresh.
+func (c *AuthController) tokenResponse(session Session, refreshToken string) (LoginResponse, error) {
+	principal := c.Roles.Assign(Principal{Username: session.Username, Roles: session.BackendRoles})
+	token, err := GenerateSessionToken(principal, session.ID, c.Keys, c.AccessTokenTTL)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	return LoginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(c.AccessTokenTTL / time.Second),
+	}, nil
+}
+
+// revokeSession rejects the access tokens still out for session
+func (c *AuthController) revokeSession(session Session) {
+	if c.Revoked == nil {
+		return
+	}
+	if err := c.Revoked.RevokeSession(session.ID, time.Now().Add(c.AccessTokenTTL)); err != nil {
+		log.Printf("Failed to revoke session %s: %v", session.ID, err)
+	}
+}
+
+// EndUserSessions logs username out everywhere: their sessions end, their access tokens
+// stop working and their personal access tokens are revoked
+func (c *AuthController) EndUserSessions(username string) error {
+	if c.Sessions != nil {
+		sessions, err := c.Sessions.EndAll(username)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			c.revokeSession(session)
+		}
+	}
+	if c.AccessTokens != nil {
+		return c.AccessTokens.RevokeAll(username)
+	}
+	return nil
+}
+
+// Refresh exchanges a refresh token for a new access token and the next refresh token.
+// A refresh token already exchanged before ends its session.
+func (c *AuthController) Refresh(ctx *gin.Context) {
+	var req RefreshRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if c.Sessions == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Refresh tokens are not enabled"})
+		return
+	}
+
+	session, refreshToken, err := c.Sessions.Rotate(req.RefreshToken, c.RefreshTokenTTL)
+	switch {
+	case errors.Is(err, ErrRefreshTokenReused):
+		c.revokeSession(session)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token was already used, please log in again"})
+		return
+	case errors.Is(err, ErrInvalidRefreshToken):
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	case err != nil:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+
+	response, err := c.tokenResponse(session, refreshToken)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	ctx.JSON(http.StatusOK, response)
+}
+
+// Logout revokes the bearer token and ends its session, or the session of the given
+// refresh token. With all set, every session of the user ends.
+// Logging out twice is not an error, so expired or revoked tokens are accepted quietly.
+func (c *AuthController) Logout(ctx *gin.Context) {
+	var req LogoutRequest
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	var claims *UserClaims
+	if authHeader := ctx.GetHeader("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		claims, _ = CheckToken(authHeader[7:], c.Keys, c.Revoked)
+	}
+	if claims == nil && req.RefreshToken == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "A bearer token or refresh_token is required"})
+		return
+	}
+
+	username := ""
+	if claims != nil {
+		username = claims.Username
+		if c.Revoked != nil && claims.ID != "" && claims.ExpiresAt != nil {
+			if err := c.Revoked.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+				return
+			}
+		}
+	}
+
+	if c.Sessions != nil {
+		var ended []Session
+		if claims != nil && claims.SessionID != "" {
+			if session, ok, err := c.Sessions.End(claims.Username, claims.SessionID); err == nil && ok {
+				ended = append(ended, session)
+			}
+		}
+		if req.RefreshToken != "" {
+			if session, ok, err := c.Sessions.EndByToken(req.RefreshToken); err == nil && ok {
+				ended = append(ended, session)
+				if username == "" {
+					username = session.Username
+				}
+			}
+		}
+		if req.All && username != "" {
+			sessions, err := c.Sessions.EndAll(username)
+			if err != nil {
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end sessions"})
+				return
+			}
+			ended = append(ended, sessions...)
+		}
+		for _, session := range ended {
+			c.revokeSession(session)
+		}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// JWKS publishes the public keys our tokens can be verified with
+func (c *AuthController) JWKS(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(http.StatusOK, c.Keys.JWKS())
+}
+
+// CreateAccessTokenRequest describes a new personal access token.
+// Paths limit it to those folders; without ExpiresAt it lasts until revoked.
+type CreateAccessTokenRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	Paths     []string   `json:"paths"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// AccessTokenResponse describes a personal access token. Token is only set when it is created.
+type AccessTokenResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Paths      []string   `json:"paths,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Token      string     `json:"token,omitempty"`
+}
+
+func newAccessTokenResponse(token AccessToken) AccessTokenResponse {
+	return AccessTokenResponse{
+		ID:         token.ID,
+		Name:       token.Name,
+		Scopes:     token.Scopes,
+		Paths:      token.Paths,
+		CreatedAt:  token.CreatedAt,
+		ExpiresAt:  token.ExpiresAt,
+		LastUsedAt: token.LastUsedAt,
+	}
+}
+
+// accessTokensEnabled answers requests for personal access tokens when they are off
+func (c *AuthController) accessTokensEnabled(ctx *gin.Context) bool {
+	if c.AccessTokens == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Personal access tokens are not enabled"})
+		return false
+	}
+	return true
+}
+
+// CreateAccessToken issues a personal access token for the caller. The token is in the
+// response only; it cannot be shown again.
+func (c *AuthController) CreateAccessToken(ctx *gin.Context) {
+	var req CreateAccessTokenRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !c.accessTokensEnabled(ctx) {
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "name must be 1 to 100 characters"})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	principal := contextPrincipal(ctx)
+	token, secret, err := c.AccessTokens.Create(principal.Username, principal.BackendRoles, req.Name, req.Scopes, req.Paths, req.ExpiresAt)
+	switch {
+	case errors.Is(err, ErrInvalidScope):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "scopes must be one or more of " + strings.Join(Scopes, ", ")})
+		return
+	case errors.Is(err, ErrTooManyAccessTokens):
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Too many access tokens, revoke some first"})
+		return
+	case err != nil:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create access token"})
+		return
+	}
+
+	response := newAccessTokenResponse(token)
+	response.Token = secret
+	ctx.JSON(http.StatusCreated, response)
+}
+
+// ListAccessTokens returns the caller's personal access tokens
+func (c *AuthController) ListAccessTokens(ctx *gin.Context) {
+	if !c.accessTokensEnabled(ctx) {
+		return
+	}
+	list := []AccessTokenResponse{}
+	for _, token := range c.AccessTokens.List(ctx.GetString("username")) {
+		list = append(list, newAccessTokenResponse(token))
+	}
+	ctx.JSON(http.StatusOK, list)
+}
+
+// RevokeAccessToken deletes one of the caller's personal access tokens
+func (c *AuthController) RevokeAccessToken(ctx *gin.Context) {
+	if !c.accessTokensEnabled(ctx) {
+		return
+	}
+	err := c.AccessTokens.Revoke(ctx.GetString("username"), ctx.Param("id"))
+	switch {
+	case errors.Is(err, ErrAccessTokenNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Access token not found"})
+	case err != nil:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke access token"})
+	default:
+		ctx.JSON(http.StatusOK, gin.H{"message": "Access token revoked"})
+	}
+}
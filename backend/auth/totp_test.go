@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the test vectors in RFC 6238 appendix B, "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The vectors are eight digits long; six digit codes are their last six digits
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range rfc6238Vectors {
+		if got := totpCode(key, totpStep(time.Unix(tt.unix, 0))); got != tt.code {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	for _, tt := range rfc6238Vectors {
+		now := time.Unix(tt.unix, 0)
+		step, ok := checkTOTP(rfc6238Secret, tt.code, now, 0)
+		if !ok || step != totpStep(now) {
+			t.Errorf("checkTOTP(%s) at %d = %d, %v", tt.code, tt.unix, step, ok)
+		}
+	}
+
+	// 1111111109 and 1111111111 fall in neighbouring steps
+	now := time.Unix(1111111111, 0)
+	for _, tt := range []struct {
+		name   string
+		secret string
+		code   string
+		now    time.Time
+		after  int64
+		ok     bool
+	}{
+		{"spaces typed", "", "050 471", now, 0, true},
+		{"lower case secret", strings.ToLower(rfc6238Secret), "050471", now, 0, true},
+		{"one step late", "", "081804", now, 0, true},
+		{"two steps late", "", "081804", now.Add(2 * totpPeriod * time.Second), 0, false},
+		{"one step early", "", "050471", time.Unix(1111111109, 0), 0, true},
+		{"wrong code", "", "050472", now, 0, false},
+		{"too short", "", "50471", now, 0, false},
+		{"eight digits", "", "14050471", now, 0, false},
+		{"already used", "", "050471", now, totpStep(now), false},
+		{"earlier step after a later one was used", "", "081804", now, totpStep(now), false},
+		{"later step after an earlier one was used", "", "050471", now, totpStep(time.Unix(1111111109, 0)), true},
+	} {
+		secret := tt.secret
+		if secret == "" {
+			secret = rfc6238Secret
+		}
+		if _, ok := checkTOTP(secret, tt.code, tt.now, tt.after); ok != tt.ok {
+			t.Errorf("%s: checkTOTP() = %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+
+	if _, ok := checkTOTP("not base32!", "050471", now, 0); ok {
+		t.Error("checkTOTP() accepted a broken secret")
+	}
+}
+
+// newTwoFactorTest returns a store at path with the second factor of alice enabled, and its recovery codes
+func newTwoFactorTest(t *testing.T, path string) (*TwoFactorStore, []byte, []string) {
+	t.Helper()
+	store, err := NewTwoFactorStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := store.Enroll("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Activate with the code of the previous step, leaving the current one for the tests
+	codes, err := store.Activate("alice", totpCode(key, totpStep(time.Now())-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("Activate() issued %d recovery codes", len(codes))
+	}
+	return store, key, codes
+}
+
+func TestTwoFactorVerifyRefusesReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "twofactor.json")
+	store, key, _ := newTwoFactorTest(t, path)
+	code := totpCode(key, totpStep(time.Now()))
+	if err := store.Verify("alice", code); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if err := store.Verify("alice", code); err != ErrInvalidCode {
+		t.Fatalf("Verify() of a used code = %v, want %v", err, ErrInvalidCode)
+	}
+
+	// The last step survives a restart
+	reopened, err := NewTwoFactorStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Verify("alice", code); err != ErrInvalidCode {
+		t.Fatalf("Verify() of a used code after reopening = %v, want %v", err, ErrInvalidCode)
+	}
+}
+
+func TestTwoFactorRecoveryCodesAreSingleUse(t *testing.T) {
+	store, _, codes := newTwoFactorTest(t, filepath.Join(t.TempDir(), "twofactor.json"))
+	if err := store.Verify("alice", codes[3]); err != nil {
+		t.Fatalf("Verify() of a recovery code error = %v", err)
+	}
+	if err := store.Verify("alice", codes[3]); err != ErrInvalidCode {
+		t.Fatalf("Verify() of a used recovery code = %v, want %v", err, ErrInvalidCode)
+	}
+	if left := store.Status("alice").RecoveryCodesLeft; left != recoveryCodeCount-1 {
+		t.Fatalf("RecoveryCodesLeft = %d, want %d", left, recoveryCodeCount-1)
+	}
+
+	// The others stay usable, typed without dashes and in upper case too
+	other := strings.ToUpper(strings.ReplaceAll(codes[4], "-", ""))
+	if err := store.Verify("alice", other); err != nil {
+		t.Fatalf("Verify(%q) error = %v", other, err)
+	}
+}
+
+func TestTwoFactorRegenerateRecoveryCodes(t *testing.T) {
+	store, _, codes := newTwoFactorTest(t, filepath.Join(t.TempDir(), "twofactor.json"))
+	fresh, err := store.RegenerateRecoveryCodes("alice", codes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Verify("alice", codes[1]); err != ErrInvalidCode {
+		t.Fatalf("Verify() of a replaced recovery code = %v, want %v", err, ErrInvalidCode)
+	}
+	if err := store.Verify("alice", fresh[1]); err != nil {
+		t.Fatalf("Verify() of a new recovery code error = %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+const (
+	// recoveryCodeCount codes are issued at a time, each good for one login without the app
+	recoveryCodeCount = 10
+	// recoveryCodeSize is the random bytes in a code, printed as 16 base32 characters
+	recoveryCodeSize = 10
+)
+
+var (
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnrolled = errors.New("two-factor authentication is not set up")
+	// ErrInvalidCode counts as a failed login with the guard
+	ErrInvalidCode = fmt.Errorf("invalid verification code: %w", ErrInvalidCredentials)
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactor is the authenticator app of a user. It stays pending until a first code
+// proves the app was set up; only SHA-256 hashes of the recovery codes are kept.
+type TwoFactor struct {
+	Secret        string     `json:"secret"`
+	Enabled       bool       `json:"enabled"`
+	RecoveryCodes []string   `json:"recovery_codes,omitempty"`
+	LastStep      int64      `json:"last_step,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	EnabledAt     *time.Time `json:"enabled_at,omitempty"`
+}
+
+// TwoFactorStatus describes the second factor of a user to themselves
+type TwoFactorStatus struct {
+	Enabled bool `json:"enabled"`
+	// Required is set when the policy demands a second factor for the user
+	Required          bool       `json:"required"`
+	RecoveryCodesLeft int        `json:"recovery_codes_left"`
+	EnabledAt         *time.Time `json:"enabled_at,omitempty"`
+}
+
+// TwoFactorStore persists the authenticator secrets of users
+type TwoFactorStore struct {
+	mu    sync.Mutex
+	file  *storage.JSONFile
+	users map[string]*TwoFactor
+}
+
+// NewTwoFactorStore loads the secrets at path
+func NewTwoFactorStore(path string) (*TwoFactorStore, error) {
+	s := &TwoFactorStore{
+		file:  storage.NewJSONFile(path),
+		users: make(map[string]*TwoFactor),
+	}
+	if err := s.file.Load(&s.users); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Enabled reports whether username logs in with a second factor. It is nil-safe.
+func (s *TwoFactorStore) Enabled(username string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tf, ok := s.users[username]
+	return ok && tf.Enabled
+}
+
+// Status returns the state of the second factor of username
+func (s *TwoFactorStore) Status(username string) TwoFactorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tf, ok := s.users[username]
+	if !ok || !tf.Enabled {
+		return TwoFactorStatus{}
+	}
+	return TwoFactorStatus{Enabled: true, RecoveryCodesLeft: len(tf.RecoveryCodes), EnabledAt: tf.EnabledAt}
+}
+
+// Enroll starts setting up an authenticator app for username and returns its secret.
+// Enrolling again before the app is confirmed replaces the secret.
+func (s *TwoFactorStore) Enroll(username string) (string, error) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tf, ok := s.users[username]; ok && tf.Enabled {
+		return "", ErrTwoFactorEnabled
+	}
+	s.users[username] = &TwoFactor{Secret: secret, CreatedAt: time.Now()}
+	if err := s.file.Save(s.users); err != nil {
+		delete(s.users, username)
+		return "", err
+	}
+	return secret, nil
+}
+
+// Activate enables the pending secret of username once code shows the app works,
+// and returns the first recovery codes
+func (s *TwoFactorStore) Activate(username, code string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tf, ok := s.users[username]
+	if !ok {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	if tf.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	step, ok := checkTOTP(tf.Secret, code, time.Now(), tf.LastStep)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	previous := *tf
+	now := time.Now()
+	tf.Enabled, tf.EnabledAt, tf.LastStep, tf.RecoveryCodes = true, &now, step, hashes
+	if err := s.file.Save(s.users); err != nil {
+		*tf = previous
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify checks a code from the app or one of the recovery codes, which is used up
+func (s *TwoFactorStore) Verify(username, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tf, ok := s.users[username]
+	if !ok || !tf.Enabled {
+		return ErrTwoFactorNotEnrolled
+	}
+
+	previous := *tf
+	if step, ok := checkTOTP(tf.Secret, code, time.Now(), tf.LastStep); ok {
+		tf.LastStep = step
+	} else if i := indexRecoveryCode(tf.RecoveryCodes, code); i >= 0 {
+		tf.RecoveryCodes = append(tf.RecoveryCodes[:i:i], tf.RecoveryCodes[i+1:]...)
+	} else {
+		return ErrInvalidCode
+	}
+	if err := s.file.Save(s.users); err != nil {
+		*tf = previous
+		return err
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of username after checking code
+func (s *TwoFactorStore) RegenerateRecoveryCodes(username, code string) ([]string, error) {
+	if err := s.Verify(username, code); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tf, ok := s.users[username]
+	if !ok || !tf.Enabled {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	previous := tf.RecoveryCodes
+	tf.RecoveryCodes = hashes
+	if err := s.file.Save(s.users); err != nil {
+		tf.RecoveryCodes = previous
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable removes the second factor of username, reporting whether there was one
+func (s *TwoFactorStore) Disable(username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tf, ok := s.users[username]
+	if !ok {
+		return false, nil
+	}
+	delete(s.users, username)
+	if err := s.file.Save(s.users); err != nil {
+		s.users[username] = tf
+		return false, err
+	}
+	return true, nil
+}
+
+// newRecoveryCodes returns fresh recovery codes, formatted like "abcd-efgh-ijkl-mnop", and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, recoveryCodeSize)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(recoveryEncoding.EncodeToString(buf))
+		codes[i] = raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		hashes[i] = hashRecoveryCode(raw)
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a code with the dashes and spaces people type stripped
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func indexRecoveryCode(hashes []string, code string) int {
+	hash := hashRecoveryCode(code)
+	for i, h := range hashes {
+		if h == hash {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,369 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"manschko.com/cloud-storage/storage"
+)
+
+const (
+	// challengeAudience marks challenge tokens, which ValidateToken refuses as access tokens
+	challengeAudience = "two-factor-challenge"
+	// challengeTTL is how long a user has to enter the code after their password
+	challengeTTL = 5 * time.Minute
+	// twoFactorGuardPrefix keeps failed codes apart from failed passwords in the guard,
+	// so that logging in with the password does not forgive wrong codes
+	twoFactorGuardPrefix = "2fa:"
+)
+
+// TwoFactorPolicy decides who must log in with a second factor
+type TwoFactorPolicy struct {
+	// All requires it of everyone, Roles of users holding any of them
+	All   bool
+	Roles []string
+}
+
+// Requires reports whether principal must use a second factor
+func (p TwoFactorPolicy) Requires(principal Principal) bool {
+	if p.All {
+		return true
+	}
+	for _, required := range p.Roles {
+		for _, role := range principal.Roles {
+			if role == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// challengeClaims are carried by the token handed out between the password and the code
+type challengeClaims struct {
+	Username     string   `json:"username"`
+	Roles        []string `json:"roles,omitempty"`
+	BackendRoles []string `json:"backend_roles,omitempty"`
+	// Enroll is set when the user must set up an authenticator app before logging in
+	Enroll bool `json:"enroll,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// TwoFactorLoginRequest completes a login with a code from the app or a recovery code
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+}
+
+// TwoFactorEnrollRequest starts setting up the app of a user who must have one to log in
+type TwoFactorEnrollRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+}
+
+// TwoFactorCodeRequest confirms a change to the second factor with a current code
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// TwoFactorEnrollment is the secret of a new authenticator app. URI is shown as a QR code,
+// the secret is for typing in by hand.
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// needsTwoFactor reports whether principal has to pass a second factor to log in
+func (c *AuthController) needsTwoFactor(principal Principal) bool {
+	if c.TwoFactor == nil {
+		return false
+	}
+	return c.TwoFactor.Enabled(principal.Username) || c.TwoFactorPolicy.Requires(principal)
+}
+
+// challenge answers a correct password of a user with a second factor with a challenge
+// token, to be sent back with their code. Users the policy requires to have a second
+// factor but who have none yet are asked to set one up first.
+func (c *AuthController) challenge(ctx *gin.Context, principal Principal) {
+	jti, err := storage.RandomID()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	now := time.Now()
+	enroll := !c.TwoFactor.Enabled(principal.Username)
+	token, err := c.Keys.Sign(&challengeClaims{
+		Username:     principal.Username,
+		Roles:        principal.Roles,
+		BackendRoles: principal.BackendRoles,
+		Enroll:       enroll,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Audience:  jwt.ClaimStrings{challengeAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(challengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	ctx.JSON(http.StatusOK, LoginResponse{
+		TwoFactorRequired:  true,
+		EnrollmentRequired: enroll,
+		ChallengeToken:     token,
+		ExpiresIn:          int(challengeTTL / time.Second),
+	})
+}
+
+// parseChallenge validates a challenge token and returns its claims
+func (c *AuthController) parseChallenge(tokenString string) (*challengeClaims, error) {
+	token, err := c.Keys.Parse(tokenString, &challengeClaims{}, jwt.WithAudience(challengeAudience))
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*challengeClaims)
+	if !ok || !token.Valid || claims.Username == "" {
+		return nil, ErrInvalidToken
+	}
+	if c.Revoked.IsRevoked(&UserClaims{RegisteredClaims: claims.RegisteredClaims}) {
+		return nil, ErrRevokedToken
+	}
+	return claims, nil
+}
+
+// respondCodeError answers a rejected code
+func respondCodeError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidCode):
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid verification code"})
+	case errors.Is(err, ErrTwoFactorNotEnrolled):
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not set up"})
+	case errors.Is(err, ErrTwoFactorEnabled):
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+	default:
+		respondLoginError(ctx, err)
+	}
+}
+
+// LoginTwoFactor completes a login with the challenge token and a code. A user setting up
+// their app confirms it here and gets their recovery codes along with the tokens.
+func (c *AuthController) LoginTwoFactor(ctx *gin.Context) {
+	var req TwoFactorLoginRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if c.TwoFactor == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	claims, err := c.parseChallenge(req.ChallengeToken)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge, please log in again"})
+		return
+	}
+
+	var recoveryCodes []string
+	err = c.Guard.Attempt(ctx.ClientIP(), twoFactorGuardPrefix+claims.Username, func() (err error) {
+		if claims.Enroll {
+			recoveryCodes, err = c.TwoFactor.Activate(claims.Username, req.Code)
+			return err
+		}
+		return c.TwoFactor.Verify(claims.Username, req.Code)
+	})
+	if err != nil {
+		respondCodeError(ctx, err)
+		return
+	}
+
+	// Each challenge completes one login
+	if c.Revoked != nil {
+		if err := c.Revoked.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+			log.Printf("Failed to revoke challenge of %s: %v", claims.Username, err)
+		}
+	}
+	response, err := c.startSession(Principal{Username: claims.Username, Roles: claims.Roles, BackendRoles: claims.BackendRoles})
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	response.RecoveryCodes = recoveryCodes
+	ctx.JSON(http.StatusOK, response)
+}
+
+// LoginTwoFactorEnroll creates the authenticator secret of a user who must set one up to log in
+func (c *AuthController) LoginTwoFactorEnroll(ctx *gin.Context) {
+	var req TwoFactorEnrollRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if c.TwoFactor == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	claims, err := c.parseChallenge(req.ChallengeToken)
+	if err != nil || !claims.Enroll {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge, please log in again"})
+		return
+	}
+	c.enroll(ctx, claims.Username)
+}
+
+// enroll creates a pending secret for username and answers with it
+func (c *AuthController) enroll(ctx *gin.Context, username string) {
+	secret, err := c.TwoFactor.Enroll(username)
+	if errors.Is(err, ErrTwoFactorEnabled) {
+		respondCodeError(ctx, err)
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+	ctx.JSON(http.StatusOK, TwoFactorEnrollment{
+		Secret: secret,
+		URI:    TOTPURI(c.TwoFactorIssuer, username, secret),
+	})
+}
+
+// twoFactorEnabled answers requests to manage second factors when the feature is off
+func (c *AuthController) twoFactorEnabled(ctx *gin.Context) bool {
+	if c.TwoFactor == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Two-factor authentication is not enabled"})
+		return false
+	}
+	return true
+}
+
+// contextPrincipal returns the authenticated user of a request
+func contextPrincipal(ctx *gin.Context) Principal {
+	return Principal{
+		Username:     ctx.GetString("username"),
+		Roles:        ctx.GetStringSlice("roles"),
+		BackendRoles: ctx.GetStringSlice("backend_roles"),
+	}
+}
+
+// TwoFactorStatus returns whether the caller has a second factor and whether they must
+func (c *AuthController) TwoFactorStatus(ctx *gin.Context) {
+	if !c.twoFactorEnabled(ctx) {
+		return
+	}
+	principal := contextPrincipal(ctx)
+	status := c.TwoFactor.Status(principal.Username)
+	status.Required = c.TwoFactorPolicy.Requires(principal)
+	ctx.JSON(http.StatusOK, status)
+}
+
+// EnrollTwoFactor starts setting up an authenticator app for the caller
+func (c *AuthController) EnrollTwoFactor(ctx *gin.Context) {
+	if !c.twoFactorEnabled(ctx) {
+		return
+	}
+	c.enroll(ctx, ctx.GetString("username"))
+}
+
+// ActivateTwoFactor turns on the caller's second factor with a first code from the app
+// and returns the recovery codes, which are not shown again
+func (c *AuthController) ActivateTwoFactor(ctx *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !c.twoFactorEnabled(ctx) {
+		return
+	}
+	username := ctx.GetString("username")
+	var codes []string
+	err := c.Guard.Attempt(ctx.ClientIP(), twoFactorGuardPrefix+username, func() (err error) {
+		codes, err = c.TwoFactor.Activate(username, req.Code)
+		return err
+	})
+	if err != nil {
+		respondCodeError(ctx, err)
+		return
+	}
+	log.Printf("Two-factor authentication enabled for %s", username)
+	ctx.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes
+func (c *AuthController) RegenerateRecoveryCodes(ctx *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !c.twoFactorEnabled(ctx) {
+		return
+	}
+	username := ctx.GetString("username")
+	var codes []string
+	err := c.Guard.Attempt(ctx.ClientIP(), twoFactorGuardPrefix+username, func() (err error) {
+		codes, err = c.TwoFactor.RegenerateRecoveryCodes(username, req.Code)
+		return err
+	})
+	if err != nil {
+		respondCodeError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// DisableTwoFactor turns off the caller's second factor after checking a current code.
+// Users the policy requires to have one cannot turn it off.
+func (c *AuthController) DisableTwoFactor(ctx *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !c.twoFactorEnabled(ctx) {
+		return
+	}
+	principal := contextPrincipal(ctx)
+	if c.TwoFactorPolicy.Requires(principal) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for your account"})
+		return
+	}
+	err := c.Guard.Attempt(ctx.ClientIP(), twoFactorGuardPrefix+principal.Username, func() error {
+		return c.TwoFactor.Verify(principal.Username, req.Code)
+	})
+	if err != nil {
+		respondCodeError(ctx, err)
+		return
+	}
+	if _, err := c.TwoFactor.Disable(principal.Username); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	log.Printf("Two-factor authentication disabled by %s", principal.Username)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// ResetTwoFactor removes the second factor of a user who lost their app and recovery codes.
+// They set up a new one at their next login if the policy requires it. Admins only.
+func (c *AuthController) ResetTwoFactor(ctx *gin.Context) {
+	admin := ctx.GetString("username")
+	if !c.twoFactorEnabled(ctx) {
+		return
+	}
+	username := ctx.Param("username")
+	removed, err := c.TwoFactor.Disable(username)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset two-factor authentication"})
+		return
+	}
+	if !removed {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "User has no second factor"})
+		return
+	}
+	log.Printf("Two-factor authentication of %q reset by %s", username, admin)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset"})
+}
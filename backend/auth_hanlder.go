@@ -1,21 +1,252 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"manschko.com/cloud-storage/auth"
 )
 
-// handleLogin handles user authentication and returns a JWT token
-func handleLogin(c *gin.Context) {
+// loadSigningKeys builds the token key set from the configured key file or secret
+// and the keys of the previous rotation
+func loadSigningKeys() (*auth.KeySet, error) {
+	var signing *auth.Key
+	var previous []*auth.Key
+	if AppConfig.JWTSigningKeyFile != "" {
+		key, err := auth.LoadKeyFile(AppConfig.JWTSigningKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWT signing key: %w", err)
+		}
+		signing = key
+		if AppConfig.JWTSecret != "" {
+			previous = append(previous, auth.NewHMACKey(AppConfig.JWTSecret))
+		}
+	} else {
+		signing = auth.NewHMACKey(AppConfig.JWTSecret)
+	}
+	for _, path := range AppConfig.JWTVerifyKeyFiles {
+		key, err := auth.LoadKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWT verification key: %w", err)
+		}
+		previous = append(previous, key)
+	}
+	for _, secret := range AppConfig.JWTPreviousSecrets {
+		previous = append(previous, auth.NewHMACKey(secret))
+	}
+	return auth.NewKeySet(signing, previous...)
+}
+
+// buildAuthenticator chains the configured account backends
+func buildAuthenticator() (auth.Authenticator, error) {
+	var backends auth.Authenticators
+	for _, name := range AppConfig.AuthBackends {
+		switch name {
+		case "sftp":
+			backends = append(backends, &auth.SFTPAuthenticator{Host: AppConfig.SFTPHost, Port: AppConfig.SFTPPort})
+		case "ldap":
+			cfg := AppConfig.LDAP
+			if AppConfig.LDAPCAFile != "" {
+				pem, err := os.ReadFile(AppConfig.LDAPCAFile)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read LDAP CA file: %w", err)
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(pem) {
+					return nil, fmt.Errorf("no certificates found in %s", AppConfig.LDAPCAFile)
+				}
+				cfg.TLSConfig = &tls.Config{RootCAs: pool}
+			}
+			ldapAuth, err := auth.NewLDAPAuthenticator(cfg)
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, ldapAuth)
+		default:
+			return nil, fmt.Errorf("unknown auth backend %q", name)
+		}
+	}
+	if len(backends) == 1 {
+		return backends[0], nil
+	}
+	return backends, nil
+}
+
+// initOIDC sets up single sign-on when an identity provider is configured
+func initOIDC() error {
+	if AppConfig.OIDCIssuer == "" {
+		return nil
+	}
+	if AppConfig.OIDCRulesFile != "" {
+		rules, err := auth.LoadIdentityRules(AppConfig.OIDCRulesFile)
+		if err != nil {
+			return fmt.Errorf("failed to load OIDC rules: %w", err)
+		}
+		identityRules = rules
+	}
+	oidcProvider = auth.NewOIDCProvider(auth.OIDCConfig{
+		Issuer:       AppConfig.OIDCIssuer,
+		ClientID:     AppConfig.OIDCClientID,
+		ClientSecret: AppConfig.OIDCClientSecret,
+		RedirectURL:  AppConfig.OIDCRedirectURL,
+		Scopes:       AppConfig.OIDCScopes,
+	}, nil)
+	return nil
+}
+
+// Create an auth controller
+func getAuthController() *auth.AuthController {
 	authController := auth.NewAuthController(
-		AppConfig.JWTSecret,
+		signingKeys,
 		AppConfig.SFTPHost,
 		AppConfig.SFTPPort,
 	)
-	authController.Login(c)
+	authController.Authenticator = authenticator
+	authController.Guard = loginGuard
+	authController.AccessTokenTTL = AppConfig.AccessTokenTTL
+	authController.RefreshTokenTTL = AppConfig.RefreshTokenTTL
+	authController.Sessions = sessionStore
+	authController.Revoked = revokedTokens
+	authController.OIDC = oidcProvider
+	authController.OIDCLogins = oidcLogins
+	authController.IdentityRules = identityRules
+	authController.Identities = identityStore
+	authController.OIDCFrontendURL = AppConfig.OIDCFrontendURL
+	if sftpgoUsers != nil {
+		authController.AccountEnabled = accountEnabled
+	}
+	authController.TwoFactor = twoFactorStore
+	authController.TwoFactorPolicy = auth.TwoFactorPolicy{
+		All:   AppConfig.TwoFactorRequired,
+		Roles: AppConfig.TwoFactorRequiredRoles,
+	}
+	authController.TwoFactorIssuer = AppConfig.TwoFactorIssuer
+	authController.AccessTokens = accessTokenStore
+	authController.Roles = auth.RoleConfig{
+		Users:   AppConfig.UserRoles,
+		Default: AppConfig.DefaultRole,
+	}
+	return authController
+}
+
+// handleLogin handles user authentication and returns a JWT token
+func handleLogin(c *gin.Context) {
+	getAuthController().Login(c)
+}
+
+// refreshToken exchanges a refresh token for new tokens
+func refreshToken(c *gin.Context) {
+	getAuthController().Refresh(c)
+}
+
+// handleLogout revokes the caller's tokens
+func handleLogout(c *gin.Context) {
+	getAuthController().Logout(c)
+}
+
+// Second step of a login with two-factor authentication
+func loginTwoFactor(c *gin.Context) {
+	getAuthController().LoginTwoFactor(c)
+}
+
+func loginTwoFactorEnroll(c *gin.Context) {
+	getAuthController().LoginTwoFactorEnroll(c)
+}
+
+// Two-factor authentication settings of the logged in user
+func twoFactorStatus(c *gin.Context) {
+	getAuthController().TwoFactorStatus(c)
+}
+
+func enrollTwoFactor(c *gin.Context) {
+	getAuthController().EnrollTwoFactor(c)
+}
+
+func activateTwoFactor(c *gin.Context) {
+	getAuthController().ActivateTwoFactor(c)
+}
+
+func regenerateRecoveryCodes(c *gin.Context) {
+	getAuthController().RegenerateRecoveryCodes(c)
+}
+
+func disableTwoFactor(c *gin.Context) {
+	getAuthController().DisableTwoFactor(c)
+}
+
+// resetTwoFactor lets an admin remove the second factor of a user
+func resetTwoFactor(c *gin.Context) {
+	getAuthController().ResetTwoFactor(c)
+}
+
+// Personal access token handlers
+func createAccessToken(c *gin.Context) {
+	getAuthController().CreateAccessToken(c)
+}
+
+func listAccessTokens(c *gin.Context) {
+	getAuthController().ListAccessTokens(c)
+}
+
+func revokeAccessToken(c *gin.Context) {
+	getAuthController().RevokeAccessToken(c)
+}
+
+// Single sign-on handlers
+func oidcLogin(c *gin.Context) {
+	getAuthController().OIDCLogin(c)
+}
+
+func oidcCallback(c *gin.Context) {
+	getAuthController().OIDCCallback(c)
+}
+
+func oidcExchange(c *gin.Context) {
+	getAuthController().OIDCExchange(c)
 }
 
-// authMiddleware creates middleware for JWT authentication
+// serveJWKS publishes the public keys of our tokens
+func serveJWKS(c *gin.Context) {
+	getAuthController().JWKS(c)
+}
+
+// Login lockout handlers for admins
+func listLockouts(c *gin.Context) {
+	getAuthController().ListLockouts(c)
+}
+
+func clearLockout(c *gin.Context) {
+	getAuthController().ClearLockout(c)
+}
+
+// davCredentials caches verified Basic logins of WebDAV clients
+var davCredentials = auth.NewCredentialCache(5 * time.Minute)
+
+// davAuthMiddleware accepts the login credentials via Basic auth or a bearer token
+func davAuthMiddleware() gin.HandlerFunc {
+	return auth.BasicOrBearerMiddleware(signingKeys, revokedTokens, "Cloud Storage", davCredentials, loginGuard, getAuthController().VerifyCredentials)
+}
+
+// authMiddleware creates middleware for JWT and personal access token authentication
 func authMiddleware() gin.HandlerFunc {
-	return auth.Middleware(AppConfig.JWTSecret)
+	return auth.Middleware(signingKeys, revokedTokens, accessTokenStore, getAuthController().Roles)
+}
+
+// requirePermission limits a route to users whose roles, and token scopes, allow perm
+func requirePermission(perm auth.Permission) gin.HandlerFunc {
+	return auth.RequirePermission(perm)
+}
+
+// requireLogin keeps personal access tokens off a route
+func requireLogin() gin.HandlerFunc {
+	return auth.RequireLogin()
+}
+
+// streamAuthMiddleware also accepts the JWT as a query parameter for event streams
+func streamAuthMiddleware() gin.HandlerFunc {
+	return auth.StreamMiddleware(signingKeys, revokedTokens)
 }
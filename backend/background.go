@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"manschko.com/cloud-storage/scanner"
+	"manschko.com/cloud-storage/sftp"
+)
+
+// shareVisitSaveInterval is how often visits of shares are written out
+const shareVisitSaveInterval = time.Minute
+
+// sessionPool holds the SFTP sessions background jobs run on
+var sessionPool *sftp.Pool
+
+// changeScanner reports changes made directly on the SFTP server; nil when disabled
+var changeScanner *scanner.Scanner
+
+// startSessionPool prepares the SFTP sessions for background jobs; they are opened on first use
+func startSessionPool() {
+	sessionPool = getFileController().NewSessionPool(AppConfig.SFTPPoolSize)
+}
+
+// startUploadCleaner periodically removes temp files left by crashed or aborted uploads,
+// and the parts of multipart uploads nobody finished
+func startUploadCleaner() {
+	if AppConfig.UploadCleanupInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(AppConfig.UploadCleanupInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			removed, err := getFileController().CleanStaleUploads(AppConfig.UploadTempMaxAge)
+			if err != nil {
+				log.Printf("Upload cleanup failed: %v", err)
+			} else if removed > 0 {
+				log.Printf("Upload cleanup removed %d stale temp files", removed)
+			}
+
+			expired, err := getS3Controller().ExpireUploads()
+			if err != nil {
+				log.Printf("Multipart upload cleanup failed: %v", err)
+			} else if expired > 0 {
+				log.Printf("Multipart upload cleanup aborted %d idle uploads", expired)
+			}
+		}
+	}()
+}
+
+// startShareVisitSaver periodically persists the view counts of shares, which visits only record in memory
+func startShareVisitSaver() {
+	go func() {
+		ticker := time.NewTicker(shareVisitSaveInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := shareStore.Flush(); err != nil {
+				log.Printf("Failed to save share visits: %v", err)
+			}
+		}
+	}()
+}
+
+// startChangeScanner starts polling the folders event streams watch for changes made outside the API
+func startChangeScanner() {
+	if AppConfig.ChangeScanInterval <= 0 {
+		return
+	}
+
+	changeScanner = getFileController().NewChangeScanner(
+		AppConfig.ChangeScanInterval,
+		max(AppConfig.ChangeScanMaxInterval, AppConfig.ChangeScanInterval),
+		AppConfig.ChangeScanMaxDirs,
+	)
+	go changeScanner.Run(nil)
+}
@@ -5,14 +5,128 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"manschko.com/cloud-storage/auth"
+	"manschko.com/cloud-storage/throttle"
 )
 
+// defaultJWTSecret is only accepted in development mode, as anyone can read it here
+const defaultJWTSecret = "lakflakfh"
+
 // Config stores the application configuration
 type Config struct {
 	SFTPHost     string
 	SFTPPort     int
 	JWTSecret    string
 	ServerPort   string
+
+	// Stale temp files from interrupted uploads are swept on this schedule
+	UploadCleanupInterval time.Duration
+	UploadTempMaxAge      time.Duration
+
+	// DataDir holds the JSON files of server-side state such as share links
+	DataDir string
+
+	// ChecksumExec enables the sha256sum-over-SSH fast path for checksums
+	ChecksumExec bool
+
+	// AdminUsers may create and delete groups and manage any membership
+	AdminUsers []string
+
+	// S3Listen is the address of the S3-compatible gateway; empty disables it
+	S3Listen string
+	S3Region string
+	// S3MultipartMaxAge is how long a multipart upload may go without a new part before it is aborted
+	S3MultipartMaxAge time.Duration
+
+	// Folders clients watch are polled for changes made directly over SFTP,
+	// backing off from ChangeScanInterval up to ChangeScanMaxInterval while nothing changes
+	ChangeScanInterval    time.Duration
+	ChangeScanMaxInterval time.Duration
+	ChangeScanMaxDirs     int
+
+	// ChangeJournalSize is how many changes the sync feed keeps; older cursors have to start over
+	ChangeJournalSize int
+
+	// Background jobs run on JobWorkers workers, at most JobsPerUser at a time for one user,
+	// with up to JobQueuePerUser unfinished; finished jobs are listed for JobRetention
+	JobWorkers      int
+	JobsPerUser     int
+	JobQueuePerUser int
+	JobRetention    time.Duration
+
+	// SFTPPoolSize bounds the SFTP sessions background jobs share
+	SFTPPoolSize int
+
+	// Transfers limits download and upload throughput and simultaneous transfers per user or share link
+	Transfers throttle.Config
+
+	// Failed logins back off exponentially; LoginMaxFailures for a username or
+	// LoginMaxFailuresPerIP for an address lock it out for LoginLockout.
+	// At most LoginMaxInFlight logins are checked against the SFTP server at once.
+	LoginMaxFailures      int
+	LoginMaxFailuresPerIP int
+	LoginLockout          time.Duration
+	LoginMaxInFlight      int
+
+	// TrustedProxies may set X-Forwarded-For; without any the client address is the peer address
+	TrustedProxies []string
+
+	// AccessTokenTTL is the lifetime of access tokens; RefreshTokenTTL is how long
+	// a login stays alive without its refresh token being used, and SessionMaxAge how long
+	// it stays alive at all, so that roles from the account backend are looked at again
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	SessionMaxAge   time.Duration
+
+	// DevMode relaxes production safeguards such as refusing the built-in JWT secret
+	DevMode bool
+
+	// JWTSigningKeyFile is a PEM private key (RSA, ECDSA or Ed25519) to sign tokens with instead of JWTSecret.
+	// Tokens signed with JWTVerifyKeyFiles or JWTPreviousSecrets, the keys before a rotation, are still accepted.
+	JWTSigningKeyFile  string
+	JWTVerifyKeyFiles  []string
+	JWTPreviousSecrets []string
+
+	// Single sign-on through an OpenID Connect provider, enabled by OIDCIssuer.
+	// OIDCRedirectURL is our /api/oidc/callback as registered at the provider, OIDCFrontendURL
+	// the login page the browser returns to, and OIDCRulesFile maps accounts to users; without it
+	// every account logs in under its subject.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+	OIDCFrontendURL  string
+	OIDCRulesFile    string
+
+	// AuthBackends check passwords, tried in order: "sftp" logs in to the SFTP server, "ldap" binds to LDAP
+	AuthBackends []string
+	// LDAP configures the ldap backend; LDAPCAFile is a PEM bundle to trust for its TLS connections
+	LDAP       auth.LDAPConfig
+	LDAPCAFile string
+
+	// Two-factor authentication is optional for users, unless TwoFactorRequired demands it of
+	// everyone or TwoFactorRequiredRoles of users holding any of these roles.
+	// TwoFactorIssuer names this server in authenticator apps.
+	TwoFactorRequired      bool
+	TwoFactorRequiredRoles []string
+	TwoFactorIssuer        string
+
+	// UserRoles gives users roles on top of those from the account backend; AdminUsers hold
+	// the admin role. DefaultRole is given to users without any, "user" when empty.
+	UserRoles   map[string][]string
+	DefaultRole string
+
+	// Admins manage users through the REST API of SFTPGo at SFTPGoURL, enabled by setting it.
+	// New users get their home below SFTPGoHomeBase on the SFTPGo host, which should be the
+	// folder the SFTP_USER account sees as its root.
+	SFTPGoURL           string
+	SFTPGoAdminUser     string
+	SFTPGoAdminPassword string
+	SFTPGoHomeBase      string
 }
 
 var AppConfig Config
@@ -32,8 +146,48 @@ func LoadConfig() error {
 	AppConfig = Config{
 		SFTPHost:     os.Getenv("SFTP_URL"),
 		SFTPPort:     port,
-		JWTSecret:    "lakflakfh", // todo Change this in production!
+		JWTSecret:    defaultJWTSecret,
 		ServerPort:   "8000",
+
+		DataDir: "./data",
+
+		S3Region:          "us-east-1",
+		S3MultipartMaxAge: 7 * 24 * time.Hour,
+
+		UploadCleanupInterval: 15 * time.Minute,
+		UploadTempMaxAge:      6 * time.Hour,
+
+		ChangeScanInterval:    10 * time.Second,
+		ChangeScanMaxInterval: 5 * time.Minute,
+		ChangeScanMaxDirs:     200,
+		ChangeJournalSize:     50000,
+
+		JobWorkers:      4,
+		JobsPerUser:     2,
+		JobQueuePerUser: 20,
+		JobRetention:    24 * time.Hour,
+		SFTPPoolSize:    8,
+
+		Transfers: throttle.Config{
+			MaxPerAccount: 4,
+			QueueTimeout:  10 * time.Second,
+		},
+
+		LoginMaxFailures:      5,
+		LoginMaxFailuresPerIP: 20,
+		LoginLockout:          15 * time.Minute,
+		LoginMaxInFlight:      16,
+
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+		SessionMaxAge:   7 * 24 * time.Hour,
+
+		OIDCFrontendURL: "http://localhost:5173/login",
+
+		AuthBackends: []string{"sftp"},
+
+		TwoFactorIssuer: "Cloud Storage",
+		SFTPGoHomeBase:  "/srv/sftpgo/data",
 	}
 
 	// Override with environment variables if set
@@ -53,9 +207,352 @@ func LoadConfig() error {
 		AppConfig.JWTSecret = jwtSecret
 	}
 
+	AppConfig.DevMode = os.Getenv("APP_ENV") == "development"
+	AppConfig.JWTSigningKeyFile = os.Getenv("JWT_SIGNING_KEY_FILE")
+	AppConfig.JWTVerifyKeyFiles = splitList(os.Getenv("JWT_VERIFY_KEY_FILES"))
+	AppConfig.JWTPreviousSecrets = splitList(os.Getenv("JWT_PREVIOUS_SECRETS"))
+
+	switch {
+	case AppConfig.JWTSigningKeyFile != "" && os.Getenv("JWT_SECRET") == "":
+		// Signing with a key file; the built-in secret must not verify anything either
+		AppConfig.JWTSecret = ""
+	case AppConfig.JWTSecret == defaultJWTSecret && !AppConfig.DevMode:
+		return fmt.Errorf("refusing to run with the built-in JWT secret: set JWT_SECRET or JWT_SIGNING_KEY_FILE, or APP_ENV=development")
+	}
+
 	if serverPort := os.Getenv("SERVER_PORT"); serverPort != "" {
 		AppConfig.ServerPort = serverPort
 	}
 
+	if dataDir := os.Getenv("DATA_DIR"); dataDir != "" {
+		AppConfig.DataDir = dataDir
+	}
+
+	if checksumExec := os.Getenv("CHECKSUM_EXEC"); checksumExec != "" {
+		enabled, err := strconv.ParseBool(checksumExec)
+		if err != nil {
+			return fmt.Errorf("invalid CHECKSUM_EXEC value: %v", err)
+		}
+		AppConfig.ChecksumExec = enabled
+	}
+
+	if admins := os.Getenv("ADMIN_USERS"); admins != "" {
+		for _, admin := range strings.Split(admins, ",") {
+			if admin = strings.TrimSpace(admin); admin != "" {
+				AppConfig.AdminUsers = append(AppConfig.AdminUsers, admin)
+			}
+		}
+	}
+
+	if s3Listen := os.Getenv("S3_LISTEN"); s3Listen != "" {
+		AppConfig.S3Listen = s3Listen
+	}
+
+	if s3Region := os.Getenv("S3_REGION"); s3Region != "" {
+		AppConfig.S3Region = s3Region
+	}
+
+	if maxAge := os.Getenv("S3_MULTIPART_MAX_AGE"); maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			return fmt.Errorf("invalid S3_MULTIPART_MAX_AGE value: %v", err)
+		}
+		AppConfig.S3MultipartMaxAge = d
+	}
+
+	if interval := os.Getenv("UPLOAD_CLEANUP_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return fmt.Errorf("invalid UPLOAD_CLEANUP_INTERVAL value: %v", err)
+		}
+		AppConfig.UploadCleanupInterval = d
+	}
+
+	if maxAge := os.Getenv("UPLOAD_TEMP_MAX_AGE"); maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			return fmt.Errorf("invalid UPLOAD_TEMP_MAX_AGE value: %v", err)
+		}
+		AppConfig.UploadTempMaxAge = d
+	}
+
+	if interval := os.Getenv("CHANGE_SCAN_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return fmt.Errorf("invalid CHANGE_SCAN_INTERVAL value: %v", err)
+		}
+		AppConfig.ChangeScanInterval = d
+	}
+
+	if maxInterval := os.Getenv("CHANGE_SCAN_MAX_INTERVAL"); maxInterval != "" {
+		d, err := time.ParseDuration(maxInterval)
+		if err != nil {
+			return fmt.Errorf("invalid CHANGE_SCAN_MAX_INTERVAL value: %v", err)
+		}
+		AppConfig.ChangeScanMaxInterval = d
+	}
+
+	if maxDirs := os.Getenv("CHANGE_SCAN_MAX_DIRS"); maxDirs != "" {
+		n, err := strconv.Atoi(maxDirs)
+		if err != nil {
+			return fmt.Errorf("invalid CHANGE_SCAN_MAX_DIRS value: %v", err)
+		}
+		AppConfig.ChangeScanMaxDirs = n
+	}
+
+	if journalSize := os.Getenv("CHANGE_JOURNAL_SIZE"); journalSize != "" {
+		n, err := strconv.Atoi(journalSize)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid CHANGE_JOURNAL_SIZE value: %v", journalSize)
+		}
+		AppConfig.ChangeJournalSize = n
+	}
+
+	if workers := os.Getenv("JOB_WORKERS"); workers != "" {
+		n, err := strconv.Atoi(workers)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid JOB_WORKERS value: %v", workers)
+		}
+		AppConfig.JobWorkers = n
+	}
+
+	if perUser := os.Getenv("JOBS_PER_USER"); perUser != "" {
+		n, err := strconv.Atoi(perUser)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid JOBS_PER_USER value: %v", perUser)
+		}
+		AppConfig.JobsPerUser = n
+	}
+
+	if queue := os.Getenv("JOB_QUEUE_PER_USER"); queue != "" {
+		n, err := strconv.Atoi(queue)
+		if err != nil {
+			return fmt.Errorf("invalid JOB_QUEUE_PER_USER value: %v", err)
+		}
+		AppConfig.JobQueuePerUser = n
+	}
+
+	if retention := os.Getenv("JOB_RETENTION"); retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil {
+			return fmt.Errorf("invalid JOB_RETENTION value: %v", err)
+		}
+		AppConfig.JobRetention = d
+	}
+
+	if poolSize := os.Getenv("SFTP_POOL_SIZE"); poolSize != "" {
+		n, err := strconv.Atoi(poolSize)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid SFTP_POOL_SIZE value: %v", poolSize)
+		}
+		AppConfig.SFTPPoolSize = n
+	}
+
+	rates := map[string]*int64{
+		"DOWNLOAD_RATE_LIMIT":           &AppConfig.Transfers.Download.Global,
+		"DOWNLOAD_RATE_LIMIT_PER_USER":  &AppConfig.Transfers.Download.PerUser,
+		"DOWNLOAD_RATE_LIMIT_PER_SHARE": &AppConfig.Transfers.Download.PerShare,
+		"UPLOAD_RATE_LIMIT":             &AppConfig.Transfers.Upload.Global,
+		"UPLOAD_RATE_LIMIT_PER_USER":    &AppConfig.Transfers.Upload.PerUser,
+		"UPLOAD_RATE_LIMIT_PER_SHARE":   &AppConfig.Transfers.Upload.PerShare,
+	}
+	for name, rate := range rates {
+		if value := os.Getenv(name); value != "" {
+			n, err := throttle.ParseRate(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s value: %v", name, err)
+			}
+			*rate = n
+		}
+	}
+
+	if maxTransfers := os.Getenv("MAX_TRANSFERS_PER_USER"); maxTransfers != "" {
+		n, err := strconv.Atoi(maxTransfers)
+		if err != nil {
+			return fmt.Errorf("invalid MAX_TRANSFERS_PER_USER value: %v", err)
+		}
+		AppConfig.Transfers.MaxPerAccount = n
+	}
+
+	if queueTimeout := os.Getenv("TRANSFER_QUEUE_TIMEOUT"); queueTimeout != "" {
+		d, err := time.ParseDuration(queueTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid TRANSFER_QUEUE_TIMEOUT value: %v", err)
+		}
+		AppConfig.Transfers.QueueTimeout = d
+	}
+
+	if maxFailures := os.Getenv("LOGIN_MAX_FAILURES"); maxFailures != "" {
+		n, err := strconv.Atoi(maxFailures)
+		if err != nil {
+			return fmt.Errorf("invalid LOGIN_MAX_FAILURES value: %v", err)
+		}
+		AppConfig.LoginMaxFailures = n
+	}
+
+	if maxFailures := os.Getenv("LOGIN_MAX_FAILURES_PER_IP"); maxFailures != "" {
+		n, err := strconv.Atoi(maxFailures)
+		if err != nil {
+			return fmt.Errorf("invalid LOGIN_MAX_FAILURES_PER_IP value: %v", err)
+		}
+		AppConfig.LoginMaxFailuresPerIP = n
+	}
+
+	if lockout := os.Getenv("LOGIN_LOCKOUT"); lockout != "" {
+		d, err := time.ParseDuration(lockout)
+		if err != nil {
+			return fmt.Errorf("invalid LOGIN_LOCKOUT value: %v", err)
+		}
+		AppConfig.LoginLockout = d
+	}
+
+	if inFlight := os.Getenv("LOGIN_MAX_IN_FLIGHT"); inFlight != "" {
+		n, err := strconv.Atoi(inFlight)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid LOGIN_MAX_IN_FLIGHT value: %v", inFlight)
+		}
+		AppConfig.LoginMaxInFlight = n
+	}
+
+	AppConfig.TrustedProxies = splitList(os.Getenv("TRUSTED_PROXIES"))
+
+	if ttl := os.Getenv("ACCESS_TOKEN_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid ACCESS_TOKEN_TTL value: %v", ttl)
+		}
+		AppConfig.AccessTokenTTL = d
+	}
+
+	if ttl := os.Getenv("REFRESH_TOKEN_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid REFRESH_TOKEN_TTL value: %v", ttl)
+		}
+		AppConfig.RefreshTokenTTL = d
+	}
+
+	if age := os.Getenv("SESSION_MAX_AGE"); age != "" {
+		d, err := time.ParseDuration(age)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid SESSION_MAX_AGE value: %v", age)
+		}
+		AppConfig.SessionMaxAge = d
+	}
+
+	AppConfig.OIDCIssuer = os.Getenv("OIDC_ISSUER")
+	AppConfig.OIDCClientID = os.Getenv("OIDC_CLIENT_ID")
+	AppConfig.OIDCClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	AppConfig.OIDCRedirectURL = os.Getenv("OIDC_REDIRECT_URL")
+	AppConfig.OIDCScopes = strings.Fields(os.Getenv("OIDC_SCOPES"))
+	AppConfig.OIDCRulesFile = os.Getenv("OIDC_RULES_FILE")
+	if frontend := os.Getenv("OIDC_FRONTEND_URL"); frontend != "" {
+		AppConfig.OIDCFrontendURL = frontend
+	}
+	if AppConfig.OIDCIssuer != "" && (AppConfig.OIDCClientID == "" || AppConfig.OIDCRedirectURL == "") {
+		return fmt.Errorf("OIDC_ISSUER requires OIDC_CLIENT_ID and OIDC_REDIRECT_URL")
+	}
+
+	if backends := splitList(os.Getenv("AUTH_BACKENDS")); len(backends) > 0 {
+		AppConfig.AuthBackends = backends
+	}
+
+	AppConfig.LDAP = auth.LDAPConfig{
+		URL:               os.Getenv("LDAP_URL"),
+		BindDN:            os.Getenv("LDAP_BIND_DN"),
+		BindPassword:      os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:            os.Getenv("LDAP_BASE_DN"),
+		UserFilter:        os.Getenv("LDAP_USER_FILTER"),
+		UsernameAttribute: os.Getenv("LDAP_USERNAME_ATTRIBUTE"),
+		GroupBaseDN:       os.Getenv("LDAP_GROUP_BASE_DN"),
+		GroupFilter:       os.Getenv("LDAP_GROUP_FILTER"),
+	}
+	AppConfig.LDAPCAFile = os.Getenv("LDAP_CA_FILE")
+
+	if startTLS := os.Getenv("LDAP_START_TLS"); startTLS != "" {
+		enabled, err := strconv.ParseBool(startTLS)
+		if err != nil {
+			return fmt.Errorf("invalid LDAP_START_TLS value: %v", err)
+		}
+		AppConfig.LDAP.StartTLS = enabled
+	}
+
+	// Group DNs contain commas, so these lists are separated by semicolons
+	if groups := os.Getenv("LDAP_REQUIRED_GROUPS"); groups != "" {
+		for _, group := range strings.Split(groups, ";") {
+			if group = strings.TrimSpace(group); group != "" {
+				AppConfig.LDAP.RequiredGroups = append(AppConfig.LDAP.RequiredGroups, group)
+			}
+		}
+	}
+
+	if roleMap := os.Getenv("LDAP_ROLE_MAP"); roleMap != "" {
+		AppConfig.LDAP.RoleMap = make(map[string]string)
+		for _, entry := range strings.Split(roleMap, ";") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			// The role follows the last "=", as the group DN has some of its own
+			eq := strings.LastIndex(entry, "=")
+			if eq < 1 || eq == len(entry)-1 {
+				return fmt.Errorf("invalid LDAP_ROLE_MAP entry: %q", entry)
+			}
+			AppConfig.LDAP.RoleMap[strings.TrimSpace(entry[:eq])] = strings.TrimSpace(entry[eq+1:])
+		}
+	}
+
+	if required := os.Getenv("TWO_FACTOR_REQUIRED"); required != "" {
+		enabled, err := strconv.ParseBool(required)
+		if err != nil {
+			return fmt.Errorf("invalid TWO_FACTOR_REQUIRED value: %v", err)
+		}
+		AppConfig.TwoFactorRequired = enabled
+	}
+	AppConfig.TwoFactorRequiredRoles = splitList(os.Getenv("TWO_FACTOR_REQUIRED_ROLES"))
+	if issuer := os.Getenv("TWO_FACTOR_ISSUER"); issuer != "" {
+		AppConfig.TwoFactorIssuer = issuer
+	}
+
+	// USER_ROLES looks like "alice=admin,bob=read-only"; a user may be listed more than once
+	AppConfig.UserRoles = make(map[string][]string)
+	for _, entry := range splitList(os.Getenv("USER_ROLES")) {
+		username, role, ok := strings.Cut(entry, "=")
+		username, role = strings.TrimSpace(username), strings.TrimSpace(role)
+		if !ok || username == "" || !auth.IsRole(role) {
+			return fmt.Errorf("invalid USER_ROLES entry: %q", entry)
+		}
+		AppConfig.UserRoles[username] = append(AppConfig.UserRoles[username], role)
+	}
+	for _, admin := range AppConfig.AdminUsers {
+		AppConfig.UserRoles[admin] = append(AppConfig.UserRoles[admin], auth.RoleAdmin)
+	}
+	if role := os.Getenv("DEFAULT_ROLE"); role != "" {
+		if !auth.IsRole(role) {
+			return fmt.Errorf("invalid DEFAULT_ROLE value: %q", role)
+		}
+		AppConfig.DefaultRole = role
+	}
+
+	AppConfig.SFTPGoURL = os.Getenv("SFTPGO_API_URL")
+	AppConfig.SFTPGoAdminUser = os.Getenv("SFTPGO_ADMIN_USER")
+	AppConfig.SFTPGoAdminPassword = os.Getenv("SFTPGO_ADMIN_PASSWORD")
+	if homeBase := os.Getenv("SFTPGO_HOME_BASE"); homeBase != "" {
+		AppConfig.SFTPGoHomeBase = homeBase
+	}
+	if AppConfig.SFTPGoURL != "" && AppConfig.SFTPGoAdminUser == "" {
+		return fmt.Errorf("SFTPGO_API_URL requires SFTPGO_ADMIN_USER")
+	}
+
 	return nil
-}
\ No newline at end of file
+}
+
+// splitList reads a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
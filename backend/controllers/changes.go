@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/scanner"
+)
+
+const (
+	changesDefaultLimit = 1000
+	changesMaxLimit     = 5000
+
+	// syncLeaseTTL is how long a user's tree stays scanned after their sync client last asked for changes
+	syncLeaseTTL = time.Hour
+	// syncRetryAfter is how long a sync client waits while the user's tree is first listed
+	syncRetryAfter = 30 * time.Second
+)
+
+// ChangesResponse is one page of the change feed
+type ChangesResponse struct {
+	Changes []EventResponse `json:"changes"`
+	Cursor  string          `json:"cursor"`
+	HasMore bool            `json:"has_more"`
+}
+
+// encodeCursor makes an opaque cursor for the journal position id
+func encodeCursor(epoch string, id uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d", epoch, id)))
+}
+
+// decodeCursor reads a cursor made by encodeCursor
+func decodeCursor(cursor string) (epoch string, id uint64, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, err
+	}
+	epoch, idStr, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return "", 0, fmt.Errorf("malformed cursor")
+	}
+	id, err = strconv.ParseUint(idStr, 10, 64)
+	return epoch, id, err
+}
+
+// syncSince keeps the user's whole tree scanned for changes made over SFTP and returns the
+// journal position since which that has been the case. Without a scanner only API writes are recorded.
+// It fails with scanner.ErrBaselinePending until the tree has been listed completely,
+// and with scanner.ErrTruncated when it has too many folders to be tracked completely.
+func (c *FileController) syncSince(username string) (uint64, error) {
+	if c.Scanner == nil {
+		return 0, nil
+	}
+	dirs := []string{userRoot(username)}
+	for _, point := range c.mountPoints(username) {
+		dirs = append(dirs, point.real)
+	}
+	return c.Scanner.Lease("sync:"+username, dirs, syncLeaseTTL)
+}
+
+// respondSyncPending asks a sync client to come back once the user's tree is fully tracked
+func respondSyncPending(ctx *gin.Context, err error) {
+	ctx.Header("Retry-After", strconv.Itoa(int(syncRetryAfter/time.Second)))
+	if errors.Is(err, scanner.ErrTruncated) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many folders to track every change, try again later"})
+		return
+	}
+	ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "Changes are not tracked completely yet, try again shortly"})
+}
+
+// respondCursorReset tells a sync client its cursor can no longer be served and it has to start over
+func respondCursorReset(ctx *gin.Context) {
+	ctx.JSON(http.StatusGone, gin.H{"error": "Cursor expired, list the tree again from a new cursor", "reset": true})
+}
+
+// LatestCursor returns a cursor for the current state of the user's tree.
+// A sync client takes it before listing the tree, so that nothing done while listing is missed.
+func (c *FileController) LatestCursor(ctx *gin.Context) {
+	if c.Events == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Change tracking is disabled"})
+		return
+	}
+	journal := c.Events.Journal()
+	if _, err := c.syncSince(ctx.GetString("username")); err != nil {
+		respondSyncPending(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"cursor": encodeCursor(journal.Epoch(), journal.LastID())})
+}
+
+// ListChanges returns the changes in the user's tree after the cursor and the cursor to continue from
+func (c *FileController) ListChanges(ctx *gin.Context) {
+	if c.Events == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Change tracking is disabled"})
+		return
+	}
+	username := ctx.GetString("username")
+
+	cursor := ctx.Query("cursor")
+	if cursor == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "cursor is required, get one from /api/changes/cursor"})
+		return
+	}
+	epoch, afterID, err := decodeCursor(cursor)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+
+	limit := changesDefaultLimit
+	if value := ctx.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = min(limit, changesMaxLimit)
+	}
+
+	// Cursors from before the tree was last fully tracked may have missed changes
+	journal := c.Events.Journal()
+	since, err := c.syncSince(username)
+	if err != nil || epoch != journal.Epoch() || afterID < since {
+		respondCursorReset(ctx)
+		return
+	}
+	list, complete := journal.Since(afterID, limit)
+	if !complete {
+		respondCursorReset(ctx)
+		return
+	}
+
+	// Access tokens limited to some folders see only the changes below them
+	everything := eventWatch{dirs: []string{"/"}, recursive: true}
+	if dirs := ctx.GetStringSlice("token_paths"); len(dirs) > 0 {
+		everything.dirs = dirs
+	}
+	resp := ChangesResponse{Changes: []EventResponse{}}
+	next := afterID
+	for _, e := range list {
+		next = e.ID
+		if change, ok := c.translate(username, e, everything); ok {
+			resp.Changes = append(resp.Changes, change)
+		}
+	}
+	resp.Cursor = encodeCursor(epoch, next)
+	resp.HasMore = next < journal.LastID()
+
+	ctx.JSON(http.StatusOK, resp)
+}
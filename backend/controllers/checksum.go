@@ -0,0 +1,301 @@
+package controllers
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/sftp"
+)
+
+// Supported checksum algorithms
+const (
+	AlgoSHA256 = "sha256"
+	AlgoSHA1   = "sha1"
+	AlgoMD5    = "md5"
+	AlgoCRC32C = "crc32c"
+)
+
+// maxChecksumCacheEntries bounds the in-memory checksum cache
+const maxChecksumCacheEntries = 4096
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// execChecksumCommands maps algorithms to the coreutils command used on the exec fast path
+var execChecksumCommands = map[string]string{
+	AlgoSHA256: "sha256sum",
+	AlgoSHA1:   "sha1sum",
+	AlgoMD5:    "md5sum",
+}
+
+// ChecksumResponse is returned by the checksum endpoint
+type ChecksumResponse struct {
+	Path     string `json:"path"`
+	Algo     string `json:"algo"`
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size"`
+	ModTime  string `json:"mod_time"`
+	Source   string `json:"source"`
+}
+
+// newHash returns a hash for a supported algorithm name
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case AlgoSHA256:
+		return sha256.New(), nil
+	case AlgoSHA1:
+		return sha1.New(), nil
+	case AlgoMD5:
+		return md5.New(), nil
+	case AlgoCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+	}
+}
+
+// checksumKey identifies a cached checksum; size and mtime invalidate it when the file changes
+type checksumKey struct {
+	path    string
+	algo    string
+	size    int64
+	modTime int64
+}
+
+// checksumCache remembers computed checksums across requests
+type checksumCache struct {
+	mu      sync.Mutex
+	entries map[checksumKey]string
+}
+
+var checksums = &checksumCache{entries: make(map[checksumKey]string)}
+
+func newChecksumKey(path, algo string, info os.FileInfo) checksumKey {
+	return checksumKey{path: path, algo: algo, size: info.Size(), modTime: info.ModTime().UnixNano()}
+}
+
+func (c *checksumCache) get(key checksumKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sum, ok := c.entries[key]
+	return sum, ok
+}
+
+func (c *checksumCache) put(key checksumKey, sum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxChecksumCacheEntries {
+		// Stale keys are never looked up again, so dropping an arbitrary entry is good enough
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = sum
+}
+
+// execChecksum asks the server to hash the file itself, avoiding the transfer
+func (c *FileController) execChecksum(scopedPath, algo string) (string, error) {
+	command, ok := execChecksumCommands[algo]
+	if !ok {
+		return "", fmt.Errorf("no exec command for %s", algo)
+	}
+	conn, err := c.getSFTPConnection()
+	if err != nil {
+		return "", err
+	}
+	out, err := conn.Exec(command + " " + sftp.ShellQuote(scopedPath))
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty %s output", command)
+	}
+	sum := strings.ToLower(strings.TrimPrefix(fields[0], `\`))
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", fmt.Errorf("unexpected %s output: %q", command, out)
+	}
+	return sum, nil
+}
+
+// storedChecksum hashes the file as stored, on the server itself when exec is enabled and works.
+// It also returns where the sum came from.
+func (c *FileController) storedChecksum(client *sftp.Client, scopedPath, algo string) (string, string, error) {
+	if c.ChecksumExec {
+		if sum, err := c.execChecksum(scopedPath, algo); err == nil {
+			return sum, "exec", nil
+		}
+	}
+	sum, err := streamChecksum(client, scopedPath, algo)
+	return sum, "stream", err
+}
+
+// streamChecksum reads the remote file through the hash
+func streamChecksum(client *sftp.Client, scopedPath, algo string) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+	file, err := client.Open(scopedPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Checksum computes the checksum of a remote file
+func (c *FileController) Checksum(ctx *gin.Context) {
+	path := ctx.Param("path")
+	algo := strings.ToLower(ctx.DefaultQuery("algo", AlgoSHA256))
+	if _, err := newHash(algo); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sc, ok := c.resolve(ctx, path, accessRead)
+	if !ok {
+		return
+	}
+	scopedPath := sc.Path
+
+	client, err := c.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	if !confinedTo(ctx, client, sc.Root, scopedPath) {
+		return
+	}
+
+	info, err := client.Stat(scopedPath)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Failed to get file info: %v", err)})
+		return
+	}
+	if info.IsDir() {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Cannot checksum a directory"})
+		return
+	}
+
+	resp := ChecksumResponse{
+		Path:    path,
+		Algo:    algo,
+		Size:    info.Size(),
+		ModTime: info.ModTime().Format(time.RFC3339),
+	}
+
+	key := newChecksumKey(scopedPath, algo, info)
+	if sum, ok := checksums.get(key); ok {
+		resp.Checksum, resp.Source = sum, "cache"
+		ctx.JSON(http.StatusOK, resp)
+		return
+	}
+
+	resp.Checksum, resp.Source, err = c.storedChecksum(client, scopedPath, algo)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to compute checksum: %v", err)})
+		return
+	}
+
+	checksums.put(key, resp.Checksum)
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// expectedDigest is a checksum the client promised for an upload
+type expectedDigest struct {
+	Algo string
+	Sum  []byte
+}
+
+// digestAlgorithms maps RFC 3230 Digest algorithm tokens onto our names
+var digestAlgorithms = map[string]string{
+	"sha-256": AlgoSHA256,
+	"sha256":  AlgoSHA256,
+	"sha":     AlgoSHA1,
+	"sha-1":   AlgoSHA1,
+	"sha1":    AlgoSHA1,
+	"md5":     AlgoMD5,
+	"crc32c":  AlgoCRC32C,
+}
+
+// parseDigest reads the first supported entry of a Digest value such as "sha-256=<base64>"
+func parseDigest(value string) (*expectedDigest, error) {
+	for _, part := range strings.Split(value, ",") {
+		token, encoded, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		algo, ok := digestAlgorithms[strings.ToLower(token)]
+		if !ok {
+			continue
+		}
+		sum, err := decodeChecksum(encoded, algo)
+		if err != nil {
+			return nil, err
+		}
+		return &expectedDigest{Algo: algo, Sum: sum}, nil
+	}
+	return nil, fmt.Errorf("no supported algorithm in digest %q", value)
+}
+
+// decodeChecksum accepts hex or base64 and checks the length matches the algorithm
+func decodeChecksum(encoded, algo string) ([]byte, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return nil, err
+	}
+	if sum, err := hex.DecodeString(encoded); err == nil && len(sum) == h.Size() {
+		return sum, nil
+	}
+	if sum, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(sum) == h.Size() {
+		return sum, nil
+	}
+	return nil, fmt.Errorf("invalid %s checksum %q", algo, encoded)
+}
+
+// uploadDigestFromRequest looks for a Digest or Content-MD5 header, then the matching form fields.
+// It returns nil when the client did not ask for verification.
+func uploadDigestFromRequest(ctx *gin.Context) (*expectedDigest, error) {
+	if value := firstNonEmpty(ctx.GetHeader("Digest"), ctx.PostForm("digest")); value != "" {
+		return parseDigest(value)
+	}
+	if value := firstNonEmpty(ctx.GetHeader("Content-MD5"), ctx.PostForm("content_md5")); value != "" {
+		sum, err := decodeChecksum(value, AlgoMD5)
+		if err != nil {
+			return nil, err
+		}
+		return &expectedDigest{Algo: AlgoMD5, Sum: sum}, nil
+	}
+	return nil, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/sftp"
+)
+
+// ConflictPolicy decides what a write does when its target already exists
+type ConflictPolicy string
+
+const (
+	ConflictFail      ConflictPolicy = "fail"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictRename    ConflictPolicy = "rename"
+)
+
+// DefaultConflictPolicy is used when a request does not set on_conflict
+const DefaultConflictPolicy = ConflictFail
+
+// maxRenameAttempts bounds the search for a free "name (n).ext" variant
+const maxRenameAttempts = 1000
+
+var errConflict = errors.New("destination already exists")
+
+// ParseConflictPolicy validates an on_conflict value, falling back to the default when empty
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case "":
+		return DefaultConflictPolicy, nil
+	case ConflictFail, ConflictOverwrite, ConflictSkip, ConflictRename:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid on_conflict value %q", value)
+	}
+}
+
+// conflictPolicyFromRequest reads on_conflict from the query string or form fields
+func conflictPolicyFromRequest(ctx *gin.Context) (ConflictPolicy, error) {
+	value := ctx.Query("on_conflict")
+	if value == "" {
+		value = ctx.PostForm("on_conflict")
+	}
+	return ParseConflictPolicy(value)
+}
+
+// conflictResolution is the outcome of checking a write target against a conflict policy
+type conflictResolution struct {
+	Path      string      // scoped path the write should go to
+	Existing  os.FileInfo // entry occupying the requested target, if any
+	Skip      bool        // the write should not happen
+	Overwrite bool        // the write replaces Existing
+}
+
+// resolveConflict applies policy to the scoped target path.
+// It returns errConflict together with the resolution when the policy is fail.
+func resolveConflict(client *sftp.Client, target string, policy ConflictPolicy) (*conflictResolution, error) {
+	res := &conflictResolution{Path: target}
+
+	existing, err := client.Lstat(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	res.Existing = existing
+
+	switch policy {
+	case ConflictOverwrite:
+		res.Overwrite = true
+	case ConflictSkip:
+		res.Skip = true
+	case ConflictRename:
+		free, err := findFreeName(client, target)
+		if err != nil {
+			return nil, err
+		}
+		res.Path = free
+	default:
+		return res, errConflict
+	}
+	return res, nil
+}
+
+// findFreeName returns the first "name (n).ext" variant of target that does not exist
+func findFreeName(client *sftp.Client, target string) (string, error) {
+	dir, base := filepath.Split(target)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	// Dotfiles such as ".env" have no stem worth numbering before
+	if stem == "" {
+		stem, ext = base, ""
+	}
+
+	for i := 1; i <= maxRenameAttempts; i++ {
+		candidate := filepath.ToSlash(filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext)))
+		if _, err := client.Lstat(candidate); err != nil {
+			if os.IsNotExist(err) {
+				return candidate, nil
+			}
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free name found for %s", base)
+}
+
+// respondConflict writes a 409 carrying the metadata of the conflicting entry.
+// Callers whose roles may not read only learn that the destination is taken.
+func respondConflict(ctx *gin.Context, existing os.FileInfo, relPath string) {
+	if !rolePermits(ctx.GetStringSlice("roles"), accessBrowse) {
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Destination already exists"})
+		return
+	}
+	ctx.JSON(http.StatusConflict, gin.H{
+		"error":    "Destination already exists",
+		"conflict": newFileInfo(existing, relPath),
+	})
+}
+
+// resolvedRelPath maps a resolved scoped path back onto the client's relative path
+func resolvedRelPath(relPath string, res *conflictResolution) string {
+	return filepath.ToSlash(filepath.Join(filepath.Dir(relPath), filepath.Base(res.Path)))
+}
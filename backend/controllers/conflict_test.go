@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/auth"
+)
+
+// existingFile is the entry a conflicting write ran into
+type existingFile struct{}
+
+func (existingFile) Name() string       { return "salaries.xlsx" }
+func (existingFile) Size() int64        { return 48213 }
+func (existingFile) Mode() os.FileMode  { return 0o640 }
+func (existingFile) ModTime() time.Time { return time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC) }
+func (existingFile) IsDir() bool        { return false }
+func (existingFile) Sys() interface{}   { return nil }
+
+func TestRespondConflict(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, tt := range []struct {
+		roles    []string
+		metadata bool
+	}{
+		{nil, true},
+		{[]string{auth.RoleUser}, true},
+		{[]string{auth.RoleUploader}, false},
+	} {
+		rec := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(rec)
+		ctx.Set("roles", tt.roles)
+		respondConflict(ctx, existingFile{}, "/hr/salaries.xlsx")
+
+		if rec.Code != http.StatusConflict {
+			t.Fatalf("roles %v: status = %d", tt.roles, rec.Code)
+		}
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := body["conflict"]; ok != tt.metadata {
+			t.Errorf("roles %v: conflict metadata sent = %v, want %v: %s", tt.roles, ok, tt.metadata, rec.Body)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,7 +11,12 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/acl"
+	"manschko.com/cloud-storage/events"
+	"manschko.com/cloud-storage/groups"
+	"manschko.com/cloud-storage/scanner"
 	"manschko.com/cloud-storage/sftp"
+	"manschko.com/cloud-storage/throttle"
 )
 
 // FileInfo represents file metadata
@@ -20,24 +27,68 @@ type FileInfo struct {
 	ModTime      string `json:"mod_time"`
 	Path         string `json:"path"`
 	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+
+	// POSIX metadata as reported by the SFTP server
+	Mode        string `json:"mode"`
+	Permissions string `json:"permissions"`
+	UID         uint32 `json:"uid"`
+	GID         uint32 `json:"gid"`
+	AccessTime  string `json:"access_time,omitempty"`
+
+	// Symlink details; targets outside the user's root are flagged but never revealed
+	IsSymlink       bool   `json:"is_symlink"`
+	LinkTarget      string `json:"link_target,omitempty"`
+	LinkOutsideRoot bool   `json:"link_outside_root,omitempty"`
+
+	// Enrichments, always set by the stat endpoint and opt-in for listings via fields=
+	MimeType  string `json:"mime_type,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Extension string `json:"extension,omitempty"`
+	Hidden    bool   `json:"hidden,omitempty"`
+
+	// Namespace details for folders other users shared
+	Virtual          bool   `json:"virtual,omitempty"`
+	SharedBy         string `json:"shared_by,omitempty"`
+	SharedPermission string `json:"shared_permission,omitempty"`
+	GroupRole        string `json:"group_role,omitempty"`
 }
 
 // MoveRequest represents a file move operation
 type MoveRequest struct {
 	Source      string `json:"source" binding:"required"`
 	Destination string `json:"destination" binding:"required"`
+	OnConflict  string `json:"on_conflict"`
 }
 
 // RenameRequest represents a file rename operation
 type RenameRequest struct {
-	Path    string `json:"path" binding:"required"`
-	NewName string `json:"new_name" binding:"required"`
+	Path       string `json:"path" binding:"required"`
+	NewName    string `json:"new_name" binding:"required"`
+	OnConflict string `json:"on_conflict"`
 }
 
 // FileController handles file operations
 type FileController struct {
 	SFTPHost string
 	SFTPPort int
+
+	// ChecksumExec lets checksums run server-side through sha256sum and friends
+	ChecksumExec bool
+
+	// Grants mounts folders other users shared under SharedWithMeDir; nil disables sharing
+	Grants *acl.Store
+
+	// Groups mounts the user's group spaces under GroupsDir; nil disables group spaces
+	Groups *groups.Store
+
+	// Events receives a notification for every change made through the controller; nil disables them
+	Events *events.Broker
+
+	// Scanner watches the folders event streams subscribe to for changes made outside the API; nil disables it
+	Scanner *scanner.Scanner
+
+	// Transfers limits the throughput and number of simultaneous downloads and uploads; nil disables limits
+	Transfers *throttle.Manager
 }
 
 // NewFileController creates a new file controller
@@ -58,108 +109,231 @@ func (c *FileController) getSFTPConnection() (*sftp.Connection, error) {
 	return sftp.NewConnection(c.SFTPHost, c.SFTPPort, sftpUser, sftpPassword), nil
 }
 
-func getUserScopedPath(ctx *gin.Context, relPath string) (string, error) {
+// connect opens an SFTP client with the service account
+func (c *FileController) connect() (*sftp.Client, error) {
+	conn, err := c.getSFTPConnection()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Connect()
+}
+
+// getUserRoot returns the folder every path of the authenticated user is confined to
+func getUserRoot(ctx *gin.Context) (string, error) {
 	username, exists := ctx.Get("username")
 	if !exists {
 		return "", fmt.Errorf("username not found in context")
 	}
+	return userRoot(username.(string)), nil
+}
+
+// HomeDirs overrides the home folder of users who were given one at login, such as single sign-on users
+var HomeDirs interface {
+	HomeDir(username string) (string, bool)
+}
+
+// userRoot returns the home folder of username
+func userRoot(username string) string {
+	if HomeDirs != nil {
+		if home, ok := HomeDirs.HomeDir(username); ok {
+			return filepath.ToSlash(filepath.Join("/", home))
+		}
+	}
+	return filepath.ToSlash(filepath.Join("/", username))
+}
+
+func getUserScopedPath(ctx *gin.Context, relPath string) (string, error) {
+	if !tokenAllows(ctx, relPath) {
+		return "", errTokenPath
+	}
+	root, err := getUserRoot(ctx)
+	if err != nil {
+		return "", err
+	}
+	return scopePath(root, relPath), nil
+}
+
+// scopePath joins relPath onto root without letting ".." climb out of it
+func scopePath(root, relPath string) string {
 	// Ensure relPath is not empty or root
 	if relPath == "" || relPath == "/" {
-		return filepath.ToSlash(filepath.Join("/", username.(string))), nil
+		return root
+	}
+	// Clean against "/" first so ".." can never climb out of the root
+	return filepath.ToSlash(filepath.Join(root, filepath.Join("/", relPath)))
+}
+
+// uploadName returns the base name of a file a client uploads.
+// Names that would address the target folder itself or its parent are refused.
+func uploadName(filename string) (string, error) {
+	name := filepath.Base(filepath.ToSlash(filename))
+	switch name {
+	case ".", "..", "/":
+		return "", fmt.Errorf("invalid file name %q", filename)
+	}
+	return name, nil
+}
+
+// newFileInfo converts remote file metadata into the API representation
+func newFileInfo(info os.FileInfo, relPath string) FileInfo {
+	fileInfo := FileInfo{
+		Name:        info.Name(),
+		Size:        info.Size(),
+		IsDir:       info.IsDir(),
+		ModTime:     info.ModTime().Format(time.RFC3339),
+		Path:        filepath.ToSlash(relPath),
+		Mode:        info.Mode().String(),
+		Permissions: fmt.Sprintf("%04o", info.Mode().Perm()),
+		IsSymlink:   info.Mode()&os.ModeSymlink != 0,
+	}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		fileInfo.UID = stat.UID
+		fileInfo.GID = stat.GID
+		if stat.Atime != 0 {
+			fileInfo.AccessTime = time.Unix(int64(stat.Atime), 0).Format(time.RFC3339)
+		}
 	}
-	return filepath.ToSlash(filepath.Join("/", username.(string), relPath)), nil
+	return fileInfo
 }
 
 // ListFiles lists files in the specified directory
 func (c *FileController) ListFiles(ctx *gin.Context) {
-	path := ctx.Param("path")
-	scopedPath, err := getUserScopedPath(ctx, path)
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	sc, ok := c.resolve(ctx, ctx.Param("path"), accessBrowse)
+	if !ok {
 		return
 	}
-	conn, err := c.getSFTPConnection()
 
+	// Enrichments such as MIME sniffing cost extra round trips, so they are opt-in
+	fields, err := parseMetadataFields(ctx.Query("fields"))
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if sc.Virtual {
+		ctx.JSON(http.StatusOK, c.listVirtual(sc))
 		return
 	}
 
-	client, err := conn.Connect()
+	client, err := c.connect()
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
 		return
 	}
 	defer client.Close()
-	// Get username from context (set by auth middleware)
-	files, err := client.ReadDir(scopedPath)
+
+	if !confinedTo(ctx, client, sc.Root, sc.Path) {
+		return
+	}
+
+	// The home folder also shows the entry points to shared folders and group spaces
+	home := sc.Prefix == "/" && sc.Path == sc.Root
+	if home {
+		c.moveShadowedFolders(client, sc.Owner)
+	}
+
+	fileInfos, err := readDirectory(client, sc, fields)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read directory: %v", err)})
 		return
 	}
-	var fileInfos []FileInfo
-	for _, file := range files {
-		fileInfos = append(fileInfos, FileInfo{
-			Name:    file.Name(),
-			Size:    file.Size(),
-			IsDir:   file.IsDir(),
-			ModTime: file.ModTime().Format(time.RFC3339),
-			Path:    filepath.Join(path, file.Name()), // Return relative path to client
-		})
+	if home {
+		fileInfos = c.withVirtualFolders(sc.Owner, fileInfos)
 	}
 
 	ctx.JSON(http.StatusOK, fileInfos)
 }
 
+// readDirectory lists the folder at sc.Path, reporting paths as the client sees them
+func readDirectory(client *sftp.Client, sc scope, fields metadataFields) ([]FileInfo, error) {
+	files, err := client.ReadDir(sc.Path)
+	if err != nil {
+		return nil, err
+	}
+	var fileInfos []FileInfo
+	for _, file := range files {
+		// In-progress uploads are an implementation detail
+		if sftp.IsTempUpload(file.Name()) {
+			continue
+		}
+		// Return relative path to client
+		entryPath := filepath.ToSlash(filepath.Join(sc.Path, file.Name()))
+		info := newFileInfo(file, sc.userPath(entryPath))
+		describeLink(client, sc, entryPath, &info)
+		enrichFileInfo(client, entryPath, &info, fields)
+		fileInfos = append(fileInfos, info)
+	}
+	return fileInfos, nil
+}
+
 // DownloadFile downloads a file from SFTP server
 func (c *FileController) DownloadFile(ctx *gin.Context) {
-	path := ctx.Param("path")
-
-	// Get username from context
-	username, exists := ctx.Get("username")
-	if !exists {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User not authenticated"})
+	sc, ok := c.resolve(ctx, ctx.Param("path"), accessRead)
+	if !ok {
 		return
 	}
 
-	// In a real application, you would retrieve the password from a secure store
-	password := "placeholder" // This would need to be securely stored/retrieved
-
-	conn := sftp.NewConnection(c.SFTPHost, c.SFTPPort, username.(string), password)
-	client, err := conn.Connect()
+	client, err := c.connect()
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
 		return
 	}
 	defer client.Close()
 
-	file, err := client.Open(path)
+	if !confinedTo(ctx, client, sc.Root, sc.Path) {
+		return
+	}
+
+	account := throttle.Account{User: ctx.GetString("username")}
+	release, ok := c.beginTransfer(ctx, account)
+	if !ok {
+		return
+	}
+	defer release()
+
+	c.serveFile(ctx, client, sc.Path, account, nil)
+}
+
+// serveFile streams a remote file as an attachment, at the rate the account's limits allow.
+// A non-nil ready runs once the file is open and may refuse it, writing the response itself.
+func (c *FileController) serveFile(ctx *gin.Context, client *sftp.Client, scopedPath string, account throttle.Account, ready func() bool) {
+	file, err := client.Open(scopedPath)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to open file: %v", err)})
 		return
 	}
 	defer file.Close()
 
-	fileInfo, err := client.Stat(path)
+	fileInfo, err := client.Stat(scopedPath)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get file info: %v", err)})
 		return
 	}
+	if ready != nil && !ready() {
+		return
+	}
 
 	ctx.Header("Content-Description", "File Transfer")
 	ctx.Header("Content-Transfer-Encoding", "binary")
-	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filepath.Base(path)))
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filepath.Base(scopedPath)))
 	ctx.Header("Content-Type", "application/octet-stream")
 	ctx.Header("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
 
 	ctx.Status(http.StatusOK)
-	io.Copy(ctx.Writer, file)
+	io.Copy(c.limitWriter(ctx, ctx.Writer, throttle.Download, account), file)
 }
 
 // UploadFile uploads a file to the SFTP server
 func (c *FileController) UploadFile(ctx *gin.Context) {
 	path := ctx.Param("path")
 
+	account := throttle.Account{User: ctx.GetString("username")}
+	release, ok := c.beginTransfer(ctx, account)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Parse multipart form
 	err := ctx.Request.ParseMultipartForm(32 << 20) // 32MB max
 	if err != nil {
@@ -167,6 +341,18 @@ func (c *FileController) UploadFile(ctx *gin.Context) {
 		return
 	}
 
+	policy, err := conflictPolicyFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	digest, err := uploadDigestFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	file, header, err := ctx.Request.FormFile("file")
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get file from form"})
@@ -174,115 +360,192 @@ func (c *FileController) UploadFile(ctx *gin.Context) {
 	}
 	defer file.Close()
 
-	// Get username from context
-	username, exists := ctx.Get("username")
-	if !exists {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User not authenticated"})
+	// Create destination path
+	name, err := uploadName(header.Filename)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	relPath := filepath.Join(path, name)
+	sc, ok := c.resolve(ctx, path, accessWrite)
+	if !ok {
+		return
+	}
+	destPath := scopePath(sc.Path, name)
+	if !isWithin(sc.Root, destPath) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Path is outside of your storage"})
 		return
 	}
 
-	// In a real application, you would retrieve the password from a secure store
-	password := "placeholder" // This would need to be securely stored/retrieved
-
-	conn := sftp.NewConnection(c.SFTPHost, c.SFTPPort, username.(string), password)
-	client, err := conn.Connect()
+	client, err := c.connect()
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
 		return
 	}
 	defer client.Close()
 
-	// Create destination path
-	destPath := filepath.Join(path, header.Filename)
+	if !confinedTo(ctx, client, sc.Root, sc.Path) {
+		return
+	}
 
-	// Create remote file
-	dstFile, err := client.Create(destPath)
+	res, err := resolveConflict(client, destPath, policy)
+	if errors.Is(err, errConflict) {
+		respondConflict(ctx, res.Existing, relPath)
+		return
+	}
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create remote file: %v", err)})
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check destination: %v", err)})
+		return
+	}
+	relPath = resolvedRelPath(relPath, res)
+	if res.Skip {
+		ctx.JSON(http.StatusOK, gin.H{"message": "File already exists, upload skipped", "path": relPath, "skipped": true})
+		return
+	}
+	// Replacing a file changes it, which uploaders may not do
+	if res.Overwrite && !rolePermits(ctx.GetStringSlice("roles"), accessModify) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to replace existing files"})
 		return
 	}
-	defer dstFile.Close()
 
-	// Copy file content
-	_, err = io.Copy(dstFile, file)
+	// When the client supplied a digest, hash what the server stored before it goes into place
+	var verify func(string, int64) error
+	if digest != nil {
+		verify = func(tmpPath string, _ int64) error {
+			sum, _, err := c.storedChecksum(client, tmpPath, digest.Algo)
+			if err != nil {
+				return fmt.Errorf("failed to hash the stored file: %v", err)
+			}
+			if sum != hex.EncodeToString(digest.Sum) {
+				return errChecksumMismatch
+			}
+			return nil
+		}
+	}
+
+	// Write to a hidden temp file and only rename it into place once complete
+	src := c.limitReader(ctx, file, throttle.Upload, account)
+	_, err = sftp.WriteAtomic(client, res.Path, src, sftp.UploadOptions{
+		Overwrite:    res.Overwrite,
+		ExpectedSize: header.Size,
+		Verify:       verify,
+	})
+	if errors.Is(err, errChecksumMismatch) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Checksum mismatch, upload rejected", "algo": digest.Algo})
+		return
+	}
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to copy file content: %v", err)})
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to upload file: %v", err)})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "path": destPath})
+	// The verified digest doubles as a cache entry for later checksum requests
+	if digest != nil {
+		if info, err := client.Stat(res.Path); err == nil {
+			checksums.put(newChecksumKey(res.Path, digest.Algo, info), hex.EncodeToString(digest.Sum))
+		}
+	}
+	c.publishWrite(ctx.GetString("username"), res.Path, res.Overwrite)
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "path": relPath})
 }
 
-// DeleteFile deletes a file or directory from the SFTP server
+// DeleteFile deletes a file from the SFTP server.
+// Folders can take long to remove, so they are deleted by a delete job instead.
 func (c *FileController) DeleteFile(ctx *gin.Context) {
-	path := ctx.Param("path")
-
-	// Get username from context
-	username, exists := ctx.Get("username")
-	if !exists {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User not authenticated"})
+	sc, ok := c.resolve(ctx, ctx.Param("path"), accessModify)
+	if !ok {
 		return
 	}
+	scopedPath := sc.Path
 
-	// In a real application, you would retrieve the password from a secure store
-	password := "placeholder" // This would need to be securely stored/retrieved
-
-	conn := sftp.NewConnection(c.SFTPHost, c.SFTPPort, username.(string), password)
-	client, err := conn.Connect()
+	client, err := c.connect()
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
 		return
 	}
 	defer client.Close()
 
+	// Deleting a symlink removes the link itself, so only its parent has to be inside root
+	if !confinedTo(ctx, client, sc.Root, sc.parentDir()) {
+		return
+	}
+
 	// Check if it's a directory
-	fileInfo, err := client.Stat(path)
+	fileInfo, err := client.Lstat(scopedPath)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get file info: %v", err)})
 		return
 	}
 
 	if fileInfo.IsDir() {
-		// Remove directory recursively
-		//err = c.removeDirectory(client, path)
-	} else {
-		// Remove file
-		err = client.Remove(path)
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error": "Folders are deleted by a job, submit one to POST /api/jobs",
+			"job":   JobRequest{Kind: JobDelete, Paths: []string{ctx.Param("path")}},
+		})
+		return
 	}
 
-	if err != nil {
+	if err := client.Remove(scopedPath); err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to delete: %v", err)})
 		return
 	}
+	c.publish(events.Event{Type: events.Deleted, Path: scopedPath, Actor: ctx.GetString("username")})
 
 	ctx.JSON(http.StatusOK, gin.H{"message": "Deleted successfully"})
 }
 
-// removeDirectory recursively removes a directory and its contents
-/*func (c *FileController) removeDirectory(client *sftp.Client, path string) error {
-	// List all items in directory
-	files, err := client.ReadDir(path)
+// CleanStaleUploads removes temp files left behind by uploads that never finished
+func (c *FileController) CleanStaleUploads(maxAge time.Duration) (int, error) {
+	client, err := c.connect()
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer client.Close()
 
-	// Delete each item
-	for _, file := range files {
-		itemPath := filepath.Join(path, file.Name())
-		if file.IsDir() {
-			if err := c.removeDirectory(client, itemPath); err != nil {
-				return err
-			}
-		} else {
-			if err := client.Remove(itemPath); err != nil {
-				return err
-			}
-		}
+	return sftp.CleanStaleUploads(client, sftp.Uploads, maxAge)
+}
+
+// renameWithPolicy moves the source entry onto the target path according to policy.
+// It returns the final relative path, or false once it has written the response itself.
+func (c *FileController) renameWithPolicy(ctx *gin.Context, client *sftp.Client, source, target scope, relTarget string, policy ConflictPolicy) (string, bool) {
+	// Renames move links rather than following them, so only the parents have to be inside root
+	if !confinedTo(ctx, client, source.Root, source.parentDir()) || !confinedTo(ctx, client, target.Root, target.parentDir()) {
+		return "", false
+	}
+
+	res, err := resolveConflict(client, target.Path, policy)
+	if errors.Is(err, errConflict) {
+		respondConflict(ctx, res.Existing, relTarget)
+		return "", false
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check destination: %v", err)})
+		return "", false
+	}
+	relTarget = resolvedRelPath(relTarget, res)
+	if res.Skip {
+		ctx.JSON(http.StatusOK, gin.H{"message": "Destination already exists, skipped", "new_path": relTarget, "skipped": true})
+		return "", false
+	}
+
+	if res.Overwrite {
+		err = sftp.ReplaceRename(client, source.Path, res.Path)
+	} else {
+		err = client.Rename(source.Path, res.Path)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to rename: %v", err)})
+		return "", false
 	}
 
-	// Delete the now-empty directory
-	return client.RemoveDirectory(path)
-}*/
+	moved := events.Event{Type: events.Moved, Path: res.Path, OldPath: source.Path, Actor: ctx.GetString("username")}
+	if info, err := client.Lstat(res.Path); err == nil {
+		moved.IsDir = info.IsDir()
+	}
+	c.publish(moved)
+	return relTarget, true
+}
 
 // MoveFile moves a file or directory to a new location
 func (c *FileController) MoveFile(ctx *gin.Context) {
@@ -292,31 +555,34 @@ func (c *FileController) MoveFile(ctx *gin.Context) {
 		return
 	}
 
-	// Get username from context
-	username, exists := ctx.Get("username")
-	if !exists {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User not authenticated"})
+	policy, err := ParseConflictPolicy(moveReq.OnConflict)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// In a real application, you would retrieve the password from a secure store
-	password := "placeholder" // This would need to be securely stored/retrieved
+	source, ok := c.resolve(ctx, moveReq.Source, accessModify)
+	if !ok {
+		return
+	}
+	destination, ok := c.resolve(ctx, moveReq.Destination, accessModify)
+	if !ok {
+		return
+	}
 
-	conn := sftp.NewConnection(c.SFTPHost, c.SFTPPort, username.(string), password)
-	client, err := conn.Connect()
+	client, err := c.connect()
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
 		return
 	}
 	defer client.Close()
 
-	err = client.Rename(moveReq.Source, moveReq.Destination)
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to move file: %v", err)})
+	newPath, ok := c.renameWithPolicy(ctx, client, source, destination, moveReq.Destination, policy)
+	if !ok {
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"message": "File moved successfully"})
+	ctx.JSON(http.StatusOK, gin.H{"message": "File moved successfully", "new_path": newPath})
 }
 
 // RenameFile renames a file or directory
@@ -327,63 +593,94 @@ func (c *FileController) RenameFile(ctx *gin.Context) {
 		return
 	}
 
-	// Get username from context
-	username, exists := ctx.Get("username")
-	if !exists {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User not authenticated"})
+	policy, err := ParseConflictPolicy(renameReq.OnConflict)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// In a real application, you would retrieve the password from a secure store
-	password := "placeholder" // This would need to be securely stored/retrieved
+	dir := filepath.Dir(renameReq.Path)
+	newPath := filepath.Join(dir, filepath.Base(renameReq.NewName))
+
+	source, ok := c.resolve(ctx, renameReq.Path, accessModify)
+	if !ok {
+		return
+	}
+	target, ok := c.resolve(ctx, newPath, accessModify)
+	if !ok {
+		return
+	}
 
-	conn := sftp.NewConnection(c.SFTPHost, c.SFTPPort, username.(string), password)
-	client, err := conn.Connect()
+	client, err := c.connect()
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
 		return
 	}
 	defer client.Close()
 
-	dir := filepath.Dir(renameReq.Path)
-	newPath := filepath.Join(dir, renameReq.NewName)
-
-	err = client.Rename(renameReq.Path, newPath)
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to rename file: %v", err)})
+	newPath, ok = c.renameWithPolicy(ctx, client, source, target, newPath, policy)
+	if !ok {
 		return
 	}
 
 	ctx.JSON(http.StatusOK, gin.H{"message": "File renamed successfully", "new_path": newPath})
 }
 
-// CreateDirectory creates a new directory on the SFTP server
+// CreateDirectory creates a new directory on the SFTP server.
+// With on_conflict=overwrite an existing directory is kept as is, since there is nothing to replace.
 func (c *FileController) CreateDirectory(ctx *gin.Context) {
 	path := ctx.Param("path")
 
-	// Get username from context
-	username, exists := ctx.Get("username")
-	if !exists {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "User not authenticated"})
+	policy, err := conflictPolicyFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// In a real application, you would retrieve the password from a secure store
-	password := "placeholder" // This would need to be securely stored/retrieved
+	sc, ok := c.resolve(ctx, path, accessCreate)
+	if !ok {
+		return
+	}
 
-	conn := sftp.NewConnection(c.SFTPHost, c.SFTPPort, username.(string), password)
-	client, err := conn.Connect()
+	client, err := c.connect()
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
 		return
 	}
 	defer client.Close()
 
-	err = client.MkdirAll(path)
+	if !confinedTo(ctx, client, sc.Root, sc.Path) {
+		return
+	}
+
+	res, err := resolveConflict(client, sc.Path, policy)
+	if errors.Is(err, errConflict) {
+		respondConflict(ctx, res.Existing, path)
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check destination: %v", err)})
+		return
+	}
+	relPath := resolvedRelPath(path, res)
+	if res.Skip {
+		ctx.JSON(http.StatusOK, gin.H{"message": "Directory already exists, skipped", "path": relPath, "skipped": true})
+		return
+	}
+	if res.Overwrite && !res.Existing.IsDir() {
+		// Replacing a file with a directory would destroy data the caller never asked to delete
+		respondConflict(ctx, res.Existing, path)
+		return
+	}
+
+	err = client.MkdirAll(res.Path)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create directory: %v", err)})
 		return
 	}
+	if res.Existing == nil {
+		c.publish(events.Event{Type: events.Created, Path: res.Path, IsDir: true, Actor: ctx.GetString("username")})
+	}
 
-	ctx.JSON(http.StatusOK, gin.H{"message": "Directory created successfully"})
+	ctx.JSON(http.StatusOK, gin.H{"message": "Directory created successfully", "path": relPath})
 }
@@ -0,0 +1,25 @@
+package controllers
+
+import "testing"
+
+func TestUploadName(t *testing.T) {
+	for _, tt := range []struct {
+		filename, want string
+		wantErr        bool
+	}{
+		{"report.pdf", "report.pdf", false},
+		{"dir/report.pdf", "report.pdf", false},
+		{"../../report.pdf", "report.pdf", false},
+		{".env", ".env", false},
+		{"", "", true},
+		{".", "", true},
+		{"..", "", true},
+		{"a/..", "", true},
+		{"/", "", true},
+	} {
+		got, err := uploadName(tt.filename)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("uploadName(%q) = %q, %v", tt.filename, got, err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/net/webdav"
+	"manschko.com/cloud-storage/events"
+	"manschko.com/cloud-storage/sftp"
+)
+
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+// davFS exposes one user's namespace, including shared folders and group spaces, to the WebDAV handler
+type davFS struct {
+	files    *FileController
+	client   *sftp.Client
+	username string
+	roles    []string
+}
+
+// davError maps namespace errors onto the errors the WebDAV handler understands
+func davError(err error) error {
+	switch {
+	case errors.Is(err, errUnknownMount), errors.Is(err, errUnknownGroup):
+		return os.ErrNotExist
+	case errors.Is(err, errForbidden), errors.Is(err, errVirtualFolder), errors.Is(err, errOutsideRoot):
+		return os.ErrPermission
+	}
+	return err
+}
+
+// resolve applies the same path scoping and permission checks as the JSON API.
+// With entryOnly the entry itself may be a link, so only its parent has to stay inside the root.
+func (d *davFS) resolve(name string, want access, entryOnly bool) (scope, error) {
+	sc, err := d.files.resolvePath(d.username, name)
+	if err == nil {
+		err = checkAccess(sc, want)
+	}
+	if err == nil && !rolePermits(d.roles, want) {
+		err = errForbidden
+	}
+	if err != nil {
+		return scope{}, davError(err)
+	}
+	if sc.Virtual {
+		return sc, nil
+	}
+
+	check := sc.Path
+	if entryOnly {
+		check = sc.parentDir()
+	}
+	if err := ensureWithinRoot(d.client, sc.Root, check); err != nil {
+		return scope{}, davError(err)
+	}
+	return sc, nil
+}
+
+// Mkdir creates a collection
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	sc, err := d.resolve(name, accessCreate, true)
+	if err != nil {
+		return err
+	}
+	if err := d.client.Mkdir(sc.Path); err != nil {
+		return err
+	}
+	d.files.publish(events.Event{Type: events.Created, Path: sc.Path, IsDir: true, Actor: d.username})
+	return nil
+}
+
+// OpenFile opens a file or collection; writes that replace a file go through a temp file
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&writeFlags == 0 {
+		sc, err := d.resolve(name, accessBrowse, false)
+		if err != nil {
+			return nil, err
+		}
+		if sc.Virtual {
+			return &davDir{fs: d, sc: sc, info: virtualDirInfo(path.Base(sc.Prefix))}, nil
+		}
+		info, err := d.client.Stat(sc.Path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return &davDir{fs: d, sc: sc, info: info}, nil
+		}
+		f, err := d.client.Open(sc.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &davFile{File: f}, nil
+	}
+
+	sc, err := d.resolve(name, accessWrite, false)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := d.client.Stat(sc.Path)
+	if err == nil && existing.IsDir() {
+		return nil, os.ErrPermission
+	}
+	// Replacing a file changes it, which uploaders may not do
+	if existing != nil && !rolePermits(d.roles, accessModify) {
+		return nil, os.ErrPermission
+	}
+
+	if flag&os.O_CREATE != 0 && flag&os.O_TRUNC != 0 {
+		// Readers never see a half-written file, exactly like uploads through the JSON API
+		temp, err := sftp.TempUploadPath(sc.Path)
+		if err != nil {
+			return nil, err
+		}
+		f, err := d.client.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			return nil, err
+		}
+		return &davUpload{davFile: davFile{File: f}, fs: d, temp: temp, target: sc.Path, replaced: existing != nil}, nil
+	}
+
+	f, err := d.client.OpenFile(sc.Path, flag)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{File: f}, nil
+}
+
+// RemoveAll deletes a file or a collection with everything below it
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	sc, err := d.resolve(name, accessModify, true)
+	if err != nil {
+		return err
+	}
+	info, err := d.client.Lstat(sc.Path)
+	if err != nil {
+		return err
+	}
+	if err := sftp.RemoveTree(d.client, sc.Path); err != nil {
+		return err
+	}
+	d.files.publish(events.Event{Type: events.Deleted, Path: sc.Path, IsDir: info.IsDir(), Actor: d.username})
+	return nil
+}
+
+// Rename moves a file or collection; the handler clears the destination first when overwriting
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	source, err := d.resolve(oldName, accessModify, true)
+	if err != nil {
+		return err
+	}
+	target, err := d.resolve(newName, accessModify, true)
+	if err != nil {
+		return err
+	}
+	info, err := d.client.Lstat(source.Path)
+	if err != nil {
+		return err
+	}
+	if err := d.client.Rename(source.Path, target.Path); err != nil {
+		return err
+	}
+	d.files.publish(events.Event{Type: events.Moved, Path: target.Path, OldPath: source.Path, IsDir: info.IsDir(), Actor: d.username})
+	return nil
+}
+
+// Stat describes a file or collection
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	sc, err := d.resolve(name, accessBrowse, false)
+	if err != nil {
+		return nil, err
+	}
+	if sc.Virtual {
+		return virtualDirInfo(path.Base(sc.Prefix)), nil
+	}
+	return d.client.Stat(sc.Path)
+}
+
+// davFile adapts a remote file to webdav.File
+type davFile struct {
+	*sftp.File
+}
+
+// Readdir fails because a plain file has no entries
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+// davUpload writes to a temp file and moves it into place on Close
+type davUpload struct {
+	davFile
+	fs       *davFS
+	temp     string
+	target   string
+	replaced bool
+}
+
+// Close finishes the upload, replacing any existing file at the target
+func (f *davUpload) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		err = sftp.ReplaceRename(f.fs.client, f.temp, f.target)
+	}
+	if err != nil {
+		f.fs.client.Remove(f.temp)
+		return err
+	}
+	f.fs.files.publishWrite(f.fs.username, f.target, f.replaced)
+	return nil
+}
+
+// davDir is a collection opened for listing
+type davDir struct {
+	fs      *davFS
+	sc      scope
+	info    fs.FileInfo
+	entries []fs.FileInfo
+	loaded  bool
+}
+
+// load reads the collection's entries once, hiding temp uploads and adding virtual folders
+func (d *davDir) load() error {
+	if d.loaded {
+		return nil
+	}
+	d.loaded = true
+
+	if d.sc.Virtual {
+		var names []string
+		if d.sc.Prefix == "/"+GroupsDir {
+			for _, membership := range d.fs.files.Groups.Memberships(d.fs.username) {
+				names = append(names, membership.Group)
+			}
+		} else {
+			for _, m := range d.fs.files.mounts(d.fs.username) {
+				names = append(names, m.Name)
+			}
+		}
+		for _, name := range names {
+			d.entries = append(d.entries, virtualDirInfo(name))
+		}
+		return nil
+	}
+
+	// In the home folder, virtual folders take the place of real ones of the same name
+	home := d.sc.Prefix == "/" && d.sc.Path == d.sc.Root
+	if home {
+		d.fs.files.moveShadowedFolders(d.fs.client, d.fs.username)
+	}
+	entries, err := d.fs.client.ReadDir(d.sc.Path)
+	if err != nil {
+		return err
+	}
+	virtual := map[string]bool{}
+	if home {
+		for _, folder := range d.fs.files.virtualFolders(d.fs.username) {
+			virtual[folder.Name] = true
+			d.entries = append(d.entries, virtualDirInfo(folder.Name))
+		}
+	}
+	for _, entry := range entries {
+		if !sftp.IsTempUpload(entry.Name()) && !virtual[entry.Name()] {
+			d.entries = append(d.entries, entry)
+		}
+	}
+	return nil
+}
+
+// Readdir returns up to count entries, or all remaining ones when count <= 0
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+func (d *davDir) Stat() (fs.FileInfo, error)                   { return d.info, nil }
+func (d *davDir) Close() error                                 { return nil }
+func (d *davDir) Read([]byte) (int, error)                     { return 0, os.ErrInvalid }
+func (d *davDir) Write([]byte) (int, error)                    { return 0, os.ErrPermission }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+
+// virtualDirInfo describes a folder that exists only in the user's namespace
+type virtualDirInfo string
+
+func (v virtualDirInfo) Name() string       { return string(v) }
+func (v virtualDirInfo) Size() int64        { return 0 }
+func (v virtualDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (v virtualDirInfo) ModTime() time.Time { return time.Now() }
+func (v virtualDirInfo) IsDir() bool        { return true }
+func (v virtualDirInfo) Sys() any           { return nil }
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// davVirtualLockRoot keeps the locks on virtual folders apart from real paths.
+// No server path contains a NUL byte, so nothing real can ever fall below it.
+const davVirtualLockRoot = "/\x00virtual"
+
+// davLocks is one user's view of the lock system all WebDAV clients share.
+// Locks are kept by real server path: a folder reached through a grant or a group space
+// carries the same locks for everyone, while equal paths in different homes never collide.
+type davLocks struct {
+	locks    webdav.LockSystem
+	files    *FileController
+	username string
+}
+
+// lockName maps a user path onto the name its locks are kept under
+func (l *davLocks) lockName(name string) string {
+	if name == "" {
+		return ""
+	}
+	sc, err := l.files.resolvePath(l.username, name)
+	if err != nil || sc.Virtual {
+		// Virtual and unknown folders exist only in this user's namespace
+		return path.Join(davVirtualLockRoot, l.username, name)
+	}
+	return sc.Path
+}
+
+// userName maps a lock name back to where the user sees it
+func (l *davLocks) userName(name string) (string, bool) {
+	virtual := path.Join(davVirtualLockRoot, l.username)
+	if isWithin(virtual, name) {
+		return toUserPath(virtual, name), true
+	}
+	if strings.HasPrefix(name, davVirtualLockRoot+"/") {
+		return "", false
+	}
+	return l.files.visiblePath(l.username, name)
+}
+
+func (l *davLocks) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	return l.locks.Confirm(now, l.lockName(name0), l.lockName(name1), conditions...)
+}
+
+func (l *davLocks) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Root = l.lockName(details.Root)
+	return l.locks.Create(now, details)
+}
+
+func (l *davLocks) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := l.locks.Refresh(now, token, duration)
+	if err != nil {
+		return details, err
+	}
+	root, ok := l.userName(details.Root)
+	if !ok {
+		// The lock is on something this user can no longer see
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	details.Root = root
+	return details, nil
+}
+
+func (l *davLocks) Unlock(now time.Time, token string) error {
+	return l.locks.Unlock(now, token)
+}
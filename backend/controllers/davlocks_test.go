@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+	"manschko.com/cloud-storage/acl"
+)
+
+func newDavLocksTest(t *testing.T) (alice, bob *davLocks) {
+	t.Helper()
+	grants, err := acl.NewStore(filepath.Join(t.TempDir(), "grants.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := grants.Grant("alice", "/docs", "bob", acl.ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+	files := NewFileController("127.0.0.1", 0)
+	files.Grants = grants
+	shared := webdav.NewMemLS()
+	return &davLocks{locks: shared, files: files, username: "alice"}, &davLocks{locks: shared, files: files, username: "bob"}
+}
+
+func lock(t *testing.T, l *davLocks, root string) (string, error) {
+	t.Helper()
+	return l.Create(time.Now(), webdav.LockDetails{Root: root, Duration: time.Minute, ZeroDepth: true})
+}
+
+func TestDavLocksOfDifferentHomesDoNotCollide(t *testing.T) {
+	alice, bob := newDavLocksTest(t)
+	if _, err := lock(t, alice, "/report.docx"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lock(t, bob, "/report.docx"); err != nil {
+		t.Fatalf("bob's own /report.docx is locked by alice: %v", err)
+	}
+}
+
+func TestDavLocksFollowTheRealPath(t *testing.T) {
+	alice, bob := newDavLocksTest(t)
+	token, err := lock(t, alice, "/docs/plan.odt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lock(t, bob, "/Shared with me/docs/plan.odt"); err != webdav.ErrLocked {
+		t.Fatalf("bob locked the file alice holds: %v", err)
+	}
+	if _, err := bob.Confirm(time.Now(), "/Shared with me/docs/plan.odt", ""); err != webdav.ErrConfirmationFailed {
+		t.Fatalf("bob may write the file alice holds: %v", err)
+	}
+
+	// The lock root is reported as each user sees it
+	details, err := bob.Refresh(time.Now(), token, time.Minute)
+	if err != nil || details.Root != "/Shared with me/docs/plan.odt" {
+		t.Fatalf("Refresh() by bob = %q, %v", details.Root, err)
+	}
+	details, err = alice.Refresh(time.Now(), token, time.Minute)
+	if err != nil || details.Root != "/docs/plan.odt" {
+		t.Fatalf("Refresh() by alice = %q, %v", details.Root, err)
+	}
+}
+
+func TestDavLocksOnVirtualFoldersStayPrivate(t *testing.T) {
+	_, bob := newDavLocksTest(t)
+	token, err := lock(t, bob, "/Shared with me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	details, err := bob.Refresh(time.Now(), token, time.Minute)
+	if err != nil || details.Root != "/Shared with me" {
+		t.Fatalf("Refresh() = %q, %v", details.Root, err)
+	}
+}
@@ -0,0 +1,356 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+	"manschko.com/cloud-storage/events"
+	"manschko.com/cloud-storage/scanner"
+)
+
+// eventHeartbeat keeps idle streams alive through proxies that close quiet connections
+const eventHeartbeat = 25 * time.Second
+
+// resyncEvent tells a client it missed events and has to reload its listings
+const resyncEvent = "resync"
+
+// EventResponse is a change as the receiving user sees it
+type EventResponse struct {
+	ID      uint64 `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Path    string `json:"path,omitempty"`
+	OldPath string `json:"old_path,omitempty"`
+	IsDir   bool   `json:"is_dir,omitempty"`
+	Actor   string `json:"actor,omitempty"`
+	Time    string `json:"time,omitempty"`
+	// External changes were made directly on the SFTP server and noticed by the change scanner
+	External bool `json:"external,omitempty"`
+}
+
+// publish reports a change to event subscribers; it does nothing when events are disabled
+func (c *FileController) publish(e events.Event) {
+	if c.Events != nil {
+		c.Events.Publish(e)
+	}
+}
+
+// publishWrite reports a file written at real, replacing an earlier one when replaced is set
+func (c *FileController) publishWrite(actor, real string, replaced bool) {
+	typ := events.Created
+	if replaced {
+		typ = events.Modified
+	}
+	c.publish(events.Event{Type: typ, Path: real, Actor: actor})
+}
+
+// visiblePath maps a real path to where username sees it, if anywhere
+func (c *FileController) visiblePath(username, real string) (string, bool) {
+	if home := userRoot(username); isWithin(home, real) {
+		return toUserPath(home, real), true
+	}
+	for _, m := range c.mounts(username) {
+		root := scopePath(userRoot(m.Grant.Owner), m.Grant.Path)
+		if isWithin(root, real) {
+			return path.Join("/", SharedWithMeDir, m.Name, toUserPath(root, real)), true
+		}
+	}
+	if c.Groups != nil {
+		for _, membership := range c.Groups.Memberships(username) {
+			root := groupRoot(membership.Group)
+			if isWithin(root, real) {
+				return path.Join("/", GroupsDir, membership.Group, toUserPath(root, real)), true
+			}
+		}
+	}
+	return "", false
+}
+
+// NewChangeScanner creates a scanner that reports changes made directly on the SFTP server
+// to the controller's event broker
+func (c *FileController) NewChangeScanner(minInterval, maxInterval time.Duration, maxDirsPerCycle int) *scanner.Scanner {
+	return scanner.New(c.connect, c.Events, minInterval, maxInterval, maxDirsPerCycle)
+}
+
+// mountPoint is a folder from elsewhere on the server that appears in a user's namespace
+type mountPoint struct {
+	userPath string
+	real     string
+}
+
+// mountPoints lists the shared folders and group spaces username sees
+func (c *FileController) mountPoints(username string) []mountPoint {
+	var points []mountPoint
+	for _, m := range c.mounts(username) {
+		points = append(points, mountPoint{
+			userPath: path.Join("/", SharedWithMeDir, m.Name),
+			real:     scopePath(userRoot(m.Grant.Owner), m.Grant.Path),
+		})
+	}
+	if c.Groups != nil {
+		for _, membership := range c.Groups.Memberships(username) {
+			points = append(points, mountPoint{
+				userPath: path.Join("/", GroupsDir, membership.Group),
+				real:     groupRoot(membership.Group),
+			})
+		}
+	}
+	return points
+}
+
+// scanWatched has the change scanner watch the server folders behind watch.
+// Recursive watches also cover the shared folders and group spaces below them.
+func (c *FileController) scanWatched(username string, watch eventWatch) (release func()) {
+	if c.Scanner == nil {
+		return func() {}
+	}
+	var releases []func()
+	for _, dir := range watch.dirs {
+		if sc, err := c.resolvePath(username, dir); err == nil && !sc.Virtual {
+			releases = append(releases, c.Scanner.Watch(sc.Path, watch.recursive))
+		}
+		if !watch.recursive {
+			continue
+		}
+		for _, point := range c.mountPoints(username) {
+			if dir == "/" || within(point.userPath, dir) && point.userPath != dir {
+				releases = append(releases, c.Scanner.Watch(point.real, true))
+			}
+		}
+	}
+	return func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+}
+
+// eventWatch is the set of folders a client subscribed to
+type eventWatch struct {
+	dirs      []string
+	recursive bool
+}
+
+// matches reports whether a change at the user path p concerns one of the watched folders.
+// Without recursion a folder sees changes to itself and its direct entries.
+func (w eventWatch) matches(p string) bool {
+	for _, dir := range w.dirs {
+		switch {
+		case p == dir || path.Dir(p) == dir:
+			return true
+		case w.recursive && (dir == "/" || within(p, dir)):
+			return true
+		}
+	}
+	return false
+}
+
+// translate turns a server event into what username sees, or false when it concerns nothing they watch.
+// A move across the edge of what the user can see shows up as a create or delete.
+func (c *FileController) translate(username string, e events.Event, watch eventWatch) (EventResponse, bool) {
+	resp := EventResponse{
+		ID:    e.ID,
+		Type:  string(e.Type),
+		IsDir: e.IsDir,
+		Actor: e.Actor,
+		Time:  e.Time.Format(time.RFC3339),
+
+		External: e.External,
+	}
+	newPath, newOK := c.visiblePath(username, e.Path)
+
+	if e.Type != events.Moved {
+		resp.Path = newPath
+		return resp, newOK && watch.matches(newPath)
+	}
+
+	oldPath, oldOK := c.visiblePath(username, e.OldPath)
+	switch {
+	case newOK && oldOK:
+		resp.Path, resp.OldPath = newPath, oldPath
+		return resp, watch.matches(newPath) || watch.matches(oldPath)
+	case newOK:
+		resp.Type, resp.Path = string(events.Created), newPath
+		return resp, watch.matches(newPath)
+	case oldOK:
+		resp.Type, resp.Path = string(events.Deleted), oldPath
+		return resp, watch.matches(oldPath)
+	}
+	return resp, false
+}
+
+// eventSink writes events to one client connection
+type eventSink interface {
+	send(event EventResponse) error
+	heartbeat() error
+}
+
+// sseSink writes Server-Sent Events. Every event is a plain message with its type in the data,
+// and its ID lets EventSource resume with Last-Event-ID after a reconnect.
+type sseSink struct {
+	w gin.ResponseWriter
+}
+
+func (s sseSink) send(event EventResponse) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.ID != 0 {
+		if _, err := fmt.Fprintf(s.w, "id: %d\n", event.ID); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	s.w.Flush()
+	return nil
+}
+
+func (s sseSink) heartbeat() error {
+	if _, err := fmt.Fprint(s.w, ": heartbeat\n\n"); err != nil {
+		return err
+	}
+	s.w.Flush()
+	return nil
+}
+
+// wsSink writes each event as one JSON text message
+type wsSink struct {
+	conn *websocket.Conn
+}
+
+func (s wsSink) send(event EventResponse) error {
+	return websocket.JSON.Send(s.conn, event)
+}
+
+func (s wsSink) heartbeat() error {
+	return websocket.JSON.Send(s.conn, EventResponse{Type: "heartbeat"})
+}
+
+// parseEventWatch reads the folders to watch from repeated path parameters, defaulting to everything
+func (c *FileController) parseEventWatch(ctx *gin.Context) (eventWatch, bool) {
+	var watch eventWatch
+	if value := ctx.Query("recursive"); value != "" {
+		recursive, err := strconv.ParseBool(value)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "recursive must be true or false"})
+			return watch, false
+		}
+		watch.recursive = recursive
+	}
+
+	dirs := ctx.QueryArray("path")
+	if len(dirs) == 0 {
+		return eventWatch{dirs: []string{"/"}, recursive: true}, true
+	}
+	for _, dir := range dirs {
+		if _, ok := c.resolve(ctx, dir, accessBrowse); !ok {
+			return watch, false
+		}
+		watch.dirs = append(watch.dirs, path.Join("/", dir))
+	}
+	return watch, true
+}
+
+// lastEventID is where a reconnecting client left off, from the header EventSource sends or a query parameter
+func lastEventID(ctx *gin.Context) uint64 {
+	value := firstNonEmpty(ctx.GetHeader("Last-Event-ID"), ctx.Query("last_event_id"))
+	id, _ := strconv.ParseUint(value, 10, 64)
+	return id
+}
+
+// StreamEvents streams changes to the folders the client watches, as Server-Sent Events
+// or, when the request asks for an upgrade, over a WebSocket
+func (c *FileController) StreamEvents(ctx *gin.Context) {
+	if c.Events == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Change notifications are disabled"})
+		return
+	}
+	username := ctx.GetString("username")
+	watch, ok := c.parseEventWatch(ctx)
+	if !ok {
+		return
+	}
+
+	sub, replay, complete := c.Events.Subscribe(lastEventID(ctx))
+	defer sub.Close()
+	defer c.scanWatched(username, watch)()
+
+	if strings.EqualFold(ctx.GetHeader("Upgrade"), "websocket") {
+		server := websocket.Server{
+			// The stream is authenticated by token rather than cookies, so any origin may connect
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(conn *websocket.Conn) {
+				streamCtx, cancel := context.WithCancel(ctx.Request.Context())
+				defer cancel()
+				go func() {
+					// Clients never send anything; reading only notices when they hang up
+					var discard []byte
+					for websocket.Message.Receive(conn, &discard) == nil {
+					}
+					cancel()
+				}()
+				c.streamEvents(streamCtx, username, watch, sub, replay, complete, wsSink{conn: conn})
+			},
+		}
+		server.ServeHTTP(ctx.Writer, ctx.Request)
+		return
+	}
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Flush()
+	c.streamEvents(ctx.Request.Context(), username, watch, sub, replay, complete, sseSink{w: ctx.Writer})
+}
+
+// streamEvents delivers the replayed and then the live events until the client goes away
+// or falls so far behind that it was dropped, in which case it is told to resync
+func (c *FileController) streamEvents(ctx context.Context, username string, watch eventWatch, sub *events.Subscription, replay []events.Event, complete bool, sink eventSink) {
+	if !complete {
+		if sink.send(EventResponse{Type: resyncEvent}) != nil {
+			return
+		}
+	}
+	for _, e := range replay {
+		if resp, ok := c.translate(username, e, watch); ok {
+			if sink.send(resp) != nil {
+				return
+			}
+		}
+	}
+
+	ticker := time.NewTicker(eventHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if sink.heartbeat() != nil {
+				return
+			}
+		case e, open := <-sub.C:
+			if !open {
+				sink.send(EventResponse{Type: resyncEvent})
+				return
+			}
+			if resp, ok := c.translate(username, e, watch); ok {
+				if sink.send(resp) != nil {
+					return
+				}
+			}
+		}
+	}
+}
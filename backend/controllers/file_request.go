@@ -0,0 +1,429 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/auth"
+	"manschko.com/cloud-storage/sftp"
+	"manschko.com/cloud-storage/shares"
+	"manschko.com/cloud-storage/throttle"
+)
+
+// maxUploaderNameLength keeps uploader prefixes from dominating file names
+const maxUploaderNameLength = 40
+
+const (
+	// maxFilesPerSubmission bounds one submission to a link that only limits the size of each file
+	maxFilesPerSubmission = 20
+	// multipartOverhead allows for the part headers and boundaries around the file contents
+	multipartOverhead = 64 << 10
+)
+
+// CreateFileRequestRequest describes a new upload-only link
+type CreateFileRequestRequest struct {
+	Path              string   `json:"path" binding:"required"`
+	Title             string   `json:"title"`
+	Password          string   `json:"password"`
+	MaxFileSize       int64    `json:"max_file_size"`
+	MaxTotalSize      int64    `json:"max_total_size"`
+	AllowedExtensions []string `json:"allowed_extensions"`
+	PrefixUploader    bool     `json:"prefix_uploader"`
+	PrefixDate        bool     `json:"prefix_date"`
+	ExpiresAt         string   `json:"expires_at"` // RFC 3339
+	ExpiresIn         int64    `json:"expires_in"` // seconds, alternative to ExpiresAt
+}
+
+// FileRequestResponse is how a file request and its arrivals are shown to the owner
+type FileRequestResponse struct {
+	ID                string           `json:"id"`
+	URL               string           `json:"url"`
+	Token             string           `json:"token"`
+	Path              string           `json:"path"`
+	Title             string           `json:"title,omitempty"`
+	HasPassword       bool             `json:"has_password"`
+	MaxFileSize       int64            `json:"max_file_size,omitempty"`
+	MaxTotalSize      int64            `json:"max_total_size,omitempty"`
+	AllowedExtensions []string         `json:"allowed_extensions,omitempty"`
+	PrefixUploader    bool             `json:"prefix_uploader"`
+	PrefixDate        bool             `json:"prefix_date"`
+	CreatedAt         time.Time        `json:"created_at"`
+	ExpiresAt         *time.Time       `json:"expires_at,omitempty"`
+	FileCount         int              `json:"file_count"`
+	ReceivedBytes     int64            `json:"received_bytes"`
+	Uploaders         []string         `json:"uploaders"`
+	LastArrivalAt     *time.Time       `json:"last_arrival_at,omitempty"`
+	Arrivals          []shares.Arrival `json:"arrivals,omitempty"`
+}
+
+// FileRequestController manages upload-only links and accepts anonymous uploads through them
+type FileRequestController struct {
+	Files    *FileController
+	Requests *shares.RequestStore
+
+	// Guard throttles password guessing per link and address; nil disables it
+	Guard *auth.LoginGuard
+}
+
+// NewFileRequestController creates a new file request controller
+func NewFileRequestController(files *FileController, store *shares.RequestStore) *FileRequestController {
+	return &FileRequestController{
+		Files:    files,
+		Requests: store,
+	}
+}
+
+// newFileRequestResponse summarises a file request; arrivals are only listed when withArrivals is set
+func newFileRequestResponse(request shares.FileRequest, withArrivals bool) FileRequestResponse {
+	resp := FileRequestResponse{
+		ID:                request.ID,
+		URL:               "/r/" + request.Token,
+		Token:             request.Token,
+		Path:              request.Path,
+		Title:             request.Title,
+		HasPassword:       request.HasPassword(),
+		MaxFileSize:       request.MaxFileSize,
+		MaxTotalSize:      request.MaxTotalSize,
+		AllowedExtensions: request.AllowedExtensions,
+		PrefixUploader:    request.PrefixUploader,
+		PrefixDate:        request.PrefixDate,
+		CreatedAt:         request.CreatedAt,
+		ExpiresAt:         request.ExpiresAt,
+		FileCount:         len(request.Arrivals),
+		ReceivedBytes:     request.ReceivedBytes(),
+		Uploaders:         []string{},
+	}
+
+	seen := map[string]bool{}
+	for _, arrival := range request.Arrivals {
+		if arrival.Uploader != "" && !seen[arrival.Uploader] {
+			seen[arrival.Uploader] = true
+			resp.Uploaders = append(resp.Uploaders, arrival.Uploader)
+		}
+		if resp.LastArrivalAt == nil || arrival.ReceivedAt.After(*resp.LastArrivalAt) {
+			receivedAt := arrival.ReceivedAt
+			resp.LastArrivalAt = &receivedAt
+		}
+	}
+	if withArrivals {
+		resp.Arrivals = request.Arrivals
+	}
+	return resp
+}
+
+// sanitizeUploaderName keeps uploader names safe to embed in a file name
+func sanitizeUploaderName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(name) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_':
+			b.WriteRune(r)
+		case unicode.IsSpace(r) || r == '.':
+			b.WriteRune('_')
+		}
+		if b.Len() >= maxUploaderNameLength {
+			break
+		}
+	}
+	return b.String()
+}
+
+// prefixedName applies the request's automatic name prefixes
+func prefixedName(request *shares.FileRequest, name, uploader string, now time.Time) string {
+	var parts []string
+	if request.PrefixDate {
+		parts = append(parts, now.Format("2006-01-02"))
+	}
+	if request.PrefixUploader && uploader != "" {
+		parts = append(parts, uploader)
+	}
+	return strings.Join(append(parts, name), "_")
+}
+
+// CreateFileRequest creates an upload-only link into a folder of the authenticated user
+func (c *FileRequestController) CreateFileRequest(ctx *gin.Context) {
+	var requestReq CreateFileRequestRequest
+	if err := ctx.ShouldBindJSON(&requestReq); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if requestReq.MaxFileSize < 0 || requestReq.MaxTotalSize < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Size limits must not be negative"})
+		return
+	}
+	expiresAt, err := parseExpiry(requestReq.ExpiresAt, requestReq.ExpiresIn)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	username := ctx.GetString("username")
+	scopedPath, err := getUserScopedPath(ctx, requestReq.Path)
+	if errors.Is(err, errTokenPath) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "This access token is not valid for the path"})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	client, err := c.Files.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	if !confined(ctx, client, scopedPath) {
+		return
+	}
+	info, err := client.Stat(scopedPath)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Failed to get file info: %v", err)})
+		return
+	}
+	if !info.IsDir() {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "File requests must point at a folder"})
+		return
+	}
+
+	request, err := c.Requests.Create(username, shares.RequestOptions{
+		Path:              toUserPath(userRoot(username), scopedPath),
+		Title:             requestReq.Title,
+		Password:          requestReq.Password,
+		MaxFileSize:       requestReq.MaxFileSize,
+		MaxTotalSize:      requestReq.MaxTotalSize,
+		AllowedExtensions: requestReq.AllowedExtensions,
+		PrefixUploader:    requestReq.PrefixUploader,
+		PrefixDate:        requestReq.PrefixDate,
+		ExpiresAt:         expiresAt,
+	})
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create file request: %v", err)})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, newFileRequestResponse(*request, false))
+}
+
+// ListFileRequests lists the authenticated user's file requests with arrival summaries
+func (c *FileRequestController) ListFileRequests(ctx *gin.Context) {
+	list := []FileRequestResponse{}
+	for _, request := range c.Requests.ListByOwner(ctx.GetString("username")) {
+		list = append(list, newFileRequestResponse(request, false))
+	}
+	ctx.JSON(http.StatusOK, list)
+}
+
+// GetFileRequest returns one file request with every arrival
+func (c *FileRequestController) GetFileRequest(ctx *gin.Context) {
+	request, err := c.Requests.GetByOwner(ctx.GetString("username"), ctx.Param("id"))
+	if errors.Is(err, shares.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "File request not found"})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, newFileRequestResponse(*request, true))
+}
+
+// RevokeFileRequest deletes one of the authenticated user's file requests
+func (c *FileRequestController) RevokeFileRequest(ctx *gin.Context) {
+	err := c.Requests.Revoke(ctx.GetString("username"), ctx.Param("id"))
+	if errors.Is(err, shares.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "File request not found"})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to revoke file request: %v", err)})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "File request revoked"})
+}
+
+// openFileRequest authenticates a visitor against a file request and writes the error response on failure.
+// The password is only taken from the X-Share-Password header, so the link is checked before any body is read.
+func (c *FileRequestController) openFileRequest(ctx *gin.Context) (*shares.FileRequest, bool) {
+	token, password := ctx.Param("token"), ctx.GetHeader("X-Share-Password")
+	var request *shares.FileRequest
+	var err error
+	if password == "" {
+		request, err = c.Requests.Open(token, password)
+	} else {
+		err = c.Guard.AttemptShare(ctx.ClientIP(), token, func() (err error) {
+			request, err = c.Requests.Open(token, password)
+			if errors.Is(err, shares.ErrInvalidPassword) {
+				return fmt.Errorf("%w: %w", auth.ErrInvalidCredentials, err)
+			}
+			return err
+		})
+	}
+	if err != nil {
+		respondShareError(ctx, err)
+		return nil, false
+	}
+	return request, true
+}
+
+// DescribeFileRequest tells a visitor what the link accepts, without revealing any folder contents
+func (c *FileRequestController) DescribeFileRequest(ctx *gin.Context) {
+	request, ok := c.openFileRequest(ctx)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"title":              request.Title,
+		"max_file_size":      request.MaxFileSize,
+		"allowed_extensions": request.AllowedExtensions,
+		"expires_at":         request.ExpiresAt,
+	})
+}
+
+// SubmitFiles accepts anonymous uploads into the file request's folder.
+// Name clashes are always resolved by renaming so visitors can never replace or probe existing files.
+func (c *FileRequestController) SubmitFiles(ctx *gin.Context) {
+	request, ok := c.openFileRequest(ctx)
+	if !ok {
+		return
+	}
+	account := throttle.Account{Share: request.ID}
+	release, ok := c.Files.beginTransfer(ctx, account)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Anonymous visitors must not be able to spool more to disk than the link accepts
+	if limit := submissionLimit(request); limit > 0 {
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, limit)
+	}
+	if err := ctx.Request.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Submission exceeds the size limit of the file request"})
+			return
+		}
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse form"})
+		return
+	}
+
+	headers := ctx.Request.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get file from form"})
+		return
+	}
+	uploader := sanitizeUploaderName(ctx.PostForm("uploader_name"))
+	folder := scopePath(userRoot(request.Owner), request.Path)
+
+	client, err := c.Files.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	if !confinedTo(ctx, client, userRoot(request.Owner), folder) {
+		return
+	}
+
+	var received []gin.H
+	for _, header := range headers {
+		originalName, err := uploadName(header.Filename)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "received": received})
+			return
+		}
+		if err := c.Requests.Reserve(request.Token, originalName, header.Size); err != nil {
+			respondFileRequestLimit(ctx, err, originalName, received)
+			return
+		}
+
+		now := time.Now().UTC()
+		target := filepath.ToSlash(filepath.Join(folder, prefixedName(request, originalName, uploader, now)))
+		res, err := resolveConflict(client, target, ConflictRename)
+		if err != nil {
+			c.Requests.Release(request.Token, header.Size)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check destination: %v", err), "received": received})
+			return
+		}
+		// Whatever the name, the file lands directly in the drop folder
+		if path.Dir(res.Path) != folder {
+			c.Requests.Release(request.Token, header.Size)
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid file name %q", header.Filename), "received": received})
+			return
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			c.Requests.Release(request.Token, header.Size)
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read uploaded file", "received": received})
+			return
+		}
+		src := c.Files.limitReader(ctx, file, throttle.Upload, account)
+		if request.MaxFileSize > 0 {
+			// Never trust the declared size alone
+			src = io.LimitReader(src, request.MaxFileSize+1)
+		}
+		written, err := sftp.WriteAtomic(client, res.Path, src, sftp.UploadOptions{ExpectedSize: header.Size})
+		file.Close()
+		if err != nil {
+			c.Requests.Release(request.Token, header.Size)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to upload file: %v", err), "received": received})
+			return
+		}
+
+		name := filepath.Base(res.Path)
+		if err := c.Requests.RecordArrival(request.Token, header.Size, shares.Arrival{
+			Name:         name,
+			OriginalName: originalName,
+			Size:         written,
+			Uploader:     uploader,
+			RemoteAddr:   ctx.ClientIP(),
+			ReceivedAt:   now,
+		}); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to record upload: %v", err), "received": received})
+			return
+		}
+		c.Files.publishWrite("", res.Path, false)
+		received = append(received, gin.H{"name": name, "size": written})
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "Files received", "received": received})
+}
+
+// submissionLimit is the largest body a submission to request may have: what is left of its total quota,
+// or else a batch of files of the maximum size. Zero means the link sets no size limit.
+func submissionLimit(request *shares.FileRequest) int64 {
+	switch {
+	case request.MaxTotalSize > 0:
+		return request.RemainingBytes() + multipartOverhead
+	case request.MaxFileSize > 0:
+		return request.MaxFileSize*maxFilesPerSubmission + multipartOverhead
+	}
+	return 0
+}
+
+// respondFileRequestLimit explains which limit an upload broke
+func respondFileRequestLimit(ctx *gin.Context, err error, name string, received []gin.H) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, shares.ErrFileTooLarge), errors.Is(err, shares.ErrQuotaExceeded):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, shares.ErrExtensionNotAllowed):
+		status = http.StatusUnsupportedMediaType
+	case errors.Is(err, shares.ErrNotFound):
+		status = http.StatusNotFound
+	}
+	ctx.JSON(status, gin.H{"error": err.Error(), "file": name, "received": received})
+}
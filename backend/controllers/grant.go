@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/acl"
+)
+
+// CreateGrantRequest shares one of the user's folders with another user
+type CreateGrantRequest struct {
+	Path       string `json:"path" binding:"required"`
+	Grantee    string `json:"grantee" binding:"required"`
+	Permission string `json:"permission"` // read (default) or read-write
+}
+
+// GrantResponse is how a grant is shown to its owner or grantee
+type GrantResponse struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner"`
+	Path       string    `json:"path"`
+	Grantee    string    `json:"grantee"`
+	Permission string    `json:"permission"`
+	MountPath  string    `json:"mount_path,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// GrantController manages folders shared between users
+type GrantController struct {
+	Files  *FileController
+	Grants *acl.Store
+}
+
+// NewGrantController creates a new grant controller
+func NewGrantController(files *FileController, store *acl.Store) *GrantController {
+	return &GrantController{
+		Files:  files,
+		Grants: store,
+	}
+}
+
+func newGrantResponse(grant acl.Grant) GrantResponse {
+	return GrantResponse{
+		ID:         grant.ID,
+		Owner:      grant.Owner,
+		Path:       grant.Path,
+		Grantee:    grant.Grantee,
+		Permission: string(grant.Permission),
+		CreatedAt:  grant.CreatedAt,
+	}
+}
+
+// CreateGrant gives another user read or read-write access to a folder of the authenticated user
+func (c *GrantController) CreateGrant(ctx *gin.Context) {
+	var grantReq CreateGrantRequest
+	if err := ctx.ShouldBindJSON(&grantReq); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	permission := acl.Read
+	if grantReq.Permission != "" {
+		var err error
+		if permission, err = acl.ParsePermission(grantReq.Permission); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	username := ctx.GetString("username")
+	grantee := strings.TrimSpace(grantReq.Grantee)
+	if grantee == "" || strings.ContainsAny(grantee, "/\\") || grantee == "." || grantee == ".." {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid grantee"})
+		return
+	}
+	if grantee == username {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Cannot share a folder with yourself"})
+		return
+	}
+
+	// Only folders the user owns can be shared on, never mounts shared with them
+	scopedPath, err := getUserScopedPath(ctx, grantReq.Path)
+	if errors.Is(err, errTokenPath) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "This access token is not valid for the path"})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	client, err := c.Files.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	if !confined(ctx, client, scopedPath) {
+		return
+	}
+	info, err := client.Stat(scopedPath)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Failed to get file info: %v", err)})
+		return
+	}
+	if !info.IsDir() {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Only folders can be shared with other users"})
+		return
+	}
+	if _, err := client.Stat(userRoot(grantee)); err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	grant, err := c.Grants.Grant(username, toUserPath(userRoot(username), scopedPath), grantee, permission)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to share folder: %v", err)})
+		return
+	}
+	// A folder of the grantee named like the virtual folder would no longer be reachable
+	c.Files.moveShadowedFolders(client, grantee)
+
+	ctx.JSON(http.StatusCreated, newGrantResponse(*grant))
+}
+
+// ListGrants lists what the authenticated user has shared and with whom
+func (c *GrantController) ListGrants(ctx *gin.Context) {
+	list := []GrantResponse{}
+	for _, grant := range c.Grants.ListByOwner(ctx.GetString("username")) {
+		list = append(list, newGrantResponse(grant))
+	}
+	ctx.JSON(http.StatusOK, list)
+}
+
+// ListSharedWithMe lists the folders other users shared with the authenticated user
+func (c *GrantController) ListSharedWithMe(ctx *gin.Context) {
+	list := []GrantResponse{}
+	for _, m := range c.Files.mounts(ctx.GetString("username")) {
+		resp := newGrantResponse(m.Grant)
+		resp.MountPath = "/" + SharedWithMeDir + "/" + m.Name
+		list = append(list, resp)
+	}
+	ctx.JSON(http.StatusOK, list)
+}
+
+// RevokeGrant withdraws one of the authenticated user's grants
+func (c *GrantController) RevokeGrant(ctx *gin.Context) {
+	err := c.Grants.Revoke(ctx.GetString("username"), ctx.Param("id"))
+	if errors.Is(err, acl.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Grant not found"})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to revoke grant: %v", err)})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Access revoked"})
+}
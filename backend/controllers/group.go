@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/auth"
+	"manschko.com/cloud-storage/groups"
+)
+
+// CreateGroupRequest describes a new group space
+type CreateGroupRequest struct {
+	Name    string `json:"name" binding:"required"`
+	Manager string `json:"manager"` // optional first manager
+}
+
+// SetMemberRequest adds a member or changes their role
+type SetMemberRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// GroupResponse is how a group is shown to admins and its members
+type GroupResponse struct {
+	groups.Group
+	Path string      `json:"path"`
+	Role groups.Role `json:"role,omitempty"`
+}
+
+// GroupController manages group spaces and their memberships
+type GroupController struct {
+	Files  *FileController
+	Groups *groups.Store
+	Admins []string
+}
+
+// NewGroupController creates a new group controller
+func NewGroupController(files *FileController, store *groups.Store, admins []string) *GroupController {
+	return &GroupController{
+		Files:  files,
+		Groups: store,
+		Admins: admins,
+	}
+}
+
+// isAdmin reports whether the authenticated user may manage every group
+func (c *GroupController) isAdmin(ctx *gin.Context) bool {
+	if auth.Permits(ctx.GetStringSlice("roles"), auth.PermAdmin) {
+		return true
+	}
+	username := ctx.GetString("username")
+	for _, admin := range c.Admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+func newGroupResponse(group groups.Group, username string) GroupResponse {
+	return GroupResponse{
+		Group: group,
+		Path:  "/" + GroupsDir + "/" + group.Name,
+		Role:  group.Members[username],
+	}
+}
+
+// respondGroupError maps group store errors onto HTTP responses
+func respondGroupError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, groups.ErrNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+	case errors.Is(err, groups.ErrNotMember):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+	case errors.Is(err, groups.ErrExists):
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Group already exists"})
+	case errors.Is(err, groups.ErrInvalidName), errors.Is(err, groups.ErrInvalidRole):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, groups.ErrLastManager):
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to update group: %v", err)})
+	}
+}
+
+// authorize loads a group the user may see; managing it requires the manager role or admin rights.
+// It writes the error response itself and returns false when the request must stop.
+func (c *GroupController) authorize(ctx *gin.Context, manage bool) (*groups.Group, bool) {
+	username := ctx.GetString("username")
+	group, err := c.Groups.Get(ctx.Param("name"))
+	if err != nil {
+		respondGroupError(ctx, err)
+		return nil, false
+	}
+	if c.isAdmin(ctx) {
+		return group, true
+	}
+	role, member := group.Members[username]
+	if !member {
+		// Non-members cannot tell a foreign group from a missing one
+		respondGroupError(ctx, groups.ErrNotFound)
+		return nil, false
+	}
+	if manage && role != groups.Manager {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Only group managers can change memberships"})
+		return nil, false
+	}
+	return group, true
+}
+
+// CreateGroup creates a group and its folder on the server; admins only
+func (c *GroupController) CreateGroup(ctx *gin.Context) {
+	username := ctx.GetString("username")
+	if !c.isAdmin(ctx) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Only administrators can create groups"})
+		return
+	}
+
+	var groupReq CreateGroupRequest
+	if err := ctx.ShouldBindJSON(&groupReq); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !groups.ValidName(groupReq.Name) {
+		respondGroupError(ctx, groups.ErrInvalidName)
+		return
+	}
+
+	client, err := c.Files.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	if err := client.MkdirAll(groupRoot(groupReq.Name)); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create group folder: %v", err)})
+		return
+	}
+
+	group, err := c.Groups.Create(groupReq.Name, username)
+	if err != nil {
+		respondGroupError(ctx, err)
+		return
+	}
+	if groupReq.Manager != "" {
+		if group, err = c.Groups.SetMember(group.Name, groupReq.Manager, groups.Manager); err != nil {
+			respondGroupError(ctx, err)
+			return
+		}
+		c.Files.moveShadowedFoldersOf(groupReq.Manager)
+	}
+
+	ctx.JSON(http.StatusCreated, newGroupResponse(*group, username))
+}
+
+// ListGroups lists every group for admins and the user's own groups otherwise
+func (c *GroupController) ListGroups(ctx *gin.Context) {
+	username := ctx.GetString("username")
+	list := []GroupResponse{}
+	for _, group := range c.Groups.List() {
+		if _, member := group.Members[username]; member || c.isAdmin(ctx) {
+			list = append(list, newGroupResponse(group, username))
+		}
+	}
+	ctx.JSON(http.StatusOK, list)
+}
+
+// GetGroup shows a group with its members
+func (c *GroupController) GetGroup(ctx *gin.Context) {
+	group, ok := c.authorize(ctx, false)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, newGroupResponse(*group, ctx.GetString("username")))
+}
+
+// DeleteGroup removes a group; its folder is kept on the server. Admins only.
+func (c *GroupController) DeleteGroup(ctx *gin.Context) {
+	if !c.isAdmin(ctx) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Only administrators can delete groups"})
+		return
+	}
+	if err := c.Groups.Delete(ctx.Param("name")); err != nil {
+		respondGroupError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Group deleted"})
+}
+
+// SetMember adds a user to a group or changes their role
+func (c *GroupController) SetMember(ctx *gin.Context) {
+	var memberReq SetMemberRequest
+	if err := ctx.ShouldBindJSON(&memberReq); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	role, err := groups.ParseRole(memberReq.Role)
+	if err != nil {
+		respondGroupError(ctx, err)
+		return
+	}
+
+	group, ok := c.authorize(ctx, true)
+	if !ok {
+		return
+	}
+	group, err = c.Groups.SetMember(group.Name, ctx.Param("username"), role)
+	if err != nil {
+		respondGroupError(ctx, err)
+		return
+	}
+	// A folder of the member named like the virtual folder would no longer be reachable
+	c.Files.moveShadowedFoldersOf(ctx.Param("username"))
+	ctx.JSON(http.StatusOK, newGroupResponse(*group, ctx.GetString("username")))
+}
+
+// RemoveMember takes a user out of a group
+func (c *GroupController) RemoveMember(ctx *gin.Context) {
+	group, ok := c.authorize(ctx, true)
+	if !ok {
+		return
+	}
+	group, err := c.Groups.RemoveMember(group.Name, ctx.Param("username"))
+	if err != nil {
+		respondGroupError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, newGroupResponse(*group, ctx.GetString("username")))
+}
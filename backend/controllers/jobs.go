@@ -0,0 +1,723 @@
+package controllers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/auth"
+	"manschko.com/cloud-storage/events"
+	"manschko.com/cloud-storage/jobs"
+	"manschko.com/cloud-storage/sftp"
+)
+
+// Job kinds
+const (
+	JobDelete  = "delete"
+	JobCopy    = "copy"
+	JobArchive = "archive"
+	JobExtract = "extract"
+)
+
+// maxJobPaths bounds how many paths one delete or archive job may name
+const maxJobPaths = 1000
+
+// jobStreamInterval spaces out progress updates on a job stream
+const jobStreamInterval = 500 * time.Millisecond
+
+// JobRequest submits a long-running file operation.
+// delete removes Paths; copy copies Source to Destination; archive zips Paths into
+// the file Destination; extract unpacks the zip file Source into the folder Destination.
+type JobRequest struct {
+	Kind        string   `json:"kind" binding:"required"`
+	Paths       []string `json:"paths"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	OnConflict  string   `json:"on_conflict"`
+}
+
+// JobResponse is a job with an estimate of the time it still needs
+type JobResponse struct {
+	jobs.Job
+	ETASeconds *int64 `json:"eta_seconds,omitempty"`
+}
+
+func newJobResponse(job jobs.Job) JobResponse {
+	resp := JobResponse{Job: job}
+	if eta, ok := job.ETA(); ok {
+		seconds := int64(eta.Round(time.Second) / time.Second)
+		resp.ETASeconds = &seconds
+	}
+	return resp
+}
+
+// JobController runs recursive deletes, copies and archive operations in the background
+type JobController struct {
+	Files *FileController
+	Jobs  *jobs.Manager
+	Pool  *sftp.Pool
+}
+
+// NewJobController creates a new job controller
+func NewJobController(files *FileController, manager *jobs.Manager, pool *sftp.Pool) *JobController {
+	return &JobController{Files: files, Jobs: manager, Pool: pool}
+}
+
+// NewSessionPool creates a pool of up to size SFTP sessions with the service account
+func (c *FileController) NewSessionPool(size int) *sftp.Pool {
+	return sftp.NewPool(c.getSFTPConnection, size)
+}
+
+// withClient runs fn on a pooled session. A session that saw an error is closed
+// rather than reused, since an interrupted transfer can leave it in an unknown state.
+func (c *JobController) withClient(ctx context.Context, fn func(client *sftp.Client) (string, error)) (string, error) {
+	client, err := c.Pool.Get(ctx)
+	if err != nil {
+		return "", fmt.Errorf("SFTP connection error: %v", err)
+	}
+	result, err := fn(client)
+	c.Pool.Put(client, err != nil)
+	return result, err
+}
+
+// treeEntry is one entry found below a job's source
+type treeEntry struct {
+	path string
+	info os.FileInfo
+}
+
+// walkTree lists root and everything below it, parents before their children.
+// Symlinks are listed but never followed, and in-progress uploads are left out.
+func walkTree(ctx context.Context, client *sftp.Client, root string) ([]treeEntry, error) {
+	var entries []treeEntry
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+		if sftp.IsTempUpload(walker.Stat().Name()) {
+			continue
+		}
+		entries = append(entries, treeEntry{path: walker.Path(), info: walker.Stat()})
+	}
+	return entries, nil
+}
+
+// treeSize counts the entries and the bytes in regular files of a tree
+func treeSize(entries []treeEntry) (items, bytes int64) {
+	for _, e := range entries {
+		items++
+		if e.info.Mode().IsRegular() {
+			bytes += e.info.Size()
+		}
+	}
+	return items, bytes
+}
+
+// jobReader counts the bytes a job transfers and stops it once the job is canceled
+type jobReader struct {
+	ctx      context.Context
+	r        io.Reader
+	progress *jobs.Reporter
+}
+
+func (r *jobReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.progress.AddBytes(int64(n))
+	}
+	return n, err
+}
+
+// copyFile copies the regular file source to target through a temp file
+func copyFile(ctx context.Context, client *sftp.Client, source, target string, size int64, overwrite bool, progress *jobs.Reporter) error {
+	f, err := client.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = sftp.WriteAtomic(client, target, &jobReader{ctx: ctx, r: f, progress: progress}, sftp.UploadOptions{
+		Overwrite:    overwrite,
+		ExpectedSize: size,
+	})
+	return err
+}
+
+// jobError explains why a job cannot use a path, in terms of what the user sees
+func jobError(sc scope, err error) error {
+	if errors.Is(err, errOutsideRoot) {
+		return fmt.Errorf("%s is outside of your storage", sc.userPath(sc.Path))
+	}
+	return fmt.Errorf("%s: %v", sc.userPath(sc.Path), err)
+}
+
+// jobTarget applies the conflict policy to the file or folder a job creates.
+// Only a file may be overwritten, and only by a file, so that a job never deletes a tree it was not asked to.
+func jobTarget(client *sftp.Client, target scope, policy ConflictPolicy, isDir bool) (*conflictResolution, error) {
+	res, err := resolveConflict(client, target.Path, policy)
+	if errors.Is(err, errConflict) {
+		return nil, fmt.Errorf("%s already exists", target.userPath(target.Path))
+	}
+	if err != nil {
+		return nil, jobError(target, err)
+	}
+	if res.Overwrite && (isDir || res.Existing.IsDir()) {
+		return nil, fmt.Errorf("%s already exists and cannot be replaced", target.userPath(target.Path))
+	}
+	return res, nil
+}
+
+// deleteJob removes each target with everything below it
+func (c *JobController) deleteJob(actor string, targets []scope) jobs.Func {
+	return func(ctx context.Context, progress *jobs.Reporter) (string, error) {
+		return c.withClient(ctx, func(client *sftp.Client) (string, error) {
+			trees := make([][]treeEntry, len(targets))
+			var total int64
+			for i, sc := range targets {
+				// Deleting a symlink removes the link itself, so only its parent has to be inside root
+				if err := ensureWithinRoot(client, sc.Root, sc.parentDir()); err != nil {
+					return "", jobError(sc, err)
+				}
+				entries, err := walkTree(ctx, client, sc.Path)
+				if err != nil {
+					return "", jobError(sc, err)
+				}
+				trees[i] = entries
+				items, _ := treeSize(entries)
+				total += items
+			}
+			progress.SetTotal(total, 0)
+
+			for i, sc := range targets {
+				entries := trees[i]
+				// Children come after their parents, so going backwards empties every folder before removing it
+				for j := len(entries) - 1; j >= 0; j-- {
+					if err := ctx.Err(); err != nil {
+						return "", err
+					}
+					var err error
+					if entries[j].info.IsDir() {
+						err = client.RemoveDirectory(entries[j].path)
+					} else {
+						err = client.Remove(entries[j].path)
+					}
+					if err != nil {
+						return "", fmt.Errorf("failed to delete %s: %v", sc.userPath(entries[j].path), err)
+					}
+					progress.AddItems(1)
+				}
+				if len(entries) > 0 {
+					c.Files.publish(events.Event{Type: events.Deleted, Path: sc.Path, IsDir: entries[0].info.IsDir(), Actor: actor})
+				}
+			}
+			return fmt.Sprintf("Deleted %d items", total), nil
+		})
+	}
+}
+
+// copyJob copies the file or folder source to target
+func (c *JobController) copyJob(actor string, source, target scope, policy ConflictPolicy) jobs.Func {
+	return func(ctx context.Context, progress *jobs.Reporter) (string, error) {
+		return c.withClient(ctx, func(client *sftp.Client) (string, error) {
+			if err := ensureWithinRoot(client, source.Root, source.Path); err != nil {
+				return "", jobError(source, err)
+			}
+			if err := ensureWithinRoot(client, target.Root, target.parentDir()); err != nil {
+				return "", jobError(target, err)
+			}
+			entries, err := walkTree(ctx, client, source.Path)
+			if err != nil {
+				return "", jobError(source, err)
+			}
+			if len(entries) == 0 {
+				return "", jobError(source, os.ErrNotExist)
+			}
+			isDir := entries[0].info.IsDir()
+
+			res, err := jobTarget(client, target, policy, isDir)
+			if err != nil {
+				return "", err
+			}
+			if res.Skip {
+				return fmt.Sprintf("%s already exists, skipped", target.userPath(target.Path)), nil
+			}
+			if isDir && isWithin(source.Path, res.Path) {
+				return "", fmt.Errorf("cannot copy a folder into itself")
+			}
+			progress.SetTotal(treeSize(entries))
+
+			copied, skipped := 0, 0
+			for _, e := range entries {
+				if err := ctx.Err(); err != nil {
+					return "", err
+				}
+				dest := res.Path + strings.TrimPrefix(e.path, source.Path)
+				switch {
+				case e.info.IsDir():
+					err = client.Mkdir(dest)
+				case e.info.Mode().IsRegular():
+					err = copyFile(ctx, client, e.path, dest, e.info.Size(), res.Overwrite, progress)
+					copied++
+				default:
+					// Links may point anywhere, and copying one would hand out access to its target
+					skipped++
+				}
+				if err != nil {
+					return "", fmt.Errorf("failed to copy %s: %v", source.userPath(e.path), err)
+				}
+				progress.AddItems(1)
+				if !e.info.IsDir() && !e.info.Mode().IsRegular() {
+					continue
+				}
+				event := events.Event{Type: events.Created, Path: dest, IsDir: e.info.IsDir(), Actor: actor}
+				if res.Overwrite {
+					event.Type = events.Modified
+				}
+				c.Files.publish(event)
+			}
+
+			result := fmt.Sprintf("Copied %d files to %s", copied, target.userPath(res.Path))
+			if skipped > 0 {
+				result += fmt.Sprintf(", skipped %d links", skipped)
+			}
+			return result, nil
+		})
+	}
+}
+
+// archiveJob zips sources into the file target. Entries are named from each source's own name down.
+func (c *JobController) archiveJob(actor string, sources []scope, target scope, policy ConflictPolicy) jobs.Func {
+	return func(ctx context.Context, progress *jobs.Reporter) (string, error) {
+		return c.withClient(ctx, func(client *sftp.Client) (string, error) {
+			trees := make([][]treeEntry, len(sources))
+			var items, bytes int64
+			for i, sc := range sources {
+				if err := ensureWithinRoot(client, sc.Root, sc.Path); err != nil {
+					return "", jobError(sc, err)
+				}
+				entries, err := walkTree(ctx, client, sc.Path)
+				if err != nil {
+					return "", jobError(sc, err)
+				}
+				trees[i] = entries
+				n, size := treeSize(entries)
+				items, bytes = items+n, bytes+size
+			}
+			if err := ensureWithinRoot(client, target.Root, target.parentDir()); err != nil {
+				return "", jobError(target, err)
+			}
+			res, err := jobTarget(client, target, policy, false)
+			if err != nil {
+				return "", err
+			}
+			if res.Skip {
+				return fmt.Sprintf("%s already exists, skipped", target.userPath(target.Path)), nil
+			}
+			progress.SetTotal(items, bytes)
+
+			pr, pw := io.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				pw.CloseWithError(writeZip(ctx, client, sources, trees, pw, progress))
+			}()
+			_, err = sftp.WriteAtomic(client, res.Path, pr, sftp.UploadOptions{Overwrite: res.Overwrite, ExpectedSize: -1})
+			pr.CloseWithError(err)
+			<-done
+			if err != nil {
+				if ctx.Err() != nil {
+					return "", ctx.Err()
+				}
+				return "", fmt.Errorf("failed to write archive: %v", err)
+			}
+			c.Files.publishWrite(actor, res.Path, res.Overwrite)
+			return fmt.Sprintf("Archived %d items to %s", items, target.userPath(res.Path)), nil
+		})
+	}
+}
+
+// writeZip streams the listed trees into w as a zip archive
+func writeZip(ctx context.Context, client *sftp.Client, sources []scope, trees [][]treeEntry, w io.Writer, progress *jobs.Reporter) error {
+	zw := zip.NewWriter(w)
+	for i, sc := range sources {
+		base := path.Dir(sc.Path)
+		for _, e := range trees[i] {
+			name := strings.TrimPrefix(strings.TrimPrefix(e.path, base), "/")
+			switch {
+			case e.info.IsDir():
+				header := &zip.FileHeader{Name: name + "/", Modified: e.info.ModTime()}
+				header.SetMode(e.info.Mode())
+				if _, err := zw.CreateHeader(header); err != nil {
+					return err
+				}
+			case e.info.Mode().IsRegular():
+				header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: e.info.ModTime()}
+				header.SetMode(e.info.Mode())
+				entry, err := zw.CreateHeader(header)
+				if err != nil {
+					return err
+				}
+				f, err := client.Open(e.path)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(entry, &jobReader{ctx: ctx, r: f, progress: progress})
+				f.Close()
+				if err != nil {
+					return err
+				}
+			}
+			progress.AddItems(1)
+		}
+	}
+	return zw.Close()
+}
+
+// extractJob unpacks the zip file source into the folder target. Every entry lands below
+// target whatever its name says, links in the archive are skipped, and the conflict policy
+// applies to each file.
+func (c *JobController) extractJob(actor string, source, target scope, policy ConflictPolicy) jobs.Func {
+	return func(ctx context.Context, progress *jobs.Reporter) (string, error) {
+		return c.withClient(ctx, func(client *sftp.Client) (string, error) {
+			if err := ensureWithinRoot(client, source.Root, source.Path); err != nil {
+				return "", jobError(source, err)
+			}
+			if err := ensureWithinRoot(client, target.Root, target.Path); err != nil {
+				return "", jobError(target, err)
+			}
+
+			f, err := client.Open(source.Path)
+			if err != nil {
+				return "", jobError(source, err)
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				return "", jobError(source, err)
+			}
+			archive, err := zip.NewReader(f, info.Size())
+			if err != nil {
+				return "", fmt.Errorf("%s is not a zip archive: %v", source.userPath(source.Path), err)
+			}
+
+			var bytes int64
+			for _, file := range archive.File {
+				bytes += int64(file.UncompressedSize64)
+			}
+			progress.SetTotal(int64(len(archive.File)), bytes)
+
+			if err := client.MkdirAll(target.Path); err != nil {
+				return "", jobError(target, err)
+			}
+			extracted, skipped := 0, 0
+			for _, file := range archive.File {
+				if err := ctx.Err(); err != nil {
+					return "", err
+				}
+				// Cleaning against "/" drops any ".." that would climb out of the target folder
+				dest := path.Join(target.Path, path.Clean("/"+file.Name))
+				mode := file.Mode()
+				switch {
+				case dest == target.Path:
+					// An entry for the archive's root names the target folder, which already exists
+				case mode.IsDir():
+					if err := c.extractDir(client, target, dest, actor); err != nil {
+						return "", err
+					}
+				case mode.IsRegular():
+					written, err := c.extractFile(ctx, client, file, target, dest, policy, actor, progress)
+					if err != nil {
+						return "", err
+					}
+					if written {
+						extracted++
+					} else {
+						skipped++
+					}
+				default:
+					skipped++
+				}
+				progress.AddItems(1)
+			}
+
+			result := fmt.Sprintf("Extracted %d files to %s", extracted, target.userPath(target.Path))
+			if skipped > 0 {
+				result += fmt.Sprintf(", skipped %d entries", skipped)
+			}
+			return result, nil
+		})
+	}
+}
+
+// extractDir creates a folder from an archive, along with any missing parents
+func (c *JobController) extractDir(client *sftp.Client, target scope, dest, actor string) error {
+	if err := ensureWithinRoot(client, target.Root, dest); err != nil {
+		return jobError(target.at(dest), err)
+	}
+	if _, err := client.Lstat(dest); err == nil {
+		return nil
+	}
+	if err := client.MkdirAll(dest); err != nil {
+		return jobError(target.at(dest), err)
+	}
+	c.Files.publish(events.Event{Type: events.Created, Path: dest, IsDir: true, Actor: actor})
+	return nil
+}
+
+// extractFile writes one file from an archive, reporting false when the conflict policy skipped it.
+// The declared size is enforced, so an archive cannot unpack to more than it claims.
+func (c *JobController) extractFile(ctx context.Context, client *sftp.Client, file *zip.File, target scope, dest string, policy ConflictPolicy, actor string, progress *jobs.Reporter) (bool, error) {
+	if err := c.extractDir(client, target, path.Dir(dest), actor); err != nil {
+		return false, err
+	}
+	res, err := jobTarget(client, target.at(dest), policy, false)
+	if err != nil {
+		return false, err
+	}
+	if res.Skip {
+		return false, nil
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s from the archive: %v", file.Name, err)
+	}
+	defer rc.Close()
+	size := int64(file.UncompressedSize64)
+	src := &jobReader{ctx: ctx, r: io.LimitReader(rc, size+1), progress: progress}
+	if _, err := sftp.WriteAtomic(client, res.Path, src, sftp.UploadOptions{Overwrite: res.Overwrite, ExpectedSize: size}); err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		return false, fmt.Errorf("failed to extract %s: %v", file.Name, err)
+	}
+	c.Files.publishWrite(actor, res.Path, res.Overwrite)
+	return true, nil
+}
+
+// describePaths names the paths of a job for its description
+func describePaths(paths []string) string {
+	if len(paths) == 1 {
+		return path.Join("/", paths[0])
+	}
+	return fmt.Sprintf("%d items", len(paths))
+}
+
+// resolveAll resolves every path for the same access, writing the error response on the first failure
+func (c *JobController) resolveAll(ctx *gin.Context, paths []string, want access) ([]scope, bool) {
+	if len(paths) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "paths is required"})
+		return nil, false
+	}
+	if len(paths) > maxJobPaths {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A job may name at most %d paths", maxJobPaths)})
+		return nil, false
+	}
+	scopes := make([]scope, 0, len(paths))
+	for _, p := range paths {
+		sc, ok := c.Files.resolve(ctx, p, want)
+		if !ok {
+			return nil, false
+		}
+		scopes = append(scopes, sc)
+	}
+	return scopes, true
+}
+
+// resolvePair resolves the source and destination of a copy or extract job
+func (c *JobController) resolvePair(ctx *gin.Context, req JobRequest, dstAccess access) (source, target scope, ok bool) {
+	if req.Source == "" || req.Destination == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "source and destination are required"})
+		return source, target, false
+	}
+	if source, ok = c.Files.resolve(ctx, req.Source, accessRead); !ok {
+		return source, target, false
+	}
+	target, ok = c.Files.resolve(ctx, req.Destination, dstAccess)
+	return source, target, ok
+}
+
+// SubmitJob checks the request against the user's permissions and queues the job
+func (c *JobController) SubmitJob(ctx *gin.Context) {
+	var req JobRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	policy, err := ParseConflictPolicy(req.OnConflict)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	username := ctx.GetString("username")
+	// Replacing files changes them, which uploaders may not do
+	if policy == ConflictOverwrite && !rolePermits(ctx.GetStringSlice("roles"), accessModify) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to replace existing files"})
+		return
+	}
+
+	var run jobs.Func
+	var description string
+	switch req.Kind {
+	case JobDelete:
+		if !auth.HasPermission(ctx, auth.PermDelete) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to delete"})
+			return
+		}
+		targets, ok := c.resolveAll(ctx, req.Paths, accessModify)
+		if !ok {
+			return
+		}
+		run = c.deleteJob(username, targets)
+		description = "Delete " + describePaths(req.Paths)
+	case JobCopy:
+		source, target, ok := c.resolvePair(ctx, req, accessCreate)
+		if !ok {
+			return
+		}
+		run = c.copyJob(username, source, target, policy)
+		description = fmt.Sprintf("Copy %s to %s", path.Join("/", req.Source), path.Join("/", req.Destination))
+	case JobArchive:
+		sources, ok := c.resolveAll(ctx, req.Paths, accessRead)
+		if !ok {
+			return
+		}
+		if req.Destination == "" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "destination is required"})
+			return
+		}
+		target, ok := c.Files.resolve(ctx, req.Destination, accessCreate)
+		if !ok {
+			return
+		}
+		run = c.archiveJob(username, sources, target, policy)
+		description = fmt.Sprintf("Archive %s to %s", describePaths(req.Paths), path.Join("/", req.Destination))
+	case JobExtract:
+		source, target, ok := c.resolvePair(ctx, req, accessWrite)
+		if !ok {
+			return
+		}
+		run = c.extractJob(username, source, target, policy)
+		description = fmt.Sprintf("Extract %s to %s", path.Join("/", req.Source), path.Join("/", req.Destination))
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "kind must be delete, copy, archive or extract"})
+		return
+	}
+
+	job, err := c.Jobs.Submit(username, req.Kind, description, run)
+	if errors.Is(err, jobs.ErrTooManyJobs) {
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many unfinished jobs, wait for some to finish"})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to submit job: %v", err)})
+		return
+	}
+	ctx.JSON(http.StatusAccepted, newJobResponse(job))
+}
+
+// ListJobs returns the user's recent jobs, newest first
+func (c *JobController) ListJobs(ctx *gin.Context) {
+	list := c.Jobs.List(ctx.GetString("username"))
+	resp := make([]JobResponse, 0, len(list))
+	for _, job := range list {
+		resp = append(resp, newJobResponse(job))
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// GetJob returns the state and progress of one job
+func (c *JobController) GetJob(ctx *gin.Context) {
+	job, err := c.Jobs.Get(ctx.GetString("username"), ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	ctx.JSON(http.StatusOK, newJobResponse(job))
+}
+
+// CancelJob stops a queued or running job
+func (c *JobController) CancelJob(ctx *gin.Context) {
+	job, err := c.Jobs.Cancel(ctx.GetString("username"), ctx.Param("id"))
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+	case errors.Is(err, jobs.ErrFinished):
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Job already finished", "job": newJobResponse(job)})
+	default:
+		ctx.JSON(http.StatusAccepted, newJobResponse(job))
+	}
+}
+
+// StreamJob sends the job as Server-Sent Events whenever it changes, until it finishes
+func (c *JobController) StreamJob(ctx *gin.Context) {
+	username, id := ctx.GetString("username"), ctx.Param("id")
+	job, err := c.Jobs.Get(username, id)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	var last jobs.Job
+	for sent := false; ; {
+		changed := c.Jobs.Changed()
+		if job, err = c.Jobs.Get(username, id); err != nil {
+			return
+		}
+		if !sent || job != last {
+			data, err := json.Marshal(newJobResponse(job))
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(ctx.Writer, "data: %s\n\n", data); err != nil {
+				return
+			}
+			ctx.Writer.Flush()
+			last, sent = job, true
+		}
+		if job.State.Finished() {
+			return
+		}
+
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(ctx.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			ctx.Writer.Flush()
+			continue
+		case <-changed:
+		}
+		// Progress changes with every chunk written, far more often than is worth sending
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case <-time.After(jobStreamInterval):
+		}
+	}
+}
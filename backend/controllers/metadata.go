@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/sftp"
+)
+
+// Kind categories derived from MIME type and extension
+const (
+	KindFolder   = "folder"
+	KindImage    = "image"
+	KindVideo    = "video"
+	KindAudio    = "audio"
+	KindDocument = "document"
+	KindArchive  = "archive"
+	KindCode     = "code"
+	KindOther    = "other"
+)
+
+// Optional FileInfo enrichments selectable through the fields parameter
+const (
+	FieldMime      = "mime"
+	FieldKind      = "kind"
+	FieldHidden    = "hidden"
+	FieldExtension = "extension"
+)
+
+// genericMimeTypes are sniffing results too vague to beat an extension lookup
+var genericMimeTypes = map[string]bool{
+	"application/octet-stream": true,
+	"text/plain":               true,
+}
+
+var extensionKinds = map[string]string{
+	".pdf": KindDocument, ".doc": KindDocument, ".docx": KindDocument, ".odt": KindDocument,
+	".xls": KindDocument, ".xlsx": KindDocument, ".ods": KindDocument, ".ppt": KindDocument,
+	".pptx": KindDocument, ".odp": KindDocument, ".rtf": KindDocument, ".txt": KindDocument,
+	".md": KindDocument, ".csv": KindDocument, ".epub": KindDocument,
+
+	".zip": KindArchive, ".tar": KindArchive, ".gz": KindArchive, ".tgz": KindArchive,
+	".bz2": KindArchive, ".xz": KindArchive, ".7z": KindArchive, ".rar": KindArchive, ".zst": KindArchive,
+
+	".go": KindCode, ".js": KindCode, ".ts": KindCode, ".vue": KindCode, ".py": KindCode,
+	".java": KindCode, ".c": KindCode, ".h": KindCode, ".cpp": KindCode, ".rs": KindCode,
+	".rb": KindCode, ".php": KindCode, ".sh": KindCode, ".html": KindCode, ".css": KindCode,
+	".json": KindCode, ".yaml": KindCode, ".yml": KindCode, ".toml": KindCode, ".xml": KindCode,
+	".sql": KindCode, ".kt": KindCode, ".swift": KindCode, ".cs": KindCode,
+}
+
+// metadataFields is the set of enrichments a request asked for
+type metadataFields map[string]bool
+
+// parseMetadataFields reads a comma separated fields value; "all" selects every enrichment
+func parseMetadataFields(value string) (metadataFields, error) {
+	fields := metadataFields{}
+	for _, field := range strings.Split(value, ",") {
+		switch field = strings.ToLower(strings.TrimSpace(field)); field {
+		case "":
+		case "all":
+			return allMetadataFields(), nil
+		case FieldMime, FieldKind, FieldHidden, FieldExtension:
+			fields[field] = true
+		default:
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+	}
+	return fields, nil
+}
+
+func allMetadataFields() metadataFields {
+	return metadataFields{FieldMime: true, FieldKind: true, FieldHidden: true, FieldExtension: true}
+}
+
+// mimeByExtension looks a type up from the file name alone
+func mimeByExtension(name string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(name)); mimeType != "" {
+		mediaType, _, err := mime.ParseMediaType(mimeType)
+		if err == nil {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// sniffMimeType reads the head of a remote file and detects its type from the content
+func sniffMimeType(client *sftp.Client, scopedPath string) (string, error) {
+	file, err := client.Open(scopedPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	detected, err := mimetype.DetectReader(file)
+	if err != nil {
+		return "", err
+	}
+	mediaType, _, err := mime.ParseMediaType(detected.String())
+	if err != nil {
+		return detected.String(), nil
+	}
+	return mediaType, nil
+}
+
+// detectMimeType prefers the sniffed type unless it is generic and the extension knows better
+func detectMimeType(client *sftp.Client, scopedPath string, info *FileInfo) string {
+	if info.IsDir {
+		return "inode/directory"
+	}
+	if info.IsSymlink && info.LinkOutsideRoot {
+		return "inode/symlink"
+	}
+
+	byExtension := mimeByExtension(info.Name)
+	sniffed, err := sniffMimeType(client, scopedPath)
+	if err != nil || (genericMimeTypes[sniffed] && byExtension != "") {
+		if byExtension == "" {
+			return "application/octet-stream"
+		}
+		return byExtension
+	}
+	return sniffed
+}
+
+// kindOf sorts an entry into a coarse category for icons and filters
+func kindOf(info *FileInfo, mimeType string) string {
+	if info.IsDir {
+		return KindFolder
+	}
+	if kind, ok := extensionKinds[strings.ToLower(filepath.Ext(info.Name))]; ok {
+		return kind
+	}
+	if mimeType == "" {
+		mimeType = mimeByExtension(info.Name)
+	}
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return KindImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return KindVideo
+	case strings.HasPrefix(mimeType, "audio/"):
+		return KindAudio
+	case strings.HasPrefix(mimeType, "text/"):
+		return KindDocument
+	}
+	return KindOther
+}
+
+// enrichFileInfo adds the requested enrichments; only the MIME type costs a round trip
+func enrichFileInfo(client *sftp.Client, scopedPath string, info *FileInfo, fields metadataFields) {
+	if fields[FieldHidden] {
+		info.Hidden = strings.HasPrefix(info.Name, ".")
+	}
+	if fields[FieldExtension] && !info.IsDir {
+		info.Extension = strings.ToLower(strings.TrimPrefix(filepath.Ext(info.Name), "."))
+	}
+	if fields[FieldMime] {
+		info.MimeType = detectMimeType(client, scopedPath, info)
+	}
+	if fields[FieldKind] {
+		info.Kind = kindOf(info, info.MimeType)
+	}
+}
+
+// Stat returns the metadata of a single file or directory with every enrichment applied
+func (c *FileController) Stat(ctx *gin.Context) {
+	sc, ok := c.resolve(ctx, ctx.Param("path"), accessBrowse)
+	if !ok {
+		return
+	}
+	if sc.Virtual {
+		ctx.JSON(http.StatusOK, virtualFolderInfo(filepath.Base(sc.Prefix), sc.Prefix))
+		return
+	}
+
+	client, err := c.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	// The entry itself may be a link pointing outside, which statFileInfo reports without following
+	if !confinedTo(ctx, client, sc.Root, sc.parentDir()) {
+		return
+	}
+
+	info, err := statFileInfo(client, sc)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Failed to get file info: %v", err)})
+		return
+	}
+	enrichFileInfo(client, sc.Path, &info, allMetadataFields())
+
+	ctx.JSON(http.StatusOK, info)
+}
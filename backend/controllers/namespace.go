@@ -0,0 +1,394 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/acl"
+	"manschko.com/cloud-storage/auth"
+	"manschko.com/cloud-storage/events"
+	"manschko.com/cloud-storage/groups"
+	"manschko.com/cloud-storage/sftp"
+)
+
+const (
+	// SharedWithMeDir is the virtual folder under which other users' shared folders appear
+	SharedWithMeDir = "Shared with me"
+	// GroupsDir is the virtual folder under which a member's group spaces appear
+	GroupsDir = "groups"
+	// GroupSpaceRoot is the server folder holding one folder per group space.
+	// It is hidden so that no username, and so no home folder, can ever take its name.
+	GroupSpaceRoot = "/.groups"
+)
+
+var (
+	errForbidden     = errors.New("permission denied")
+	errVirtualFolder = errors.New("virtual folder")
+	errUnknownMount  = errors.New("no such shared folder")
+	errUnknownGroup  = errors.New("no such group space")
+	errTokenPath     = errors.New("path not allowed for this access token")
+)
+
+// access is what a handler intends to do with a resolved path
+type access int
+
+const (
+	// accessBrowse reads metadata and accepts virtual folders
+	accessBrowse access = iota
+	// accessRead reads file content
+	accessRead
+	// accessWrite creates or changes entries below the path
+	accessWrite
+	// accessCreate creates the entry at the path itself, which uploaders may do
+	accessCreate
+	// accessModify deletes, renames or moves the entry at the path itself
+	accessModify
+)
+
+// scope is a user-visible path resolved onto the SFTP server
+type scope struct {
+	Path     string // real path on the server
+	Root     string // real folder Path must stay within
+	Prefix   string // user-visible path of Root
+	Owner    string // user owning Root, the requesting user for virtual folders, empty for group spaces
+	Writable bool   // the user may change entries below Root
+	Fixed    bool   // Path is a root that cannot be removed or renamed
+	Virtual  bool   // Path is a virtual folder with no server counterpart
+}
+
+// userPath maps a real path inside the scope back to what the client sees
+func (s scope) userPath(real string) string {
+	return path.Join(s.Prefix, toUserPath(s.Root, real))
+}
+
+// at returns the same scope for another real path below Root
+func (s scope) at(real string) scope {
+	s.Path = real
+	s.Fixed = real == s.Root
+	return s
+}
+
+// parentDir is the folder holding Path, never leaving Root
+func (s scope) parentDir() string {
+	if s.Path == s.Root {
+		return s.Root
+	}
+	return path.Dir(s.Path)
+}
+
+// groupRoot is the server folder of a group space
+func groupRoot(name string) string {
+	return path.Join(GroupSpaceRoot, name)
+}
+
+// within reports whether the clean user path p is dir or below it
+func within(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// mount is a folder shared with the user and its name under SharedWithMeDir
+type mount struct {
+	Name  string
+	Grant acl.Grant
+}
+
+// mounts lists the folders shared with username under stable, unique names
+func (c *FileController) mounts(username string) []mount {
+	if c.Grants == nil {
+		return nil
+	}
+	var list []mount
+	used := map[string]bool{}
+	for _, grant := range c.Grants.ListForGrantee(username) {
+		name := path.Base(grant.Path)
+		if grant.Path == "/" {
+			name = grant.Owner
+		}
+		if used[name] {
+			name = fmt.Sprintf("%s (%s)", name, grant.Owner)
+		}
+		if used[name] {
+			name = fmt.Sprintf("%s %s", name, grant.ID[:6])
+		}
+		used[name] = true
+		list = append(list, mount{Name: name, Grant: grant})
+	}
+	return list
+}
+
+// hasSharedWithMe reports whether username sees the SharedWithMeDir virtual folder
+func (c *FileController) hasSharedWithMe(username string) bool {
+	return c.Grants != nil && len(c.mounts(username)) > 0
+}
+
+// hasGroups reports whether username sees the GroupsDir virtual folder
+func (c *FileController) hasGroups(username string) bool {
+	return c.Groups != nil && len(c.Groups.Memberships(username)) > 0
+}
+
+// resolvePath maps a path as the client sees it onto the server.
+// Paths below SharedWithMeDir land in the owner's folder with the grant's permission.
+// Virtual folders are only mounted for users with something in them, so everyone else
+// keeps access to real folders of the same name.
+func (c *FileController) resolvePath(username, relPath string) (scope, error) {
+	clean := path.Join("/", relPath)
+	switch {
+	case within(clean, "/"+SharedWithMeDir) && c.hasSharedWithMe(username):
+		return c.resolveShared(username, clean)
+	case within(clean, "/"+GroupsDir) && c.hasGroups(username):
+		return c.resolveGroup(username, clean)
+	}
+
+	home := userRoot(username)
+	return scope{
+		Path:     scopePath(home, clean),
+		Root:     home,
+		Prefix:   "/",
+		Owner:    username,
+		Writable: true,
+		Fixed:    clean == "/",
+	}, nil
+}
+
+// resolveShared maps a path below SharedWithMeDir onto the folder behind the grant
+func (c *FileController) resolveShared(username, clean string) (scope, error) {
+	sharedDir := "/" + SharedWithMeDir
+	if clean == sharedDir {
+		return scope{Prefix: sharedDir, Owner: username, Fixed: true, Virtual: true}, nil
+	}
+
+	name, sub, _ := strings.Cut(strings.TrimPrefix(clean, sharedDir+"/"), "/")
+	for _, m := range c.mounts(username) {
+		if m.Name != name {
+			continue
+		}
+		root := scopePath(userRoot(m.Grant.Owner), m.Grant.Path)
+		return scope{
+			Path:     scopePath(root, sub),
+			Root:     root,
+			Prefix:   path.Join(sharedDir, name),
+			Owner:    m.Grant.Owner,
+			Writable: m.Grant.CanWrite(),
+			Fixed:    sub == "",
+		}, nil
+	}
+	return scope{}, errUnknownMount
+}
+
+// resolveGroup maps a path below GroupsDir onto a group space, with access following the member's role
+func (c *FileController) resolveGroup(username, clean string) (scope, error) {
+	groupsDir := "/" + GroupsDir
+	if clean == groupsDir {
+		return scope{Prefix: groupsDir, Owner: username, Fixed: true, Virtual: true}, nil
+	}
+
+	name, sub, _ := strings.Cut(strings.TrimPrefix(clean, groupsDir+"/"), "/")
+	role, err := c.Groups.RoleOf(name, username)
+	if err != nil {
+		// Non-members cannot tell a foreign group from a missing one
+		return scope{}, errUnknownGroup
+	}
+	root := groupRoot(name)
+	return scope{
+		Path:     scopePath(root, sub),
+		Root:     root,
+		Prefix:   path.Join(groupsDir, name),
+		Writable: role.AtLeast(groups.Editor),
+		Fixed:    sub == "",
+	}, nil
+}
+
+// tokenAllows reports whether relPath is within the folders a personal access token is limited to.
+// Logins and unlimited tokens reach every path.
+func tokenAllows(ctx *gin.Context, relPath string) bool {
+	dirs := ctx.GetStringSlice("token_paths")
+	if len(dirs) == 0 {
+		return true
+	}
+	clean := path.Join("/", relPath)
+	for _, dir := range dirs {
+		if within(clean, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// rolePermits reports whether roles allow the intended access: reading needs read permission,
+// adding entries upload permission and changing existing ones write permission
+func rolePermits(roles []string, want access) bool {
+	switch want {
+	case accessBrowse, accessRead:
+		return auth.Permits(roles, auth.PermRead)
+	case accessWrite, accessCreate:
+		return auth.Permits(roles, auth.PermUpload)
+	}
+	return auth.Permits(roles, auth.PermWrite)
+}
+
+// checkAccess enforces what the caller may do with a resolved scope
+func checkAccess(sc scope, want access) error {
+	switch {
+	case sc.Virtual && want != accessBrowse:
+		return errVirtualFolder
+	case want >= accessWrite && !sc.Writable:
+		return errForbidden
+	case want >= accessCreate && sc.Fixed:
+		return errForbidden
+	}
+	return nil
+}
+
+// resolve maps relPath for the authenticated user and checks the intended access.
+// It writes the error response itself and returns false when the request must stop.
+func (c *FileController) resolve(ctx *gin.Context, relPath string, want access) (scope, bool) {
+	username, exists := ctx.Get("username")
+	if !exists {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "username not found in context"})
+		return scope{}, false
+	}
+
+	if !tokenAllows(ctx, relPath) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "This access token is not valid for the path"})
+		return scope{}, false
+	}
+	sc, err := c.resolvePath(username.(string), relPath)
+	if err == nil {
+		err = checkAccess(sc, want)
+	}
+	if err == nil && !rolePermits(ctx.GetStringSlice("roles"), want) {
+		err = errForbidden
+	}
+	switch {
+	case err == nil:
+		return sc, true
+	case errors.Is(err, errUnknownMount):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Shared folder not found"})
+	case errors.Is(err, errUnknownGroup):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Group space not found"})
+	case errors.Is(err, errVirtualFolder):
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Operation not supported on a virtual folder"})
+	case errors.Is(err, errForbidden):
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission for this operation"})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return scope{}, false
+}
+
+// virtualFolderInfo describes a folder that exists only in the user's namespace
+func virtualFolderInfo(name, userPath string) FileInfo {
+	return FileInfo{
+		Name:        name,
+		IsDir:       true,
+		ModTime:     time.Now().UTC().Format(time.RFC3339),
+		Path:        userPath,
+		Mode:        (os.ModeDir | 0o555).String(),
+		Permissions: "0555",
+	}
+}
+
+// listSharedWithMe lists the folders mounted under SharedWithMeDir
+func (c *FileController) listSharedWithMe(username string) []FileInfo {
+	entries := []FileInfo{}
+	for _, m := range c.mounts(username) {
+		info := virtualFolderInfo(m.Name, path.Join("/", SharedWithMeDir, m.Name))
+		info.SharedBy = m.Grant.Owner
+		info.SharedPermission = string(m.Grant.Permission)
+		entries = append(entries, info)
+	}
+	return entries
+}
+
+// listGroups lists the group spaces mounted under GroupsDir
+func (c *FileController) listGroups(username string) []FileInfo {
+	entries := []FileInfo{}
+	for _, membership := range c.Groups.Memberships(username) {
+		info := virtualFolderInfo(membership.Group, path.Join("/", GroupsDir, membership.Group))
+		info.GroupRole = string(membership.Role)
+		entries = append(entries, info)
+	}
+	return entries
+}
+
+// listVirtual lists the content of a virtual folder
+func (c *FileController) listVirtual(sc scope) []FileInfo {
+	if sc.Prefix == "/"+GroupsDir {
+		return c.listGroups(sc.Owner)
+	}
+	return c.listSharedWithMe(sc.Owner)
+}
+
+// virtualFolders are the entries the home folder shows next to the user's own files
+func (c *FileController) virtualFolders(username string) []FileInfo {
+	var entries []FileInfo
+	if c.hasSharedWithMe(username) {
+		entries = append(entries, virtualFolderInfo(SharedWithMeDir, "/"+SharedWithMeDir))
+	}
+	if c.hasGroups(username) {
+		entries = append(entries, virtualFolderInfo(GroupsDir, "/"+GroupsDir))
+	}
+	for i := range entries {
+		entries[i].Virtual = true
+	}
+	return entries
+}
+
+// moveShadowedFolders renames entries of the home folder that a virtual folder took the name of,
+// such as a folder "groups" of a user who just joined a group, to the next free "name (n)".
+// Users can still create such entries over SFTP, so listings of the home folder run it too.
+func (c *FileController) moveShadowedFolders(client *sftp.Client, username string) {
+	home := userRoot(username)
+	for _, folder := range c.virtualFolders(username) {
+		real := path.Join(home, folder.Name)
+		if _, err := client.Lstat(real); err != nil {
+			continue
+		}
+		free, err := findFreeName(client, real)
+		if err == nil {
+			err = client.Rename(real, free)
+		}
+		if err != nil {
+			log.Printf("Failed to move %q of %s out of the way of the virtual folder: %v", folder.Name, username, err)
+			continue
+		}
+		log.Printf("Moved %q of %s to %q, as a virtual folder took its name", folder.Name, username, path.Base(free))
+		c.publish(events.Event{Type: events.Moved, OldPath: real, Path: free, Actor: username})
+	}
+}
+
+// moveShadowedFoldersOf connects to run moveShadowedFolders for a user who was just given a mount.
+// The mount is in place already, so failures are only logged.
+func (c *FileController) moveShadowedFoldersOf(username string) {
+	client, err := c.connect()
+	if err != nil {
+		log.Printf("Failed to move folders of %s out of the way of virtual folders: %v", username, err)
+		return
+	}
+	defer client.Close()
+	c.moveShadowedFolders(client, username)
+}
+
+// withVirtualFolders adds the virtual folders to a listing of the home folder.
+// A real entry that could not be moved out of their way cannot be reached, so it is left out.
+func (c *FileController) withVirtualFolders(username string, entries []FileInfo) []FileInfo {
+	virtual := c.virtualFolders(username)
+	kept := entries[:0]
+	for _, entry := range entries {
+		hidden := false
+		for _, folder := range virtual {
+			hidden = hidden || entry.Name == folder.Name
+		}
+		if !hidden {
+			kept = append(kept, entry)
+		}
+	}
+	return append(kept, virtual...)
+}
@@ -0,0 +1,350 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/events"
+	"manschko.com/cloud-storage/sftp"
+)
+
+var errOutsideRoot = errors.New("path resolves outside the user's root")
+
+// ChmodRequest changes the permission bits of a file or directory
+type ChmodRequest struct {
+	Path string `json:"path" binding:"required"`
+	Mode string `json:"mode" binding:"required"` // octal, e.g. "0644"
+}
+
+// ChtimesRequest sets the modification and optionally the access time
+type ChtimesRequest struct {
+	Path       string `json:"path" binding:"required"`
+	ModTime    string `json:"mod_time" binding:"required"` // RFC 3339
+	AccessTime string `json:"access_time"`                 // RFC 3339, defaults to ModTime
+}
+
+// SymlinkRequest creates a symlink at Link pointing at Target, both relative to the user's root
+type SymlinkRequest struct {
+	Target     string `json:"target" binding:"required"`
+	Link       string `json:"link" binding:"required"`
+	OnConflict string `json:"on_conflict"`
+}
+
+// isWithin reports whether p is root or lies below it
+func isWithin(root, p string) bool {
+	return p == root || strings.HasPrefix(p, root+"/")
+}
+
+// toUserPath maps a scoped path back to the path the client sees
+func toUserPath(root, scopedPath string) string {
+	rel := strings.TrimPrefix(scopedPath, root)
+	if rel == "" {
+		return "/"
+	}
+	return rel
+}
+
+// linkTarget reads a symlink and resolves its target to an absolute, cleaned path
+func linkTarget(client *sftp.Client, scopedPath string) (string, error) {
+	target, err := client.ReadLink(scopedPath)
+	if err != nil {
+		return "", err
+	}
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(scopedPath), target)
+	}
+	return path.Clean(target), nil
+}
+
+// ensureWithinRoot rejects scoped paths that escape root through symlinks.
+// A path that does not exist yet is checked through its nearest existing parent.
+func ensureWithinRoot(client *sftp.Client, root, scopedPath string) error {
+	// A symlink at the path itself must point inside root before anything follows it
+	if info, err := client.Lstat(scopedPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		target, err := linkTarget(client, scopedPath)
+		if err != nil {
+			return err
+		}
+		if !isWithin(root, target) {
+			return errOutsideRoot
+		}
+	}
+
+	// The server's canonical path catches links in intermediate directories
+	for p := scopedPath; ; p = path.Dir(p) {
+		real, err := client.RealPath(p)
+		if err == nil {
+			if !isWithin(root, real) {
+				return errOutsideRoot
+			}
+			return nil
+		}
+		if p == root || p == "/" {
+			return nil
+		}
+	}
+}
+
+// confined checks scopedPath against the user's root and writes the error response when it escapes
+func confined(ctx *gin.Context, client *sftp.Client, scopedPath string) bool {
+	root, err := getUserRoot(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return confinedTo(ctx, client, root, scopedPath)
+}
+
+// confinedTo is confined for an explicit root, such as the folder behind a share link
+func confinedTo(ctx *gin.Context, client *sftp.Client, root, scopedPath string) bool {
+	err := ensureWithinRoot(client, root, scopedPath)
+	if errors.Is(err, errOutsideRoot) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Path is outside of your storage"})
+		return false
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to resolve path: %v", err)})
+		return false
+	}
+	return true
+}
+
+// describeLink fills in the symlink fields of info without following links that leave the scope's root
+func describeLink(client *sftp.Client, sc scope, scopedPath string, info *FileInfo) {
+	if !info.IsSymlink {
+		return
+	}
+	target, err := linkTarget(client, scopedPath)
+	if err != nil {
+		return
+	}
+	if !isWithin(sc.Root, target) {
+		info.LinkOutsideRoot = true
+		return
+	}
+	info.LinkTarget = sc.userPath(target)
+}
+
+// statFileInfo builds the FileInfo of the entry at sc.Path, including link details
+func statFileInfo(client *sftp.Client, sc scope) (FileInfo, error) {
+	stat, err := client.Lstat(sc.Path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info := newFileInfo(stat, sc.userPath(sc.Path))
+	describeLink(client, sc, sc.Path, &info)
+	return info, nil
+}
+
+// Chmod changes the permission bits of a file or directory
+func (c *FileController) Chmod(ctx *gin.Context) {
+	var chmodReq ChmodRequest
+	if err := ctx.ShouldBindJSON(&chmodReq); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	mode, err := strconv.ParseUint(chmodReq.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Mode must be octal permission bits between 0000 and 0777"})
+		return
+	}
+
+	sc, ok := c.resolve(ctx, chmodReq.Path, accessWrite)
+	if !ok {
+		return
+	}
+	scopedPath := sc.Path
+
+	client, err := c.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	if !confinedTo(ctx, client, sc.Root, scopedPath) {
+		return
+	}
+
+	if err := client.Chmod(scopedPath, os.FileMode(mode)); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to change mode: %v", err)})
+		return
+	}
+
+	info, err := statFileInfo(client, sc)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get file info: %v", err)})
+		return
+	}
+	c.publish(events.Event{Type: events.Modified, Path: scopedPath, IsDir: info.IsDir, Actor: ctx.GetString("username")})
+	ctx.JSON(http.StatusOK, info)
+}
+
+// Chtimes sets the modification and access time of a file or directory
+func (c *FileController) Chtimes(ctx *gin.Context) {
+	var chtimesReq ChtimesRequest
+	if err := ctx.ShouldBindJSON(&chtimesReq); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	mtime, err := time.Parse(time.RFC3339, chtimesReq.ModTime)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "mod_time must be an RFC 3339 timestamp"})
+		return
+	}
+	atime := mtime
+	if chtimesReq.AccessTime != "" {
+		if atime, err = time.Parse(time.RFC3339, chtimesReq.AccessTime); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "access_time must be an RFC 3339 timestamp"})
+			return
+		}
+	}
+
+	sc, ok := c.resolve(ctx, chtimesReq.Path, accessWrite)
+	if !ok {
+		return
+	}
+	scopedPath := sc.Path
+
+	client, err := c.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	if !confinedTo(ctx, client, sc.Root, scopedPath) {
+		return
+	}
+
+	if err := client.Chtimes(scopedPath, atime, mtime); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to set times: %v", err)})
+		return
+	}
+
+	info, err := statFileInfo(client, sc)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get file info: %v", err)})
+		return
+	}
+	c.publish(events.Event{Type: events.Modified, Path: scopedPath, IsDir: info.IsDir, Actor: ctx.GetString("username")})
+	ctx.JSON(http.StatusOK, info)
+}
+
+// CreateSymlink creates a symlink inside the user's root pointing at another path inside it
+func (c *FileController) CreateSymlink(ctx *gin.Context) {
+	var symlinkReq SymlinkRequest
+	if err := ctx.ShouldBindJSON(&symlinkReq); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	policy, err := ParseConflictPolicy(symlinkReq.OnConflict)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Both ends are scoped, so the stored target is always an absolute path inside root
+	target, ok := c.resolve(ctx, symlinkReq.Target, accessBrowse)
+	if !ok {
+		return
+	}
+	link, ok := c.resolve(ctx, symlinkReq.Link, accessModify)
+	if !ok {
+		return
+	}
+	if target.Virtual || target.Root != link.Root {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Symlink target must be in the same storage as the link"})
+		return
+	}
+
+	client, err := c.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	if !confinedTo(ctx, client, target.Root, target.Path) || !confinedTo(ctx, client, link.Root, link.parentDir()) {
+		return
+	}
+
+	res, err := resolveConflict(client, link.Path, policy)
+	if errors.Is(err, errConflict) {
+		respondConflict(ctx, res.Existing, symlinkReq.Link)
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check destination: %v", err)})
+		return
+	}
+	if res.Skip {
+		ctx.JSON(http.StatusOK, gin.H{"message": "Destination already exists, skipped", "path": resolvedRelPath(symlinkReq.Link, res), "skipped": true})
+		return
+	}
+	if res.Overwrite {
+		// Symlink creation cannot replace an entry, so clear the way first
+		if err := client.Remove(res.Path); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to replace existing entry: %v", err)})
+			return
+		}
+	}
+
+	if err := client.Symlink(target.Path, res.Path); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create symlink: %v", err)})
+		return
+	}
+
+	info, err := statFileInfo(client, link.at(res.Path))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get file info: %v", err)})
+		return
+	}
+	c.publishWrite(ctx.GetString("username"), res.Path, res.Overwrite)
+	ctx.JSON(http.StatusOK, info)
+}
+
+// ReadLink returns where a symlink points, as long as the target stays inside the user's root
+func (c *FileController) ReadLink(ctx *gin.Context) {
+	sc, ok := c.resolve(ctx, ctx.Param("path"), accessRead)
+	if !ok {
+		return
+	}
+
+	client, err := c.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	if !confinedTo(ctx, client, sc.Root, sc.parentDir()) {
+		return
+	}
+
+	info, err := statFileInfo(client, sc)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Failed to get file info: %v", err)})
+		return
+	}
+	if !info.IsSymlink {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Not a symlink"})
+		return
+	}
+	if info.LinkOutsideRoot {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Symlink points outside of your storage", "link_outside_root": true})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"path": info.Path, "target": info.LinkTarget})
+}
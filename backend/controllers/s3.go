@@ -0,0 +1,1043 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/auth"
+	"manschko.com/cloud-storage/events"
+	"manschko.com/cloud-storage/s3"
+	"manschko.com/cloud-storage/sftp"
+	"manschko.com/cloud-storage/throttle"
+)
+
+const (
+	s3SignedKey         = "s3signed"
+	s3DefaultMaxKeys    = 1000
+	s3MaxCompleteBody   = 1 << 20
+	s3PartsRoot         = "/.s3-multipart"
+	s3StandardClass     = "STANDARD"
+	s3DecodedLengthHead = "X-Amz-Decoded-Content-Length"
+)
+
+var validBucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// S3Controller serves an S3-compatible API on top of the user-scoped storage.
+// Buckets are the top-level folders of the user's home and object keys are paths below them.
+type S3Controller struct {
+	Files    *FileController
+	Keys     *s3.KeyStore
+	Uploads  *s3.UploadStore
+	Verifier *s3.Verifier
+	// Roles adds the configured roles to the key owner's on every request
+	Roles auth.RoleConfig
+}
+
+// NewS3Controller creates a new S3 gateway controller
+func NewS3Controller(files *FileController, keys *s3.KeyStore, uploads *s3.UploadStore, region string) *S3Controller {
+	return &S3Controller{
+		Files:    files,
+		Keys:     keys,
+		Uploads:  uploads,
+		Verifier: &s3.Verifier{Region: region, Lookup: keys.Lookup},
+	}
+}
+
+// CreateAccessKeyRequest describes a new S3 access key
+type CreateAccessKeyRequest struct {
+	Description string `json:"description"`
+}
+
+// AccessKeyResponse shows an access key; the secret is only included right after creation
+type AccessKeyResponse struct {
+	AccessKeyID string `json:"access_key_id"`
+	SecretKey   string `json:"secret_access_key,omitempty"`
+	Description string `json:"description,omitempty"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func newAccessKeyResponse(key s3.AccessKey, withSecret bool) AccessKeyResponse {
+	resp := AccessKeyResponse{
+		AccessKeyID: key.AccessKeyID,
+		Description: key.Description,
+		CreatedAt:   key.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
+	}
+	if withSecret {
+		resp.SecretKey = key.SecretKey
+	}
+	return resp
+}
+
+// CreateAccessKey issues an S3 access key for the authenticated user
+func (c *S3Controller) CreateAccessKey(ctx *gin.Context) {
+	var keyReq CreateAccessKeyRequest
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&keyReq); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	key, err := c.Keys.Create(ctx.GetString("username"), ctx.GetStringSlice("backend_roles"), keyReq.Description)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create access key: %v", err)})
+		return
+	}
+	ctx.JSON(http.StatusCreated, newAccessKeyResponse(*key, true))
+}
+
+// ListAccessKeys lists the authenticated user's S3 access keys without their secrets
+func (c *S3Controller) ListAccessKeys(ctx *gin.Context) {
+	list := []AccessKeyResponse{}
+	for _, key := range c.Keys.ListByOwner(ctx.GetString("username")) {
+		list = append(list, newAccessKeyResponse(key, false))
+	}
+	ctx.JSON(http.StatusOK, list)
+}
+
+// RevokeAccessKey deletes one of the authenticated user's S3 access keys
+func (c *S3Controller) RevokeAccessKey(ctx *gin.Context) {
+	err := c.Keys.Revoke(ctx.GetString("username"), ctx.Param("id"))
+	if errors.Is(err, s3.ErrInvalidAccessKeyID) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Access key not found"})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to revoke access key: %v", err)})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Access key revoked"})
+}
+
+// respondS3Error writes err as an S3 XML error
+func respondS3Error(ctx *gin.Context, err error) {
+	var s3err *s3.Error
+	switch {
+	case errors.As(err, &s3err):
+	case errors.Is(err, errOutsideRoot), errors.Is(err, errForbidden), errors.Is(err, errVirtualFolder), os.IsPermission(err):
+		s3err = s3.ErrAccessDenied
+	case os.IsNotExist(err):
+		s3err = s3.ErrNoSuchKey
+	default:
+		s3err = s3.ErrInternalError.WithMessage(err.Error())
+	}
+	ctx.XML(s3err.StatusCode, s3.ErrorResponse{
+		Code:     s3err.Code,
+		Message:  s3err.Message,
+		Resource: ctx.Request.URL.Path,
+	})
+}
+
+// Authenticate verifies the SigV4 signature and acts as the access key's owner
+func (c *S3Controller) Authenticate(ctx *gin.Context) {
+	signed, err := c.Verifier.Verify(ctx.Request)
+	if err != nil {
+		respondS3Error(ctx, err)
+		ctx.Abort()
+		return
+	}
+	principal := c.Roles.Assign(auth.Principal{Username: signed.Owner, Roles: signed.BackendRoles})
+	ctx.Set("username", principal.Username)
+	ctx.Set("roles", principal.Roles)
+	ctx.Set("backend_roles", principal.BackendRoles)
+	ctx.Set(s3SignedKey, signed)
+	ctx.Next()
+}
+
+// Serve dispatches a path-style S3 request to the matching operation
+func (c *S3Controller) Serve(ctx *gin.Context) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(ctx.Param("path"), "/"), "/")
+	query := ctx.Request.URL.Query()
+	method := ctx.Request.Method
+
+	// Roles apply by method: uploads only add data, and replacing an existing object is
+	// checked where the object is known. Every other S3 request changes data.
+	perm := auth.PermWrite
+	switch {
+	case method == http.MethodGet || method == http.MethodHead:
+		perm = auth.PermRead
+	case method == http.MethodPut || method == http.MethodPost || method == http.MethodDelete && query.Has("uploadId"):
+		perm = auth.PermUpload
+	}
+	if !auth.Permits(ctx.GetStringSlice("roles"), perm) {
+		respondS3Error(ctx, s3.ErrAccessDenied)
+		return
+	}
+
+	// Object reads and writes move the data and count as transfers
+	if key != "" && (method == http.MethodPut || method == http.MethodGet && !query.Has("uploadId")) {
+		account := throttle.Account{User: ctx.GetString("username")}
+		release, err := c.Files.acquireTransfer(ctx, account)
+		if err != nil {
+			respondS3Error(ctx, s3.ErrSlowDown)
+			return
+		}
+		defer release()
+		c.Files.limitBody(ctx, account)
+	}
+
+	client, err := c.Files.connect()
+	if err != nil {
+		respondS3Error(ctx, s3.ErrInternalError.WithMessage(fmt.Sprintf("SFTP connection error: %v", err)))
+		return
+	}
+	defer client.Close()
+
+	switch {
+	case bucket == "" && method == http.MethodGet:
+		c.listBuckets(ctx, client)
+	case bucket == "":
+		respondS3Error(ctx, s3.ErrNotImplemented)
+
+	case key == "" && method == http.MethodGet && query.Has("location"):
+		c.getBucketLocation(ctx, client, bucket)
+	case key == "" && method == http.MethodGet && !query.Has("uploads"):
+		c.listObjects(ctx, client, bucket)
+	case key == "" && method == http.MethodHead:
+		c.headBucket(ctx, client, bucket)
+	case key == "" && method == http.MethodPut:
+		c.createBucket(ctx, client, bucket)
+	case key == "" && method == http.MethodDelete:
+		c.deleteBucket(ctx, client, bucket)
+	case key == "":
+		respondS3Error(ctx, s3.ErrNotImplemented)
+
+	case method == http.MethodPost && query.Has("uploads"):
+		c.createMultipartUpload(ctx, client, bucket, key)
+	case method == http.MethodPost && query.Has("uploadId"):
+		c.completeMultipartUpload(ctx, client, bucket, key, query.Get("uploadId"))
+	case method == http.MethodPut && query.Has("uploadId"):
+		c.uploadPart(ctx, client, bucket, key, query.Get("uploadId"), query.Get("partNumber"))
+	case method == http.MethodGet && query.Has("uploadId"):
+		c.listParts(ctx, client, bucket, key, query.Get("uploadId"))
+	case method == http.MethodDelete && query.Has("uploadId"):
+		c.abortMultipartUpload(ctx, client, bucket, key, query.Get("uploadId"))
+
+	case method == http.MethodPut && ctx.GetHeader("X-Amz-Copy-Source") != "":
+		respondS3Error(ctx, s3.ErrNotImplemented.WithMessage("CopyObject is not supported."))
+	case method == http.MethodPut:
+		c.putObject(ctx, client, bucket, key)
+	case method == http.MethodGet, method == http.MethodHead:
+		c.getObject(ctx, client, bucket, key, method == http.MethodHead)
+	case method == http.MethodDelete:
+		c.deleteObject(ctx, client, bucket, key)
+	default:
+		respondS3Error(ctx, s3.ErrNotImplemented)
+	}
+}
+
+// homeScope resolves the user's home, which holds the buckets
+func (c *S3Controller) homeScope(ctx *gin.Context) (scope, error) {
+	return c.Files.resolvePath(ctx.GetString("username"), "/")
+}
+
+// bucketScope resolves a bucket to an existing top-level folder of the user's home
+func (c *S3Controller) bucketScope(ctx *gin.Context, client *sftp.Client, bucket string) (scope, error) {
+	if bucket == "." || bucket == ".." || strings.ContainsAny(bucket, `\`) {
+		return scope{}, s3.ErrNoSuchBucket
+	}
+	sc, err := c.Files.resolvePath(ctx.GetString("username"), "/"+bucket)
+	if err != nil || sc.Virtual || sc.Prefix != "/" {
+		// Shared folders and group spaces are not buckets
+		return scope{}, s3.ErrNoSuchBucket
+	}
+	if err := ensureWithinRoot(client, sc.Root, sc.Path); err != nil {
+		return scope{}, err
+	}
+	info, err := client.Stat(sc.Path)
+	if err != nil || !info.IsDir() {
+		return scope{}, s3.ErrNoSuchBucket
+	}
+	return sc, nil
+}
+
+// objectScope resolves a key below a bucket and applies the same checks as the JSON API.
+// Writes only need the parent inside the root, reads the object itself.
+func objectScope(client *sftp.Client, bucket scope, key string, want access) (scope, error) {
+	sc, err := objectAt(bucket, key)
+	if err != nil {
+		return scope{}, err
+	}
+	if err := checkAccess(sc, want); err != nil {
+		return scope{}, err
+	}
+	check := sc.Path
+	if want >= accessWrite {
+		check = sc.parentDir()
+	}
+	if err := ensureWithinRoot(client, sc.Root, check); err != nil {
+		return scope{}, err
+	}
+	return sc, nil
+}
+
+// objectAt maps a key onto a path below the bucket's folder.
+// Keys never leave the bucket, and those naming the bucket folder itself are refused.
+func objectAt(bucket scope, key string) (scope, error) {
+	real := scopePath(bucket.Path, key)
+	if real == bucket.Path || !isWithin(bucket.Path, real) {
+		return scope{}, s3.ErrInvalidArgument.WithMessage("Invalid object key.")
+	}
+	return bucket.at(real), nil
+}
+
+// mayReplace refuses to overwrite an existing object for roles that may only add new ones
+func mayReplace(ctx *gin.Context, existing os.FileInfo) error {
+	if existing != nil && !rolePermits(ctx.GetStringSlice("roles"), accessModify) {
+		return s3.ErrAccessDenied
+	}
+	return nil
+}
+
+// objectETag returns the MD5 when one is cached and a size/mtime tag otherwise
+func objectETag(realPath string, info os.FileInfo) string {
+	if sum, ok := checksums.get(newChecksumKey(realPath, AlgoMD5, info)); ok {
+		return `"` + sum + `"`
+	}
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// listBuckets lists the top-level folders of the user's home
+func (c *S3Controller) listBuckets(ctx *gin.Context, client *sftp.Client) {
+	home, err := c.homeScope(ctx)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	username := ctx.GetString("username")
+	c.Files.moveShadowedFolders(client, username)
+	entries, err := client.ReadDir(home.Path)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	// Folders that could not be moved out of the way of a virtual folder cannot be reached as buckets
+	shadowed := map[string]bool{}
+	for _, folder := range c.Files.virtualFolders(username) {
+		shadowed[folder.Name] = true
+	}
+	result := s3.ListAllMyBucketsResult{Owner: s3.Owner{ID: username, DisplayName: username}}
+	for _, entry := range entries {
+		if entry.IsDir() && !sftp.IsTempUpload(entry.Name()) && !shadowed[entry.Name()] {
+			result.Buckets = append(result.Buckets, s3.Bucket{Name: entry.Name(), CreationDate: s3.FormatTime(entry.ModTime())})
+		}
+	}
+	ctx.XML(http.StatusOK, result)
+}
+
+func (c *S3Controller) getBucketLocation(ctx *gin.Context, client *sftp.Client, bucket string) {
+	if _, err := c.bucketScope(ctx, client, bucket); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	ctx.XML(http.StatusOK, s3.LocationConstraint{Region: c.Verifier.Region})
+}
+
+func (c *S3Controller) headBucket(ctx *gin.Context, client *sftp.Client, bucket string) {
+	if _, err := c.bucketScope(ctx, client, bucket); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// createBucket creates a top-level folder
+func (c *S3Controller) createBucket(ctx *gin.Context, client *sftp.Client, bucket string) {
+	if !validBucketName.MatchString(bucket) {
+		respondS3Error(ctx, s3.ErrInvalidBucketName)
+		return
+	}
+	sc, err := c.Files.resolvePath(ctx.GetString("username"), "/"+bucket)
+	if err != nil || sc.Virtual || sc.Prefix != "/" {
+		respondS3Error(ctx, s3.ErrInvalidBucketName.WithMessage("The bucket name is reserved."))
+		return
+	}
+	if err := checkAccess(sc, accessCreate); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	if err := ensureWithinRoot(client, sc.Root, sc.parentDir()); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	if _, err := client.Lstat(sc.Path); err == nil {
+		respondS3Error(ctx, s3.ErrBucketAlreadyOwnedByYou)
+		return
+	}
+	if err := client.Mkdir(sc.Path); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	c.Files.publish(events.Event{Type: events.Created, Path: sc.Path, IsDir: true, Actor: ctx.GetString("username")})
+	ctx.Header("Location", "/"+bucket)
+	ctx.Status(http.StatusOK)
+}
+
+// deleteBucket removes an empty top-level folder
+func (c *S3Controller) deleteBucket(ctx *gin.Context, client *sftp.Client, bucket string) {
+	sc, err := c.bucketScope(ctx, client, bucket)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	if err := checkAccess(sc, accessModify); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	entries, err := client.ReadDir(sc.Path)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	if len(entries) > 0 {
+		respondS3Error(ctx, s3.ErrBucketNotEmpty)
+		return
+	}
+	if err := client.RemoveDirectory(sc.Path); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	c.Files.publish(events.Event{Type: events.Deleted, Path: sc.Path, IsDir: true, Actor: ctx.GetString("username")})
+	ctx.Status(http.StatusNoContent)
+}
+
+// listEntry is a candidate key of a listing; folders only show up in delimited listings
+type listEntry struct {
+	key  string
+	info os.FileInfo
+	real string
+}
+
+// collectKeys gathers the keys below prefix, sorted. With the "/" delimiter only the
+// folder holding prefix is read, and its subfolders become keys ending in "/".
+func collectKeys(client *sftp.Client, bucket scope, prefix, delimiter string) ([]listEntry, error) {
+	base := prefix[:strings.LastIndex(prefix, "/")+1]
+	dir := scopePath(bucket.Path, base)
+	if !isWithin(bucket.Path, dir) {
+		return nil, nil
+	}
+	if err := ensureWithinRoot(client, bucket.Root, dir); err != nil {
+		return nil, err
+	}
+
+	var entries []listEntry
+	if delimiter == "/" {
+		infos, err := client.ReadDir(dir)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if sftp.IsTempUpload(info.Name()) {
+				continue
+			}
+			entry := listEntry{key: base + info.Name(), info: info, real: path.Join(dir, info.Name())}
+			switch {
+			case info.IsDir():
+				entry.key += "/"
+			case !info.Mode().IsRegular():
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	} else {
+		walker := client.Walk(dir)
+		for walker.Step() {
+			if walker.Err() != nil {
+				continue
+			}
+			info := walker.Stat()
+			if !info.Mode().IsRegular() || sftp.IsTempUpload(info.Name()) {
+				continue
+			}
+			key := strings.TrimPrefix(walker.Path(), bucket.Path+"/")
+			entries = append(entries, listEntry{key: key, info: info, real: walker.Path()})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+// listObjects implements ListObjectsV2
+func (c *S3Controller) listObjects(ctx *gin.Context, client *sftp.Client, bucket string) {
+	sc, err := c.bucketScope(ctx, client, bucket)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	query := ctx.Request.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := s3DefaultMaxKeys
+	if value := query.Get("max-keys"); value != "" {
+		if maxKeys, err = strconv.Atoi(value); err != nil || maxKeys < 0 {
+			respondS3Error(ctx, s3.ErrInvalidArgument.WithMessage("max-keys must be a non-negative integer."))
+			return
+		}
+		maxKeys = min(maxKeys, s3DefaultMaxKeys)
+	}
+	encodeURL := query.Get("encoding-type") == "url"
+	encode := func(s string) string {
+		if encodeURL {
+			return url.QueryEscape(s)
+		}
+		return s
+	}
+
+	marker := query.Get("start-after")
+	token := query.Get("continuation-token")
+	if token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			respondS3Error(ctx, s3.ErrInvalidArgument.WithMessage("The continuation token provided is incorrect."))
+			return
+		}
+		marker = string(decoded)
+	}
+
+	entries, err := collectKeys(client, sc, prefix, delimiter)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	result := s3.ListBucketResult{
+		Name:              bucket,
+		Prefix:            encode(prefix),
+		Delimiter:         encode(delimiter),
+		MaxKeys:           maxKeys,
+		ContinuationToken: token,
+		StartAfter:        encode(query.Get("start-after")),
+	}
+	if encodeURL {
+		result.EncodingType = "url"
+	}
+
+	last := ""
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.key, prefix) {
+			continue
+		}
+		name, isPrefix := entry.key, false
+		if delimiter != "" {
+			if i := strings.Index(entry.key[len(prefix):], delimiter); i >= 0 {
+				name, isPrefix = entry.key[:len(prefix)+i+len(delimiter)], true
+			}
+		}
+		if name <= marker || name == last {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		last = name
+		result.KeyCount++
+
+		if isPrefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3.CommonPrefix{Prefix: encode(name)})
+			continue
+		}
+		if entry.info.IsDir() {
+			// A folder only lists as an object when the delimiter does not roll it up
+			result.KeyCount--
+			continue
+		}
+		result.Contents = append(result.Contents, s3.Object{
+			Key:          encode(name),
+			LastModified: s3.FormatTime(entry.info.ModTime()),
+			ETag:         objectETag(entry.real, entry.info),
+			Size:         entry.info.Size(),
+			StorageClass: s3StandardClass,
+		})
+	}
+
+	ctx.XML(http.StatusOK, result)
+}
+
+// getObject serves GetObject and HeadObject, including range and conditional requests
+func (c *S3Controller) getObject(ctx *gin.Context, client *sftp.Client, bucket, key string, headOnly bool) {
+	bsc, err := c.bucketScope(ctx, client, bucket)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	sc, err := objectScope(client, bsc, key, accessRead)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	info, err := client.Stat(sc.Path)
+	if err != nil || info.IsDir() || strings.HasSuffix(key, "/") {
+		respondS3Error(ctx, s3.ErrNoSuchKey)
+		return
+	}
+
+	ctx.Header("ETag", objectETag(sc.Path, info))
+	ctx.Header("Content-Type", mimeByExtension(path.Base(sc.Path)))
+	ctx.Header("Accept-Ranges", "bytes")
+
+	if headOnly {
+		ctx.Header("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		ctx.Header("Content-Length", strconv.FormatInt(info.Size(), 10))
+		ctx.Status(http.StatusOK)
+		return
+	}
+
+	file, err := client.Open(sc.Path)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	defer file.Close()
+	w := c.Files.limitResponse(ctx, throttle.Account{User: ctx.GetString("username")})
+	http.ServeContent(w, ctx.Request, path.Base(sc.Path), info.ModTime(), file)
+}
+
+// requestBody returns the verified body and its length, or -1 when unknown
+func requestBody(ctx *gin.Context) (io.Reader, int64, error) {
+	signed := ctx.MustGet(s3SignedKey).(*s3.Signed)
+	size := ctx.Request.ContentLength
+	if signed.Streaming() {
+		decoded, err := strconv.ParseInt(ctx.GetHeader(s3DecodedLengthHead), 10, 64)
+		if err != nil {
+			return nil, 0, s3.ErrInvalidRequest.WithMessage("Missing or invalid " + s3DecodedLengthHead + " header.")
+		}
+		size = decoded
+	}
+	return signed.Body(ctx.Request.Body), size, nil
+}
+
+// contentMD5 decodes the optional Content-MD5 header
+func contentMD5(ctx *gin.Context) ([]byte, error) {
+	header := ctx.GetHeader("Content-MD5")
+	if header == "" {
+		return nil, nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || len(sum) != md5.Size {
+		return nil, s3.ErrInvalidDigest
+	}
+	return sum, nil
+}
+
+// writeObject stores body at target atomically and returns the MD5 of what was written
+func writeObject(client *sftp.Client, target string, body io.Reader, size int64, expected []byte) ([]byte, error) {
+	hash := md5.New()
+	_, err := sftp.WriteAtomic(client, target, io.TeeReader(body, hash), sftp.UploadOptions{
+		Overwrite:    true,
+		ExpectedSize: size,
+		Verify: func(string, int64) error {
+			if expected != nil && !bytes.Equal(hash.Sum(nil), expected) {
+				return s3.ErrBadDigest
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// putObject implements PutObject; keys ending in "/" create folders
+func (c *S3Controller) putObject(ctx *gin.Context, client *sftp.Client, bucket, key string) {
+	bsc, err := c.bucketScope(ctx, client, bucket)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	sc, err := objectScope(client, bsc, key, accessCreate)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	body, size, err := requestBody(ctx)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	expected, err := contentMD5(ctx)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	if strings.HasSuffix(key, "/") {
+		// Folder markers carry no data
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			respondS3Error(ctx, err)
+			return
+		}
+		_, statErr := client.Stat(sc.Path)
+		if err := client.MkdirAll(sc.Path); err != nil {
+			respondS3Error(ctx, err)
+			return
+		}
+		if statErr != nil {
+			c.Files.publish(events.Event{Type: events.Created, Path: sc.Path, IsDir: true, Actor: ctx.GetString("username")})
+		}
+		ctx.Header("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		ctx.Status(http.StatusOK)
+		return
+	}
+
+	existing, err := client.Stat(sc.Path)
+	if err == nil && existing.IsDir() {
+		respondS3Error(ctx, s3.ErrInvalidRequest.WithMessage("The key names an existing folder."))
+		return
+	}
+	if err := mayReplace(ctx, existing); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	if err := client.MkdirAll(path.Dir(sc.Path)); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	sum, err := writeObject(client, sc.Path, body, size, expected)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	etag := hex.EncodeToString(sum)
+	if info, err := client.Stat(sc.Path); err == nil {
+		checksums.put(newChecksumKey(sc.Path, AlgoMD5, info), etag)
+	}
+	c.Files.publishWrite(ctx.GetString("username"), sc.Path, existing != nil)
+
+	ctx.Header("ETag", `"`+etag+`"`)
+	ctx.Status(http.StatusOK)
+}
+
+// deleteObject implements DeleteObject; missing keys succeed like they do on S3
+func (c *S3Controller) deleteObject(ctx *gin.Context, client *sftp.Client, bucket, key string) {
+	bsc, err := c.bucketScope(ctx, client, bucket)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	sc, err := objectScope(client, bsc, key, accessModify)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	info, err := client.Lstat(sc.Path)
+	switch {
+	case err != nil:
+	case info.IsDir():
+		// Only an empty folder behaves like a folder marker; anything else is left alone
+		if strings.HasSuffix(key, "/") && client.RemoveDirectory(sc.Path) == nil {
+			c.Files.publish(events.Event{Type: events.Deleted, Path: sc.Path, IsDir: true, Actor: ctx.GetString("username")})
+		}
+	default:
+		if err := client.Remove(sc.Path); err != nil {
+			respondS3Error(ctx, err)
+			return
+		}
+		c.Files.publish(events.Event{Type: events.Deleted, Path: sc.Path, Actor: ctx.GetString("username")})
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// partsDir is the server folder holding the parts of an upload until it completes.
+// It lies outside every home, so parts never show up in listings, and only
+// the expiry of the upload, never the temp upload cleaner, removes them.
+func partsDir(uploadID string) string {
+	return path.Join(s3PartsRoot, uploadID)
+}
+
+// partPath is where a part waits for completion
+func partPath(uploadID string, number int) string {
+	return path.Join(partsDir(uploadID), fmt.Sprintf("%05d", number))
+}
+
+func (c *S3Controller) createMultipartUpload(ctx *gin.Context, client *sftp.Client, bucket, key string) {
+	bsc, err := c.bucketScope(ctx, client, bucket)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	sc, err := objectScope(client, bsc, key, accessCreate)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	// Refuse early what completing the upload would refuse
+	existing, _ := client.Stat(sc.Path)
+	if err := mayReplace(ctx, existing); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	upload, err := c.Uploads.Create(ctx.GetString("username"), bucket, key)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	ctx.XML(http.StatusOK, s3.InitiateMultipartUploadResult{Bucket: bucket, Key: key, UploadID: upload.ID})
+}
+
+func (c *S3Controller) uploadPart(ctx *gin.Context, client *sftp.Client, bucket, key, uploadID, partNumber string) {
+	number, err := strconv.Atoi(partNumber)
+	if err != nil || number < 1 || number > s3.MaxPartNumber {
+		respondS3Error(ctx, s3.ErrInvalidArgument.WithMessage("Part number must be an integer between 1 and 10000, inclusive."))
+		return
+	}
+	upload, err := c.Uploads.Get(ctx.GetString("username"), bucket, key, uploadID)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	if _, err := c.bucketScope(ctx, client, bucket); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	body, size, err := requestBody(ctx)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	expected, err := contentMD5(ctx)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	if err := client.MkdirAll(partsDir(upload.ID)); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	target := partPath(upload.ID, number)
+	sum, err := writeObject(client, target, body, size, expected)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	info, err := client.Stat(target)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	etag := hex.EncodeToString(sum)
+	part := s3.PartInfo{Number: number, ETag: etag, Size: info.Size(), LastModified: info.ModTime().UTC()}
+	if err := c.Uploads.PutPart(upload.ID, part); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	ctx.Header("ETag", `"`+etag+`"`)
+	ctx.Status(http.StatusOK)
+}
+
+// partsReader streams the parts one after another, opening each only when it is reached
+type partsReader struct {
+	client  *sftp.Client
+	paths   []string
+	current *sftp.File
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			file, err := r.client.Open(r.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.paths = file, r.paths[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() {
+	if r.current != nil {
+		r.current.Close()
+	}
+}
+
+func (c *S3Controller) completeMultipartUpload(ctx *gin.Context, client *sftp.Client, bucket, key, uploadID string) {
+	upload, err := c.Uploads.Get(ctx.GetString("username"), bucket, key, uploadID)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	body, _, err := requestBody(ctx)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	var completeReq s3.CompleteMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(body, s3MaxCompleteBody)).Decode(&completeReq); err != nil || len(completeReq.Parts) == 0 {
+		respondS3Error(ctx, s3.ErrMalformedXML)
+		return
+	}
+
+	bsc, err := c.bucketScope(ctx, client, bucket)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	sc, err := objectScope(client, bsc, key, accessCreate)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	paths, size, etag, err := assembleParts(upload, completeReq.Parts)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	existing, err := client.Stat(sc.Path)
+	if err == nil && existing.IsDir() {
+		respondS3Error(ctx, s3.ErrInvalidRequest.WithMessage("The key names an existing folder."))
+		return
+	}
+	if err := mayReplace(ctx, existing); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	if err := client.MkdirAll(path.Dir(sc.Path)); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+
+	parts := &partsReader{client: client, paths: paths}
+	sum, err := writeObject(client, sc.Path, parts, size, nil)
+	parts.Close()
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	if info, err := client.Stat(sc.Path); err == nil {
+		checksums.put(newChecksumKey(sc.Path, AlgoMD5, info), hex.EncodeToString(sum))
+	}
+	c.Files.publishWrite(ctx.GetString("username"), sc.Path, existing != nil)
+
+	c.removeParts(client, upload)
+	ctx.XML(http.StatusOK, s3.CompleteMultipartUploadResult{
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     etag,
+	})
+}
+
+// assembleParts checks the parts a client completes an upload with against those it uploaded.
+// It returns the part files in order, the object size and the multipart ETag, which is
+// the MD5 of the concatenated part MD5s suffixed with the part count.
+func assembleParts(upload *s3.Upload, requested []s3.CompletedPart) ([]string, int64, string, error) {
+	var paths []string
+	var size int64
+	etagHash := md5.New()
+	for i, req := range requested {
+		if i > 0 && req.PartNumber <= requested[i-1].PartNumber {
+			return nil, 0, "", s3.ErrInvalidPartOrder
+		}
+		part, ok := upload.Parts[req.PartNumber]
+		if !ok || strings.Trim(req.ETag, `"`) != part.ETag {
+			return nil, 0, "", s3.ErrInvalidPart
+		}
+		sum, _ := hex.DecodeString(part.ETag)
+		etagHash.Write(sum)
+		paths = append(paths, partPath(upload.ID, part.Number))
+		size += part.Size
+	}
+	return paths, size, fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(etagHash.Sum(nil)), len(requested)), nil
+}
+
+// removeParts deletes the stored parts of an upload and forgets it
+func (c *S3Controller) removeParts(client *sftp.Client, upload *s3.Upload) {
+	sftp.RemoveTree(client, partsDir(upload.ID))
+	c.Uploads.Remove(upload.ID)
+}
+
+// ExpireUploads aborts the multipart uploads that have been idle for too long and deletes their parts.
+// It returns how many uploads expired.
+func (c *S3Controller) ExpireUploads() (int, error) {
+	expired, err := c.Uploads.Expire()
+	if len(expired) == 0 {
+		return 0, err
+	}
+	client, connErr := c.Files.connect()
+	if connErr != nil {
+		return 0, connErr
+	}
+	defer client.Close()
+
+	for _, upload := range expired {
+		if err := sftp.RemoveTree(client, partsDir(upload.ID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete parts of expired multipart upload %s: %v", upload.ID, err)
+		}
+	}
+	return len(expired), err
+}
+
+func (c *S3Controller) abortMultipartUpload(ctx *gin.Context, client *sftp.Client, bucket, key, uploadID string) {
+	upload, err := c.Uploads.Get(ctx.GetString("username"), bucket, key, uploadID)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	if _, err := c.bucketScope(ctx, client, bucket); err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	c.removeParts(client, upload)
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *S3Controller) listParts(ctx *gin.Context, client *sftp.Client, bucket, key, uploadID string) {
+	upload, err := c.Uploads.Get(ctx.GetString("username"), bucket, key, uploadID)
+	if err != nil {
+		respondS3Error(ctx, err)
+		return
+	}
+	result := s3.ListPartsResult{Bucket: bucket, Key: key, UploadID: upload.ID, StorageClass: s3StandardClass}
+	for _, part := range upload.SortedParts() {
+		result.Parts = append(result.Parts, s3.ListedPart{
+			PartNumber:   part.Number,
+			LastModified: s3.FormatTime(part.LastModified),
+			ETag:         `"` + part.ETag + `"`,
+			Size:         part.Size,
+		})
+	}
+	ctx.XML(http.StatusOK, result)
+}
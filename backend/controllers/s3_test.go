@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+
+	"manschko.com/cloud-storage/s3"
+)
+
+func TestObjectAtStaysInBucket(t *testing.T) {
+	bucket := scope{Path: "/alice/photos", Root: "/alice", Prefix: "/", Owner: "alice", Writable: true}
+	for _, tt := range []struct {
+		key, want string
+	}{
+		{"a.jpg", "/alice/photos/a.jpg"},
+		{"2024/summer/a.jpg", "/alice/photos/2024/summer/a.jpg"},
+		{"/a.jpg", "/alice/photos/a.jpg"},
+		{"../a.jpg", "/alice/photos/a.jpg"},
+		{"../../../etc/passwd", "/alice/photos/etc/passwd"},
+		{"2024/../../docs/a.pdf", "/alice/photos/docs/a.pdf"},
+		{"..\\a.jpg", "/alice/photos/..\\a.jpg"},
+	} {
+		sc, err := objectAt(bucket, tt.key)
+		if err != nil {
+			t.Errorf("objectAt(%q) error = %v", tt.key, err)
+			continue
+		}
+		if sc.Path != tt.want || sc.Root != bucket.Root || sc.Fixed {
+			t.Errorf("objectAt(%q) = %+v, want path %s", tt.key, sc, tt.want)
+		}
+	}
+}
+
+func TestObjectAtRefusesTheBucketItself(t *testing.T) {
+	bucket := scope{Path: "/alice/photos", Root: "/alice", Prefix: "/", Owner: "alice", Writable: true}
+	for _, key := range []string{"", "/", ".", "..", "a/..", "../photos/.."} {
+		if sc, err := objectAt(bucket, key); err == nil {
+			t.Errorf("objectAt(%q) = %s, want an error", key, sc.Path)
+		}
+	}
+}
+
+func TestAssembleParts(t *testing.T) {
+	md5Hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	completed := func(number int, etag string) s3.CompletedPart {
+		return s3.CompletedPart{PartNumber: number, ETag: etag}
+	}
+	upload := &s3.Upload{ID: "u1", Parts: map[int]s3.PartInfo{
+		1: {Number: 1, ETag: md5Hex("first"), Size: 5},
+		2: {Number: 2, ETag: md5Hex("second"), Size: 6},
+		4: {Number: 4, ETag: md5Hex("fourth"), Size: 6},
+	}}
+
+	paths, size, etag, err := assembleParts(upload, []s3.CompletedPart{
+		{PartNumber: 1, ETag: `"` + md5Hex("first") + `"`},
+		{PartNumber: 4, ETag: md5Hex("fourth")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := hex.DecodeString(md5Hex("first"))
+	fourth, _ := hex.DecodeString(md5Hex("fourth"))
+	want := md5.Sum(append(first, fourth...))
+	if etag != `"`+hex.EncodeToString(want[:])+`-2"` {
+		t.Fatalf("ETag = %s", etag)
+	}
+	if size != 11 || len(paths) != 2 || paths[0] != partPath("u1", 1) || paths[1] != partPath("u1", 4) {
+		t.Fatalf("got %v of %d bytes", paths, size)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		parts []s3.CompletedPart
+		want  *s3.Error
+	}{
+		{"descending", []s3.CompletedPart{completed(2, md5Hex("second")), completed(1, md5Hex("first"))}, s3.ErrInvalidPartOrder},
+		{"repeated", []s3.CompletedPart{completed(1, md5Hex("first")), completed(1, md5Hex("first"))}, s3.ErrInvalidPartOrder},
+		{"missing", []s3.CompletedPart{completed(1, md5Hex("first")), completed(3, md5Hex("third"))}, s3.ErrInvalidPart},
+		{"wrong ETag", []s3.CompletedPart{completed(2, md5Hex("first"))}, s3.ErrInvalidPart},
+	} {
+		if _, _, _, err := assembleParts(upload, tt.parts); err != tt.want {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/auth"
+	"manschko.com/cloud-storage/shares"
+	"manschko.com/cloud-storage/throttle"
+)
+
+// CreateShareRequest describes a new public link
+type CreateShareRequest struct {
+	Path         string `json:"path" binding:"required"`
+	ExpiresAt    string `json:"expires_at"` // RFC 3339
+	ExpiresIn    int64  `json:"expires_in"` // seconds, alternative to ExpiresAt
+	Password     string `json:"password"`
+	MaxDownloads int    `json:"max_downloads"`
+	AllowBrowse  bool   `json:"allow_browse"`
+}
+
+// ShareResponse is how a share is shown to its owner
+type ShareResponse struct {
+	ID           string     `json:"id"`
+	URL          string     `json:"url"`
+	Token        string     `json:"token"`
+	Path         string     `json:"path"`
+	IsDir        bool       `json:"is_dir"`
+	AllowBrowse  bool       `json:"allow_browse"`
+	HasPassword  bool       `json:"has_password"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	Views        int        `json:"views"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	LastAccessAt *time.Time `json:"last_access_at,omitempty"`
+}
+
+// ShareController manages public share links and serves them to anonymous visitors
+type ShareController struct {
+	Files  *FileController
+	Shares *shares.Store
+
+	// Guard throttles password guessing per link and address; nil disables it
+	Guard *auth.LoginGuard
+}
+
+// NewShareController creates a new share controller
+func NewShareController(files *FileController, store *shares.Store) *ShareController {
+	return &ShareController{
+		Files:  files,
+		Shares: store,
+	}
+}
+
+func newShareResponse(share shares.Share) ShareResponse {
+	return ShareResponse{
+		ID:           share.ID,
+		URL:          "/s/" + share.Token,
+		Token:        share.Token,
+		Path:         share.Path,
+		IsDir:        share.IsDir,
+		AllowBrowse:  share.AllowBrowse,
+		HasPassword:  share.HasPassword(),
+		MaxDownloads: share.MaxDownloads,
+		Downloads:    share.Downloads,
+		Views:        share.Views,
+		CreatedAt:    share.CreatedAt,
+		ExpiresAt:    share.ExpiresAt,
+		LastAccessAt: share.LastAccessAt,
+	}
+}
+
+// parseExpiry turns the request's expiry fields into an absolute time
+func parseExpiry(expiresAt string, expiresIn int64) (*time.Time, error) {
+	switch {
+	case expiresAt != "":
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("expires_at must be an RFC 3339 timestamp")
+		}
+		if t.Before(time.Now()) {
+			return nil, fmt.Errorf("expires_at is in the past")
+		}
+		t = t.UTC()
+		return &t, nil
+	case expiresIn > 0:
+		t := time.Now().UTC().Add(time.Duration(expiresIn) * time.Second)
+		return &t, nil
+	case expiresIn < 0:
+		return nil, fmt.Errorf("expires_in must be positive")
+	}
+	return nil, nil
+}
+
+// CreateShare creates a public link for a file or folder of the authenticated user
+func (c *ShareController) CreateShare(ctx *gin.Context) {
+	var shareReq CreateShareRequest
+	if err := ctx.ShouldBindJSON(&shareReq); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if shareReq.MaxDownloads < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "max_downloads must not be negative"})
+		return
+	}
+	expiresAt, err := parseExpiry(shareReq.ExpiresAt, shareReq.ExpiresIn)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	username := ctx.GetString("username")
+	scopedPath, err := getUserScopedPath(ctx, shareReq.Path)
+	if errors.Is(err, errTokenPath) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "This access token is not valid for the path"})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	client, err := c.Files.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	if !confined(ctx, client, scopedPath) {
+		return
+	}
+	info, err := client.Stat(scopedPath)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Failed to get file info: %v", err)})
+		return
+	}
+
+	share, err := c.Shares.Create(username, shares.Options{
+		Path:         toUserPath(userRoot(username), scopedPath),
+		IsDir:        info.IsDir(),
+		AllowBrowse:  shareReq.AllowBrowse,
+		Password:     shareReq.Password,
+		MaxDownloads: shareReq.MaxDownloads,
+		ExpiresAt:    expiresAt,
+	})
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create share: %v", err)})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, newShareResponse(*share))
+}
+
+// ListShares lists the authenticated user's share links
+func (c *ShareController) ListShares(ctx *gin.Context) {
+	list := []ShareResponse{}
+	for _, share := range c.Shares.ListByOwner(ctx.GetString("username")) {
+		list = append(list, newShareResponse(share))
+	}
+	ctx.JSON(http.StatusOK, list)
+}
+
+// RevokeShare deletes one of the authenticated user's share links
+func (c *ShareController) RevokeShare(ctx *gin.Context) {
+	err := c.Shares.Revoke(ctx.GetString("username"), ctx.Param("id"))
+	if errors.Is(err, shares.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to revoke share: %v", err)})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Share revoked"})
+}
+
+// respondShareError maps share access errors onto HTTP responses
+func respondShareError(ctx *gin.Context, err error) {
+	var blocked *auth.BlockedError
+	switch {
+	case errors.As(err, &blocked):
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(blocked.RetryAfter.Seconds()))))
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many wrong passwords, try again later"})
+	case errors.Is(err, auth.ErrTooManyLogins):
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many password checks in progress, try again shortly"})
+	case errors.Is(err, shares.ErrNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+	case errors.Is(err, shares.ErrExpired):
+		ctx.JSON(http.StatusGone, gin.H{"error": "Share has expired"})
+	case errors.Is(err, shares.ErrDownloadLimit):
+		ctx.JSON(http.StatusGone, gin.H{"error": "Share download limit reached"})
+	case errors.Is(err, shares.ErrPasswordRequired):
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Password required", "password_required": true})
+	case errors.Is(err, shares.ErrInvalidPassword):
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password", "password_required": true})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to open share: %v", err)})
+	}
+}
+
+// openShare checks the visitor's password, if any, through the guard so wrong guesses back off
+func (c *ShareController) openShare(ctx *gin.Context, token, password string) (*shares.Share, error) {
+	if password == "" {
+		// Without a password nothing is being guessed
+		return c.Shares.Open(token, password)
+	}
+	var share *shares.Share
+	err := c.Guard.AttemptShare(ctx.ClientIP(), token, func() (err error) {
+		share, err = c.Shares.Open(token, password)
+		if errors.Is(err, shares.ErrInvalidPassword) {
+			return fmt.Errorf("%w: %w", auth.ErrInvalidCredentials, err)
+		}
+		return err
+	})
+	return share, err
+}
+
+// OpenShare serves a share link to an anonymous visitor.
+// File shares download directly; folder shares list or download entries below the shared folder.
+// The password is only taken from the X-Share-Password header, never the URL, so it stays out of logs.
+func (c *ShareController) OpenShare(ctx *gin.Context) {
+	token := ctx.Param("token")
+	share, err := c.openShare(ctx, token, ctx.GetHeader("X-Share-Password"))
+	if err != nil {
+		respondShareError(ctx, err)
+		return
+	}
+
+	subPath := ctx.Param("path")
+	if !share.IsDir && subPath != "" && subPath != "/" {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	shareRoot := scopePath(userRoot(share.Owner), share.Path)
+	target := scopePath(shareRoot, subPath)
+
+	client, err := c.Files.connect()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("SFTP connection error: %v", err)})
+		return
+	}
+	defer client.Close()
+
+	if !confinedTo(ctx, client, shareRoot, target) {
+		return
+	}
+	info, err := client.Stat(target)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	if info.IsDir() {
+		if !share.AllowBrowse {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "Browsing is not allowed for this share"})
+			return
+		}
+		relDir := toUserPath(shareRoot, target)
+		entries, err := readDirectory(client, scope{Path: target, Root: shareRoot, Prefix: "/"}, metadataFields{})
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read directory: %v", err)})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"name":       filepath.Base(shareRoot),
+			"path":       relDir,
+			"expires_at": share.ExpiresAt,
+			"entries":    entries,
+		})
+		return
+	}
+
+	account := throttle.Account{Share: share.ID}
+	release, ok := c.Files.beginTransfer(ctx, account)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Only downloads that actually start count against the limit
+	c.Files.serveFile(ctx, client, target, account, func() bool {
+		if err := c.Shares.RecordDownload(token); err != nil {
+			respondShareError(ctx, err)
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/throttle"
+)
+
+// transferRetryAfter is how long a client refused a transfer slot is asked to wait
+const transferRetryAfter = 5 * time.Second
+
+// acquireTransfer takes one of the account's transfer slots. When none frees up in time
+// it sets Retry-After and returns the error, leaving the response body to the caller.
+func (c *FileController) acquireTransfer(ctx *gin.Context, account throttle.Account) (release func(), err error) {
+	if c.Transfers == nil {
+		return func() {}, nil
+	}
+	release, err = c.Transfers.Acquire(ctx.Request.Context(), account)
+	if err != nil {
+		ctx.Header("Retry-After", strconv.Itoa(int(transferRetryAfter/time.Second)))
+	}
+	return release, err
+}
+
+// beginTransfer is acquireTransfer for the JSON API; it writes the 429 itself
+func (c *FileController) beginTransfer(ctx *gin.Context, account throttle.Account) (release func(), ok bool) {
+	release, err := c.acquireTransfer(ctx, account)
+	if err != nil {
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many simultaneous transfers, try again later"})
+		return nil, false
+	}
+	return release, true
+}
+
+// limitReader applies the rate limits of account to data read from r
+func (c *FileController) limitReader(ctx *gin.Context, r io.Reader, dir throttle.Direction, account throttle.Account) io.Reader {
+	if c.Transfers == nil {
+		return r
+	}
+	return c.Transfers.Reader(ctx.Request.Context(), r, dir, account)
+}
+
+// limitWriter applies the rate limits of account to data written to w
+func (c *FileController) limitWriter(ctx *gin.Context, w io.Writer, dir throttle.Direction, account throttle.Account) io.Writer {
+	if c.Transfers == nil {
+		return w
+	}
+	return c.Transfers.Writer(ctx.Request.Context(), w, dir, account)
+}
+
+// limitedBody is a request body read through the rate limits
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// limitBody applies the upload limits of account to the request body
+func (c *FileController) limitBody(ctx *gin.Context, account throttle.Account) {
+	if c.Transfers == nil || ctx.Request.Body == nil {
+		return
+	}
+	body := ctx.Request.Body
+	ctx.Request.Body = limitedBody{Reader: c.limitReader(ctx, body, throttle.Upload, account), Closer: body}
+}
+
+// limitedResponseWriter is a response written through the rate limits
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (w limitedResponseWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// limitResponse returns the response writer with the download limits of account applied
+func (c *FileController) limitResponse(ctx *gin.Context, account throttle.Account) http.ResponseWriter {
+	if c.Transfers == nil {
+		return ctx.Writer
+	}
+	return limitedResponseWriter{ResponseWriter: ctx.Writer, w: c.limitWriter(ctx, ctx.Writer, throttle.Download, account)}
+}
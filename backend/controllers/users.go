@@ -0,0 +1,279 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/auth"
+	"manschko.com/cloud-storage/sftpgo"
+	"manschko.com/cloud-storage/storage"
+)
+
+// CreateUserRequest describes a new account; without a password one is generated
+type CreateUserRequest struct {
+	Username    string `json:"username" binding:"required"`
+	Password    string `json:"password"`
+	Email       string `json:"email"`
+	Description string `json:"description"`
+}
+
+// ResetPasswordRequest sets a new password; without one a password is generated
+type ResetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// UserResponse is an account as shown to admins. Password is only set once, when it was generated.
+type UserResponse struct {
+	sftpgo.User
+	Password string `json:"password,omitempty"`
+}
+
+// UserController lets admins manage the accounts of the SFTP server
+type UserController struct {
+	Files *FileController
+	Users sftpgo.Client
+	// Logout ends the sessions and revokes the credentials of a user who was disabled,
+	// deleted or given a new password
+	Logout func(username string) error
+	// Revoke takes back the share links, file requests, grants and group memberships
+	// of a user who was disabled or deleted; nil keeps them
+	Revoke func(username string) error
+}
+
+// NewUserController creates a new user controller; users may be nil when user management is not configured
+func NewUserController(files *FileController, users sftpgo.Client, logout func(username string) error) *UserController {
+	return &UserController{
+		Files:  files,
+		Users:  users,
+		Logout: logout,
+	}
+}
+
+// generatedPasswordSize is the random bytes in generated passwords, printed as 22 characters
+const generatedPasswordSize = 16
+
+// choosePassword returns password, or when it is empty a generated one that is also returned as generated
+func choosePassword(password string) (chosen, generated string, err error) {
+	if password != "" {
+		return password, "", nil
+	}
+	generated, err = storage.RandomToken(generatedPasswordSize)
+	return generated, generated, err
+}
+
+// usable checks that user management is configured, responding otherwise.
+// Only admins reach these handlers, which the /api/admin routes ensure.
+func (c *UserController) usable(ctx *gin.Context) bool {
+	if c.Users == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "User management is not configured"})
+		return false
+	}
+	return true
+}
+
+// respondUserError maps errors of the SFTP server onto HTTP responses
+func respondUserError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, sftpgo.ErrUserNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, sftpgo.ErrUserExists):
+		ctx.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+	case errors.Is(err, sftpgo.ErrInvalidUser):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("SFTP server error: %v", err)})
+	}
+}
+
+// logout ends the sessions of username, logging failures as the change itself was made
+func (c *UserController) logout(username string) {
+	if c.Logout == nil {
+		return
+	}
+	if err := c.Logout(username); err != nil {
+		log.Printf("Failed to log out %q: %v", username, err)
+	}
+}
+
+// revoke takes back what username shared or was given, logging failures as the change itself was made
+func (c *UserController) revoke(username string) {
+	if c.Revoke == nil {
+		return
+	}
+	if err := c.Revoke(username); err != nil {
+		log.Printf("Failed to revoke the access of %q: %v", username, err)
+	}
+}
+
+// notSelf refuses changes admins would lock themselves out with
+func notSelf(ctx *gin.Context, username, action string) bool {
+	if username == ctx.GetString("username") {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("You cannot %s your own account", action)})
+		return false
+	}
+	return true
+}
+
+// ListUsers lists the accounts of the SFTP server. Admins only.
+func (c *UserController) ListUsers(ctx *gin.Context) {
+	if !c.usable(ctx) {
+		return
+	}
+	users, err := c.Users.ListUsers(ctx.Request.Context())
+	if err != nil {
+		respondUserError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, users)
+}
+
+// CreateUser adds an account and creates its home folder, so the user finds their files
+// at once. Admins only.
+func (c *UserController) CreateUser(ctx *gin.Context) {
+	if !c.usable(ctx) {
+		return
+	}
+	var userReq CreateUserRequest
+	if err := ctx.ShouldBindJSON(&userReq); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	// Homes sit next to the hidden group spaces folder on the server, so a user may not take its name
+	if !sftpgo.ValidUsername(userReq.Username) || !auth.UsableUsername(userReq.Username) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
+		return
+	}
+
+	password, generated, err := choosePassword(userReq.Password)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate password"})
+		return
+	}
+
+	user, err := c.Users.CreateUser(ctx.Request.Context(), sftpgo.NewUser{
+		Username:    userReq.Username,
+		Password:    password,
+		Email:       userReq.Email,
+		Description: userReq.Description,
+	})
+	if err != nil {
+		respondUserError(ctx, err)
+		return
+	}
+
+	if err := c.provisionHome(user.Username); err != nil {
+		// Without a home the account is of no use, so it is removed again
+		if delErr := c.Users.DeleteUser(ctx.Request.Context(), user.Username); delErr != nil {
+			log.Printf("Failed to remove %q after provisioning failed: %v", user.Username, delErr)
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create home folder: %v", err)})
+		return
+	}
+
+	log.Printf("User %q created by %s", user.Username, ctx.GetString("username"))
+	ctx.JSON(http.StatusCreated, UserResponse{User: user, Password: generated})
+}
+
+// provisionHome creates the home folder the file operations of username resolve to
+func (c *UserController) provisionHome(username string) error {
+	client, err := c.Files.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.MkdirAll(userRoot(username))
+}
+
+// setEnabled enables or disables the account named in the path
+func (c *UserController) setEnabled(ctx *gin.Context, enabled bool) {
+	if !c.usable(ctx) {
+		return
+	}
+	username := ctx.Param("username")
+	if !enabled && !notSelf(ctx, username, "disable") {
+		return
+	}
+	if err := c.Users.SetEnabled(ctx.Request.Context(), username, enabled); err != nil {
+		respondUserError(ctx, err)
+		return
+	}
+
+	if enabled {
+		log.Printf("User %q enabled by %s", username, ctx.GetString("username"))
+		ctx.JSON(http.StatusOK, gin.H{"message": "User enabled"})
+		return
+	}
+	c.logout(username)
+	c.revoke(username)
+	log.Printf("User %q disabled by %s", username, ctx.GetString("username"))
+	ctx.JSON(http.StatusOK, gin.H{"message": "User disabled"})
+}
+
+// DisableUser keeps a user from logging in, ends their sessions and revokes what they shared.
+// Enabling them again does not bring back their links, grants or group memberships. Admins only.
+func (c *UserController) DisableUser(ctx *gin.Context) {
+	c.setEnabled(ctx, false)
+}
+
+// EnableUser lets a disabled user log in again. Admins only.
+func (c *UserController) EnableUser(ctx *gin.Context) {
+	c.setEnabled(ctx, true)
+}
+
+// ResetPassword gives a user a new password and ends their sessions. Admins only.
+func (c *UserController) ResetPassword(ctx *gin.Context) {
+	if !c.usable(ctx) {
+		return
+	}
+	// The body is optional, as without a password one is generated
+	var resetReq ResetPasswordRequest
+	if err := ctx.ShouldBindJSON(&resetReq); err != nil && !errors.Is(err, io.EOF) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	password, generated, err := choosePassword(resetReq.Password)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate password"})
+		return
+	}
+
+	username := ctx.Param("username")
+	if err := c.Users.SetPassword(ctx.Request.Context(), username, password); err != nil {
+		respondUserError(ctx, err)
+		return
+	}
+	c.logout(username)
+
+	log.Printf("Password of %q reset by %s", username, ctx.GetString("username"))
+	response := gin.H{"message": "Password reset"}
+	if generated != "" {
+		response["password"] = generated
+	}
+	ctx.JSON(http.StatusOK, response)
+}
+
+// DeleteUser removes an account, ends its sessions and revokes what it shared; its home folder
+// is kept on the server. Admins only.
+func (c *UserController) DeleteUser(ctx *gin.Context) {
+	if !c.usable(ctx) {
+		return
+	}
+	username := ctx.Param("username")
+	if !notSelf(ctx, username, "delete") {
+		return
+	}
+	if err := c.Users.DeleteUser(ctx.Request.Context(), username); err != nil {
+		respondUserError(ctx, err)
+		return
+	}
+	c.logout(username)
+	c.revoke(username)
+
+	log.Printf("User %q deleted by %s", username, ctx.GetString("username"))
+	ctx.JSON(http.StatusOK, gin.H{"message": "User deleted"})
+}
@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/auth"
+	"manschko.com/cloud-storage/sftpgo"
+)
+
+// userTest is a UserController on a Fake, recording whom it logged out and revoked
+type userTest struct {
+	users      *sftpgo.Fake
+	controller *UserController
+	loggedOut  []string
+	revoked    []string
+}
+
+func newUserTest(t *testing.T) *userTest {
+	t.Helper()
+	// Without service account credentials no home folder can be created
+	t.Setenv("SFTP_USER", "")
+	ut := &userTest{users: sftpgo.NewFake("/srv/sftpgo/data")}
+	ut.controller = NewUserController(NewFileController("127.0.0.1", 0), ut.users, func(username string) error {
+		ut.loggedOut = append(ut.loggedOut, username)
+		return nil
+	})
+	ut.controller.Revoke = func(username string) error {
+		ut.revoked = append(ut.revoked, username)
+		return nil
+	}
+	for _, name := range []string{"admin", "alice"} {
+		if _, err := ut.users.CreateUser(context.Background(), sftpgo.NewUser{Username: name, Password: name + "-pw"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ut
+}
+
+// serve runs one request as caller holding role through the user management routes and their admin guard
+func (ut *userTest) serve(caller, role, method, target, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(ctx *gin.Context) {
+		ctx.Set("username", caller)
+		ctx.Set("roles", []string{role})
+	}, auth.RequirePermission(auth.PermAdmin))
+	router.GET("/admin/users", ut.controller.ListUsers)
+	router.POST("/admin/users", ut.controller.CreateUser)
+	router.POST("/admin/users/:username/disable", ut.controller.DisableUser)
+	router.POST("/admin/users/:username/enable", ut.controller.EnableUser)
+	router.POST("/admin/users/:username/password", ut.controller.ResetPassword)
+	router.DELETE("/admin/users/:username", ut.controller.DeleteUser)
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func (ut *userTest) enabled(t *testing.T, username string) bool {
+	t.Helper()
+	user, err := ut.users.GetUser(context.Background(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.Enabled
+}
+
+func TestUserManagementNeedsAdmin(t *testing.T) {
+	ut := newUserTest(t)
+	for _, tt := range []struct{ method, target string }{
+		{http.MethodGet, "/admin/users"},
+		{http.MethodPost, "/admin/users/admin/disable"},
+		{http.MethodPost, "/admin/users/admin/password"},
+		{http.MethodDelete, "/admin/users/admin"},
+	} {
+		if rec := ut.serve("alice", auth.RoleUser, tt.method, tt.target, ""); rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s by a user: status %d, want 403", tt.method, tt.target, rec.Code)
+		}
+	}
+	if !ut.enabled(t, "admin") || len(ut.loggedOut) != 0 {
+		t.Fatal("a user changed an account")
+	}
+}
+
+func TestUserManagementNotConfigured(t *testing.T) {
+	ut := newUserTest(t)
+	ut.controller.Users = nil
+	if rec := ut.serve("admin", auth.RoleAdmin, http.MethodGet, "/admin/users", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want 404", rec.Code)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	ut := newUserTest(t)
+	rec := ut.serve("admin", auth.RoleAdmin, http.MethodGet, "/admin/users", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	var users []sftpgo.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Username != "admin" || users[1].Username != "alice" {
+		t.Fatalf("users = %+v", users)
+	}
+}
+
+func TestCreateUserRefusesReservedNames(t *testing.T) {
+	ut := newUserTest(t)
+	for _, name := range []string{".groups", "a/b", ""} {
+		rec := ut.serve("admin", auth.RoleAdmin, http.MethodPost, "/admin/users", `{"username":"`+name+`","password":"pw"}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("username %q: status %d, want 400", name, rec.Code)
+		}
+	}
+}
+
+func TestCreateUserRemovesAccountWithoutHome(t *testing.T) {
+	ut := newUserTest(t)
+	rec := ut.serve("admin", auth.RoleAdmin, http.MethodPost, "/admin/users", `{"username":"bob","password":"pw"}`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500 as no home folder can be created", rec.Code)
+	}
+	if _, err := ut.users.GetUser(context.Background(), "bob"); err == nil {
+		t.Fatal("account without a home folder was kept")
+	}
+}
+
+func TestCreateUserConflict(t *testing.T) {
+	ut := newUserTest(t)
+	rec := ut.serve("admin", auth.RoleAdmin, http.MethodPost, "/admin/users", `{"username":"alice","password":"pw"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status %d, want 409", rec.Code)
+	}
+}
+
+func TestDisableUserEndsSessionsAndRevokesAccess(t *testing.T) {
+	ut := newUserTest(t)
+	rec := ut.serve("admin", auth.RoleAdmin, http.MethodPost, "/admin/users/alice/disable", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	if ut.enabled(t, "alice") || ut.users.CheckPassword("alice", "alice-pw") {
+		t.Fatal("alice can still log in")
+	}
+	if len(ut.loggedOut) != 1 || ut.loggedOut[0] != "alice" || len(ut.revoked) != 1 || ut.revoked[0] != "alice" {
+		t.Fatalf("logged out %v and revoked %v, want alice", ut.loggedOut, ut.revoked)
+	}
+
+	rec = ut.serve("admin", auth.RoleAdmin, http.MethodPost, "/admin/users/alice/enable", "")
+	if rec.Code != http.StatusOK || !ut.users.CheckPassword("alice", "alice-pw") {
+		t.Fatalf("enabling failed: status %d", rec.Code)
+	}
+}
+
+func TestAdminCannotLockThemselvesOut(t *testing.T) {
+	ut := newUserTest(t)
+	for _, tt := range []struct{ method, target string }{
+		{http.MethodPost, "/admin/users/admin/disable"},
+		{http.MethodDelete, "/admin/users/admin"},
+	} {
+		if rec := ut.serve("admin", auth.RoleAdmin, tt.method, tt.target, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: status %d, want 400", tt.method, tt.target, rec.Code)
+		}
+	}
+	if !ut.enabled(t, "admin") || len(ut.loggedOut) != 0 || len(ut.revoked) != 0 {
+		t.Fatal("the admin's own account was changed")
+	}
+}
+
+func TestResetPasswordGeneratesOne(t *testing.T) {
+	ut := newUserTest(t)
+	rec := ut.serve("admin", auth.RoleAdmin, http.MethodPost, "/admin/users/alice/password", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	var response struct {
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Password == "" || !ut.users.CheckPassword("alice", response.Password) || ut.users.CheckPassword("alice", "alice-pw") {
+		t.Fatal("the generated password was not set")
+	}
+	// A new password ends the sessions but keeps what the user shared
+	if len(ut.loggedOut) != 1 || len(ut.revoked) != 0 {
+		t.Fatalf("logged out %v and revoked %v", ut.loggedOut, ut.revoked)
+	}
+
+	rec = ut.serve("admin", auth.RoleAdmin, http.MethodPost, "/admin/users/alice/password", `{"password":"chosen"}`)
+	if rec.Code != http.StatusOK || !ut.users.CheckPassword("alice", "chosen") || strings.Contains(rec.Body.String(), "chosen") {
+		t.Fatalf("setting a chosen password: status %d, body %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	ut := newUserTest(t)
+	rec := ut.serve("admin", auth.RoleAdmin, http.MethodDelete, "/admin/users/alice", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	if _, err := ut.users.GetUser(context.Background(), "alice"); err == nil {
+		t.Fatal("alice still exists")
+	}
+	if len(ut.loggedOut) != 1 || len(ut.revoked) != 1 {
+		t.Fatalf("logged out %v and revoked %v, want alice", ut.loggedOut, ut.revoked)
+	}
+
+	rec = ut.serve("admin", auth.RoleAdmin, http.MethodDelete, "/admin/users/alice", "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("deleting again: status %d, want 404", rec.Code)
+	}
+	if len(ut.loggedOut) != 1 {
+		t.Fatal("a missing user was logged out")
+	}
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
+	"manschko.com/cloud-storage/throttle"
+)
+
+// WebDAVMethods are the request methods the WebDAV endpoint answers besides the standard ones
+var WebDAVMethods = []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"}
+
+// WebDAVController serves the user's namespace over WebDAV classes 1 and 2
+type WebDAVController struct {
+	Files  *FileController
+	Prefix string
+	Locks  webdav.LockSystem
+}
+
+// NewWebDAVController creates a WebDAV controller mounted at prefix.
+// Locks must outlive single requests, so the lock system is shared by the caller.
+// It is keyed by real server paths, which each request maps its user's paths onto.
+func NewWebDAVController(files *FileController, prefix string, locks webdav.LockSystem) *WebDAVController {
+	return &WebDAVController{
+		Files:  files,
+		Prefix: prefix,
+		Locks:  locks,
+	}
+}
+
+// ServeWebDAV handles one WebDAV request for the authenticated user
+func (c *WebDAVController) ServeWebDAV(ctx *gin.Context) {
+	username := ctx.GetString("username")
+	account := throttle.Account{User: username}
+
+	// Only reading and writing file content counts as a transfer, not browsing or locking
+	if method := ctx.Request.Method; method == http.MethodGet || method == http.MethodPut {
+		release, err := c.Files.acquireTransfer(ctx, account)
+		if err != nil {
+			ctx.String(http.StatusTooManyRequests, "Too many simultaneous transfers, try again later")
+			return
+		}
+		defer release()
+	}
+	c.Files.limitBody(ctx, account)
+
+	client, err := c.Files.connect()
+	if err != nil {
+		ctx.String(http.StatusBadGateway, fmt.Sprintf("SFTP connection error: %v", err))
+		return
+	}
+	defer client.Close()
+
+	handler := &webdav.Handler{
+		Prefix:     c.Prefix,
+		FileSystem: &davFS{files: c.Files, client: client, username: username, roles: ctx.GetStringSlice("roles")},
+		LockSystem: &davLocks{locks: c.Locks, files: c.Files, username: username},
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("webdav %s %s (%s): %v", r.Method, r.URL.Path, username, err)
+			}
+		},
+	}
+	handler.ServeHTTP(c.Files.limitResponse(ctx, account), ctx.Request)
+}
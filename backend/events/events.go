@@ -0,0 +1,120 @@
+package events
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Type is the kind of change an event reports
+type Type string
+
+const (
+	Created  Type = "created"
+	Modified Type = "modified"
+	Deleted  Type = "deleted"
+	Moved    Type = "moved"
+)
+
+// Event is a change on the SFTP server. Paths are real server paths;
+// subscribers translate them into what each user sees.
+type Event struct {
+	ID      uint64    `json:"id"`
+	Type    Type      `json:"type"`
+	Path    string    `json:"path"`
+	OldPath string    `json:"old_path,omitempty"` // source of a move
+	IsDir   bool      `json:"is_dir,omitempty"`
+	Actor   string    `json:"actor,omitempty"`
+	Time    time.Time `json:"time"`
+	// External marks changes made directly on the SFTP server rather than through the API
+	External bool `json:"external,omitempty"`
+}
+
+// Subscription receives events until it is closed.
+// A subscriber that falls too far behind is dropped and its channel closed,
+// so that a stalled client cannot hold up the writers.
+type Subscription struct {
+	C <-chan Event
+
+	ch     chan Event
+	broker *Broker
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	if _, ok := s.broker.subs[s]; ok {
+		delete(s.broker.subs, s)
+		close(s.ch)
+	}
+}
+
+// Broker fans events out to subscribers and records them in its journal,
+// so that reconnecting clients and sync clients can catch up on what they missed
+type Broker struct {
+	mu      sync.Mutex
+	subs    map[*Subscription]struct{}
+	journal *Journal
+	size    int
+}
+
+// NewBroker creates a broker buffering up to size events per subscriber and keeping them in memory only
+func NewBroker(size int) *Broker {
+	journal, _ := OpenJournal("", size)
+	return NewJournaledBroker(size, journal)
+}
+
+// NewJournaledBroker creates a broker buffering up to size events per subscriber and recording all of them in journal
+func NewJournaledBroker(size int, journal *Journal) *Broker {
+	return &Broker{
+		subs:    make(map[*Subscription]struct{}),
+		journal: journal,
+		size:    size,
+	}
+}
+
+// Journal is where the broker records events
+func (b *Broker) Journal() *Journal {
+	return b.journal
+}
+
+// Publish assigns the event an ID and delivers it to every subscriber without blocking
+func (b *Broker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e, err := b.journal.Append(e)
+	if err != nil {
+		log.Printf("Failed to record change event: %v", err)
+	}
+
+	for s := range b.subs {
+		select {
+		case s.ch <- e:
+		default:
+			delete(b.subs, s)
+			close(s.ch)
+		}
+	}
+}
+
+// Subscribe starts a subscription. With a non-zero lastID it first replays the events after it;
+// ok is false when some of them are no longer in the history and the client has to reload.
+func (b *Broker) Subscribe(lastID uint64) (sub *Subscription, replay []Event, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, b.size)
+	sub = &Subscription{C: ch, ch: ch, broker: b}
+	b.subs[sub] = struct{}{}
+
+	if lastID == 0 {
+		return sub, nil, true
+	}
+	replay, ok = b.journal.Since(lastID, 0)
+	return sub, replay, ok
+}
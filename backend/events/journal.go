@@ -0,0 +1,192 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+// journalHeader is the first line of a journal file
+type journalHeader struct {
+	Epoch string `json:"epoch"`
+}
+
+// Journal keeps the most recent events in order and appends them to a JSON-lines file,
+// so that event IDs and the changes behind them survive restarts.
+// It holds between max and twice max events; older ones are dropped when the file is compacted.
+// An empty path keeps everything in memory only.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	epoch   string
+	entries []Event
+	max     int
+	lastID  uint64
+}
+
+// OpenJournal loads the journal at path, creating it with a fresh epoch when missing
+func OpenJournal(path string, max int) (*Journal, error) {
+	j := &Journal{path: path, max: max}
+	if path == "" {
+		return j, j.reset()
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return j, j.rewrite()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for first := true; scanner.Scan(); first = false {
+		if first {
+			var header journalHeader
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+			}
+			j.epoch = header.Epoch
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A crash can leave a torn last line; everything before it is intact
+			break
+		}
+		j.entries = append(j.entries, e)
+		j.lastID = e.ID
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	// Compacting on load also gives a header without an epoch a fresh one
+	return j, j.rewrite()
+}
+
+// reset starts a new epoch; cursors from the previous one no longer apply
+func (j *Journal) reset() error {
+	epoch, err := storage.RandomID()
+	if err != nil {
+		return err
+	}
+	j.epoch = epoch
+	return nil
+}
+
+// rewrite compacts the file to the retained entries and reopens it for appending; callers hold the lock
+func (j *Journal) rewrite() error {
+	if j.epoch == "" {
+		if err := j.reset(); err != nil {
+			return err
+		}
+	}
+	if len(j.entries) > j.max {
+		j.entries = append([]Event(nil), j.entries[len(j.entries)-j.max:]...)
+	}
+	if j.path == "" {
+		return nil
+	}
+
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create data directory: %v", err)
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	enc.Encode(journalHeader{Epoch: j.epoch})
+	for _, e := range j.entries {
+		enc.Encode(e)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", j.path, err)
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", j.path, err)
+	}
+	return nil
+}
+
+// Epoch identifies this journal; it changes when the journal is lost and started over
+func (j *Journal) Epoch() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.epoch
+}
+
+// LastID is the ID of the newest event, or where numbering continues from
+func (j *Journal) LastID() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lastID
+}
+
+// Append records the next event, assigning its ID
+func (j *Journal) Append(e Event) (Event, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.lastID++
+	e.ID = j.lastID
+	j.entries = append(j.entries, e)
+
+	if len(j.entries) >= 2*j.max {
+		return e, j.rewrite()
+	}
+	if j.file == nil {
+		return e, nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+	_, err = j.file.Write(append(data, '\n'))
+	return e, err
+}
+
+// Since returns up to limit events after afterID; a limit of zero returns all of them.
+// complete is false when events after afterID were already dropped, or afterID is from the future.
+func (j *Journal) Since(afterID uint64, limit int) (list []Event, complete bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if afterID > j.lastID {
+		return nil, false
+	}
+	if afterID == j.lastID {
+		return nil, true
+	}
+	if len(j.entries) == 0 || j.entries[0].ID > afterID+1 {
+		return nil, false
+	}
+	start := sort.Search(len(j.entries), func(i int) bool { return j.entries[i].ID > afterID })
+	end := len(j.entries)
+	if limit > 0 && end-start > limit {
+		end = start + limit
+	}
+	return append([]Event(nil), j.entries[start:end]...), true
+}
@@ -7,10 +7,22 @@ import (
 
 // Create a file controller
 func getFileController() *controllers.FileController {
-	return controllers.NewFileController(
+	controller := controllers.NewFileController(
 		AppConfig.SFTPHost,
 		AppConfig.SFTPPort,
 	)
+	controller.ChecksumExec = AppConfig.ChecksumExec
+	controller.Grants = grantStore
+	controller.Groups = groupStore
+	controller.Events = eventBroker
+	controller.Scanner = changeScanner
+	controller.Transfers = transferLimits
+	return controller
+}
+
+// Create a WebDAV controller
+func getWebDAVController() *controllers.WebDAVController {
+	return controllers.NewWebDAVController(getFileController(), webdavPrefix, davLocks)
 }
 
 // File operation handlers
@@ -40,4 +52,44 @@ func renameFile(c *gin.Context) {
 
 func createDirectory(c *gin.Context) {
 	getFileController().CreateDirectory(c)
-}
\ No newline at end of file
+}
+
+func checksumFile(c *gin.Context) {
+	getFileController().Checksum(c)
+}
+
+func streamEvents(c *gin.Context) {
+	getFileController().StreamEvents(c)
+}
+
+func latestChangeCursor(c *gin.Context) {
+	getFileController().LatestCursor(c)
+}
+
+func listChanges(c *gin.Context) {
+	getFileController().ListChanges(c)
+}
+
+func chmodFile(c *gin.Context) {
+	getFileController().Chmod(c)
+}
+
+func chtimesFile(c *gin.Context) {
+	getFileController().Chtimes(c)
+}
+
+func createSymlink(c *gin.Context) {
+	getFileController().CreateSymlink(c)
+}
+
+func readLink(c *gin.Context) {
+	getFileController().ReadLink(c)
+}
+
+func statFile(c *gin.Context) {
+	getFileController().Stat(c)
+}
+
+func serveWebDAV(c *gin.Context) {
+	getWebDAVController().ServeWebDAV(c)
+}
@@ -0,0 +1,268 @@
+package groups
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+// Role is a member's level of access to a group space
+type Role string
+
+const (
+	Viewer  Role = "viewer"
+	Editor  Role = "editor"
+	Manager Role = "manager"
+)
+
+var (
+	ErrNotFound    = errors.New("group not found")
+	ErrExists      = errors.New("group already exists")
+	ErrInvalidName = errors.New("group names may only contain lowercase letters, digits, '-' and '_'")
+	ErrInvalidRole = errors.New("role must be viewer, editor or manager")
+	ErrNotMember   = errors.New("user is not a member of the group")
+	ErrLastManager = errors.New("a group needs at least one manager")
+	validGroupName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	roleLevels     = map[Role]int{Viewer: 1, Editor: 2, Manager: 3}
+)
+
+// ParseRole validates a role value
+func ParseRole(value string) (Role, error) {
+	role := Role(value)
+	if _, ok := roleLevels[role]; !ok {
+		return "", ErrInvalidRole
+	}
+	return role, nil
+}
+
+// AtLeast reports whether r grants everything other does
+func (r Role) AtLeast(other Role) bool {
+	return roleLevels[r] >= roleLevels[other]
+}
+
+// ValidName reports whether name can be used as a group and folder name
+func ValidName(name string) bool {
+	return validGroupName.MatchString(name)
+}
+
+// Group is a space owned by a team rather than a single user
+type Group struct {
+	Name      string          `json:"name"`
+	Members   map[string]Role `json:"members"`
+	CreatedBy string          `json:"created_by"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Membership is one group as seen by one of its members
+type Membership struct {
+	Group string `json:"group"`
+	Role  Role   `json:"role"`
+}
+
+// managers counts the members holding the manager role
+func (g *Group) managers() int {
+	count := 0
+	for _, role := range g.Members {
+		if role == Manager {
+			count++
+		}
+	}
+	return count
+}
+
+// copyGroup returns a snapshot that is safe to read without the lock
+func copyGroup(g *Group) *Group {
+	copied := *g
+	copied.Members = make(map[string]Role, len(g.Members))
+	for user, role := range g.Members {
+		copied.Members[user] = role
+	}
+	return &copied
+}
+
+// Store keeps groups in memory and persists them as JSON
+type Store struct {
+	mu     sync.RWMutex
+	file   *storage.JSONFile
+	groups map[string]*Group // keyed by name
+}
+
+// NewStore loads the groups saved at path; an empty path keeps them in memory only
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		file:   storage.NewJSONFile(path),
+		groups: make(map[string]*Group),
+	}
+	if err := s.file.Load(&s.groups); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save persists the current groups; callers hold the lock
+func (s *Store) save() error {
+	return s.file.Save(s.groups)
+}
+
+// Create adds an empty group; the creator is recorded but only becomes a member when added
+func (s *Store) Create(name, createdBy string) (*Group, error) {
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.groups[name]; ok {
+		return nil, ErrExists
+	}
+	group := &Group{
+		Name:      name,
+		Members:   map[string]Role{},
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+	}
+	s.groups[name] = group
+	if err := s.save(); err != nil {
+		delete(s.groups, name)
+		return nil, err
+	}
+	return copyGroup(group), nil
+}
+
+// Delete removes a group; its files stay on the server
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.groups[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.groups, name)
+	return s.save()
+}
+
+// Get returns a group by name
+func (s *Store) Get(name string) (*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	group, ok := s.groups[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyGroup(group), nil
+}
+
+// List returns all groups sorted by name
+func (s *Store) List() []Group {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Group, 0, len(s.groups))
+	for _, group := range s.groups {
+		list = append(list, *copyGroup(group))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Memberships returns the groups username belongs to, sorted by name
+func (s *Store) Memberships(username string) []Membership {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var list []Membership
+	for name, group := range s.groups {
+		if role, ok := group.Members[username]; ok {
+			list = append(list, Membership{Group: name, Role: role})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Group < list[j].Group })
+	return list
+}
+
+// RoleOf returns username's role in a group
+func (s *Store) RoleOf(name, username string) (Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	group, ok := s.groups[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	role, ok := group.Members[username]
+	if !ok {
+		return "", ErrNotMember
+	}
+	return role, nil
+}
+
+// SetMember adds username to a group or changes their role
+func (s *Store) SetMember(name, username string, role Role) (*Group, error) {
+	if _, err := ParseRole(string(role)); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	previous, existed := group.Members[username]
+	if previous == Manager && role != Manager && group.managers() == 1 {
+		return nil, ErrLastManager
+	}
+	group.Members[username] = role
+	if err := s.save(); err != nil {
+		if existed {
+			group.Members[username] = previous
+		} else {
+			delete(group.Members, username)
+		}
+		return nil, err
+	}
+	return copyGroup(group), nil
+}
+
+// RemoveMember takes username out of a group
+func (s *Store) RemoveMember(name, username string) (*Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	role, ok := group.Members[username]
+	if !ok {
+		return nil, ErrNotMember
+	}
+	if role == Manager && group.managers() == 1 {
+		return nil, ErrLastManager
+	}
+	delete(group.Members, username)
+	if err := s.save(); err != nil {
+		group.Members[username] = role
+		return nil, err
+	}
+	return copyGroup(group), nil
+}
+
+// RemoveUser takes username out of every group. Unlike RemoveMember it also removes
+// the last manager, as it is meant for accounts that are gone; admins can still manage such groups.
+func (s *Store) RemoveUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, group := range s.groups {
+		delete(group.Members, username)
+	}
+	return s.save()
+}
@@ -0,0 +1,369 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+// State is where a job is in its life cycle
+type State string
+
+const (
+	Queued    State = "queued"
+	Running   State = "running"
+	Succeeded State = "succeeded"
+	Failed    State = "failed"
+	Canceled  State = "canceled"
+)
+
+// Finished reports whether the job will not change any more
+func (s State) Finished() bool {
+	return s == Succeeded || s == Failed || s == Canceled
+}
+
+var (
+	ErrNotFound    = errors.New("job not found")
+	ErrTooManyJobs = errors.New("too many unfinished jobs")
+	ErrFinished    = errors.New("job already finished")
+)
+
+// Progress counts the work a job has done out of the work it found to do
+type Progress struct {
+	ItemsDone  int64 `json:"items_done"`
+	ItemsTotal int64 `json:"items_total"`
+	BytesDone  int64 `json:"bytes_done"`
+	BytesTotal int64 `json:"bytes_total"`
+}
+
+// Job is one long-running operation submitted by a user
+type Job struct {
+	ID          string     `json:"id"`
+	Owner       string     `json:"owner"`
+	Kind        string     `json:"kind"`
+	Description string     `json:"description"`
+	State       State      `json:"state"`
+	Progress    Progress   `json:"progress"`
+	Error       string     `json:"error,omitempty"`
+	Result      string     `json:"result,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// ETA estimates the time left from the rate of progress so far, preferring bytes over items
+func (j *Job) ETA() (time.Duration, bool) {
+	if j.State != Running || j.StartedAt == nil {
+		return 0, false
+	}
+	done, total := j.Progress.BytesDone, j.Progress.BytesTotal
+	if total == 0 {
+		done, total = j.Progress.ItemsDone, j.Progress.ItemsTotal
+	}
+	if done <= 0 || total <= done {
+		return 0, false
+	}
+	elapsed := time.Since(*j.StartedAt)
+	return time.Duration(float64(elapsed) * float64(total-done) / float64(done)), true
+}
+
+// Func does the work of a job, reporting progress as it goes. It must return
+// promptly once ctx is done; the string it returns is kept as the job's result.
+type Func func(ctx context.Context, progress *Reporter) (string, error)
+
+// Reporter updates the progress of a running job
+type Reporter struct {
+	m  *Manager
+	id string
+}
+
+// SetTotal records how much work the job found to do
+func (r *Reporter) SetTotal(items, bytes int64) {
+	r.m.update(r.id, func(p *Progress) {
+		p.ItemsTotal, p.BytesTotal = items, bytes
+	})
+}
+
+// AddItems counts finished items
+func (r *Reporter) AddItems(n int64) {
+	r.m.update(r.id, func(p *Progress) { p.ItemsDone += n })
+}
+
+// AddBytes counts transferred bytes
+func (r *Reporter) AddBytes(n int64) {
+	r.m.update(r.id, func(p *Progress) { p.BytesDone += n })
+}
+
+// entry is a job together with what is needed to run and cancel it
+type entry struct {
+	job    Job
+	run    Func
+	cancel context.CancelFunc
+}
+
+// Manager runs jobs on a bounded number of workers. Each user has at most
+// MaxPerUser jobs running at once; their other jobs wait in the queue in order.
+// Finished jobs are kept for Retention and survive restarts.
+type Manager struct {
+	workers    int
+	maxPerUser int
+	maxQueued  int
+	retention  time.Duration
+
+	mu      sync.Mutex
+	file    *storage.JSONFile
+	jobs    map[string]*entry
+	queue   []*entry
+	running int
+	perUser map[string]int
+	changed chan struct{}
+}
+
+// NewManager loads the job history at path. Jobs that were still queued or running
+// when the server stopped are marked failed, since their work cannot be resumed.
+func NewManager(path string, workers, maxPerUser, maxQueued int, retention time.Duration) (*Manager, error) {
+	m := &Manager{
+		workers:    max(workers, 1),
+		maxPerUser: max(maxPerUser, 1),
+		maxQueued:  maxQueued,
+		retention:  retention,
+		file:       storage.NewJSONFile(path),
+		jobs:       make(map[string]*entry),
+		perUser:    make(map[string]int),
+		changed:    make(chan struct{}),
+	}
+
+	var history []Job
+	if err := m.file.Load(&history); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, job := range history {
+		if !job.State.Finished() {
+			job.State = Failed
+			job.Error = "interrupted by a server restart"
+			job.FinishedAt = &now
+		}
+		m.jobs[job.ID] = &entry{job: job}
+	}
+	m.prune()
+	return m, m.save()
+}
+
+// save persists the job history; callers hold the lock
+func (m *Manager) save() error {
+	history := make([]Job, 0, len(m.jobs))
+	for _, e := range m.jobs {
+		history = append(history, e.job)
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].CreatedAt.Before(history[j].CreatedAt) })
+	return m.file.Save(history)
+}
+
+// saveLogged persists the history where a failure must not stop the job itself; callers hold the lock
+func (m *Manager) saveLogged() {
+	if err := m.save(); err != nil {
+		log.Printf("Failed to save job history: %v", err)
+	}
+}
+
+// prune drops finished jobs older than the retention period; callers hold the lock
+func (m *Manager) prune() {
+	cutoff := time.Now().Add(-m.retention)
+	for id, e := range m.jobs {
+		if e.job.State.Finished() && e.job.FinishedAt != nil && e.job.FinishedAt.Before(cutoff) {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// notify wakes everyone waiting in Changed; callers hold the lock
+func (m *Manager) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// Changed returns a channel that is closed the next time any job changes
+func (m *Manager) Changed() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.changed
+}
+
+// Submit queues a job for owner and starts it as soon as a worker and the owner's quota allow
+func (m *Manager) Submit(owner, kind, description string, run Func) (Job, error) {
+	id, err := storage.RandomID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.maxQueued > 0 {
+		unfinished := 0
+		for _, e := range m.jobs {
+			if e.job.Owner == owner && !e.job.State.Finished() {
+				unfinished++
+			}
+		}
+		if unfinished >= m.maxQueued {
+			return Job{}, ErrTooManyJobs
+		}
+	}
+
+	e := &entry{
+		job: Job{
+			ID:          id,
+			Owner:       owner,
+			Kind:        kind,
+			Description: description,
+			State:       Queued,
+			CreatedAt:   time.Now(),
+		},
+		run: run,
+	}
+	m.prune()
+	m.jobs[id] = e
+	m.queue = append(m.queue, e)
+	m.saveLogged()
+	m.dispatch()
+	m.notify()
+	return e.job, nil
+}
+
+// dispatch starts queued jobs while workers are free, skipping owners at their limit; callers hold the lock
+func (m *Manager) dispatch() {
+	remaining := m.queue[:0]
+	for _, e := range m.queue {
+		if m.running >= m.workers || m.perUser[e.job.Owner] >= m.maxPerUser {
+			remaining = append(remaining, e)
+			continue
+		}
+		m.start(e)
+	}
+	clear(m.queue[len(remaining):])
+	m.queue = remaining
+}
+
+// start runs e on a new worker; callers hold the lock
+func (m *Manager) start(e *entry) {
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	e.cancel = cancel
+	e.job.State = Running
+	e.job.StartedAt = &now
+	m.running++
+	m.perUser[e.job.Owner]++
+	m.saveLogged()
+
+	run, progress := e.run, &Reporter{m: m, id: e.job.ID}
+	go func() {
+		result, err := run(ctx, progress)
+		m.finish(e, ctx, result, err)
+	}()
+}
+
+// finish records the outcome of a job and hands its worker to the next one
+func (m *Manager) finish(e *entry, ctx context.Context, result string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	e.job.FinishedAt = &now
+	e.job.Result = result
+	switch {
+	case ctx.Err() != nil:
+		e.job.State = Canceled
+	case err != nil:
+		e.job.State = Failed
+		e.job.Error = err.Error()
+	default:
+		e.job.State = Succeeded
+	}
+	e.cancel()
+	e.cancel = nil
+	e.run = nil
+
+	m.running--
+	if m.perUser[e.job.Owner]--; m.perUser[e.job.Owner] == 0 {
+		delete(m.perUser, e.job.Owner)
+	}
+	m.saveLogged()
+	m.dispatch()
+	m.notify()
+}
+
+// update changes the progress of a job
+func (m *Manager) update(id string, change func(p *Progress)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.jobs[id]; ok {
+		change(&e.job.Progress)
+		m.notify()
+	}
+}
+
+// Get returns a job of owner
+func (m *Manager) Get(owner, id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.jobs[id]
+	if !ok || e.job.Owner != owner {
+		return Job{}, ErrNotFound
+	}
+	return e.job, nil
+}
+
+// List returns the jobs of owner, newest first
+func (m *Manager) List(owner string) []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+
+	list := []Job{}
+	for _, e := range m.jobs {
+		if e.job.Owner == owner {
+			list = append(list, e.job)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Cancel stops a job of owner. A queued job is canceled at once; a running one
+// stops at its next check and is marked canceled when its worker returns.
+func (m *Manager) Cancel(owner, id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.jobs[id]
+	if !ok || e.job.Owner != owner {
+		return Job{}, ErrNotFound
+	}
+	switch e.job.State {
+	case Queued:
+		for i, queued := range m.queue {
+			if queued == e {
+				m.queue = append(m.queue[:i], m.queue[i+1:]...)
+				break
+			}
+		}
+		now := time.Now()
+		e.run = nil
+		e.job.State = Canceled
+		e.job.FinishedAt = &now
+		m.saveLogged()
+		m.notify()
+	case Running:
+		e.cancel()
+	default:
+		return e.job, ErrFinished
+	}
+	return e.job, nil
+}
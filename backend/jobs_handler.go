@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/controllers"
+)
+
+// Create a job controller
+func getJobController() *controllers.JobController {
+	return controllers.NewJobController(getFileController(), jobManager, sessionPool)
+}
+
+// Background job handlers
+func submitJob(c *gin.Context) {
+	getJobController().SubmitJob(c)
+}
+
+func listJobs(c *gin.Context) {
+	getJobController().ListJobs(c)
+}
+
+func getJob(c *gin.Context) {
+	getJobController().GetJob(c)
+}
+
+func cancelJob(c *gin.Context) {
+	getJobController().CancelJob(c)
+}
+
+func streamJob(c *gin.Context) {
+	getJobController().StreamJob(c)
+}
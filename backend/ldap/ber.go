@@ -0,0 +1,245 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// maxPacketSize bounds the messages accepted from the server
+	maxPacketSize = 16 << 20
+	// maxPacketDepth bounds the nesting of elements, far beyond anything LDAP uses
+	maxPacketDepth = 32
+)
+
+// BER classes
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+)
+
+// Universal tags used by LDAP
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x10
+	tagSet         = 0x11
+)
+
+// packet is one BER element. Constructed elements keep their children, primitive ones their bytes.
+type packet struct {
+	class       byte
+	constructed bool
+	tag         int
+	data        []byte
+	children    []*packet
+}
+
+func primitive(class byte, tag int, data []byte) *packet {
+	return &packet{class: class, tag: tag, data: data}
+}
+
+func constructed(class byte, tag int, children ...*packet) *packet {
+	return &packet{class: class, constructed: true, tag: tag, children: children}
+}
+
+func octetString(s string) *packet {
+	return primitive(classUniversal, tagOctetString, []byte(s))
+}
+
+func boolean(b bool) *packet {
+	if b {
+		return primitive(classUniversal, tagBoolean, []byte{0xff})
+	}
+	return primitive(classUniversal, tagBoolean, []byte{0})
+}
+
+func integerBytes(n int64) []byte {
+	var out []byte
+	for {
+		out = append([]byte{byte(n)}, out...)
+		n >>= 8
+		if (n == 0 && out[0]&0x80 == 0) || (n == -1 && out[0]&0x80 != 0) {
+			return out
+		}
+	}
+}
+
+func integer(n int64) *packet {
+	return primitive(classUniversal, tagInteger, integerBytes(n))
+}
+
+func enumerated(n int64) *packet {
+	return primitive(classUniversal, tagEnumerated, integerBytes(n))
+}
+
+func sequence(children ...*packet) *packet {
+	return constructed(classUniversal, tagSequence, children...)
+}
+
+// encode serializes the element with definite lengths
+func (p *packet) encode() []byte {
+	content := p.data
+	if p.constructed {
+		content = nil
+		for _, child := range p.children {
+			content = append(content, child.encode()...)
+		}
+	}
+
+	var out []byte
+	first := p.class
+	if p.constructed {
+		first |= 0x20
+	}
+	if p.tag < 31 {
+		out = append(out, first|byte(p.tag))
+	} else {
+		out = append(out, first|0x1f)
+		var tag []byte
+		for t := p.tag; t > 0; t >>= 7 {
+			b := byte(t & 0x7f)
+			if len(tag) > 0 {
+				b |= 0x80
+			}
+			tag = append([]byte{b}, tag...)
+		}
+		out = append(out, tag...)
+	}
+
+	if n := len(content); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, content...)
+}
+
+// readPacket reads one element from r. It returns io.EOF only when r ends before the element starts.
+func readPacket(r *bufio.Reader) (*packet, error) {
+	return readNested(r, 0)
+}
+
+func readNested(r *bufio.Reader, depth int) (*packet, error) {
+	if depth > maxPacketDepth {
+		return nil, errors.New("ldap: elements nested too deeply")
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	p, err := readElement(r, first, depth)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return p, err
+}
+
+// readElement reads the rest of an element whose first byte was first
+func readElement(r *bufio.Reader, first byte, depth int) (*packet, error) {
+	p := &packet{class: first & 0xc0, constructed: first&0x20 != 0, tag: int(first & 0x1f)}
+	if p.tag == 0x1f {
+		p.tag = 0
+		for i := 0; ; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if i > 3 {
+				return nil, errors.New("ldap: tag too long")
+			}
+			p.tag = p.tag<<7 | int(b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+	}
+
+	lengthByte, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := int(lengthByte)
+	if lengthByte&0x80 != 0 {
+		count := int(lengthByte & 0x7f)
+		if count == 0 || count > 4 {
+			return nil, errors.New("ldap: unsupported length encoding")
+		}
+		length = 0
+		for i := 0; i < count; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxPacketSize {
+		return nil, fmt.Errorf("ldap: message of %d bytes is too large", length)
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	if !p.constructed {
+		p.data = content
+		return p, nil
+	}
+	return p, p.parseChildren(content, depth+1)
+}
+
+// parseChildren decodes the content of a constructed element
+func (p *packet) parseChildren(content []byte, depth int) error {
+	r := bufio.NewReader(bytes.NewReader(content))
+	for {
+		child, err := readNested(r, depth)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return errors.New("ldap: truncated element")
+			}
+			return err
+		}
+		p.children = append(p.children, child)
+	}
+}
+
+// int decodes an INTEGER or ENUMERATED
+func (p *packet) int() int64 {
+	var n int64
+	for i, b := range p.data {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+func (p *packet) string() string {
+	return string(p.data)
+}
+
+// child returns the i-th child, or an empty element when missing, so that malformed
+// responses fail on their values instead of panicking
+func (p *packet) child(i int) *packet {
+	if i < len(p.children) {
+		return p.children[i]
+	}
+	return &packet{}
+}
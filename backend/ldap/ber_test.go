@@ -0,0 +1,130 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+func decode(t *testing.T, data []byte) *packet {
+	t.Helper()
+	p, err := readPacket(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("readPacket(%x) error = %v", data, err)
+	}
+	return p
+}
+
+// samePacket reports whether two elements have the same class, tag, content and children
+func samePacket(a, b *packet) bool {
+	if a.class != b.class || a.constructed != b.constructed || a.tag != b.tag || len(a.children) != len(b.children) {
+		return false
+	}
+	if !a.constructed && !bytes.Equal(a.data, b.data) {
+		return false
+	}
+	for i := range a.children {
+		if !samePacket(a.children[i], b.children[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEncodeKnownAnswers(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		p    *packet
+		want string
+	}{
+		{"integer 0", integer(0), "020100"},
+		{"integer 127", integer(127), "02017f"},
+		{"integer 128", integer(128), "02020080"},
+		{"integer 256", integer(256), "02020100"},
+		{"integer -1", integer(-1), "0201ff"},
+		{"integer -128", integer(-128), "020180"},
+		{"integer -129", integer(-129), "0202ff7f"},
+		{"enumerated 3", enumerated(3), "0a0103"},
+		{"boolean", boolean(true), "0101ff"},
+		{"octet string", octetString("uid"), "0403756964"},
+		{"long length", octetString(strings.Repeat("a", 200)), "0481c8" + strings.Repeat("61", 200)},
+		{"high tag", primitive(classApplication, 200, []byte{1}), "5f8148" + "0101"},
+		{"sequence", sequence(integer(1), octetString("")), "3005020101" + "0400"},
+		// The simple bind request of RFC 4511 for cn=admin with password "secret"
+		{"bind request", constructed(classApplication, 0, integer(3), octetString("cn=admin"), primitive(classContext, 0, []byte("secret"))),
+			"6015020103" + "0408636e3d61646d696e" + "8006736563726574"},
+	} {
+		if got := hex.EncodeToString(tt.p.encode()); got != tt.want {
+			t.Errorf("%s: encode() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		p    *packet
+	}{
+		{"integers", sequence(integer(0), integer(1<<31), integer(-1<<40), enumerated(10))},
+		{"nested", sequence(sequence(sequence(octetString("deep")), boolean(false)), constructed(classContext, 3))},
+		{"two length bytes", octetString(strings.Repeat("x", 300))},
+		{"three length bytes", octetString(strings.Repeat("x", 70000))},
+		{"high tags", constructed(classApplication, 31, primitive(classContext, 12345, []byte("v")))},
+	} {
+		got := decode(t, tt.p.encode())
+		if !samePacket(got, tt.p) {
+			t.Errorf("%s: decoded %+v", tt.name, got)
+		}
+		if !tt.p.constructed {
+			continue
+		}
+		for i, child := range tt.p.children {
+			if child.tag == tagInteger && got.child(i).int() != child.int() {
+				t.Errorf("%s: integer %d decoded as %d", tt.name, child.int(), got.child(i).int())
+			}
+		}
+	}
+}
+
+func TestIntegerValues(t *testing.T) {
+	for _, n := range []int64{0, 1, 127, 128, 255, 256, 65535, 1 << 40, -1, -127, -128, -129, -1 << 40} {
+		if got := decode(t, integer(n).encode()).int(); got != n {
+			t.Errorf("integer %d decoded as %d", n, got)
+		}
+	}
+}
+
+func TestReadPacketRejects(t *testing.T) {
+	deep := octetString("x")
+	for i := 0; i <= maxPacketDepth+1; i++ {
+		deep = sequence(deep)
+	}
+	for _, tt := range []struct {
+		name string
+		data string
+	}{
+		{"truncated content", "0405616263"},
+		{"truncated length", "0482"},
+		{"missing length", "04"},
+		{"indefinite length", "3080"},
+		{"five length bytes", "04850000000001"},
+		{"too large", "0484" + "7fffffff"},
+		{"child overruns parent", "3003" + "040561"},
+		{"tag too long", "1f8181818181" + "00"},
+		{"nested too deeply", hex.EncodeToString(deep.encode())},
+	} {
+		data, _ := hex.DecodeString(tt.data)
+		if _, err := readPacket(bufio.NewReader(bytes.NewReader(data))); err == nil || err == io.EOF {
+			t.Errorf("%s: readPacket(%s) error = %v, want a decoding error", tt.name, tt.data, err)
+		}
+	}
+}
+
+func TestReadPacketEOF(t *testing.T) {
+	if _, err := readPacket(bufio.NewReader(bytes.NewReader(nil))); err != io.EOF {
+		t.Fatalf("readPacket() of an empty stream error = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,294 @@
+// Package ldap is a small LDAPv3 client with just what authentication needs:
+// simple binds, searches and StartTLS.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Protocol operation tags (RFC 4511 section 4.2 onwards)
+const (
+	opBindRequest      = 0
+	opBindResponse     = 1
+	opUnbindRequest    = 2
+	opSearchRequest    = 3
+	opSearchEntry      = 4
+	opSearchDone       = 5
+	opSearchReference  = 19
+	opExtendedRequest  = 23
+	opExtendedResponse = 24
+)
+
+// Result codes handled specially
+const (
+	resultSuccess            = 0
+	resultSizeLimitExceeded  = 4
+	resultNoSuchObject       = 32
+	resultInvalidCredentials = 49
+)
+
+const (
+	startTLSOID = "1.3.6.1.4.1.1466.20037"
+	// defaultTimeout bounds every operation
+	defaultTimeout = 10 * time.Second
+	// maxSearchEntries and maxSearchSeconds are the limits asked of the server for searches
+	maxSearchEntries = 1000
+	maxSearchSeconds = 30
+)
+
+// ErrInvalidCredentials is returned when the server rejects a bind
+var ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+
+// ResultError is a failed operation as reported by the server
+type ResultError struct {
+	Code    int64
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// Entry is one search result
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the values of attribute name, matching its name case-insensitively
+func (e *Entry) Get(name string) []string {
+	for attr, values := range e.Attributes {
+		if strings.EqualFold(attr, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// Conn is a connection to an LDAP server. It runs one operation at a time.
+type Conn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	messageID int64
+	timeout   time.Duration
+}
+
+// Dial connects to an ldap:// or ldaps:// URL. tlsConfig is used for ldaps and may be nil.
+func Dial(ctx context.Context, rawURL string, tlsConfig *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid URL %q: %w", rawURL, err)
+	}
+	host := u.Host
+	dialer := &net.Dialer{Timeout: defaultTimeout}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: withServerName(tlsConfig, u.Hostname())}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", host)
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+// NewConn runs the protocol over an established connection
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn: conn, r: bufio.NewReader(conn), timeout: defaultTimeout}
+}
+
+func withServerName(cfg *tls.Config, host string) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	return cfg
+}
+
+// Close ends the session politely and closes the connection
+func (c *Conn) Close() error {
+	c.messageID++
+	msg := sequence(integer(c.messageID), primitive(classApplication, opUnbindRequest, nil))
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.conn.Write(msg.encode())
+	return c.conn.Close()
+}
+
+// send writes a request and returns its message ID
+func (c *Conn) send(op *packet) (int64, error) {
+	c.messageID++
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(sequence(integer(c.messageID), op).encode())
+	return c.messageID, err
+}
+
+// receive reads the next response to id and returns its protocol operation
+func (c *Conn) receive(id int64) (*packet, error) {
+	for {
+		msg, err := readPacket(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if len(msg.children) < 2 {
+			return nil, errors.New("ldap: malformed message")
+		}
+		switch msg.child(0).int() {
+		case id:
+			return msg.child(1), nil
+		case 0:
+			// An unsolicited notification, such as notice of disconnection
+			return nil, fmt.Errorf("ldap: server ended the session: %s", msg.child(1).child(2).string())
+		}
+	}
+}
+
+// result checks the LDAPResult at the start of a response
+func result(op *packet) error {
+	code := op.child(0).int()
+	switch code {
+	case resultSuccess:
+		return nil
+	case resultInvalidCredentials:
+		return ErrInvalidCredentials
+	}
+	return &ResultError{Code: code, Message: op.child(2).string()}
+}
+
+// StartTLS upgrades the connection to TLS
+func (c *Conn) StartTLS(tlsConfig *tls.Config, host string) error {
+	req := constructed(classApplication, opExtendedRequest, primitive(classContext, 0, []byte(startTLSOID)))
+	id, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	resp, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if resp.tag != opExtendedResponse {
+		return errors.New("ldap: unexpected response to StartTLS")
+	}
+	if err := result(resp); err != nil {
+		return err
+	}
+
+	conn := tls.Client(c.conn, withServerName(tlsConfig, host))
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	return nil
+}
+
+// Bind authenticates as dn. An empty password is refused here, since servers treat it
+// as an anonymous bind that succeeds for any dn.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return ErrInvalidCredentials
+	}
+	req := constructed(classApplication, opBindRequest,
+		integer(3), // LDAPv3
+		octetString(dn),
+		primitive(classContext, 0, []byte(password)),
+	)
+	id, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	resp, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if resp.tag != opBindResponse {
+		return errors.New("ldap: unexpected response to bind")
+	}
+	return result(resp)
+}
+
+// Search returns the entries below base matching filter, with the given attributes
+func (c *Conn) Search(base, filter string, attributes []string) ([]Entry, error) {
+	compiled, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attrs := sequence()
+	for _, attr := range attributes {
+		attrs.children = append(attrs.children, octetString(attr))
+	}
+	req := constructed(classApplication, opSearchRequest,
+		octetString(base),
+		enumerated(2), // whole subtree
+		enumerated(3), // always dereference aliases
+		integer(maxSearchEntries),
+		integer(maxSearchSeconds),
+		boolean(false),
+		compiled,
+		attrs,
+	)
+	id, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for {
+		resp, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.tag {
+		case opSearchEntry:
+			entry := Entry{DN: resp.child(0).string(), Attributes: make(map[string][]string)}
+			for _, attr := range resp.child(1).children {
+				var values []string
+				for _, value := range attr.child(1).children {
+					values = append(values, value.string())
+				}
+				entry.Attributes[attr.child(0).string()] = values
+			}
+			entries = append(entries, entry)
+		case opSearchReference:
+			// Referrals to other servers are not followed
+		case opSearchDone:
+			err := result(resp)
+			var resultErr *ResultError
+			if errors.As(err, &resultErr) && resultErr.Code == resultNoSuchObject {
+				return nil, nil
+			}
+			if errors.As(err, &resultErr) && resultErr.Code == resultSizeLimitExceeded {
+				return entries, nil
+			}
+			return entries, err
+		default:
+			return nil, errors.New("ldap: unexpected response to search")
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Filter choice tags (RFC 4511 section 4.5.1)
+const (
+	filterAnd             = 0
+	filterOr              = 1
+	filterNot             = 2
+	filterEqualityMatch   = 3
+	filterSubstrings      = 4
+	filterGreaterOrEqual  = 5
+	filterLessOrEqual     = 6
+	filterPresent         = 7
+	filterApproxMatch     = 8
+	filterExtensibleMatch = 9
+)
+
+// EscapeFilter escapes a value for use inside a search filter, so that user input
+// such as a username cannot change the meaning of the filter
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '*' || c == '(' || c == ')' || c == '\\' || c == 0 || c >= 0x80:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileFilter parses a string filter such as "(&(objectClass=person)(uid=jdoe))" (RFC 4515)
+func compileFilter(filter string) (*packet, error) {
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return nil, fmt.Errorf("ldap: empty filter")
+	}
+	if filter[0] != '(' {
+		filter = "(" + filter + ")"
+	}
+	p, rest, err := parseFilter(filter, 0)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldap: unexpected %q after filter", rest)
+	}
+	return p, nil
+}
+
+// parseFilter parses one parenthesized filter at the start of s and returns the rest
+func parseFilter(s string, depth int) (*packet, string, error) {
+	if depth > maxPacketDepth {
+		return nil, "", fmt.Errorf("ldap: filter nested too deeply")
+	}
+	if s == "" || s[0] != '(' {
+		return nil, "", fmt.Errorf("ldap: filter must start with '('")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", fmt.Errorf("ldap: unterminated filter")
+	}
+
+	switch s[0] {
+	case '&', '|':
+		tag := filterAnd
+		if s[0] == '|' {
+			tag = filterOr
+		}
+		set := constructed(classContext, tag)
+		s = s[1:]
+		for s != "" && s[0] == '(' {
+			child, rest, err := parseFilter(s, depth+1)
+			if err != nil {
+				return nil, "", err
+			}
+			set.children = append(set.children, child)
+			s = rest
+		}
+		if s == "" || s[0] != ')' {
+			return nil, "", fmt.Errorf("ldap: unterminated filter")
+		}
+		return set, s[1:], nil
+	case '!':
+		child, rest, err := parseFilter(s[1:], depth+1)
+		if err != nil {
+			return nil, "", err
+		}
+		if rest == "" || rest[0] != ')' {
+			return nil, "", fmt.Errorf("ldap: unterminated filter")
+		}
+		return constructed(classContext, filterNot, child), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("ldap: unterminated filter")
+	}
+	item, err := parseItem(s[:end])
+	if err != nil {
+		return nil, "", err
+	}
+	return item, s[end+1:], nil
+}
+
+// parseItem parses the inside of a simple filter such as "uid=jdoe" or "cn=J*"
+func parseItem(item string) (*packet, error) {
+	eq := strings.IndexByte(item, '=')
+	if eq < 1 {
+		return nil, fmt.Errorf("ldap: invalid filter item %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+
+	tag := filterEqualityMatch
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = filterGreaterOrEqual, attr[:len(attr)-1]
+	case '<':
+		tag, attr = filterLessOrEqual, attr[:len(attr)-1]
+	case '~':
+		tag, attr = filterApproxMatch, attr[:len(attr)-1]
+	case ':':
+		return parseExtensible(attr[:len(attr)-1], value)
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("ldap: invalid filter item %q", item)
+	}
+
+	if tag == filterEqualityMatch {
+		if value == "*" {
+			return primitive(classContext, filterPresent, []byte(attr)), nil
+		}
+		if strings.Contains(value, "*") {
+			return parseSubstrings(attr, value)
+		}
+	}
+	decoded, err := unescapeFilter(value)
+	if err != nil {
+		return nil, err
+	}
+	return constructed(classContext, tag, octetString(attr), octetString(decoded)), nil
+}
+
+// parseSubstrings encodes a value with wildcards such as "J*n*e"
+func parseSubstrings(attr, value string) (*packet, error) {
+	parts := strings.Split(value, "*")
+	subs := sequence()
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		decoded, err := unescapeFilter(part)
+		if err != nil {
+			return nil, err
+		}
+		kind := 1 // any
+		switch i {
+		case 0:
+			kind = 0 // initial
+		case len(parts) - 1:
+			kind = 2 // final
+		}
+		subs.children = append(subs.children, primitive(classContext, kind, []byte(decoded)))
+	}
+	return constructed(classContext, filterSubstrings, octetString(attr), subs), nil
+}
+
+// parseExtensible encodes "attr:dn:rule:=value" and its shorter forms
+func parseExtensible(spec, value string) (*packet, error) {
+	fields := strings.Split(spec, ":")
+	attr, rest := fields[0], fields[1:]
+	dnAttributes := false
+	rule := ""
+	for _, field := range rest {
+		switch {
+		case strings.EqualFold(field, "dn"):
+			dnAttributes = true
+		case rule == "" && field != "":
+			rule = field
+		default:
+			return nil, fmt.Errorf("ldap: invalid extensible match %q", spec)
+		}
+	}
+	if attr == "" && rule == "" {
+		return nil, fmt.Errorf("ldap: extensible match needs an attribute or a rule")
+	}
+	decoded, err := unescapeFilter(value)
+	if err != nil {
+		return nil, err
+	}
+
+	match := constructed(classContext, filterExtensibleMatch)
+	if rule != "" {
+		match.children = append(match.children, primitive(classContext, 1, []byte(rule)))
+	}
+	if attr != "" {
+		match.children = append(match.children, primitive(classContext, 2, []byte(attr)))
+	}
+	match.children = append(match.children, primitive(classContext, 3, []byte(decoded)))
+	if dnAttributes {
+		match.children = append(match.children, primitive(classContext, 4, []byte{0xff}))
+	}
+	return match, nil
+}
+
+// unescapeFilter decodes the \XX escapes of a filter value
+func unescapeFilter(value string) (string, error) {
+	if !strings.Contains(value, "\\") {
+		return value, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return "", fmt.Errorf("ldap: invalid escape in %q", value)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("ldap: invalid escape in %q", value)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
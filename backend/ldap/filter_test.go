@@ -0,0 +1,105 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestEscapeFilter(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"jdoe", "jdoe"},
+		{"*", `\2a`},
+		{"admin)(uid=*", `admin\29\28uid=\2a`},
+		{`a\b`, `a\5cb`},
+		{"nul\x00byte", `nul\00byte`},
+		{"Jürgen", `J\c3\bcrgen`},
+		{"*)(|(objectClass=*", `\2a\29\28|\28objectClass=\2a`},
+	} {
+		if got := EscapeFilter(tt.in); got != tt.want {
+			t.Errorf("EscapeFilter(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// Whatever a user enters, an escaped value stays a single equality match on exactly that value
+func TestEscapedValuesCannotChangeTheFilter(t *testing.T) {
+	for _, username := range []string{
+		"*",
+		"admin)(uid=*",
+		"*)(|(uid=*)",
+		"jdoe)(!(memberOf=cn=blocked,dc=example,dc=org)",
+		`\2a`,
+		`x\`,
+		"nul\x00)",
+		"(&)",
+		"Jürgen",
+	} {
+		filter := "(&(objectClass=person)(uid=" + EscapeFilter(username) + "))"
+		p, err := compileFilter(filter)
+		if err != nil {
+			t.Errorf("username %q: compileFilter(%q) error = %v", username, filter, err)
+			continue
+		}
+		if p.tag != filterAnd || len(p.children) != 2 {
+			t.Errorf("username %q: filter became %s", username, hex.EncodeToString(p.encode()))
+			continue
+		}
+		match := p.children[1]
+		if match.tag != filterEqualityMatch || match.child(0).string() != "uid" || match.child(1).string() != username {
+			t.Errorf("username %q: matches tag %d on %q = %q", username, match.tag, match.child(0).string(), match.child(1).string())
+		}
+	}
+}
+
+func TestCompileFilterKnownAnswers(t *testing.T) {
+	for _, tt := range []struct{ filter, want string }{
+		// equalityMatch [3] { "uid", "jdoe" }
+		{"(uid=jdoe)", "a30b" + "0403756964" + "04046a646f65"},
+		// Filters without parentheses are accepted
+		{"uid=jdoe", "a30b" + "0403756964" + "04046a646f65"},
+		// present [7] "cn"
+		{"(cn=*)", "8702636e"},
+		// and [0] { equalityMatch, not [2] { present } }
+		{"(&(a=b)(!(c=*)))", "a00d" + "a306" + "040161" + "040162" + "a203" + "870163"},
+		// substrings [4] { "cn", { initial "J", any "o", final "e" } }
+		{"(cn=J*o*e)", "a40f" + "0402636e" + "3009" + "80014a" + "81016f" + "820165"},
+		// greaterOrEqual [5] { "age", "21" }
+		{"(age>=21)", "a509" + "0403616765" + "04023231"},
+		// extensibleMatch [9] { rule "2.5.13.2", type "cn", value "x", dnAttributes }
+		{"(cn:dn:2.5.13.2:=x)", "a914" + "8108322e352e31332e32" + "8202636e" + "830178" + "8401ff"},
+		// Escapes are decoded into the value
+		{`(cn=a\2ab)`, "a309" + "0402636e" + "0403612a62"},
+	} {
+		p, err := compileFilter(tt.filter)
+		if err != nil {
+			t.Errorf("compileFilter(%q) error = %v", tt.filter, err)
+			continue
+		}
+		if got := hex.EncodeToString(p.encode()); got != tt.want {
+			t.Errorf("compileFilter(%q) = %s, want %s", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestCompileFilterRejects(t *testing.T) {
+	for _, filter := range []string{
+		"",
+		"(",
+		"(uid=jdoe",
+		"(uid=jdoe))",
+		"(&(uid=a)",
+		"(!(uid=a)",
+		"(=jdoe)",
+		"(>=1)",
+		`(uid=\2)`,
+		`(uid=\zz)`,
+		"(::=x)",
+		"(cn:a:b:=x)",
+		strings.Repeat("(!", maxPacketDepth+2) + "(a=b)" + strings.Repeat(")", maxPacketDepth+2),
+	} {
+		if _, err := compileFilter(filter); err == nil {
+			t.Errorf("compileFilter(%q) succeeded", filter)
+		}
+	}
+}
@@ -19,15 +19,25 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Load persistent state
+	if err := initStores(); err != nil {
+		log.Fatalf("Failed to load stores: %v", err)
+	}
+
 	// Set up Gin router
 	router := gin.Default()
 
+	// Login throttling keys on the client address, so only known proxies may set it
+	if err := router.SetTrustedProxies(AppConfig.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
+
 	// Configure CORS
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:8080", "http://localhost:5173"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-Share-Password", "Digest", "Content-MD5"},
+		ExposeHeaders:    []string{"Content-Length", "Retry-After"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -35,6 +45,13 @@ func main() {
 	// Register routes
 	SetupRoutes(router)
 
+	// Start background maintenance
+	startSessionPool()
+	startUploadCleaner()
+	startShareVisitSaver()
+	startChangeScanner()
+	startS3Gateway()
+
 	// Start server
 	log.Println("Starting server on :8000")
 	router.Run(":8000")
@@ -2,24 +2,145 @@ package main
 
 import (
 	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/auth"
+	"manschko.com/cloud-storage/controllers"
 )
 
+// webdavPrefix is where the WebDAV endpoint is mounted
+const webdavPrefix = "/webdav"
+
 // SetupRoutes registers all API endpoints
 func SetupRoutes(router *gin.Engine) {
 	// Auth routes
 	router.POST("/api/login", handleLogin)
+	// Users with a second factor finish their login with the challenge token from /api/login
+	router.POST("/api/login/2fa", loginTwoFactor)
+	router.POST("/api/login/2fa/enroll", loginTwoFactorEnroll)
+	// Refresh and logout must work with an expired access token, so they check their tokens themselves
+	router.POST("/api/token/refresh", refreshToken)
+	router.POST("/api/logout", handleLogout)
+	// Single sign-on through the identity provider, an alternative to /api/login
+	router.GET("/api/oidc/login", oidcLogin)
+	router.GET("/api/oidc/callback", oidcCallback)
+	router.POST("/api/oidc/exchange", oidcExchange)
+	// Public keys for other services verifying our tokens
+	router.GET("/.well-known/jwks.json", serveJWKS)
+
+	// Public share links and file requests, deliberately outside the auth middleware
+	router.GET("/s/:token", openShare)
+	router.GET("/s/:token/*path", openShare)
+	router.GET("/r/:token", describeFileRequest)
+	router.POST("/r/:token", submitFiles)
+
+	// WebDAV mount of the same storage, authenticated with Basic auth or a bearer token
+	dav := router.Group(webdavPrefix)
+	dav.Use(davAuthMiddleware())
+	{
+		dav.Any("/*path", serveWebDAV)
+		for _, method := range controllers.WebDAVMethods {
+			dav.Handle(method, "/*path", serveWebDAV)
+		}
+	}
+
+	// Users only reach the routes their roles allow, personal access tokens
+	// also only those their scopes allow and none of those managing credentials or accounts.
+	read, upload, write := requirePermission(auth.PermRead), requirePermission(auth.PermUpload), requirePermission(auth.PermWrite)
+	del, share := requirePermission(auth.PermDelete), requirePermission(auth.PermShare)
+
+	// Change notifications; browsers cannot set headers on event streams, so the token may come as a query parameter.
+	// Events name the files they concern, so streaming them needs the read permission.
+	router.GET("/api/events", streamAuthMiddleware(), read, streamEvents)
+	router.GET("/api/jobs/:id/stream", streamAuthMiddleware(), read, streamJob)
 
 	// Protected routes
+	login := requireLogin()
 	authorized := router.Group("/api")
 	authorized.Use(authMiddleware())
 	{
 		// File operations
-		authorized.GET("/files/*path", listFiles)
-		authorized.GET("/download/*path", downloadFile)
-		authorized.POST("/upload/*path", uploadFile)
-		authorized.DELETE("/files/*path", deleteFile)
-		authorized.PUT("/move", moveFile)
-		authorized.PUT("/rename", renameFile)
-		authorized.POST("/mkdir/*path", createDirectory)
+		authorized.GET("/files/*path", read, listFiles)
+		authorized.GET("/stat/*path", read, statFile)
+		authorized.GET("/download/*path", read, downloadFile)
+		authorized.POST("/upload/*path", upload, uploadFile)
+		authorized.DELETE("/files/*path", del, deleteFile)
+		authorized.PUT("/move", write, moveFile)
+		authorized.PUT("/rename", write, renameFile)
+		authorized.POST("/mkdir/*path", upload, createDirectory)
+		authorized.GET("/checksum/*path", read, checksumFile)
+		authorized.PUT("/chmod", write, chmodFile)
+		authorized.PUT("/chtimes", write, chtimesFile)
+		authorized.POST("/symlink", write, createSymlink)
+		authorized.GET("/readlink/*path", read, readLink)
+
+		// Delta sync feed
+		authorized.GET("/changes/cursor", read, latestChangeCursor)
+		authorized.GET("/changes", read, listChanges)
+
+		// Share links
+		authorized.POST("/shares", share, createShare)
+		authorized.GET("/shares", share, listShares)
+		authorized.DELETE("/shares/:id", share, revokeShare)
+
+		// Upload-only file requests
+		authorized.POST("/file-requests", share, createFileRequest)
+		authorized.GET("/file-requests", share, listFileRequests)
+		authorized.GET("/file-requests/:id", share, getFileRequest)
+		authorized.DELETE("/file-requests/:id", share, revokeFileRequest)
+
+		// Folders shared with other users
+		authorized.POST("/grants", share, createGrant)
+		authorized.GET("/grants", share, listGrants)
+		authorized.GET("/grants/shared-with-me", read, listSharedWithMe)
+		authorized.DELETE("/grants/:id", share, revokeGrant)
+
+		// Group spaces and memberships
+		authorized.POST("/groups", login, share, createGroup)
+		authorized.GET("/groups", read, listGroups)
+		authorized.GET("/groups/:name", read, getGroup)
+		authorized.DELETE("/groups/:name", login, share, deleteGroup)
+		authorized.PUT("/groups/:name/members/:username", login, share, setGroupMember)
+		authorized.DELETE("/groups/:name/members/:username", login, share, removeGroupMember)
+
+		// Access keys for the S3 gateway
+		authorized.POST("/s3/keys", login, createS3Key)
+		authorized.GET("/s3/keys", login, listS3Keys)
+		authorized.DELETE("/s3/keys/:id", login, revokeS3Key)
+
+		// Personal access tokens for scripts and CI
+		authorized.POST("/tokens", login, createAccessToken)
+		authorized.GET("/tokens", login, listAccessTokens)
+		authorized.DELETE("/tokens/:id", login, revokeAccessToken)
+
+		// Background jobs for long-running file operations; delete jobs also need the delete permission,
+		// and jobs overwriting files the write permission
+		authorized.POST("/jobs", upload, submitJob)
+		authorized.GET("/jobs", read, listJobs)
+		authorized.GET("/jobs/:id", read, getJob)
+		authorized.DELETE("/jobs/:id", upload, cancelJob)
+
+		// Two-factor authentication of the logged in user
+		authorized.GET("/2fa", login, twoFactorStatus)
+		authorized.POST("/2fa/enroll", login, enrollTwoFactor)
+		authorized.POST("/2fa/activate", login, activateTwoFactor)
+		authorized.POST("/2fa/recovery-codes", login, regenerateRecoveryCodes)
+		authorized.DELETE("/2fa", login, disableTwoFactor)
+
+	}
+
+	// Server management, admins only
+	admin := authorized.Group("/admin", requireLogin(), requirePermission(auth.PermAdmin))
+	{
+		// Login lockouts and second factors
+		admin.GET("/lockouts", listLockouts)
+		admin.DELETE("/lockouts/:kind/:value", clearLockout)
+		admin.DELETE("/2fa/:username", resetTwoFactor)
+
+		// Accounts on the SFTP server
+		admin.GET("/users", listUsers)
+		admin.POST("/users", createUser)
+		admin.POST("/users/:username/disable", disableUser)
+		admin.POST("/users/:username/enable", enableUser)
+		admin.PUT("/users/:username/password", resetPassword)
+		admin.DELETE("/users/:username", deleteUser)
 	}
 }
@@ -0,0 +1,99 @@
+package s3
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxChunkSize bounds a single aws-chunked chunk so a client cannot make us buffer without limit
+const maxChunkSize = 16 << 20
+
+var errMalformedChunk = ErrInvalidRequest.WithMessage("The aws-chunked body is malformed.")
+
+// hashingReader fails at EOF when the body does not match the signed SHA-256
+type hashingReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.expected {
+		return n, ErrContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body, verifying each chunk's signature before releasing its data
+type chunkedReader struct {
+	r        *bufio.Reader
+	signed   *Signed
+	previous string
+	buf      []byte
+	err      error
+}
+
+func newChunkedReader(body io.Reader, signed *Signed) *chunkedReader {
+	return &chunkedReader{
+		r:        bufio.NewReader(body),
+		signed:   signed,
+		previous: signed.seedSignature,
+	}
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.err = c.next()
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// next reads and verifies one chunk; the final zero-length chunk ends the body with io.EOF
+func (c *chunkedReader) next() error {
+	header, err := c.r.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	sizeHex, params, _ := strings.Cut(strings.TrimRight(header, "\r\n"), ";")
+	signature, ok := strings.CutPrefix(params, "chunk-signature=")
+	if !ok {
+		return errMalformedChunk
+	}
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errMalformedChunk
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(c.r, crlf[:]); err != nil || string(crlf[:]) != "\r\n" {
+		return errMalformedChunk
+	}
+
+	expected := c.signed.chunkSignature(c.previous, data)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrSignatureDoesNotMatch
+	}
+	c.previous = signature
+
+	if size == 0 {
+		return io.EOF
+	}
+	c.buf = data
+	return nil
+}
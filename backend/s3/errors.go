@@ -0,0 +1,52 @@
+package s3
+
+import "net/http"
+
+// Error is an S3 error with the code and status clients switch on
+type Error struct {
+	Code       string
+	Message    string
+	StatusCode int
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// WithMessage returns a copy of e carrying a more specific message
+func (e *Error) WithMessage(message string) *Error {
+	copied := *e
+	copied.Message = message
+	return &copied
+}
+
+// Is lets copies made by WithMessage match their original with errors.Is
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+var (
+	ErrAccessDenied                 = &Error{"AccessDenied", "Access Denied", http.StatusForbidden}
+	ErrInvalidAccessKeyID           = &Error{"InvalidAccessKeyId", "The access key ID you provided does not exist in our records.", http.StatusForbidden}
+	ErrSignatureDoesNotMatch        = &Error{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.", http.StatusForbidden}
+	ErrRequestTimeTooSkewed         = &Error{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.", http.StatusForbidden}
+	ErrAuthorizationHeaderMalformed = &Error{"AuthorizationHeaderMalformed", "The authorization header is malformed.", http.StatusBadRequest}
+	ErrContentSHA256Mismatch        = &Error{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.", http.StatusBadRequest}
+	ErrInvalidRequest               = &Error{"InvalidRequest", "Invalid request.", http.StatusBadRequest}
+	ErrInvalidArgument              = &Error{"InvalidArgument", "Invalid argument.", http.StatusBadRequest}
+	ErrInvalidDigest                = &Error{"InvalidDigest", "The Content-MD5 you specified is not valid.", http.StatusBadRequest}
+	ErrBadDigest                    = &Error{"BadDigest", "The Content-MD5 you specified did not match what we received.", http.StatusBadRequest}
+	ErrMalformedXML                 = &Error{"MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema.", http.StatusBadRequest}
+	ErrInvalidBucketName            = &Error{"InvalidBucketName", "The specified bucket is not valid.", http.StatusBadRequest}
+	ErrNoSuchBucket                 = &Error{"NoSuchBucket", "The specified bucket does not exist.", http.StatusNotFound}
+	ErrNoSuchKey                    = &Error{"NoSuchKey", "The specified key does not exist.", http.StatusNotFound}
+	ErrNoSuchUpload                 = &Error{"NoSuchUpload", "The specified multipart upload does not exist.", http.StatusNotFound}
+	ErrInvalidPart                  = &Error{"InvalidPart", "One or more of the specified parts could not be found.", http.StatusBadRequest}
+	ErrInvalidPartOrder             = &Error{"InvalidPartOrder", "The list of parts was not in ascending order.", http.StatusBadRequest}
+	ErrBucketNotEmpty               = &Error{"BucketNotEmpty", "The bucket you tried to delete is not empty.", http.StatusConflict}
+	ErrBucketAlreadyOwnedByYou      = &Error{"BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it.", http.StatusConflict}
+	ErrSlowDown                     = &Error{"SlowDown", "Please reduce your request rate.", http.StatusTooManyRequests}
+	ErrNotImplemented               = &Error{"NotImplemented", "A header or query you provided implies functionality that is not implemented.", http.StatusNotImplemented}
+	ErrInternalError                = &Error{"InternalError", "We encountered an internal error. Please try again.", http.StatusInternalServerError}
+)
@@ -0,0 +1,141 @@
+package s3
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"sort"
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+// AccessKey lets S3 clients act as one user.
+// SigV4 signs with the secret itself, so unlike passwords it cannot be stored hashed.
+type AccessKey struct {
+	AccessKeyID string `json:"access_key_id"`
+	SecretKey   string `json:"secret_access_key"`
+	Owner       string `json:"owner"`
+	// BackendRoles are the owner's roles from the account backend when the key was created;
+	// the configured roles are added each time the key is used
+	BackendRoles []string  `json:"backend_roles,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// KeyStore keeps access keys in memory and persists them as JSON
+type KeyStore struct {
+	mu   sync.RWMutex
+	file *storage.JSONFile
+	keys map[string]*AccessKey // keyed by access key ID
+}
+
+// NewKeyStore loads the access keys saved at path; an empty path keeps them in memory only
+func NewKeyStore(path string) (*KeyStore, error) {
+	s := &KeyStore{
+		file: storage.NewJSONFile(path),
+		keys: make(map[string]*AccessKey),
+	}
+	if err := s.file.Load(&s.keys); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save persists the current keys; callers hold the lock
+func (s *KeyStore) save() error {
+	return s.file.Save(s.keys)
+}
+
+// newAccessKeyID returns an ID in the usual uppercase AWS shape
+func newAccessKeyID() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "SCK" + base32.StdEncoding.EncodeToString(buf), nil
+}
+
+// Create issues a new access key for owner, who holds backendRoles in the account backend
+func (s *KeyStore) Create(owner string, backendRoles []string, description string) (*AccessKey, error) {
+	id, err := newAccessKeyID()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := storage.RandomToken(30)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &AccessKey{
+		AccessKeyID:  id,
+		SecretKey:    secret,
+		Owner:        owner,
+		BackendRoles: backendRoles,
+		Description:  description,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[id] = key
+	if err := s.save(); err != nil {
+		delete(s.keys, id)
+		return nil, err
+	}
+	copied := *key
+	return &copied, nil
+}
+
+// ListByOwner returns the owner's access keys, oldest first
+func (s *KeyStore) ListByOwner(owner string) []AccessKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var list []AccessKey
+	for _, key := range s.keys {
+		if key.Owner == owner {
+			list = append(list, *key)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Revoke deletes one of the owner's access keys
+func (s *KeyStore) Revoke(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok || key.Owner != owner {
+		return ErrInvalidAccessKeyID
+	}
+	delete(s.keys, id)
+	return s.save()
+}
+
+// RevokeAll deletes every access key of owner
+func (s *KeyStore) RevokeAll(owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, key := range s.keys {
+		if key.Owner == owner {
+			delete(s.keys, id)
+		}
+	}
+	return s.save()
+}
+
+// Lookup returns the credentials behind an access key ID, for Verifier
+func (s *KeyStore) Lookup(id string) (Credentials, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return Credentials{}, ErrInvalidAccessKeyID
+	}
+	return Credentials{AccessKeyID: key.AccessKeyID, SecretKey: key.SecretKey, Owner: key.Owner, BackendRoles: key.BackendRoles}, nil
+}
@@ -0,0 +1,175 @@
+package s3
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+// MaxPartNumber is the highest part number S3 accepts
+const MaxPartNumber = 10000
+
+// Upload is a multipart upload in progress
+type Upload struct {
+	ID        string           `json:"id"`
+	Owner     string           `json:"owner"`
+	Bucket    string           `json:"bucket"`
+	Key       string           `json:"key"`
+	Initiated time.Time        `json:"initiated"`
+	Parts     map[int]PartInfo `json:"parts"`
+}
+
+// PartInfo describes one uploaded part
+type PartInfo struct {
+	Number       int       `json:"number"`
+	ETag         string    `json:"etag"` // hex MD5 without quotes
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// LastActivity is when the upload was started or last received a part
+func (u *Upload) LastActivity() time.Time {
+	last := u.Initiated
+	for _, part := range u.Parts {
+		if part.LastModified.After(last) {
+			last = part.LastModified
+		}
+	}
+	return last
+}
+
+// SortedParts returns the parts by ascending part number
+func (u *Upload) SortedParts() []PartInfo {
+	parts := make([]PartInfo, 0, len(u.Parts))
+	for _, part := range u.Parts {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts
+}
+
+func copyUpload(u *Upload) *Upload {
+	copied := *u
+	copied.Parts = make(map[int]PartInfo, len(u.Parts))
+	for number, part := range u.Parts {
+		copied.Parts[number] = part
+	}
+	return &copied
+}
+
+// UploadStore tracks multipart uploads; the part data itself lives on the SFTP server.
+// Uploads without a new part for maxAge expire, as S3 lifecycle rules would abort them.
+type UploadStore struct {
+	mu      sync.Mutex
+	file    *storage.JSONFile
+	uploads map[string]*Upload // keyed by upload ID
+	maxAge  time.Duration
+}
+
+// NewUploadStore loads the uploads saved at path; an empty path keeps them in memory only.
+// A maxAge of zero keeps uploads until they are completed or aborted.
+func NewUploadStore(path string, maxAge time.Duration) (*UploadStore, error) {
+	s := &UploadStore{
+		file:    storage.NewJSONFile(path),
+		uploads: make(map[string]*Upload),
+		maxAge:  maxAge,
+	}
+	if err := s.file.Load(&s.uploads); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save persists the current uploads; callers hold the lock
+func (s *UploadStore) save() error {
+	return s.file.Save(s.uploads)
+}
+
+// expired reports whether upload has been idle for longer than maxAge
+func (s *UploadStore) expired(upload *Upload, now time.Time) bool {
+	return s.maxAge > 0 && now.Sub(upload.LastActivity()) > s.maxAge
+}
+
+// Create starts a multipart upload of bucket/key for owner
+func (s *UploadStore) Create(owner, bucket, key string) (*Upload, error) {
+	id, err := storage.RandomToken(24)
+	if err != nil {
+		return nil, err
+	}
+	upload := &Upload{
+		ID:        id,
+		Owner:     owner,
+		Bucket:    bucket,
+		Key:       key,
+		Initiated: time.Now().UTC(),
+		Parts:     map[int]PartInfo{},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads[id] = upload
+	if err := s.save(); err != nil {
+		delete(s.uploads, id)
+		return nil, err
+	}
+	return copyUpload(upload), nil
+}
+
+// Get returns one of the owner's uploads, which must be for bucket/key
+func (s *UploadStore) Get(owner, bucket, key, id string) (*Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok || upload.Owner != owner || upload.Bucket != bucket || upload.Key != key || s.expired(upload, time.Now()) {
+		return nil, ErrNoSuchUpload
+	}
+	return copyUpload(upload), nil
+}
+
+// PutPart records an uploaded part, replacing an earlier part with the same number
+func (s *UploadStore) PutPart(id string, part PartInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok {
+		return ErrNoSuchUpload
+	}
+	upload.Parts[part.Number] = part
+	return s.save()
+}
+
+// Remove forgets an upload after it completed or was aborted
+func (s *UploadStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.uploads[id]; !ok {
+		return ErrNoSuchUpload
+	}
+	delete(s.uploads, id)
+	return s.save()
+}
+
+// Expire forgets the uploads that have been idle for too long and returns them,
+// so that the caller can delete their parts
+func (s *UploadStore) Expire() ([]Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []Upload
+	now := time.Now()
+	for id, upload := range s.uploads {
+		if s.expired(upload, now) {
+			expired = append(expired, *copyUpload(upload))
+			delete(s.uploads, id)
+		}
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	return expired, s.save()
+}
@@ -0,0 +1,81 @@
+package s3
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUploadStoreChecksOwnerAndKey(t *testing.T) {
+	s, err := NewUploadStore("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := s.Create("alice", "photos", "2024/a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("alice", "photos", "2024/a.jpg", upload.ID); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	for _, tt := range []struct{ owner, bucket, key string }{
+		{"bob", "photos", "2024/a.jpg"},
+		{"alice", "docs", "2024/a.jpg"},
+		{"alice", "photos", "2024/b.jpg"},
+	} {
+		if _, err := s.Get(tt.owner, tt.bucket, tt.key, upload.ID); err != ErrNoSuchUpload {
+			t.Errorf("Get(%s, %s, %s) error = %v, want NoSuchUpload", tt.owner, tt.bucket, tt.key, err)
+		}
+	}
+}
+
+func TestUploadStoreParts(t *testing.T) {
+	s, _ := NewUploadStore("", 0)
+	upload, _ := s.Create("alice", "photos", "a.jpg")
+	for _, part := range []PartInfo{{Number: 3, ETag: "c"}, {Number: 1, ETag: "a"}, {Number: 3, ETag: "d"}} {
+		if err := s.PutPart(upload.ID, part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, _ := s.Get("alice", "photos", "a.jpg", upload.ID)
+	parts := got.SortedParts()
+	if len(parts) != 2 || parts[0].ETag != "a" || parts[1].ETag != "d" {
+		t.Fatalf("parts = %+v, want 1 and the second part 3", parts)
+	}
+
+	// Callers get copies that do not change the store
+	got.Parts[2] = PartInfo{Number: 2}
+	if again, _ := s.Get("alice", "photos", "a.jpg", upload.ID); len(again.Parts) != 2 {
+		t.Fatal("a copy changed the stored upload")
+	}
+
+	if err := s.Remove(upload.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutPart(upload.ID, PartInfo{Number: 1}); err != ErrNoSuchUpload {
+		t.Fatalf("PutPart() after Remove() error = %v", err)
+	}
+}
+
+func TestUploadStoreExpiresIdleUploads(t *testing.T) {
+	s, _ := NewUploadStore("", time.Hour)
+	idle, _ := s.Create("alice", "photos", "idle.jpg")
+	active, _ := s.Create("alice", "photos", "active.jpg")
+
+	s.uploads[idle.ID].Initiated = time.Now().Add(-2 * time.Hour)
+	s.uploads[active.ID].Initiated = time.Now().Add(-2 * time.Hour)
+	s.PutPart(active.ID, PartInfo{Number: 1, LastModified: time.Now()})
+
+	if _, err := s.Get("alice", "photos", "idle.jpg", idle.ID); err != ErrNoSuchUpload {
+		t.Fatalf("Get() of an idle upload error = %v", err)
+	}
+	expired, err := s.Expire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].ID != idle.ID {
+		t.Fatalf("Expire() = %+v, want only the idle upload", expired)
+	}
+	if _, err := s.Get("alice", "photos", "active.jpg", active.ID); err != nil {
+		t.Fatalf("an upload receiving parts expired: %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat = "20060102T150405Z"
+
+	// UnsignedPayload marks a body that is not covered by the signature
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// StreamingPayload marks an aws-chunked body whose chunks are signed one by one
+	StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxClockSkew     = 15 * time.Minute
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// Credentials are an access key's secret and the user it acts for
+type Credentials struct {
+	AccessKeyID  string
+	SecretKey    string
+	Owner        string
+	BackendRoles []string
+}
+
+// Verifier checks AWS Signature Version 4 on incoming requests
+type Verifier struct {
+	Region string
+	Lookup func(accessKeyID string) (Credentials, error)
+
+	// now is the clock signatures are checked against; nil means time.Now
+	now func() time.Time
+}
+
+func (v *Verifier) clock() time.Time {
+	if v.now != nil {
+		return v.now()
+	}
+	return time.Now()
+}
+
+// Signed is a request whose signature checked out
+type Signed struct {
+	Credentials
+	PayloadHash string
+
+	signingKey    []byte
+	scope         string
+	amzDate       string
+	seedSignature string
+}
+
+// authParams are the pieces of a signature, from the Authorization header or a presigned URL
+type authParams struct {
+	accessKeyID   string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	payloadHash   string
+}
+
+// Verify authenticates r by its Authorization header or presigned query
+func (v *Verifier) Verify(r *http.Request) (*Signed, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return v.verifyHeader(r, header)
+	}
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		return v.verifyPresigned(r)
+	}
+	return nil, ErrAccessDenied
+}
+
+// parseCredential splits AKID/date/region/service/aws4_request
+func parseCredential(credential string, p *authParams) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return ErrAuthorizationHeaderMalformed.WithMessage("The credential scope is malformed.")
+	}
+	p.accessKeyID, p.date, p.region, p.service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+func (v *Verifier) verifyHeader(r *http.Request, header string) (*Signed, error) {
+	fields, ok := strings.CutPrefix(header, signAlgorithm+" ")
+	if !ok {
+		return nil, ErrAuthorizationHeaderMalformed.WithMessage("Only " + signAlgorithm + " signatures are supported.")
+	}
+
+	var p authParams
+	for _, field := range strings.Split(fields, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "Credential":
+			if err := parseCredential(value, &p); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			p.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			p.signature = value
+		}
+	}
+	if p.accessKeyID == "" || len(p.signedHeaders) == 0 || p.signature == "" {
+		return nil, ErrAuthorizationHeaderMalformed
+	}
+
+	p.amzDate = r.Header.Get("X-Amz-Date")
+	if p.amzDate == "" {
+		if date, err := http.ParseTime(r.Header.Get("Date")); err == nil {
+			p.amzDate = date.UTC().Format(amzDateFormat)
+		}
+	}
+	signedAt, err := time.Parse(amzDateFormat, p.amzDate)
+	if err != nil {
+		return nil, ErrAccessDenied.WithMessage("AWS authentication requires a valid Date or x-amz-date header.")
+	}
+	if skew := v.clock().Sub(signedAt); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, ErrRequestTimeTooSkewed
+	}
+
+	p.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if p.payloadHash == "" {
+		return nil, ErrInvalidRequest.WithMessage("Missing required header for this request: x-amz-content-sha256.")
+	}
+	return v.check(r, p, r.URL.Query())
+}
+
+func (v *Verifier) verifyPresigned(r *http.Request) (*Signed, error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signAlgorithm {
+		return nil, ErrAuthorizationHeaderMalformed.WithMessage("Only " + signAlgorithm + " signatures are supported.")
+	}
+
+	var p authParams
+	if err := parseCredential(query.Get("X-Amz-Credential"), &p); err != nil {
+		return nil, err
+	}
+	p.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	p.signature = query.Get("X-Amz-Signature")
+	p.amzDate = query.Get("X-Amz-Date")
+	p.payloadHash = UnsignedPayload
+	if hash := query.Get("X-Amz-Content-Sha256"); hash != "" {
+		p.payloadHash = hash
+	}
+
+	signedAt, err := time.Parse(amzDateFormat, p.amzDate)
+	if err != nil {
+		return nil, ErrAuthorizationHeaderMalformed.WithMessage("X-Amz-Date must be in the ISO8601 long format.")
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignExpiry {
+		return nil, ErrAuthorizationHeaderMalformed.WithMessage("X-Amz-Expires must be between 0 and 604800 seconds.")
+	}
+	if signedAt.Sub(v.clock()) > maxClockSkew {
+		return nil, ErrAccessDenied.WithMessage("Request is not valid yet.")
+	}
+	if v.clock().After(signedAt.Add(time.Duration(expires) * time.Second)) {
+		return nil, ErrAccessDenied.WithMessage("Request has expired.")
+	}
+
+	query.Del("X-Amz-Signature")
+	return v.check(r, p, query)
+}
+
+// check recomputes the signature over the canonical request and compares it
+func (v *Verifier) check(r *http.Request, p authParams, query url.Values) (*Signed, error) {
+	if p.service != "s3" {
+		return nil, ErrAuthorizationHeaderMalformed.WithMessage("The credential scope must be for the s3 service.")
+	}
+	if v.Region != "" && p.region != v.Region {
+		return nil, ErrAuthorizationHeaderMalformed.WithMessage(fmt.Sprintf("The region '%s' is wrong; expecting '%s'.", p.region, v.Region))
+	}
+	if !strings.HasPrefix(p.amzDate, p.date) {
+		return nil, ErrAuthorizationHeaderMalformed.WithMessage("The credential date does not match the request date.")
+	}
+	if !validPayloadHash(p.payloadHash) {
+		return nil, ErrInvalidArgument.WithMessage("x-amz-content-sha256 must be UNSIGNED-PAYLOAD, " + StreamingPayload + " or a SHA-256 hex digest.")
+	}
+	hasHost := false
+	for _, name := range p.signedHeaders {
+		hasHost = hasHost || name == "host"
+	}
+	if !hasHost {
+		return nil, ErrAccessDenied.WithMessage("The host header must be signed.")
+	}
+
+	creds, err := v.Lookup(p.accessKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := strings.Join([]string{p.date, p.region, p.service, "aws4_request"}, "/")
+	canonical := canonicalRequest(r, query, p.signedHeaders, p.payloadHash)
+	stringToSign := strings.Join([]string{signAlgorithm, p.amzDate, scope, sha256Hex([]byte(canonical))}, "\n")
+
+	key := signingKey(creds.SecretKey, p.date, p.region, p.service)
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(p.signature)) {
+		return nil, ErrSignatureDoesNotMatch
+	}
+
+	return &Signed{
+		Credentials:   creds,
+		PayloadHash:   p.payloadHash,
+		signingKey:    key,
+		scope:         scope,
+		amzDate:       p.amzDate,
+		seedSignature: p.signature,
+	}, nil
+}
+
+// Body wraps the request body so the payload is checked against what was signed.
+// Mismatches surface as read errors once the offending data arrives.
+func (s *Signed) Body(body io.Reader) io.Reader {
+	switch s.PayloadHash {
+	case UnsignedPayload:
+		return body
+	case StreamingPayload:
+		return newChunkedReader(body, s)
+	}
+	return &hashingReader{r: body, hash: sha256.New(), expected: s.PayloadHash}
+}
+
+// Streaming reports whether the body is aws-chunked
+func (s *Signed) Streaming() bool {
+	return s.PayloadHash == StreamingPayload
+}
+
+// chunkSignature signs one chunk of a streaming payload, chained to the previous signature
+func (s *Signed) chunkSignature(previous string, chunk []byte) string {
+	stringToSign := strings.Join([]string{
+		signAlgorithm + "-PAYLOAD", s.amzDate, s.scope, previous, emptySHA256, sha256Hex(chunk),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(s.signingKey, stringToSign))
+}
+
+func validPayloadHash(hash string) bool {
+	if hash == UnsignedPayload || hash == StreamingPayload {
+		return true
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil && len(hash) == sha256.Size*2
+}
+
+// canonicalRequest builds the SigV4 canonical form of r
+func canonicalRequest(r *http.Request, query url.Values, signedHeaders []string, payloadHash string) string {
+	canonicalURI := uriEncode(r.URL.Path, false)
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	// Parameters sort by encoded name, then value; sorting the joined pairs would put
+	// "a-b=" before "a=" as '-' sorts before '='
+	var pairs [][2]string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, [2]string{uriEncode(key, true), uriEncode(value, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	encoded := make([]string, len(pairs))
+	for i, pair := range pairs {
+		encoded[i] = pair[0] + "=" + pair[1]
+	}
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		headers.WriteString(name + ":" + canonicalHeaderValue(r, name) + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		canonicalURI,
+		strings.Join(encoded, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// canonicalHeaderValue joins a header's values with runs of spaces collapsed
+func canonicalHeaderValue(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		values = []string{r.Host}
+	case "content-length":
+		values = r.Header.Values(name)
+		if len(values) == 0 && r.ContentLength >= 0 {
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		}
+	default:
+		values = r.Header.Values(name)
+	}
+	for i, value := range values {
+		values[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, as SigV4 requires
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/controllers"
+)
+
+// Create an S3 gateway controller
+func getS3Controller() *controllers.S3Controller {
+	controller := controllers.NewS3Controller(getFileController(), s3KeyStore, s3UploadStore, AppConfig.S3Region)
+	controller.Roles = getAuthController().Roles
+	return controller
+}
+
+// S3 access key handlers
+func createS3Key(c *gin.Context) {
+	getS3Controller().CreateAccessKey(c)
+}
+
+func listS3Keys(c *gin.Context) {
+	getS3Controller().ListAccessKeys(c)
+}
+
+func revokeS3Key(c *gin.Context) {
+	getS3Controller().RevokeAccessKey(c)
+}
+
+// S3 gateway handlers
+func s3Authenticate(c *gin.Context) {
+	getS3Controller().Authenticate(c)
+}
+
+func serveS3(c *gin.Context) {
+	getS3Controller().Serve(c)
+}
+
+// startS3Gateway serves the S3-compatible API on its own listener.
+// Clients address buckets path-style, so it cannot share the API's routes.
+func startS3Gateway() {
+	if AppConfig.S3Listen == "" {
+		return
+	}
+
+	engine := gin.Default()
+	engine.Use(s3Authenticate)
+	engine.Any("/*path", serveS3)
+
+	go func() {
+		log.Printf("Starting S3 gateway on %s", AppConfig.S3Listen)
+		if err := engine.Run(AppConfig.S3Listen); err != nil {
+			log.Printf("S3 gateway stopped: %v", err)
+		}
+	}()
+}
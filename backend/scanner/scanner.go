@@ -0,0 +1,515 @@
+package scanner
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/events"
+	"manschko.com/cloud-storage/sftp"
+)
+
+var (
+	// ErrBaselinePending means the leased folders have not all been listed yet,
+	// so changes made over SFTP could still go unnoticed
+	ErrBaselinePending = errors.New("folders not fully listed yet")
+	// ErrTruncated means the lease covered more folders than the scanner tracks,
+	// so changes in some of them went unnoticed
+	ErrTruncated = errors.New("too many folders to track")
+)
+
+// entry is what a snapshot remembers about one directory entry
+type entry struct {
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// dirState is a tracked directory with its last snapshot and polling schedule
+type dirState struct {
+	snapshot map[string]entry // nil until the first scan
+	interval time.Duration
+	next     time.Time
+	// announce reports every entry of the first snapshot as created,
+	// for folders that appeared after their parent was already being tracked
+	announce bool
+	// expected holds names the API changed since the last scan; their changes were already published
+	expected map[string]bool
+}
+
+// lease keeps folders scanned recursively for a while without a live watch
+type lease struct {
+	dirs    []string
+	expires time.Time
+	since   uint64
+	// ready is set once every folder below dirs has been listed; since is only valid from then on
+	ready bool
+	// truncated is set when a folder below dirs could not be tracked because of MaxDirs
+	truncated bool
+}
+
+// watchKey identifies a watched folder
+type watchKey struct {
+	dir       string
+	recursive bool
+}
+
+// Scanner notices changes made directly on the SFTP server by periodically
+// listing the watched folders and diffing each listing against the previous one.
+// Folders that keep changing are polled every MinInterval; quiet ones back off up to MaxInterval.
+type Scanner struct {
+	Connect func() (*sftp.Client, error)
+	Broker  *events.Broker
+
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// MaxDirsPerCycle bounds how many folders one cycle lists
+	MaxDirsPerCycle int
+	// MaxDirs bounds how many folders recursive watches track in total
+	MaxDirs int
+
+	mu      sync.Mutex
+	watches map[watchKey]int
+	leases  map[string]*lease
+	dirs    map[string]*dirState
+}
+
+// New creates a scanner publishing to broker
+func New(connect func() (*sftp.Client, error), broker *events.Broker, minInterval, maxInterval time.Duration, maxDirsPerCycle int) *Scanner {
+	return &Scanner{
+		Connect:         connect,
+		Broker:          broker,
+		MinInterval:     minInterval,
+		MaxInterval:     maxInterval,
+		MaxDirsPerCycle: maxDirsPerCycle,
+		MaxDirs:         10000,
+		watches:         make(map[watchKey]int),
+		leases:          make(map[string]*lease),
+		dirs:            make(map[string]*dirState),
+	}
+}
+
+// Watch starts tracking dir, and with recursive every folder below it, until release is called.
+// Watches are reference counted, so several clients can watch the same folder.
+func (s *Scanner) Watch(dir string, recursive bool) (release func()) {
+	key := watchKey{dir: path.Clean(dir), recursive: recursive}
+
+	s.mu.Lock()
+	s.watches[key]++
+	if _, ok := s.dirs[key.dir]; !ok {
+		s.dirs[key.dir] = &dirState{interval: s.MinInterval}
+	}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.watches[key]--; s.watches[key] <= 0 {
+				delete(s.watches, key)
+				s.prune()
+			}
+		})
+	}
+}
+
+// Lease keeps dirs and everything below them scanned until ttl after the last call for name.
+// It returns the event ID since which the scans have covered every folder below dirs without a break;
+// changes made over SFTP before it, or while the lease had lapsed, may have gone unnoticed.
+// Until every folder has been listed once it fails with ErrBaselinePending. When some folder
+// could not be tracked it fails once with ErrTruncated and starts over with a new baseline.
+func (s *Scanner) Lease(name string, dirs []string, ttl time.Duration) (since uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	l, ok := s.leases[name]
+	truncated := ok && l.truncated
+	if !ok || truncated || now.After(l.expires) || !sameDirs(l.dirs, dirs) {
+		l = &lease{dirs: dirs}
+		s.leases[name] = l
+		s.prune()
+	}
+	l.expires = now.Add(ttl)
+	for _, dir := range dirs {
+		if _, ok := s.dirs[dir]; !ok {
+			s.dirs[dir] = &dirState{interval: s.MinInterval}
+		}
+	}
+	switch {
+	case truncated:
+		return 0, ErrTruncated
+	case !l.ready:
+		return 0, ErrBaselinePending
+	}
+	return l.since, nil
+}
+
+// checkBaselines marks the leases whose folders have all been listed as ready.
+// Their feed starts after the changes published so far, which the listings already reflect.
+func (s *Scanner) checkBaselines() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.leases {
+		if l.ready || l.truncated {
+			continue
+		}
+		complete := true
+		for dir, state := range s.dirs {
+			if state.snapshot == nil && l.covers(dir) {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			l.ready = true
+			l.since = s.Broker.Journal().LastID()
+		}
+	}
+}
+
+// covers reports whether dir lies below one of the lease's folders
+func (l *lease) covers(dir string) bool {
+	for _, root := range l.dirs {
+		if isWithin(root, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameDirs reports whether two folder lists hold the same folders
+func sameDirs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool, len(a))
+	for _, dir := range a {
+		seen[dir] = true
+	}
+	for _, dir := range b {
+		if !seen[dir] {
+			return false
+		}
+	}
+	return true
+}
+
+// covered reports whether some watch or lease still wants dir scanned; callers hold the lock
+func (s *Scanner) covered(dir string) bool {
+	for key := range s.watches {
+		if key.dir == dir || key.recursive && isWithin(key.dir, dir) {
+			return true
+		}
+	}
+	for _, l := range s.leases {
+		if l.covers(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// expireLeases drops the leases nobody renewed in time
+func (s *Scanner) expireLeases(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := false
+	for name, l := range s.leases {
+		if now.After(l.expires) {
+			delete(s.leases, name)
+			expired = true
+		}
+	}
+	if expired {
+		s.prune()
+	}
+}
+
+// prune forgets folders no watch covers anymore; callers hold the lock
+func (s *Scanner) prune() {
+	for dir := range s.dirs {
+		if !s.covered(dir) {
+			delete(s.dirs, dir)
+		}
+	}
+}
+
+// Run scans until stop is closed
+func (s *Scanner) Run(stop <-chan struct{}) {
+	go s.followAPI(stop)
+
+	ticker := time.NewTicker(s.MinInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.cycle()
+		}
+	}
+}
+
+// followAPI records the changes made through the API, so that scans do not report them a second time
+func (s *Scanner) followAPI(stop <-chan struct{}) {
+	for {
+		sub, _, _ := s.Broker.Subscribe(0)
+		for open := true; open; {
+			select {
+			case <-stop:
+				sub.Close()
+				return
+			case e, ok := <-sub.C:
+				if open = ok; ok && !e.External {
+					s.expect(e.Path)
+					s.expect(e.OldPath)
+				}
+			}
+		}
+		// Dropped for falling behind; a few duplicate events are the worst that can happen
+	}
+}
+
+// expect marks the entry at p as already reported
+func (s *Scanner) expect(p string) {
+	if p == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.dirs[path.Dir(p)]; ok && state.snapshot != nil {
+		if state.expected == nil {
+			state.expected = make(map[string]bool)
+		}
+		state.expected[path.Base(p)] = true
+	}
+}
+
+// due returns the folders whose next scan has come, most overdue first and at most MaxDirsPerCycle
+func (s *Scanner) due(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var dirs []string
+	for dir, state := range s.dirs {
+		if !state.next.After(now) {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return s.dirs[dirs[i]].next.Before(s.dirs[dirs[j]].next) })
+	if s.MaxDirsPerCycle > 0 && len(dirs) > s.MaxDirsPerCycle {
+		dirs = dirs[:s.MaxDirsPerCycle]
+	}
+	return dirs
+}
+
+// cycle scans the folders that are due
+func (s *Scanner) cycle() {
+	now := time.Now()
+	s.expireLeases(now)
+	dirs := s.due(now)
+	if len(dirs) == 0 {
+		return
+	}
+
+	client, err := s.Connect()
+	if err != nil {
+		log.Printf("Change scan failed to connect: %v", err)
+		return
+	}
+	defer client.Close()
+
+	for _, dir := range dirs {
+		s.scan(client, dir, now)
+	}
+	s.checkBaselines()
+}
+
+// list reads a folder as a snapshot, leaving out in-progress uploads
+func list(client *sftp.Client, dir string) (map[string]entry, error) {
+	infos, err := client.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string]entry, len(infos))
+	for _, info := range infos {
+		if sftp.IsTempUpload(info.Name()) {
+			continue
+		}
+		snapshot[info.Name()] = entry{Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}
+	}
+	return snapshot, nil
+}
+
+// scan lists one folder, publishes what changed since its last listing and reschedules it
+func (s *Scanner) scan(client *sftp.Client, dir string, now time.Time) {
+	snapshot, err := list(client, dir)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.dirs[dir]
+	if !ok {
+		// Released while the listing was running
+		return
+	}
+	if err != nil {
+		if os.IsNotExist(err) && !s.watched(dir) {
+			// The parent's scan reports the removal; subfolders just stop being tracked
+			delete(s.dirs, dir)
+			return
+		}
+		if os.IsNotExist(err) && state.snapshot == nil {
+			// A watched folder that does not exist yet is empty; whatever appears later is new
+			state.snapshot = map[string]entry{}
+		}
+		state.next = now.Add(state.interval)
+		return
+	}
+
+	var changes []events.Event
+	switch {
+	case state.snapshot == nil && state.announce:
+		changes = diff(dir, map[string]entry{}, snapshot, nil)
+	case state.snapshot != nil:
+		changes = diff(dir, state.snapshot, snapshot, state.expected)
+	}
+	state.snapshot = snapshot
+	state.expected = nil
+	state.announce = false
+
+	// Busy folders are polled quickly, quiet ones less and less often
+	if len(changes) > 0 {
+		state.interval = s.MinInterval
+	} else {
+		state.interval = min(state.interval*2, s.MaxInterval)
+	}
+	state.next = now.Add(state.interval)
+
+	s.track(dir, snapshot, changes)
+	for _, e := range changes {
+		s.Broker.Publish(e)
+	}
+}
+
+// watched reports whether dir itself is a watched folder; callers hold the lock
+func (s *Scanner) watched(dir string) bool {
+	if s.watches[watchKey{dir, false}] > 0 || s.watches[watchKey{dir, true}] > 0 {
+		return true
+	}
+	for _, l := range s.leases {
+		for _, root := range l.dirs {
+			if root == dir {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// track starts tracking the subfolders recursive watches cover. Folders that just appeared
+// announce their content, since whatever they hold was created along with them.
+func (s *Scanner) track(dir string, snapshot map[string]entry, changes []events.Event) {
+	created := map[string]bool{}
+	for _, e := range changes {
+		if e.IsDir && e.Type == events.Created {
+			created[e.Path] = true
+		}
+	}
+	for name, info := range snapshot {
+		sub := path.Join(dir, name)
+		if !info.IsDir || !s.covered(sub) {
+			continue
+		}
+		if _, ok := s.dirs[sub]; ok {
+			continue
+		}
+		if s.MaxDirs > 0 && len(s.dirs) >= s.MaxDirs {
+			s.truncate(sub)
+			continue
+		}
+		s.dirs[sub] = &dirState{interval: s.MinInterval, announce: created[sub]}
+	}
+}
+
+// truncate marks the leases covering dir as incomplete, since dir is not tracked; callers hold the lock
+func (s *Scanner) truncate(dir string) {
+	for name, l := range s.leases {
+		if !l.truncated && l.covers(dir) {
+			l.truncated = true
+			log.Printf("Change scan: %s covers more than %d folders, its change feed is incomplete", name, s.MaxDirs)
+		}
+	}
+}
+
+// diff compares two listings of dir. A removed and an added entry of the same kind, size
+// and modification time are reported as a move, which is how renames show up in a listing.
+// Entries in expected were changed through the API and are skipped.
+func diff(dir string, before, after map[string]entry, expected map[string]bool) []events.Event {
+	var added, removed []string
+	var changes []events.Event
+
+	for name, now := range after {
+		if expected[name] {
+			continue
+		}
+		was, ok := before[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case was.IsDir != now.IsDir:
+			changes = append(changes,
+				external(events.Deleted, path.Join(dir, name), "", was.IsDir),
+				external(events.Created, path.Join(dir, name), "", now.IsDir))
+		case !now.IsDir && (was.Size != now.Size || !was.ModTime.Equal(now.ModTime)):
+			changes = append(changes, external(events.Modified, path.Join(dir, name), "", false))
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok && !expected[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	for _, name := range added {
+		now := after[name]
+		moved := -1
+		for i, old := range removed {
+			if was := before[old]; was.IsDir == now.IsDir && was.Size == now.Size && was.ModTime.Equal(now.ModTime) {
+				moved = i
+				break
+			}
+		}
+		if moved >= 0 {
+			changes = append(changes, external(events.Moved, path.Join(dir, name), path.Join(dir, removed[moved]), now.IsDir))
+			removed = append(removed[:moved], removed[moved+1:]...)
+			continue
+		}
+		changes = append(changes, external(events.Created, path.Join(dir, name), "", now.IsDir))
+	}
+	for _, name := range removed {
+		changes = append(changes, external(events.Deleted, path.Join(dir, name), "", before[name].IsDir))
+	}
+	return changes
+}
+
+// external builds an event for a change made outside the API
+func external(typ events.Type, p, oldPath string, isDir bool) events.Event {
+	return events.Event{Type: typ, Path: p, OldPath: oldPath, IsDir: isDir, External: true}
+}
+
+// isWithin reports whether p is root or lies below it
+func isWithin(root, p string) bool {
+	return p == root || root == "/" || strings.HasPrefix(p, root+"/")
+}
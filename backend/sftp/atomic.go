@@ -0,0 +1,223 @@
+package sftp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"manschko.com/cloud-storage/storage"
+)
+
+// Temporary upload names are hidden and carry a fixed prefix/suffix so listings and the cleaner can recognise them
+const (
+	TempUploadPrefix = ".upload-"
+	TempUploadSuffix = ".part"
+)
+
+// FSyncExtension is the OpenSSH extension that flushes a remote file to stable storage
+const FSyncExtension = "fsync@openssh.com"
+
+// UploadOptions controls how WriteAtomic finalises an upload
+type UploadOptions struct {
+	// Overwrite replaces an existing target instead of failing
+	Overwrite bool
+	// ExpectedSize is compared with the bytes written when it is not negative
+	ExpectedSize int64
+	// Verify runs after the temp file at tmpPath is closed and before it is renamed into place
+	Verify func(tmpPath string, written int64) error
+}
+
+// IsTempUpload reports whether name is an in-progress upload created by WriteAtomic
+func IsTempUpload(name string) bool {
+	return strings.HasPrefix(name, TempUploadPrefix) && strings.HasSuffix(name, TempUploadSuffix)
+}
+
+// Uploads records the folders temp uploads are written to; nil leaves them untracked
+var Uploads *UploadDirs
+
+// UploadDirs remembers which folders received temp uploads, so the cleaner only has to look there.
+// The set is persisted because a crash is exactly when temp files get left behind.
+type UploadDirs struct {
+	mu   sync.Mutex
+	file *storage.JSONFile
+	dirs map[string]time.Time // folder -> when the last temp upload was started there
+}
+
+// NewUploadDirs loads the folders saved at path; an empty path keeps them in memory only
+func NewUploadDirs(path string) (*UploadDirs, error) {
+	u := &UploadDirs{
+		file: storage.NewJSONFile(path),
+		dirs: make(map[string]time.Time),
+	}
+	if err := u.file.Load(&u.dirs); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Add records that a temp upload is being written in dir
+func (u *UploadDirs) Add(dir string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, known := u.dirs[dir]
+	u.dirs[dir] = time.Now().UTC()
+	// Only new folders have to reach disk; the time merely delays forgetting a folder
+	if !known {
+		u.file.Save(u.dirs)
+	}
+}
+
+// snapshot returns the tracked folders with the time of their latest temp upload
+func (u *UploadDirs) snapshot() map[string]time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	dirs := make(map[string]time.Time, len(u.dirs))
+	for dir, at := range u.dirs {
+		dirs[dir] = at
+	}
+	return dirs
+}
+
+// forget drops dir unless another temp upload was started there after seen
+func (u *UploadDirs) forget(dir string, seen time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if at, ok := u.dirs[dir]; ok && !at.After(seen) {
+		delete(u.dirs, dir)
+		u.file.Save(u.dirs)
+	}
+}
+
+// TempUploadPath returns a fresh hidden temp path next to target and records its folder for the cleaner
+func TempUploadPath(target string) (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	Uploads.Add(path.Dir(target))
+	name := TempUploadPrefix + path.Base(target) + "." + hex.EncodeToString(buf) + TempUploadSuffix
+	return path.Join(path.Dir(target), name), nil
+}
+
+// WriteAtomic streams src into a temp file beside target and renames it into place once complete.
+// Readers of target never observe a partially written file, and the temp file is removed on failure.
+func WriteAtomic(client *Client, target string, src io.Reader, opts UploadOptions) (written int64, err error) {
+	tmpPath, err := TempUploadPath(target)
+	if err != nil {
+		return 0, fmt.Errorf("failed to pick temp name: %v", err)
+	}
+
+	tmp, err := client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			client.Remove(tmpPath)
+		}
+	}()
+
+	written, err = io.Copy(tmp, src)
+	if err != nil {
+		tmp.Close()
+		return written, fmt.Errorf("failed to copy file content: %w", err)
+	}
+
+	if _, ok := client.HasExtension(FSyncExtension); ok {
+		if err = tmp.Sync(); err != nil {
+			tmp.Close()
+			return written, fmt.Errorf("failed to sync temp file: %v", err)
+		}
+	}
+	if err = tmp.Close(); err != nil {
+		return written, fmt.Errorf("failed to close temp file: %v", err)
+	}
+
+	if opts.ExpectedSize >= 0 {
+		if err = verifySize(client, tmpPath, written, opts.ExpectedSize); err != nil {
+			return written, err
+		}
+	}
+	if opts.Verify != nil {
+		if err = opts.Verify(tmpPath, written); err != nil {
+			return written, err
+		}
+	}
+
+	if opts.Overwrite {
+		err = ReplaceRename(client, tmpPath, target)
+	} else {
+		// Plain SFTP rename refuses to replace an existing target
+		err = client.Rename(tmpPath, target)
+	}
+	if err != nil {
+		return written, fmt.Errorf("failed to move upload into place: %v", err)
+	}
+	return written, nil
+}
+
+// verifySize checks both the local byte count and what the server reports for the temp file
+func verifySize(client *Client, tmpPath string, written, expected int64) error {
+	if written != expected {
+		return fmt.Errorf("size mismatch: expected %d bytes, received %d", expected, written)
+	}
+	info, err := client.Stat(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat temp file: %v", err)
+	}
+	if info.Size() != expected {
+		return fmt.Errorf("size mismatch: expected %d bytes, server has %d", expected, info.Size())
+	}
+	return nil
+}
+
+// CleanStaleUploads removes temp upload files older than maxAge from the folders dirs tracks.
+// Folders without temp files and no upload for maxAge are forgotten. It returns how many files were removed.
+func CleanStaleUploads(client *Client, dirs *UploadDirs, maxAge time.Duration) (int, error) {
+	if dirs == nil {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+
+	for dir, seen := range dirs.snapshot() {
+		entries, err := client.ReadDir(dir)
+		if os.IsNotExist(err) {
+			dirs.forget(dir, seen)
+			continue
+		}
+		if err != nil {
+			// Skip unreadable folders rather than aborting the whole sweep
+			continue
+		}
+
+		pending := false
+		for _, info := range entries {
+			if info.IsDir() || !IsTempUpload(info.Name()) {
+				continue
+			}
+			if info.ModTime().After(cutoff) {
+				pending = true
+				continue
+			}
+			target := path.Join(dir, info.Name())
+			if err := client.Remove(target); err != nil && !os.IsNotExist(err) {
+				return removed, fmt.Errorf("failed to remove %s: %v", target, err)
+			}
+			removed++
+		}
+		if !pending && seen.Before(cutoff) {
+			dirs.forget(dir, seen)
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,36 @@
+package sftp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Exec runs a single command over a fresh SSH session and returns its standard output.
+// Servers that only allow the sftp subsystem will reject the request.
+func (c *Connection) Exec(command string) (string, error) {
+	conn, err := c.Dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to open SSH session: %v", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(command); err != nil {
+		return "", fmt.Errorf("command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// ShellQuote quotes s as a single POSIX shell word
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
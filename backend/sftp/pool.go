@@ -0,0 +1,179 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// poolIdleTimeout is how long an unused session is kept before it is closed
+	poolIdleTimeout = 5 * time.Minute
+	// poolReapInterval is how often idle sessions are checked against poolIdleTimeout
+	poolReapInterval = time.Minute
+)
+
+// pooledSession is an SFTP client together with the SSH connection it runs on
+type pooledSession struct {
+	ssh      *ssh.Client
+	client   *sftp.Client
+	lastUsed time.Time
+}
+
+func (s *pooledSession) close() {
+	s.client.Close()
+	s.ssh.Close()
+}
+
+// Pool hands out SFTP sessions for background work, reusing idle ones.
+// At most size sessions are open at once; Get waits for a free one.
+type Pool struct {
+	connect func() (*Connection, error)
+	slots   chan struct{}
+	done    chan struct{}
+
+	mu     sync.Mutex
+	idle   []*pooledSession
+	inUse  map[*sftp.Client]*pooledSession
+	closed bool
+}
+
+// NewPool creates a pool of up to size sessions on the connections connect returns.
+// Sessions left idle for poolIdleTimeout are closed until Close is called.
+func NewPool(connect func() (*Connection, error), size int) *Pool {
+	p := &Pool{
+		connect: connect,
+		slots:   make(chan struct{}, max(size, 1)),
+		done:    make(chan struct{}),
+		inUse:   make(map[*sftp.Client]*pooledSession),
+	}
+	go p.reap()
+	return p
+}
+
+// reap closes idle sessions once they have gone unused for poolIdleTimeout
+func (p *Pool) reap() {
+	ticker := time.NewTicker(poolReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		// The idle list is ordered by last use, so expired sessions sit at its front
+		p.mu.Lock()
+		expired := 0
+		for expired < len(p.idle) && time.Since(p.idle[expired].lastUsed) >= poolIdleTimeout {
+			expired++
+		}
+		stale := append([]*pooledSession(nil), p.idle[:expired]...)
+		p.idle = p.idle[expired:]
+		p.mu.Unlock()
+
+		for _, session := range stale {
+			session.close()
+		}
+	}
+}
+
+// Get returns a session, waiting until one is free or ctx is done
+func (p *Pool) Get(ctx context.Context) (*Client, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	session, err := p.take()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	p.mu.Lock()
+	p.inUse[session.client] = session
+	p.mu.Unlock()
+	return session.client, nil
+}
+
+// take reuses the most recently used idle session that still answers, or opens a new one
+func (p *Pool) take() (*pooledSession, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("session pool is closed")
+		}
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		session := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if time.Since(session.lastUsed) < poolIdleTimeout {
+			if _, err := session.client.Getwd(); err == nil {
+				return session, nil
+			}
+		}
+		session.close()
+	}
+
+	connection, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := connection.Dial()
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create SFTP client: %v", err)
+	}
+	return &pooledSession{ssh: conn, client: client}, nil
+}
+
+// Put returns a session taken with Get. Sessions that saw a connection error
+// should be put back with broken set, so that they are closed instead of reused.
+func (p *Pool) Put(client *Client, broken bool) {
+	p.mu.Lock()
+	session, ok := p.inUse[client]
+	delete(p.inUse, client)
+	if ok && !broken && !p.closed {
+		session.lastUsed = time.Now()
+		p.idle = append(p.idle, session)
+		session = nil
+	}
+	p.mu.Unlock()
+
+	if session != nil {
+		session.close()
+	}
+	if ok {
+		<-p.slots
+	}
+}
+
+// Close closes the idle sessions; sessions in use are closed when they are put back
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	if !p.closed {
+		close(p.done)
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, session := range idle {
+		session.close()
+	}
+}
@@ -0,0 +1,17 @@
+package sftp
+
+import "github.com/pkg/sftp"
+
+// RemoveTree deletes path and, for directories, everything below it.
+// Unlike Client.RemoveAll it never follows a symlink at path, so a link to a
+// folder elsewhere only removes the link.
+func RemoveTree(client *sftp.Client, path string) error {
+	info, err := client.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return client.Remove(path)
+	}
+	return client.RemoveAll(path)
+}
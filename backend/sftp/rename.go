@@ -0,0 +1,29 @@
+package sftp
+
+import (
+	"fmt"
+	"os"
+)
+
+// PosixRenameExtension is the OpenSSH extension that lets rename replace an existing target
+const PosixRenameExtension = "posix-rename@openssh.com"
+
+// SupportsPosixRename reports whether the server can replace a rename target atomically
+func SupportsPosixRename(client *Client) bool {
+	_, ok := client.HasExtension(PosixRenameExtension)
+	return ok
+}
+
+// ReplaceRename renames oldPath to newPath, replacing newPath if it already exists.
+// The posix-rename extension is used when available so the replacement is atomic;
+// otherwise the target is removed first, which briefly leaves no entry at newPath.
+func ReplaceRename(client *Client, oldPath, newPath string) error {
+	if SupportsPosixRename(client) {
+		return client.PosixRename(oldPath, newPath)
+	}
+
+	if err := client.Remove(newPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove existing target: %v", err)
+	}
+	return client.Rename(oldPath, newPath)
+}
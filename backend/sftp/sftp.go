@@ -1,13 +1,27 @@
 package sftp
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
+// ErrAuthFailed means the server rejected the username or password
+var ErrAuthFailed = errors.New("authentication failed")
+
+// Client is the SFTP client returned by Connect
+type Client = sftp.Client
+
+// FileStat is the raw attribute set behind os.FileInfo.Sys for remote files
+type FileStat = sftp.FileStat
+
+// File is an open remote file
+type File = sftp.File
+
 // Connection represents an SFTP connection with credentials
 type Connection struct {
 	Host     string
@@ -26,8 +40,8 @@ func NewConnection(host string, port int, username, password string) *Connection
 	}
 }
 
-// Connect establishes a connection to the SFTP server
-func (c *Connection) Connect() (*sftp.Client, error) {
+// Dial opens the underlying SSH connection
+func (c *Connection) Dial() (*ssh.Client, error) {
 	// Configure SSH client
 	sshConfig := &ssh.ClientConfig{
 		User: c.Username,
@@ -42,8 +56,21 @@ func (c *Connection) Connect() (*sftp.Client, error) {
 	addr := fmt.Sprintf("%s:%d", c.Host, c.Port)
 	conn, err := ssh.Dial("tcp", addr, sshConfig)
 	if err != nil {
+		// The ssh package reports rejected credentials only through the message
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+		}
 		return nil, fmt.Errorf("failed to connect to SSH server: %v", err)
 	}
+	return conn, nil
+}
+
+// Connect establishes a connection to the SFTP server
+func (c *Connection) Connect() (*sftp.Client, error) {
+	conn, err := c.Dial()
+	if err != nil {
+		return nil, err
+	}
 
 	// Create SFTP client
 	client, err := sftp.NewClient(conn)
@@ -55,12 +82,19 @@ func (c *Connection) Connect() (*sftp.Client, error) {
 	return client, nil
 }
 
-// TestConnection attempts to connect to verify credentials
+// TestConnection attempts to connect to verify credentials.
+// It fails with ErrAuthFailed when the server rejects them.
 func (c *Connection) TestConnection() error {
-	client, err := c.Connect()
+	conn, err := c.Dial()
 	if err != nil {
 		return err
 	}
-	defer client.Close()
-	return nil
+	// Closing the SFTP client leaves the SSH connection open, so both are closed here
+	defer conn.Close()
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return fmt.Errorf("failed to create SFTP client: %v", err)
+	}
+	return client.Close()
 }
@@ -0,0 +1,126 @@
+package sftpgo
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fakeUser is an account of Fake with its password
+type fakeUser struct {
+	User
+	password string
+}
+
+// Fake is a Client keeping accounts in memory, for tests and trying the API without SFTPGo
+type Fake struct {
+	mu       sync.Mutex
+	homeBase string
+	users    map[string]*fakeUser
+}
+
+// NewFake creates an empty Fake giving new users their home below homeBase
+func NewFake(homeBase string) *Fake {
+	return &Fake{homeBase: homeBase, users: make(map[string]*fakeUser)}
+}
+
+// CheckPassword reports whether username could log in with password
+func (f *Fake) CheckPassword(username, password string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.users[username]
+	return ok && u.Enabled && u.password == password
+}
+
+// ListUsers returns every account, ordered by username
+func (f *Fake) ListUsers(ctx context.Context) ([]User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	users := []User{}
+	for _, u := range f.users {
+		users = append(users, u.User)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// GetUser returns one account
+func (f *Fake) GetUser(ctx context.Context, username string) (User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.users[username]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return u.User, nil
+}
+
+// CreateUser adds an enabled account, checking it as SFTPGo would
+func (f *Fake) CreateUser(ctx context.Context, user NewUser) (User, error) {
+	if !ValidUsername(user.Username) {
+		return User{}, fmt.Errorf("%w: username %q is not valid", ErrInvalidUser, user.Username)
+	}
+	if user.Password == "" {
+		return User{}, fmt.Errorf("%w: a password is required", ErrInvalidUser)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.users[user.Username]; ok {
+		return User{}, ErrUserExists
+	}
+	u := &fakeUser{
+		User: User{
+			Username:    user.Username,
+			Email:       user.Email,
+			Description: user.Description,
+			Enabled:     true,
+			HomeDir:     path.Join(f.homeBase, user.Username),
+			CreatedAt:   time.Now().UTC(),
+		},
+		password: user.Password,
+	}
+	f.users[user.Username] = u
+	return u.User, nil
+}
+
+// SetEnabled enables or disables an account
+func (f *Fake) SetEnabled(ctx context.Context, username string, enabled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.Enabled = enabled
+	return nil
+}
+
+// SetPassword replaces the password of an account
+func (f *Fake) SetPassword(ctx context.Context, username, password string) error {
+	if password == "" {
+		return fmt.Errorf("%w: a password is required", ErrInvalidUser)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.password = password
+	return nil
+}
+
+// DeleteUser removes an account
+func (f *Fake) DeleteUser(ctx context.Context, username string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.users[username]; !ok {
+		return ErrUserNotFound
+	}
+	delete(f.users, username)
+	return nil
+}
@@ -0,0 +1,291 @@
+package sftpgo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// statusEnabled and statusDisabled are SFTPGo's account states
+	statusEnabled  = 1
+	statusDisabled = 0
+	// listPageSize is how many users are fetched per request
+	listPageSize = 500
+	// tokenRenewBefore renews the admin token this long before it expires
+	tokenRenewBefore = 30 * time.Second
+	// maxResponse bounds the documents read from the server
+	maxResponse = 8 << 20
+)
+
+// Config describes how to reach the SFTPGo REST API
+type Config struct {
+	// URL is the base of the API, such as http://localhost:8080
+	URL           string
+	AdminUser     string
+	AdminPassword string
+	// HomeBase is the folder on the SFTPGo host under which new users get their home
+	HomeBase string
+}
+
+// apiUser is the part of SFTPGo's user object we read and write
+type apiUser struct {
+	Username    string              `json:"username"`
+	Password    string              `json:"password,omitempty"`
+	Email       string              `json:"email,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Status      int                 `json:"status"`
+	HomeDir     string              `json:"home_dir,omitempty"`
+	Permissions map[string][]string `json:"permissions,omitempty"`
+	CreatedAt   int64               `json:"created_at,omitempty"`
+	LastLogin   int64               `json:"last_login,omitempty"`
+}
+
+// user converts the API representation; SFTPGo reports times in Unix milliseconds
+func (u apiUser) user() User {
+	user := User{
+		Username:    u.Username,
+		Email:       u.Email,
+		Description: u.Description,
+		Enabled:     u.Status == statusEnabled,
+		HomeDir:     u.HomeDir,
+		CreatedAt:   time.UnixMilli(u.CreatedAt).UTC(),
+	}
+	if u.LastLogin > 0 {
+		lastLogin := time.UnixMilli(u.LastLogin).UTC()
+		user.LastLogin = &lastLogin
+	}
+	return user
+}
+
+// apiError is the body SFTPGo sends with failed requests
+type apiError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// HTTPClient manages users through SFTPGo's REST API with an admin account.
+// The admin token is fetched on first use and renewed before it expires.
+type HTTPClient struct {
+	cfg    Config
+	client *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewHTTPClient creates a client for cfg; client may be nil for a default one
+func NewHTTPClient(cfg Config, client *http.Client) *HTTPClient {
+	if client == nil {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+	return &HTTPClient{cfg: cfg, client: client}
+}
+
+// adminToken returns a token for the admin account, logging in when there is none left
+func (c *HTTPClient) adminToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Until(c.tokenExpiry) > tokenRenewBefore {
+		return c.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.URL+"/api/v2/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(c.cfg.AdminUser, c.cfg.AdminPassword)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("SFTPGo login failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("SFTPGo login failed: %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string    `json:"access_token"`
+		ExpiresAt   time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponse)).Decode(&token); err != nil {
+		return "", fmt.Errorf("SFTPGo login failed: %w", err)
+	}
+	c.token, c.tokenExpiry = token.AccessToken, token.ExpiresAt
+	return c.token, nil
+}
+
+// dropToken forgets a token the server no longer accepts
+func (c *HTTPClient) dropToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+// do sends a request to the API, decoding the response into out when it is not nil.
+// A rejected token, as after a restart of the server, is renewed once.
+func (c *HTTPClient) do(ctx context.Context, method, endpoint string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.adminToken(ctx)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, method, c.cfg.URL+endpoint, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", method, endpoint, err)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			c.dropToken(token)
+			continue
+		}
+		defer resp.Body.Close()
+		return decodeResponse(resp, method, endpoint, out)
+	}
+}
+
+// decodeResponse maps failed requests onto our errors and decodes successful ones into out
+func decodeResponse(resp *http.Response, method, endpoint string, out interface{}) error {
+	body := io.LimitReader(resp.Body, maxResponse)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(body).Decode(out)
+	}
+
+	var apiErr apiError
+	json.NewDecoder(body).Decode(&apiErr)
+	reason := apiErr.Error
+	if reason == "" {
+		reason = apiErr.Message
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrUserNotFound
+	case http.StatusConflict:
+		return ErrUserExists
+	case http.StatusBadRequest:
+		return fmt.Errorf("%w: %s", ErrInvalidUser, reason)
+	}
+	return fmt.Errorf("%s %s: %s: %s", method, endpoint, resp.Status, reason)
+}
+
+// userPath is the API endpoint of one user
+func userPath(username string) string {
+	return "/api/v2/users/" + url.PathEscape(username)
+}
+
+// ListUsers returns every account, ordered by username
+func (c *HTTPClient) ListUsers(ctx context.Context) ([]User, error) {
+	users := []User{}
+	for offset := 0; ; offset += listPageSize {
+		var page []apiUser
+		endpoint := fmt.Sprintf("/api/v2/users?offset=%d&limit=%d&order=ASC", offset, listPageSize)
+		if err := c.do(ctx, http.MethodGet, endpoint, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, u := range page {
+			users = append(users, u.user())
+		}
+		if len(page) < listPageSize {
+			return users, nil
+		}
+	}
+}
+
+// GetUser returns one account
+func (c *HTTPClient) GetUser(ctx context.Context, username string) (User, error) {
+	var u apiUser
+	if err := c.do(ctx, http.MethodGet, userPath(username), nil, &u); err != nil {
+		return User{}, err
+	}
+	return u.user(), nil
+}
+
+// CreateUser adds an enabled account with full permissions on its home folder
+func (c *HTTPClient) CreateUser(ctx context.Context, user NewUser) (User, error) {
+	req := apiUser{
+		Username:    user.Username,
+		Password:    user.Password,
+		Email:       user.Email,
+		Description: user.Description,
+		Status:      statusEnabled,
+		Permissions: map[string][]string{"/": {"*"}},
+	}
+	if c.cfg.HomeBase != "" {
+		req.HomeDir = path.Join(c.cfg.HomeBase, user.Username)
+	}
+
+	var created apiUser
+	if err := c.do(ctx, http.MethodPost, "/api/v2/users", req, &created); err != nil {
+		return User{}, err
+	}
+	return created.user(), nil
+}
+
+// updateUser changes fields of an account. Updates replace the whole user, so the
+// current one is fetched as is and sent back with the changes, keeping the settings we do not know.
+func (c *HTTPClient) updateUser(ctx context.Context, username string, change func(map[string]interface{})) error {
+	var current map[string]interface{}
+	if err := c.do(ctx, http.MethodGet, userPath(username), nil, &current); err != nil {
+		return err
+	}
+	// An empty password keeps the current one
+	delete(current, "password")
+	change(current)
+	return c.do(ctx, http.MethodPut, userPath(username), current, nil)
+}
+
+// SetEnabled enables or disables an account; disabled accounts cannot log in
+func (c *HTTPClient) SetEnabled(ctx context.Context, username string, enabled bool) error {
+	status := statusDisabled
+	if enabled {
+		status = statusEnabled
+	}
+	return c.updateUser(ctx, username, func(u map[string]interface{}) {
+		u["status"] = status
+	})
+}
+
+// SetPassword replaces the password of an account
+func (c *HTTPClient) SetPassword(ctx context.Context, username, password string) error {
+	return c.updateUser(ctx, username, func(u map[string]interface{}) {
+		u["password"] = password
+	})
+}
+
+// DeleteUser removes an account; its files stay on the server
+func (c *HTTPClient) DeleteUser(ctx context.Context, username string) error {
+	return c.do(ctx, http.MethodDelete, userPath(username), nil, nil)
+}
@@ -0,0 +1,290 @@
+package sftpgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubServer is an SFTPGo REST API keeping users as the raw JSON objects it would store
+type stubServer struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	users  map[string]map[string]interface{}
+	token  string
+	logins int
+	// tokenTTL is the lifetime of the admin tokens handed out
+	tokenTTL time.Duration
+	// requests counts the user API requests, including rejected ones
+	requests int
+	// puts are the bodies of the user updates received
+	puts []map[string]interface{}
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	t.Helper()
+	s := &stubServer{users: make(map[string]map[string]interface{}), tokenTTL: 20 * time.Minute}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/token", s.handleToken)
+	mux.HandleFunc("/api/v2/users", s.handleUsers)
+	mux.HandleFunc("/api/v2/users/", s.handleUser)
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *stubServer) client() *HTTPClient {
+	return NewHTTPClient(Config{URL: s.server.URL + "/", AdminUser: "admin", AdminPassword: "secret"}, s.server.Client())
+}
+
+// restart forgets the admin token, as SFTPGo does when it restarts
+func (s *stubServer) restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *stubServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if !ok || user != "admin" || password != "secret" {
+		writeJSON(w, http.StatusUnauthorized, apiError{Error: "invalid credentials"})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins++
+	s.token = strings.Repeat("t", s.logins)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": s.token,
+		"expires_at":   time.Now().Add(s.tokenTTL),
+	})
+}
+
+// authorized counts the request and checks its bearer token; callers hold the lock
+func (s *stubServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	s.requests++
+	if s.token == "" || r.Header.Get("Authorization") != "Bearer "+s.token {
+		writeJSON(w, http.StatusUnauthorized, apiError{Error: "invalid token"})
+		return false
+	}
+	return true
+}
+
+func (s *stubServer) handleUsers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list := []map[string]interface{}{}
+		for _, u := range s.users {
+			list = append(list, u)
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		var u map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&u)
+		name, _ := u["username"].(string)
+		if _, ok := s.users[name]; ok {
+			writeJSON(w, http.StatusConflict, apiError{Error: "user exists"})
+			return
+		}
+		if password, _ := u["password"].(string); password == "" {
+			writeJSON(w, http.StatusBadRequest, apiError{Message: "please set a password"})
+			return
+		}
+		u["password"] = "$2a$hashed"
+		u["created_at"] = time.Now().UnixMilli()
+		s.users[name] = u
+		writeJSON(w, http.StatusCreated, u)
+	}
+}
+
+func (s *stubServer) handleUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authorized(w, r) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/v2/users/")
+	u, ok := s.users[name]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, u)
+	case http.MethodPut:
+		var update map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&update)
+		s.puts = append(s.puts, update)
+		// Like SFTPGo, an update replaces the user and an empty password keeps the old one
+		stored := make(map[string]interface{}, len(update))
+		for k, v := range update {
+			stored[k] = v
+		}
+		if password, _ := update["password"].(string); password == "" {
+			stored["password"] = u["password"]
+		}
+		s.users[name] = stored
+		writeJSON(w, http.StatusOK, map[string]string{"message": "User updated"})
+	case http.MethodDelete:
+		delete(s.users, name)
+		writeJSON(w, http.StatusOK, map[string]string{"message": "User deleted"})
+	}
+}
+
+func TestHTTPClientReusesAdminToken(t *testing.T) {
+	s := newStubServer(t)
+	c := s.client()
+	ctx := context.Background()
+
+	if _, err := c.CreateUser(ctx, NewUser{Username: "alice", Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetUser(ctx, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.logins != 1 {
+		t.Fatalf("logged in %d times, want once", s.logins)
+	}
+}
+
+func TestHTTPClientRenewsExpiringToken(t *testing.T) {
+	s := newStubServer(t)
+	s.tokenTTL = tokenRenewBefore / 2
+	c := s.client()
+	ctx := context.Background()
+
+	if _, err := c.ListUsers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ListUsers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s.logins != 2 {
+		t.Fatalf("logged in %d times, want a new token for each request", s.logins)
+	}
+}
+
+func TestHTTPClientRetriesOnceAfterUnauthorized(t *testing.T) {
+	s := newStubServer(t)
+	c := s.client()
+	ctx := context.Background()
+	if _, err := c.CreateUser(ctx, NewUser{Username: "alice", Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.restart()
+	s.requests = 0
+	user, err := c.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetUser() after a restart error = %v", err)
+	}
+	if user.Username != "alice" || !user.Enabled {
+		t.Fatalf("GetUser() = %+v", user)
+	}
+	if s.logins != 2 || s.requests != 2 {
+		t.Fatalf("got %d logins and %d requests, want the request retried once with a new token", s.logins, s.requests)
+	}
+}
+
+func TestHTTPClientGivesUpWhenTokenKeepsFailing(t *testing.T) {
+	s := newStubServer(t)
+	c := s.client()
+	// Every token is rejected, as if the admin lost its permissions
+	s.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/token" {
+			s.handleToken(w, r)
+			return
+		}
+		s.mu.Lock()
+		s.requests++
+		s.mu.Unlock()
+		writeJSON(w, http.StatusUnauthorized, apiError{Error: "invalid token"})
+	})
+
+	if _, err := c.GetUser(context.Background(), "alice"); err == nil {
+		t.Fatal("GetUser() succeeded with a rejected token")
+	}
+	if s.requests != 2 {
+		t.Fatalf("sent %d requests, want the first and one retry", s.requests)
+	}
+}
+
+func TestHTTPClientUpdateKeepsUnknownSettings(t *testing.T) {
+	s := newStubServer(t)
+	c := s.client()
+	ctx := context.Background()
+	if _, err := c.CreateUser(ctx, NewUser{Username: "alice", Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+	s.users["alice"]["filters"] = map[string]interface{}{"max_upload_file_size": float64(1024)}
+	s.users["alice"]["quota_size"] = float64(1 << 30)
+
+	if err := c.SetEnabled(ctx, "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	put := s.puts[len(s.puts)-1]
+	if _, ok := put["password"]; ok {
+		t.Fatal("disabling sent the stored password back")
+	}
+	if put["status"] != float64(statusDisabled) {
+		t.Fatalf("status = %v, want disabled", put["status"])
+	}
+	if put["quota_size"] != float64(1<<30) || put["filters"] == nil {
+		t.Fatalf("update dropped settings: %v", put)
+	}
+	if user, _ := c.GetUser(ctx, "alice"); user.Enabled {
+		t.Fatal("user still enabled")
+	}
+
+	if err := c.SetPassword(ctx, "alice", "new password"); err != nil {
+		t.Fatal(err)
+	}
+	put = s.puts[len(s.puts)-1]
+	if put["password"] != "new password" || put["status"] != float64(statusDisabled) || put["filters"] == nil {
+		t.Fatalf("password update sent %v", put)
+	}
+}
+
+func TestHTTPClientMapsErrors(t *testing.T) {
+	s := newStubServer(t)
+	c := s.client()
+	ctx := context.Background()
+
+	if _, err := c.GetUser(ctx, "nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("GetUser() of a missing user error = %v", err)
+	}
+	if err := c.SetEnabled(ctx, "nobody", true); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("SetEnabled() of a missing user error = %v", err)
+	}
+	if _, err := c.CreateUser(ctx, NewUser{Username: "alice", Password: "pw"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateUser(ctx, NewUser{Username: "alice", Password: "pw"}); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("CreateUser() of an existing user error = %v", err)
+	}
+	_, err := c.CreateUser(ctx, NewUser{Username: "bob"})
+	if !errors.Is(err, ErrInvalidUser) || !strings.Contains(err.Error(), "please set a password") {
+		t.Fatalf("CreateUser() without a password error = %v", err)
+	}
+}
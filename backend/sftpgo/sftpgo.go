@@ -0,0 +1,59 @@
+package sftpgo
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+	// ErrInvalidUser is wrapped with the reason the server gave
+	ErrInvalidUser = errors.New("invalid user")
+)
+
+// usernamePattern keeps usernames usable as the name of their home folder
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@-]{0,63}$`)
+
+// ValidUsername reports whether name can be given to a new user
+func ValidUsername(name string) bool {
+	return usernamePattern.MatchString(name)
+}
+
+// User is an account on the SFTP server
+type User struct {
+	Username    string     `json:"username"`
+	Email       string     `json:"email,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Enabled     bool       `json:"enabled"`
+	HomeDir     string     `json:"home_dir,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLogin   *time.Time `json:"last_login,omitempty"`
+}
+
+// NewUser describes an account to create
+type NewUser struct {
+	Username    string
+	Password    string
+	Email       string
+	Description string
+}
+
+// Client manages the accounts of the SFTP server. HTTPClient talks to SFTPGo's REST API,
+// Fake keeps accounts in memory for tests.
+type Client interface {
+	// ListUsers returns every account, ordered by username
+	ListUsers(ctx context.Context) ([]User, error)
+	// GetUser returns one account
+	GetUser(ctx context.Context, username string) (User, error)
+	// CreateUser adds an enabled account with full permissions on its home folder
+	CreateUser(ctx context.Context, user NewUser) (User, error)
+	// SetEnabled enables or disables an account; disabled accounts cannot log in
+	SetEnabled(ctx context.Context, username string, enabled bool) error
+	// SetPassword replaces the password of an account
+	SetPassword(ctx context.Context, username, password string) error
+	// DeleteUser removes an account; its files stay on the server
+	DeleteUser(ctx context.Context, username string) error
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/controllers"
+)
+
+// Create a share controller
+func getShareController() *controllers.ShareController {
+	shareController := controllers.NewShareController(getFileController(), shareStore)
+	shareController.Guard = loginGuard
+	return shareController
+}
+
+// Create a file request controller
+func getFileRequestController() *controllers.FileRequestController {
+	fileRequestController := controllers.NewFileRequestController(getFileController(), requestStore)
+	fileRequestController.Guard = loginGuard
+	return fileRequestController
+}
+
+// Create a grant controller
+func getGrantController() *controllers.GrantController {
+	return controllers.NewGrantController(getFileController(), grantStore)
+}
+
+// Create a group controller
+func getGroupController() *controllers.GroupController {
+	return controllers.NewGroupController(getFileController(), groupStore, AppConfig.AdminUsers)
+}
+
+// Share link handlers
+func createShare(c *gin.Context) {
+	getShareController().CreateShare(c)
+}
+
+func listShares(c *gin.Context) {
+	getShareController().ListShares(c)
+}
+
+func revokeShare(c *gin.Context) {
+	getShareController().RevokeShare(c)
+}
+
+func openShare(c *gin.Context) {
+	getShareController().OpenShare(c)
+}
+
+// File request handlers
+func createFileRequest(c *gin.Context) {
+	getFileRequestController().CreateFileRequest(c)
+}
+
+func listFileRequests(c *gin.Context) {
+	getFileRequestController().ListFileRequests(c)
+}
+
+func getFileRequest(c *gin.Context) {
+	getFileRequestController().GetFileRequest(c)
+}
+
+func revokeFileRequest(c *gin.Context) {
+	getFileRequestController().RevokeFileRequest(c)
+}
+
+func describeFileRequest(c *gin.Context) {
+	getFileRequestController().DescribeFileRequest(c)
+}
+
+func submitFiles(c *gin.Context) {
+	getFileRequestController().SubmitFiles(c)
+}
+
+// Folder sharing between users
+func createGrant(c *gin.Context) {
+	getGrantController().CreateGrant(c)
+}
+
+func listGrants(c *gin.Context) {
+	getGrantController().ListGrants(c)
+}
+
+func listSharedWithMe(c *gin.Context) {
+	getGrantController().ListSharedWithMe(c)
+}
+
+func revokeGrant(c *gin.Context) {
+	getGrantController().RevokeGrant(c)
+}
+
+// Group spaces
+func createGroup(c *gin.Context) {
+	getGroupController().CreateGroup(c)
+}
+
+func listGroups(c *gin.Context) {
+	getGroupController().ListGroups(c)
+}
+
+func getGroup(c *gin.Context) {
+	getGroupController().GetGroup(c)
+}
+
+func deleteGroup(c *gin.Context) {
+	getGroupController().DeleteGroup(c)
+}
+
+func setGroupMember(c *gin.Context) {
+	getGroupController().SetMember(c)
+}
+
+func removeGroupMember(c *gin.Context) {
+	getGroupController().RemoveMember(c)
+}
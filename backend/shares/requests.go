@@ -0,0 +1,334 @@
+package shares
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"manschko.com/cloud-storage/storage"
+)
+
+var (
+	ErrExtensionNotAllowed = errors.New("file extension not allowed")
+	ErrFileTooLarge        = errors.New("file exceeds the size limit")
+	ErrQuotaExceeded       = errors.New("file request quota exceeded")
+)
+
+// FileRequest is an upload-only link into a folder of its owner.
+// Visitors can add files but never list or download anything.
+type FileRequest struct {
+	ID                string     `json:"id"`
+	Token             string     `json:"token"`
+	Owner             string     `json:"owner"`
+	Path              string     `json:"path"`
+	Title             string     `json:"title,omitempty"`
+	PasswordHash      string     `json:"password_hash,omitempty"`
+	MaxFileSize       int64      `json:"max_file_size,omitempty"`
+	MaxTotalSize      int64      `json:"max_total_size,omitempty"`
+	AllowedExtensions []string   `json:"allowed_extensions,omitempty"`
+	PrefixUploader    bool       `json:"prefix_uploader"`
+	PrefixDate        bool       `json:"prefix_date"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	Arrivals          []Arrival  `json:"arrivals"`
+
+	// reserved counts the bytes of uploads still being written; it is not persisted
+	reserved int64
+}
+
+// Arrival records one file uploaded through a file request
+type Arrival struct {
+	Name         string    `json:"name"`
+	OriginalName string    `json:"original_name"`
+	Size         int64     `json:"size"`
+	Uploader     string    `json:"uploader,omitempty"`
+	RemoteAddr   string    `json:"remote_addr,omitempty"`
+	ReceivedAt   time.Time `json:"received_at"`
+}
+
+// RequestOptions are the owner-chosen settings of a new file request
+type RequestOptions struct {
+	Path              string
+	Title             string
+	Password          string
+	MaxFileSize       int64
+	MaxTotalSize      int64
+	AllowedExtensions []string
+	PrefixUploader    bool
+	PrefixDate        bool
+	ExpiresAt         *time.Time
+}
+
+// HasPassword reports whether visitors must supply a password
+func (r *FileRequest) HasPassword() bool {
+	return r.PasswordHash != ""
+}
+
+// Expired reports whether the file request is past its expiry
+func (r *FileRequest) Expired(now time.Time) bool {
+	return r.ExpiresAt != nil && now.After(*r.ExpiresAt)
+}
+
+// ReceivedBytes sums the sizes of all arrivals
+func (r *FileRequest) ReceivedBytes() int64 {
+	var total int64
+	for _, arrival := range r.Arrivals {
+		total += arrival.Size
+	}
+	return total
+}
+
+// RemainingBytes is how much of MaxTotalSize is neither received nor reserved by uploads in progress.
+// It is negative when the request has no total limit.
+func (r *FileRequest) RemainingBytes() int64 {
+	if r.MaxTotalSize <= 0 {
+		return -1
+	}
+	return max(r.MaxTotalSize-r.ReceivedBytes()-r.reserved, 0)
+}
+
+// Accepts checks a prospective upload against the request's limits
+func (r *FileRequest) Accepts(name string, size int64) error {
+	if len(r.AllowedExtensions) > 0 {
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+		allowed := false
+		for _, candidate := range r.AllowedExtensions {
+			if candidate == ext {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ErrExtensionNotAllowed
+		}
+	}
+	if r.MaxFileSize > 0 && size > r.MaxFileSize {
+		return ErrFileTooLarge
+	}
+	if r.MaxTotalSize > 0 && r.ReceivedBytes()+r.reserved+size > r.MaxTotalSize {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// normalizeExtensions lowercases extensions and strips leading dots
+func normalizeExtensions(extensions []string) []string {
+	var normalized []string
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			normalized = append(normalized, ext)
+		}
+	}
+	return normalized
+}
+
+// RequestStore keeps file requests in memory and persists them as JSON
+type RequestStore struct {
+	mu       sync.Mutex
+	file     *storage.JSONFile
+	requests map[string]*FileRequest // keyed by token
+}
+
+// NewRequestStore loads the file requests saved at path; an empty path keeps them in memory only
+func NewRequestStore(path string) (*RequestStore, error) {
+	s := &RequestStore{
+		file:     storage.NewJSONFile(path),
+		requests: make(map[string]*FileRequest),
+	}
+	if err := s.file.Load(&s.requests); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save persists the current requests; callers hold the lock
+func (s *RequestStore) save() error {
+	return s.file.Save(s.requests)
+}
+
+// copyRequest returns a snapshot that is safe to read without the lock
+func copyRequest(r *FileRequest) *FileRequest {
+	copied := *r
+	copied.AllowedExtensions = append([]string(nil), r.AllowedExtensions...)
+	copied.Arrivals = append([]Arrival(nil), r.Arrivals...)
+	return &copied
+}
+
+// Create stores a new file request for owner
+func (s *RequestStore) Create(owner string, opts RequestOptions) (*FileRequest, error) {
+	id, err := storage.RandomID()
+	if err != nil {
+		return nil, err
+	}
+	token, err := storage.RandomToken(24)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &FileRequest{
+		ID:                id,
+		Token:             token,
+		Owner:             owner,
+		Path:              opts.Path,
+		Title:             opts.Title,
+		MaxFileSize:       opts.MaxFileSize,
+		MaxTotalSize:      opts.MaxTotalSize,
+		AllowedExtensions: normalizeExtensions(opts.AllowedExtensions),
+		PrefixUploader:    opts.PrefixUploader,
+		PrefixDate:        opts.PrefixDate,
+		CreatedAt:         time.Now().UTC(),
+		ExpiresAt:         opts.ExpiresAt,
+		Arrivals:          []Arrival{},
+	}
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		request.PasswordHash = string(hash)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[token] = request
+	if err := s.save(); err != nil {
+		delete(s.requests, token)
+		return nil, err
+	}
+	return copyRequest(request), nil
+}
+
+// ListByOwner returns the owner's file requests, newest first
+func (s *RequestStore) ListByOwner(owner string) []FileRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []FileRequest
+	for _, request := range s.requests {
+		if request.Owner == owner {
+			list = append(list, *copyRequest(request))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// GetByOwner returns one of the owner's file requests by ID
+func (s *RequestStore) GetByOwner(owner, id string) (*FileRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, request := range s.requests {
+		if request.ID == id && request.Owner == owner {
+			return copyRequest(request), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Revoke deletes one of the owner's file requests by ID
+func (s *RequestStore) Revoke(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, request := range s.requests {
+		if request.ID == id && request.Owner == owner {
+			delete(s.requests, token)
+			return s.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// RevokeAll deletes every file request of owner
+func (s *RequestStore) RevokeAll(owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, request := range s.requests {
+		if request.Owner == owner {
+			delete(s.requests, token)
+		}
+	}
+	return s.save()
+}
+
+// Open checks a visitor's access to a file request.
+// The password is compared without holding the lock, as bcrypt is slow on purpose.
+func (s *RequestStore) Open(token, password string) (*FileRequest, error) {
+	request, err := s.usable(token)
+	if err != nil {
+		return nil, err
+	}
+	if request.HasPassword() {
+		if password == "" {
+			return nil, ErrPasswordRequired
+		}
+		if bcrypt.CompareHashAndPassword([]byte(request.PasswordHash), []byte(password)) != nil {
+			return nil, ErrInvalidPassword
+		}
+	}
+	return request, nil
+}
+
+// usable returns a copy of the file request at token unless it has expired
+func (s *RequestStore) usable(token string) (*FileRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request, ok := s.requests[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if request.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+	return copyRequest(request), nil
+}
+
+// Reserve checks an upload against the live request and sets its size aside,
+// so concurrent uploads can never overrun the quota together.
+// Every successful Reserve is followed by RecordArrival or Release.
+func (s *RequestStore) Reserve(token, name string, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request, ok := s.requests[token]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := request.Accepts(name, size); err != nil {
+		return err
+	}
+	request.reserved += size
+	return nil
+}
+
+// Release gives back a reservation whose upload failed
+func (s *RequestStore) Release(token string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if request, ok := s.requests[token]; ok {
+		request.reserved -= size
+	}
+}
+
+// RecordArrival turns the reservation of a completed upload into an entry of the request's summary
+func (s *RequestStore) RecordArrival(token string, reserved int64, arrival Arrival) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request, ok := s.requests[token]
+	if !ok {
+		return ErrNotFound
+	}
+	request.reserved -= reserved
+	request.Arrivals = append(request.Arrivals, arrival)
+	return s.save()
+}
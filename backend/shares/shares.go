@@ -0,0 +1,250 @@
+package shares
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"manschko.com/cloud-storage/storage"
+)
+
+var (
+	ErrNotFound         = errors.New("share not found")
+	ErrExpired          = errors.New("share expired")
+	ErrDownloadLimit    = errors.New("share download limit reached")
+	ErrPasswordRequired = errors.New("share password required")
+	ErrInvalidPassword  = errors.New("invalid share password")
+)
+
+// Share is a public link to a file or folder inside its owner's storage
+type Share struct {
+	ID           string     `json:"id"`
+	Token        string     `json:"token"`
+	Owner        string     `json:"owner"`
+	Path         string     `json:"path"`
+	IsDir        bool       `json:"is_dir"`
+	AllowBrowse  bool       `json:"allow_browse"`
+	PasswordHash string     `json:"password_hash,omitempty"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	Views        int        `json:"views"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	LastAccessAt *time.Time `json:"last_access_at,omitempty"`
+}
+
+// Options are the owner-chosen settings of a new share
+type Options struct {
+	Path         string
+	IsDir        bool
+	AllowBrowse  bool
+	Password     string
+	MaxDownloads int
+	ExpiresAt    *time.Time
+}
+
+// HasPassword reports whether visitors must supply a password
+func (s *Share) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+// Expired reports whether the share is past its expiry
+func (s *Share) Expired(now time.Time) bool {
+	return s.ExpiresAt != nil && now.After(*s.ExpiresAt)
+}
+
+// Exhausted reports whether the download limit has been used up
+func (s *Share) Exhausted() bool {
+	return s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads
+}
+
+// Store keeps shares in memory and persists them as JSON.
+// Visits only change statistics, so they are written out by Flush rather than on every view.
+type Store struct {
+	mu     sync.Mutex
+	file   *storage.JSONFile
+	shares map[string]*Share // keyed by token
+	// unsaved marks visits recorded since the last save
+	unsaved bool
+}
+
+// NewStore loads the shares saved at path; an empty path keeps them in memory only
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		file:   storage.NewJSONFile(path),
+		shares: make(map[string]*Share),
+	}
+	if err := s.file.Load(&s.shares); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save persists the current shares; callers hold the lock
+func (s *Store) save() error {
+	if err := s.file.Save(s.shares); err != nil {
+		return err
+	}
+	s.unsaved = false
+	return nil
+}
+
+// Flush persists the visits recorded since the last save
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.unsaved {
+		return nil
+	}
+	return s.save()
+}
+
+// Create stores a new share for owner
+func (s *Store) Create(owner string, opts Options) (*Share, error) {
+	id, err := storage.RandomID()
+	if err != nil {
+		return nil, err
+	}
+	token, err := storage.RandomToken(24)
+	if err != nil {
+		return nil, err
+	}
+
+	share := &Share{
+		ID:           id,
+		Token:        token,
+		Owner:        owner,
+		Path:         opts.Path,
+		IsDir:        opts.IsDir,
+		AllowBrowse:  opts.IsDir && opts.AllowBrowse,
+		MaxDownloads: opts.MaxDownloads,
+		CreatedAt:    time.Now().UTC(),
+		ExpiresAt:    opts.ExpiresAt,
+	}
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		share.PasswordHash = string(hash)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shares[token] = share
+	if err := s.save(); err != nil {
+		delete(s.shares, token)
+		return nil, err
+	}
+	copied := *share
+	return &copied, nil
+}
+
+// ListByOwner returns the owner's shares, newest first
+func (s *Store) ListByOwner(owner string) []Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []Share
+	for _, share := range s.shares {
+		if share.Owner == owner {
+			list = append(list, *share)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Revoke deletes one of the owner's shares by ID
+func (s *Store) Revoke(owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, share := range s.shares {
+		if share.ID == id && share.Owner == owner {
+			delete(s.shares, token)
+			return s.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// RevokeAll deletes every share of owner
+func (s *Store) RevokeAll(owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, share := range s.shares {
+		if share.Owner == owner {
+			delete(s.shares, token)
+		}
+	}
+	return s.save()
+}
+
+// Open checks a visitor's access to a share and records the visit.
+// It returns a copy of the share that is safe to read without the lock.
+// The password is compared without holding the lock, as bcrypt is slow on purpose.
+func (s *Store) Open(token, password string) (*Share, error) {
+	share, err := s.usable(token)
+	if err != nil {
+		return nil, err
+	}
+	if share.HasPassword() {
+		if password == "" {
+			return nil, ErrPasswordRequired
+		}
+		if bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(password)) != nil {
+			return nil, ErrInvalidPassword
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	live, ok := s.shares[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	now := time.Now().UTC()
+	live.Views++
+	live.LastAccessAt = &now
+	s.unsaved = true
+	copied := *live
+	return &copied, nil
+}
+
+// usable returns a copy of the share at token unless it can no longer be opened
+func (s *Store) usable(token string) (Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	share, ok := s.shares[token]
+	if !ok {
+		return Share{}, ErrNotFound
+	}
+	if share.Expired(time.Now()) {
+		return Share{}, ErrExpired
+	}
+	if !share.IsDir && share.Exhausted() {
+		return Share{}, ErrDownloadLimit
+	}
+	return *share, nil
+}
+
+// RecordDownload counts a download, refusing once the limit is reached
+func (s *Store) RecordDownload(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	share, ok := s.shares[token]
+	if !ok {
+		return ErrNotFound
+	}
+	if share.Exhausted() {
+		return ErrDownloadLimit
+	}
+	share.Downloads++
+	return s.save()
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// JSONFile persists a single value as JSON on disk.
+// Saves go to a temp file that is renamed over the old one, so a crash never leaves a torn file.
+// An empty path keeps everything in memory only.
+type JSONFile struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewJSONFile creates a JSON file store at path
+func NewJSONFile(path string) *JSONFile {
+	return &JSONFile{path: path}
+}
+
+// Load decodes the file into v; a missing file leaves v untouched
+func (f *JSONFile) Load(v interface{}) error {
+	if f.path == "" {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", f.path, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", f.path, err)
+	}
+	return nil
+}
+
+// Save encodes v and atomically replaces the file
+func (f *JSONFile) Save(v interface{}) error {
+	if f.path == "" {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %v", f.path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create data directory: %v", err)
+	}
+
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", f.path, err)
+	}
+	return nil
+}
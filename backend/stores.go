@@ -0,0 +1,167 @@
+package main
+
+import (
+	"path/filepath"
+
+	"golang.org/x/net/webdav"
+
+	"manschko.com/cloud-storage/acl"
+	"manschko.com/cloud-storage/auth"
+	"manschko.com/cloud-storage/controllers"
+	"manschko.com/cloud-storage/events"
+	"manschko.com/cloud-storage/groups"
+	"manschko.com/cloud-storage/jobs"
+	"manschko.com/cloud-storage/s3"
+	"manschko.com/cloud-storage/sftp"
+	"manschko.com/cloud-storage/sftpgo"
+	"manschko.com/cloud-storage/shares"
+	"manschko.com/cloud-storage/throttle"
+)
+
+// Server-side state shared by all requests
+var (
+	shareStore   *shares.Store
+	requestStore *shares.RequestStore
+	grantStore   *acl.Store
+	groupStore   *groups.Store
+
+	s3KeyStore    *s3.KeyStore
+	s3UploadStore *s3.UploadStore
+
+	// eventBroker delivers change notifications and records them in the change journal
+	eventBroker *events.Broker
+
+	// jobManager runs background file operations and keeps their history
+	jobManager *jobs.Manager
+
+	// transferLimits paces downloads and uploads and caps how many run at once
+	transferLimits *throttle.Manager
+
+	// loginGuard throttles password guessing; failures are kept in memory only
+	loginGuard *auth.LoginGuard
+
+	// authenticator checks passwords with the configured account backends
+	authenticator auth.Authenticator
+
+	// signingKeys sign our tokens and verify those presented, including ones from before a key rotation
+	signingKeys *auth.KeySet
+
+	// sessionStore holds the refresh tokens of logged in users, revokedTokens the access tokens ended early
+	sessionStore  *auth.SessionStore
+	revokedTokens *auth.RevocationList
+
+	// twoFactorStore holds the authenticator app secrets and recovery codes of users
+	twoFactorStore *auth.TwoFactorStore
+
+	// accessTokenStore holds the personal access tokens scripts and CI authenticate with
+	accessTokenStore *auth.AccessTokenStore
+
+	// sftpgoUsers manages the accounts of the SFTP server; nil unless configured
+	sftpgoUsers sftpgo.Client
+
+	// Single sign-on: the provider, the rules mapping its accounts to users, the homes they were
+	// given and the logins in progress. oidcProvider is nil unless configured.
+	oidcProvider  *auth.OIDCProvider
+	identityRules []auth.IdentityRule
+	identityStore *auth.IdentityStore
+	oidcLogins    = auth.NewOIDCLogins()
+
+	// WebDAV locks live in memory; clients refresh them and they expire on restart anyway
+	davLocks = webdav.NewMemLS()
+)
+
+// initStores loads the persistent stores from the data directory
+func initStores() error {
+	var err error
+	signingKeys, err = loadSigningKeys()
+	if err != nil {
+		return err
+	}
+	authenticator, err = buildAuthenticator()
+	if err != nil {
+		return err
+	}
+	shareStore, err = shares.NewStore(filepath.Join(AppConfig.DataDir, "shares.json"))
+	if err != nil {
+		return err
+	}
+	requestStore, err = shares.NewRequestStore(filepath.Join(AppConfig.DataDir, "file_requests.json"))
+	if err != nil {
+		return err
+	}
+	grantStore, err = acl.NewStore(filepath.Join(AppConfig.DataDir, "grants.json"))
+	if err != nil {
+		return err
+	}
+	groupStore, err = groups.NewStore(filepath.Join(AppConfig.DataDir, "groups.json"))
+	if err != nil {
+		return err
+	}
+	s3KeyStore, err = s3.NewKeyStore(filepath.Join(AppConfig.DataDir, "s3_keys.json"))
+	if err != nil {
+		return err
+	}
+	sftp.Uploads, err = sftp.NewUploadDirs(filepath.Join(AppConfig.DataDir, "upload_dirs.json"))
+	if err != nil {
+		return err
+	}
+	s3UploadStore, err = s3.NewUploadStore(filepath.Join(AppConfig.DataDir, "s3_multipart.json"), AppConfig.S3MultipartMaxAge)
+	if err != nil {
+		return err
+	}
+	journal, err := events.OpenJournal(filepath.Join(AppConfig.DataDir, "changes.jsonl"), AppConfig.ChangeJournalSize)
+	if err != nil {
+		return err
+	}
+	eventBroker = events.NewJournaledBroker(1024, journal)
+	transferLimits = throttle.NewManager(AppConfig.Transfers)
+	loginGuard = auth.NewLoginGuard(auth.GuardConfig{
+		MaxFailures:      AppConfig.LoginMaxFailures,
+		MaxFailuresPerIP: AppConfig.LoginMaxFailuresPerIP,
+		Lockout:          AppConfig.LoginLockout,
+		MaxInFlight:      AppConfig.LoginMaxInFlight,
+	})
+	sessionStore, err = auth.NewSessionStore(filepath.Join(AppConfig.DataDir, "sessions.json"), AppConfig.SessionMaxAge)
+	if err != nil {
+		return err
+	}
+	revokedTokens, err = auth.NewRevocationList(filepath.Join(AppConfig.DataDir, "revoked_tokens.json"))
+	if err != nil {
+		return err
+	}
+	twoFactorStore, err = auth.NewTwoFactorStore(filepath.Join(AppConfig.DataDir, "two_factor.json"))
+	if err != nil {
+		return err
+	}
+	accessTokenStore, err = auth.NewAccessTokenStore(filepath.Join(AppConfig.DataDir, "access_tokens.json"))
+	if err != nil {
+		return err
+	}
+	identityStore, err = auth.NewIdentityStore(filepath.Join(AppConfig.DataDir, "identities.json"))
+	if err != nil {
+		return err
+	}
+	controllers.HomeDirs = identityStore
+	if err := initOIDC(); err != nil {
+		return err
+	}
+	if AppConfig.SFTPGoURL != "" {
+		sftpgoUsers = sftpgo.NewHTTPClient(sftpgo.Config{
+			URL:           AppConfig.SFTPGoURL,
+			AdminUser:     AppConfig.SFTPGoAdminUser,
+			AdminPassword: AppConfig.SFTPGoAdminPassword,
+			HomeBase:      AppConfig.SFTPGoHomeBase,
+		}, nil)
+	}
+	jobManager, err = jobs.NewManager(
+		filepath.Join(AppConfig.DataDir, "jobs.json"),
+		AppConfig.JobWorkers,
+		AppConfig.JobsPerUser,
+		AppConfig.JobQueuePerUser,
+		AppConfig.JobRetention,
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minBurst lets a bucket pass at least one full copy buffer at once, however low its rate
+const minBurst = 32 * 1024
+
+// Bucket is a token bucket refilled at a fixed rate of bytes per second.
+// Takes may overdraw it; the taker then waits until the debt is paid back,
+// which keeps the average rate exact without splitting every read.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	used   time.Time
+}
+
+// NewBucket creates a full bucket passing rate bytes per second with bursts of up to one second's worth
+func NewBucket(rate int64) *Bucket {
+	burst := float64(max(rate, minBurst))
+	return &Bucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// refill adds the tokens earned since the last call; callers hold the lock
+func (b *Bucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take removes n tokens and returns how long the caller has to wait before going on
+func (b *Bucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.refill(now)
+	b.used = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund gives back n tokens a taker did not use
+func (b *Bucket) refund(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens = min(b.burst, b.tokens+float64(n))
+}
+
+// idle reports whether the bucket is full and unused since cutoff, so dropping it changes nothing
+func (b *Bucket) idle(cutoff time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.tokens >= b.burst && b.used.Before(cutoff)
+}
+
+// WaitN takes n tokens and waits until the bucket allows them or ctx is done.
+// The tokens are given back when ctx ends the wait, so a cancelled transfer does not slow down others.
+func (b *Bucket) WaitN(ctx context.Context, n int) error {
+	wait := b.take(n)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.refund(n)
+		return ctx.Err()
+	}
+}
+
+// ParseRate reads a rate in bytes per second such as "500K", "10M" or "1.5G".
+// Suffixes are binary multiples, an optional "B", "iB" or "/s" is ignored, and 0 means unlimited.
+func ParseRate(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(s, "/S")
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	multiplier := 1.0
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+	number, err := strconv.ParseFloat(s, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	return int64(number * multiplier), nil
+}
@@ -0,0 +1,92 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBucketRate(t *testing.T) {
+	const rate = 1 << 20
+	b := NewBucket(rate)
+	start := time.Now()
+	// The full burst passes at once, the next quarter second's worth has to be earned
+	if err := b.WaitN(context.Background(), rate); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("the burst waited %v", elapsed)
+	}
+	if err := b.WaitN(context.Background(), rate/4); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("a quarter second beyond the burst took %v", elapsed)
+	}
+}
+
+func TestBucketMinBurst(t *testing.T) {
+	b := NewBucket(1)
+	start := time.Now()
+	if err := b.WaitN(context.Background(), minBurst); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("one copy buffer waited %v at a rate of one byte per second", elapsed)
+	}
+}
+
+func TestBucketCancelledWaitRefunds(t *testing.T) {
+	const rate = 1 << 20
+	b := NewBucket(rate)
+	if err := b.WaitN(context.Background(), rate); err != nil {
+		t.Fatal(err)
+	}
+
+	// An hour's worth of debt would stall every later taker if it were kept
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.WaitN(ctx, 3600*rate); err != context.DeadlineExceeded {
+		t.Fatalf("WaitN() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	next, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.WaitN(next, rate/100); err != nil {
+		t.Fatalf("the next take after a cancelled one: %v", err)
+	}
+}
+
+func TestBucketRefundStaysWithinBurst(t *testing.T) {
+	b := NewBucket(1 << 20)
+	b.refund(1 << 30)
+	if b.tokens > b.burst {
+		t.Fatalf("tokens = %v beyond the burst of %v", b.tokens, b.burst)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"1000", 1000},
+		{"500K", 500 << 10},
+		{"500kb", 500 << 10},
+		{"10M", 10 << 20},
+		{"10MiB/s", 10 << 20},
+		{" 1.5G ", 3 << 29},
+		{"2B", 2},
+	} {
+		got, err := ParseRate(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "fast", "-1M", "M", "10T"} {
+		if _, err := ParseRate(in); err == nil {
+			t.Errorf("ParseRate(%q) succeeded", in)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// chunkSize bounds how much one read or write passes before the buckets are consulted
+const chunkSize = 32 * 1024
+
+// bucketIdleTime is how long an unused per-user or per-link bucket is kept
+const bucketIdleTime = 10 * time.Minute
+
+// ErrBusy is returned when an account has no free transfer slot
+var ErrBusy = errors.New("too many simultaneous transfers")
+
+// Direction is which way data flows between the client and the storage server
+type Direction int
+
+const (
+	Download Direction = iota
+	Upload
+)
+
+// Limits are the rates, in bytes per second, of one direction; zero means unlimited
+type Limits struct {
+	Global   int64
+	PerUser  int64
+	PerShare int64
+}
+
+// Config sets the rate limits and how many transfers one account may run at once
+type Config struct {
+	Download Limits
+	Upload   Limits
+
+	// MaxPerAccount caps the simultaneous transfers of one user or link; zero means unlimited.
+	// A transfer beyond the cap waits up to QueueTimeout for a slot before it is refused.
+	MaxPerAccount int
+	QueueTimeout  time.Duration
+}
+
+// Account is who a transfer counts against: a signed-in user, or the share link an anonymous visitor used
+type Account struct {
+	User  string
+	Share string
+}
+
+// key identifies the account for concurrency slots
+func (a Account) key() string {
+	if a.User != "" {
+		return "user:" + a.User
+	}
+	return "share:" + a.Share
+}
+
+// bucketKey identifies a per-account bucket
+type bucketKey struct {
+	dir   Direction
+	share bool
+	name  string
+}
+
+// slots is a per-account semaphore; refs counts holders and waiters so it can be dropped when unused
+type slots struct {
+	ch   chan struct{}
+	refs int
+}
+
+// Manager applies the configured limits to transfers
+type Manager struct {
+	cfg    Config
+	global [2]*Bucket
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*Bucket
+	lastSweep time.Time
+	slots     map[string]*slots
+}
+
+// NewManager creates a manager for cfg
+func NewManager(cfg Config) *Manager {
+	m := &Manager{
+		cfg:       cfg,
+		buckets:   make(map[bucketKey]*Bucket),
+		lastSweep: time.Now(),
+		slots:     make(map[string]*slots),
+	}
+	if cfg.Download.Global > 0 {
+		m.global[Download] = NewBucket(cfg.Download.Global)
+	}
+	if cfg.Upload.Global > 0 {
+		m.global[Upload] = NewBucket(cfg.Upload.Global)
+	}
+	return m
+}
+
+// limits returns the configured limits of dir
+func (m *Manager) limits(dir Direction) Limits {
+	if dir == Upload {
+		return m.cfg.Upload
+	}
+	return m.cfg.Download
+}
+
+// bucket returns the bucket of one account, creating it on first use
+func (m *Manager) bucket(key bucketKey, rate int64) *Bucket {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now := time.Now(); now.Sub(m.lastSweep) > bucketIdleTime {
+		cutoff := now.Add(-bucketIdleTime)
+		for k, b := range m.buckets {
+			if b.idle(cutoff) {
+				delete(m.buckets, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = NewBucket(rate)
+		m.buckets[key] = b
+	}
+	return b
+}
+
+// bucketsFor lists every bucket a transfer of account in dir has to pass
+func (m *Manager) bucketsFor(dir Direction, account Account) []*Bucket {
+	var list []*Bucket
+	if b := m.global[dir]; b != nil {
+		list = append(list, b)
+	}
+	limits := m.limits(dir)
+	if account.User != "" && limits.PerUser > 0 {
+		list = append(list, m.bucket(bucketKey{dir: dir, name: account.User}, limits.PerUser))
+	}
+	if account.Share != "" && limits.PerShare > 0 {
+		list = append(list, m.bucket(bucketKey{dir: dir, share: true, name: account.Share}, limits.PerShare))
+	}
+	return list
+}
+
+// wait blocks until every bucket allows n more bytes
+func wait(ctx context.Context, buckets []*Bucket, n int) error {
+	for _, b := range buckets {
+		if err := b.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reader paces reads through the buckets
+type reader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*Bucket
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := wait(r.ctx, r.buckets, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// writer paces writes through the buckets
+type writer struct {
+	ctx     context.Context
+	w       io.Writer
+	buckets []*Bucket
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), chunkSize)]
+		if err := wait(w.ctx, w.buckets, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Reader limits the rate data is read from r for a transfer of account in dir
+func (m *Manager) Reader(ctx context.Context, r io.Reader, dir Direction, account Account) io.Reader {
+	buckets := m.bucketsFor(dir, account)
+	if len(buckets) == 0 {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, buckets: buckets}
+}
+
+// Writer limits the rate data is written to w for a transfer of account in dir
+func (m *Manager) Writer(ctx context.Context, w io.Writer, dir Direction, account Account) io.Writer {
+	buckets := m.bucketsFor(dir, account)
+	if len(buckets) == 0 {
+		return w
+	}
+	return &writer{ctx: ctx, w: w, buckets: buckets}
+}
+
+// Acquire takes one of the account's transfer slots, waiting for up to the queue timeout.
+// It returns ErrBusy when none frees up in time; release gives the slot back.
+func (m *Manager) Acquire(ctx context.Context, account Account) (release func(), err error) {
+	if m.cfg.MaxPerAccount <= 0 {
+		return func() {}, nil
+	}
+	key := account.key()
+
+	m.mu.Lock()
+	s, ok := m.slots[key]
+	if !ok {
+		s = &slots{ch: make(chan struct{}, m.cfg.MaxPerAccount)}
+		m.slots[key] = s
+	}
+	s.refs++
+	m.mu.Unlock()
+
+	drop := func() {
+		m.mu.Lock()
+		if s.refs--; s.refs == 0 {
+			delete(m.slots, key)
+		}
+		m.mu.Unlock()
+	}
+
+	select {
+	case s.ch <- struct{}{}:
+	default:
+		timer := time.NewTimer(m.cfg.QueueTimeout)
+		defer timer.Stop()
+		select {
+		case s.ch <- struct{}{}:
+		case <-timer.C:
+			drop()
+			return nil, ErrBusy
+		case <-ctx.Done():
+			drop()
+			return nil, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-s.ch
+			drop()
+		})
+	}, nil
+}
@@ -0,0 +1,130 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestManagerWriterRate(t *testing.T) {
+	const rate = 1 << 20
+	m := NewManager(Config{Download: Limits{PerUser: rate}})
+	var out bytes.Buffer
+	w := m.Writer(context.Background(), &out, Download, Account{User: "alice"})
+
+	start := time.Now()
+	if _, err := w.Write(make([]byte, rate+rate/2)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("one and a half seconds' worth took %v", elapsed)
+	}
+	if out.Len() != rate+rate/2 {
+		t.Fatalf("wrote %d bytes", out.Len())
+	}
+
+	// Uploads and other users have their own buckets
+	start = time.Now()
+	if _, err := io.Copy(io.Discard, m.Reader(context.Background(), bytes.NewReader(make([]byte, rate)), Upload, Account{User: "alice"})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Writer(context.Background(), io.Discard, Download, Account{User: "bob"}).Write(make([]byte, rate)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("unrelated transfers waited %v", elapsed)
+	}
+}
+
+func TestManagerUnlimited(t *testing.T) {
+	m := NewManager(Config{})
+	var out bytes.Buffer
+	if w := m.Writer(context.Background(), &out, Download, Account{User: "alice"}); w != &out {
+		t.Fatal("an unlimited writer was wrapped")
+	}
+	release, err := m.Acquire(context.Background(), Account{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestAcquireTimesOut(t *testing.T) {
+	m := NewManager(Config{MaxPerAccount: 1, QueueTimeout: 50 * time.Millisecond})
+	alice := Account{User: "alice"}
+	release, err := m.Acquire(context.Background(), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := m.Acquire(context.Background(), alice); err != ErrBusy {
+		t.Fatalf("Acquire() = %v, want %v", err, ErrBusy)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("Acquire() gave up after %v", elapsed)
+	}
+
+	// Another account is not affected
+	other, err := m.Acquire(context.Background(), Account{Share: "alice"})
+	if err != nil {
+		t.Fatalf("Acquire() for a link = %v", err)
+	}
+	other()
+
+	// Releasing twice gives back one slot
+	release()
+	release()
+	first, err := m.Acquire(context.Background(), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Acquire(context.Background(), alice); err != ErrBusy {
+		t.Fatalf("Acquire() beyond the cap = %v, want %v", err, ErrBusy)
+	}
+	first()
+	if len(m.slots) != 0 {
+		t.Fatalf("%d slot sets left after every transfer ended", len(m.slots))
+	}
+}
+
+func TestAcquireWaitsForASlot(t *testing.T) {
+	m := NewManager(Config{MaxPerAccount: 1, QueueTimeout: time.Second})
+	alice := Account{User: "alice"}
+	release, err := m.Acquire(context.Background(), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, release)
+
+	start := time.Now()
+	next, err := m.Acquire(context.Background(), alice)
+	if err != nil {
+		t.Fatalf("Acquire() = %v while a slot freed up", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Acquire() waited %v for a released slot", elapsed)
+	}
+	next()
+}
+
+func TestAcquireCancelled(t *testing.T) {
+	m := NewManager(Config{MaxPerAccount: 1, QueueTimeout: time.Minute})
+	alice := Account{User: "alice"}
+	release, err := m.Acquire(context.Background(), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := m.Acquire(ctx, alice); err != context.DeadlineExceeded {
+		t.Fatalf("Acquire() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if s := m.slots[alice.key()]; s == nil || s.refs != 1 {
+		t.Fatal("a cancelled Acquire() still counts as a holder")
+	}
+}
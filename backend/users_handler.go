@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"manschko.com/cloud-storage/controllers"
+	"manschko.com/cloud-storage/sftpgo"
+)
+
+// Create a user management controller
+func getUserController() *controllers.UserController {
+	userController := controllers.NewUserController(getFileController(), sftpgoUsers, logoutEverywhere)
+	userController.Revoke = revokeAccess
+	return userController
+}
+
+// logoutEverywhere ends the sessions of username and revokes their tokens, S3 access keys
+// and cached WebDAV logins
+func logoutEverywhere(username string) error {
+	davCredentials.Forget(username)
+	if err := getAuthController().EndUserSessions(username); err != nil {
+		return err
+	}
+	return s3KeyStore.RevokeAll(username)
+}
+
+// revokeAccess takes back what username handed to others or was given: share links,
+// file requests, grants and group memberships
+func revokeAccess(username string) error {
+	return errors.Join(
+		shareStore.RevokeAll(username),
+		requestStore.RevokeAll(username),
+		grantStore.RevokeAll(username),
+		groupStore.RemoveUser(username),
+	)
+}
+
+// accountEnabled reports whether username may log in through single sign-on. Users without
+// an account on the SFTP server are not held back, as single sign-on does not need one.
+func accountEnabled(ctx context.Context, username string) (bool, error) {
+	user, err := sftpgoUsers.GetUser(ctx, username)
+	if errors.Is(err, sftpgo.ErrUserNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return user.Enabled, nil
+}
+
+// User management handlers
+func listUsers(c *gin.Context) {
+	getUserController().ListUsers(c)
+}
+
+func createUser(c *gin.Context) {
+	getUserController().CreateUser(c)
+}
+
+func disableUser(c *gin.Context) {
+	getUserController().DisableUser(c)
+}
+
+func enableUser(c *gin.Context) {
+	getUserController().EnableUser(c)
+}
+
+func resetPassword(c *gin.Context) {
+	getUserController().ResetPassword(c)
+}
+
+func deleteUser(c *gin.Context) {
+	getUserController().DeleteUser(c)
+}
@@ -2,6 +2,34 @@ import axios from "axios";
 import { defineStore } from "pinia";
 import { useRouter } from "vue-router";
 
+// refreshing is the refresh in flight, shared by every caller: a refresh token can only be
+// used once, and the server ends the session when it sees one used twice
+let refreshing: Promise<string | null> | null = null;
+
+// refreshToken trades the stored refresh token for a new access token, returning it or null
+function refreshToken(): Promise<string | null> {
+  if (!refreshing) {
+    refreshing = exchangeRefreshToken().finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+}
+
+async function exchangeRefreshToken(): Promise<string | null> {
+  const refresh = localStorage.getItem('refresh_token');
+  if (!refresh) return null;
+  try {
+    const response = await axios.post('/api/token/refresh', { refresh_token: refresh });
+    localStorage.setItem('jwt', response.data.token);
+    localStorage.setItem('refresh_token', response.data.refresh_token);
+    return response.data.token;
+  } catch {
+    localStorage.removeItem('refresh_token');
+    return null;
+  }
+}
+
 export const useFileStore = defineStore('file',{
   state: () => ({
     folders: [] as any[],
@@ -42,7 +70,15 @@ export const useFileStore = defineStore('file',{
           console.log('Fetching from API:', path)
           const token = localStorage.getItem('jwt');
           const headers = token ? { Authorization: `Bearer ${token}`} : {};
-          const response = await axios.get(`/api/files${path}` , { headers });
+          let response;
+          try {
+            response = await axios.get(`/api/files${path}` , { headers });
+          } catch (error: any) {
+            // The access token is short-lived; retry once with a refreshed one
+            const refreshed = error.response?.status === 401 ? await refreshToken() : null;
+            if (!refreshed) throw error;
+            response = await axios.get(`/api/files${path}` , { headers: { Authorization: `Bearer ${refreshed}` } });
+          }
           // Store in cache
           this.cache[path] = response.data
 
@@ -58,6 +94,7 @@ export const useFileStore = defineStore('file',{
       } catch (error: any) {
         if (error.response && error.response.status === 401) {
           localStorage.removeItem('jwt')
+          localStorage.removeItem('refresh_token')
         }
         this.error = error.response.status
         this.loading = false